@@ -10,6 +10,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
@@ -18,7 +19,9 @@ import (
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/audit"
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -31,11 +34,14 @@ type argContainer struct {
 	longnames, allow_other, reverse, aessiv, nonempty, raw64,
 	noprealloc, speed, hkdf, serialize_reads, hh, info,
 	sharedstorage, fsck, one_file_system, deterministic_names,
-	xchacha, noxattr bool
+	xchacha, noxattr, stable_ivs, follow_symlinks, decrypt_tree, encrypt_tree, tar,
+	repair, dry_run, repair_diriv, offline, scrub, status bool
 	// Mount options with opposites
 	dev, nodev, suid, nosuid, exec, noexec, rw, ro, kernel_cache, acl bool
 	masterkey, mountpoint, cipherdir, cpuprofile,
-	memprofile, ko, ctlsock, fsname, force_owner, trace, context string
+	memprofile, ko, ctlsock, fsname, force_owner, trace, context, subdir, webdav, webdav_token,
+	repair_blocks, repair_log, fsck_checkpoint, fsck_report, scrub_state,
+	corruption_log, metrics, audit_log string
 	// FIDO2
 	fido2                string
 	fido2_assert_options []string
@@ -43,11 +49,27 @@ type argContainer struct {
 	extpass, badname, passfile []string
 	// For reverse mode, several ways to specify exclusions. All can be specified multiple times.
 	exclude, excludeWildcard, excludeFrom []string
+	// -merge NAME=PATH, can be passed multiple times (reverse mode)
+	merge []string
+	// -webdav-user can be passed multiple times
+	webdav_user []string
+	// -ctlsock-allow can be passed multiple times
+	ctlsock_allow []string
 	// Configuration file name override
 	config             string
 	notifypid, scryptn int
+	// -fsck-workers
+	fsck_workers int
+	// -audit-log-size (in MB) and -audit-log-keep
+	audit_log_size, audit_log_keep int
+	// -fsck-progress
+	fsck_progress time.Duration
 	// Idle time before autounmount
 	idle time.Duration
+	// -scrub-bwlimit in MB/s
+	scrub_bwlimit float64
+	// -scrub-interval
+	scrub_interval time.Duration
 	// -longnamemax (hash encrypted names that are longer than this)
 	longnamemax uint8
 	// Helper variables that are NOT cli options all start with an underscore
@@ -55,10 +77,18 @@ type argContainer struct {
 	_configCustom bool
 	// _ctlsockFd stores the control socket file descriptor (ctlsock stores the path)
 	_ctlsockFd net.Listener
+	// _ctlsockACL is the parsed version of "-ctlsock-allow", set if
+	// -ctlsock is used
+	_ctlsockACL *ctlsocksrv.ACL
+	// _auditLog is the opened "-audit-log"
+	_auditLog *audit.Logger
 	// _forceOwner is, if non-nil, a parsed, validated Owner (as opposed to the string above)
 	_forceOwner *fuse.Owner
 	// _explicitScryptn is true then the user passed "-scryptn=xyz"
 	_explicitScryptn bool
+	// _mergeDirs is the parsed version of "-merge": top-level directory name
+	// -> absolute path
+	_mergeDirs map[string]string
 }
 
 var flagSet *flag.FlagSet
@@ -183,12 +213,28 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.BoolVar(&args.serialize_reads, "serialize_reads", false, "Try to serialize read operations")
 	flagSet.BoolVar(&args.hh, "hh", false, "Show this long help text")
 	flagSet.BoolVar(&args.info, "info", false, "Display information about CIPHERDIR")
+	flagSet.BoolVar(&args.status, "status", false, "Display the status of a mounted filesystem (pass the mountpoint or the -ctlsock path)")
 	flagSet.BoolVar(&args.sharedstorage, "sharedstorage", false, "Make concurrent access to a shared CIPHERDIR safer")
 	flagSet.BoolVar(&args.fsck, "fsck", false, "Run a filesystem check on CIPHERDIR")
+	flagSet.IntVar(&args.fsck_workers, "fsck-workers", runtime.NumCPU(), "With -fsck: number of files to check in parallel")
+	flagSet.DurationVar(&args.fsck_progress, "fsck-progress", 10*time.Second, "With -fsck: print progress at this interval, 0 to disable")
+	flagSet.StringVar(&args.fsck_checkpoint, "fsck-checkpoint", "", "With -fsck: save progress to this file, and resume from it")
+	flagSet.StringVar(&args.fsck_report, "fsck-report", "", "With -fsck: write a report in JSON format to this file")
+	flagSet.BoolVar(&args.offline, "offline", false, "With -fsck: check CIPHERDIR directly instead of mounting it")
+	flagSet.BoolVar(&args.repair, "repair", false, "With -fsck: repair the problems found")
+	flagSet.BoolVar(&args.dry_run, "dry-run", false, "With -fsck -repair: only show what would be repaired")
+	flagSet.BoolVar(&args.repair_diriv, "repair-diriv", false, "With -fsck -repair: recreate invalid gocryptfs.diriv files, moving the entries to lost+found")
+	flagSet.StringVar(&args.repair_blocks, "repair-blocks", "zero", "With -fsck -repair: \"zero\" or \"remove\" blocks that fail authentication")
+	flagSet.StringVar(&args.repair_log, "repair-log", "", "With -fsck -repair: append every repair action to this file")
+	flagSet.BoolVar(&args.decrypt_tree, "decrypt-tree", false, "Decrypt CIPHERDIR into a directory or tar stream without mounting")
+	flagSet.BoolVar(&args.encrypt_tree, "encrypt-tree", false, "Encrypt a plaintext directory into CIPHERDIR without mounting")
+	flagSet.BoolVar(&args.tar, "tar", false, "Write the reverse-mode ciphertext of PLAINDIR to stdout as a tar stream")
 	flagSet.BoolVar(&args.one_file_system, "one-file-system", false, "Don't cross filesystem boundaries")
 	flagSet.BoolVar(&args.deterministic_names, "deterministic-names", false, "Disable diriv file name randomisation")
 	flagSet.BoolVar(&args.xchacha, "xchacha", false, "Use XChaCha20-Poly1305 file content encryption")
 	flagSet.BoolVar(&args.noxattr, "noxattr", false, "Disable extended attribute operations")
+	flagSet.BoolVar(&args.follow_symlinks, "follow-symlinks", false, "Present symlink targets instead of symlinks (reverse mode)")
+	flagSet.BoolVar(&args.stable_ivs, "stable-ivs", false, "Derive file IVs from a per-file ID instead of the path (reverse mode)")
 
 	// Mount options with opposites
 	flagSet.BoolVar(&args.dev, "dev", false, "Allow device files")
@@ -213,6 +259,10 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.StringVar(&args.trace, "trace", "", "Write execution trace to file")
 	flagSet.StringVar(&args.fido2, "fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
 	flagSet.StringVar(&args.context, "context", "", "Set SELinux context (see mount(8) for details)")
+	flagSet.StringVar(&args.webdav, "webdav", "", "Serve the plaintext view over WebDAV on a Unix socket or localhost TCP address")
+	flagSet.StringVar(&args.webdav_token, "webdav-token", "", "Require HTTP basic auth with the password read from this file (-webdav)")
+	flagSet.StringVar(&args.metrics, "metrics", "", "Serve metrics in Prometheus text format on a Unix socket or localhost TCP address")
+	flagSet.StringVar(&args.subdir, "subdir", "", "Only decrypt this subdirectory, or encrypt into it (-decrypt-tree, -encrypt-tree)")
 	flagSet.StringArrayVar(&args.fido2_assert_options, "fido2-assert-option", nil, "Options to be passed with `fido2-assert -t`")
 
 	// Exclusion options
@@ -221,6 +271,9 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.StringArrayVar(&args.excludeWildcard, "ew", nil, "Alias for -exclude-wildcard")
 	flagSet.StringArrayVar(&args.excludeWildcard, "exclude-wildcard", nil, "Exclude path from reverse view, supporting wildcards")
 	flagSet.StringArrayVar(&args.excludeFrom, "exclude-from", nil, "File from which to read exclusion patterns (with -exclude-wildcard syntax)")
+	flagSet.StringArrayVar(&args.merge, "merge", nil, "Present additional plaintext directory PATH as top-level directory NAME (NAME=PATH, reverse mode)")
+	flagSet.StringArrayVar(&args.webdav_user, "webdav-user", nil, "Allow this user to connect to the -webdav Unix socket")
+	flagSet.StringArrayVar(&args.ctlsock_allow, "ctlsock-allow", nil, "Allow this user (or @group) to use the control socket (USER[:status,paths,admin])")
 
 	// multipleStrings options ([]string)
 	flagSet.StringArrayVar(&args.extpass, "extpass", nil, "Use external program for the password prompt")
@@ -238,6 +291,14 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 	flagSet.DurationVar(&args.idle, "i", 0, "Alias for -idle")
 	flagSet.DurationVar(&args.idle, "idle", 0, "Auto-unmount after specified idle duration (ignored in reverse mode). "+
 		"Durations are specified like \"500s\" or \"2h45m\". 0 means stay mounted indefinitely.")
+	flagSet.BoolVar(&args.scrub, "scrub", false, "Check all files in the background for corruption (forward mode only)")
+	flagSet.Float64Var(&args.scrub_bwlimit, "scrub-bwlimit", 4, "With -scrub: maximum read rate in MB/s, 0 means unlimited")
+	flagSet.DurationVar(&args.scrub_interval, "scrub-interval", 7*24*time.Hour, "With -scrub: time between the starts of two scrub passes")
+	flagSet.StringVar(&args.scrub_state, "scrub-state", "", "With -scrub: remember the scrub progress in this file")
+	flagSet.StringVar(&args.audit_log, "audit-log", "", "Log file operations to this file, or to \"syslog\" (forward mode only)")
+	flagSet.IntVar(&args.audit_log_size, "audit-log-size", 100, "With -audit-log: rotate the file at this size in MB, 0 means never")
+	flagSet.IntVar(&args.audit_log_keep, "audit-log-keep", 5, "With -audit-log: number of rotated files to keep")
+	flagSet.StringVar(&args.corruption_log, "corruption-log", "", "Keep the log of corruptions found in this file (forward mode only)")
 
 	var dummyString string
 	flagSet.StringVar(&dummyString, "o", "", "For compatibility with mount(1), options can be also passed as a comma-separated list to -o on the end.")
@@ -306,6 +367,75 @@ func parseCliOpts(osArgs []string) (args argContainer) {
 			os.Exit(exitcodes.Usage)
 		}
 	}
+	// Parse "-merge NAME=PATH"
+	for _, m := range args.merge {
+		name, path, found := strings.Cut(m, "=")
+		if !found || name == "" || path == "" {
+			tlog.Fatal.Printf("-merge: invalid value %q, must be in form NAME=PATH", m)
+			os.Exit(exitcodes.Usage)
+		}
+		if name == "." || name == ".." || strings.Contains(name, "/") ||
+			name == configfile.ConfDefaultName || name == configfile.ConfReverseName {
+			tlog.Fatal.Printf("-merge: invalid directory name %q", name)
+			os.Exit(exitcodes.Usage)
+		}
+		if args._mergeDirs == nil {
+			args._mergeDirs = make(map[string]string)
+		}
+		if _, dupe := args._mergeDirs[name]; dupe {
+			tlog.Fatal.Printf("-merge: directory name %q specified twice", name)
+			os.Exit(exitcodes.Usage)
+		}
+		args._mergeDirs[name], _ = filepath.Abs(path)
+	}
+	// Parse "-ctlsock-allow"
+	if len(args.ctlsock_allow) > 0 && args.ctlsock == "" {
+		tlog.Fatal.Printf("-ctlsock-allow only works with -ctlsock")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.ctlsock != "" {
+		args._ctlsockACL, err = ctlsockACL(args.ctlsock_allow)
+		if err != nil {
+			tlog.Fatal.Printf("-ctlsock-allow: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	if args.metrics != "" && args.webdav != "" {
+		tlog.Fatal.Printf("-metrics does not work with -webdav")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.repair || args.offline) && !args.fsck {
+		tlog.Fatal.Printf("-repair and -offline only work with -fsck")
+		os.Exit(exitcodes.Usage)
+	}
+	if !args.repair && (args.dry_run || args.repair_diriv || args.repair_log != "" || isFlagPassed(flagSet, "repair-blocks")) {
+		tlog.Fatal.Printf("-dry-run, -repair-diriv, -repair-blocks and -repair-log only work with -fsck -repair")
+		os.Exit(exitcodes.Usage)
+	}
+	if !args.scrub && (isFlagPassed(flagSet, "scrub-bwlimit") || isFlagPassed(flagSet, "scrub-interval") || args.scrub_state != "") {
+		tlog.Fatal.Printf("-scrub-bwlimit, -scrub-interval and -scrub-state only work with -scrub")
+		os.Exit(exitcodes.Usage)
+	}
+	if (args.scrub || args.corruption_log != "") && args.reverse {
+		tlog.Fatal.Printf("-scrub and -corruption-log are not supported in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.audit_log == "" && (isFlagPassed(flagSet, "audit-log-size") || isFlagPassed(flagSet, "audit-log-keep")) {
+		tlog.Fatal.Printf("-audit-log-size and -audit-log-keep only work with -audit-log")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.audit_log != "" && (args.reverse || args.webdav != "") {
+		tlog.Fatal.Printf("-audit-log is not supported in reverse mode and with -webdav")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.audit_log_size < 0 || args.audit_log_keep < 0 {
+		tlog.Fatal.Printf("-audit-log-size and -audit-log-keep cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
+	if args.scrub_bwlimit < 0 || args.scrub_interval < 0 {
+		tlog.Fatal.Printf("-scrub-bwlimit and -scrub-interval cannot be less than 0")
+		os.Exit(exitcodes.Usage)
+	}
 	if args.longnamemax > 0 && args.longnamemax < 62 {
 		tlog.Fatal.Printf("-longnamemax: value %d is outside allowed range 62 ... 255", args.longnamemax)
 		os.Exit(exitcodes.Usage)
@@ -337,6 +467,21 @@ func countOpFlags(args *argContainer) int {
 	if args.fsck {
 		count++
 	}
+	if args.decrypt_tree {
+		count++
+	}
+	if args.encrypt_tree {
+		count++
+	}
+	if args.webdav != "" {
+		count++
+	}
+	if args.tar {
+		count++
+	}
+	if args.status {
+		count++
+	}
 	return count
 }
 
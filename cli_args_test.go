@@ -1,9 +1,13 @@
 package main
 
 import (
+	"os"
 	"reflect"
+	"runtime"
 	"testing"
+	"time"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/v2/internal/stupidgcm"
 )
 
@@ -122,6 +126,16 @@ func TestParseCliOpts(t *testing.T) {
 		hkdf:        true,
 		openssl:     stupidgcm.PreferOpenSSLAES256GCM(), // depends on CPU and build flags
 		scryptn:     16,
+		// fsck defaults
+		repair_blocks: "zero",
+		fsck_workers:  runtime.NumCPU(),
+		fsck_progress: 10 * time.Second,
+		// scrub defaults
+		scrub_bwlimit:  4,
+		scrub_interval: 7 * 24 * time.Hour,
+		// audit log defaults
+		audit_log_size: 100,
+		audit_log_keep: 5,
 	}
 
 	type testcaseContainer struct {
@@ -178,3 +192,21 @@ func TestParseCliOpts(t *testing.T) {
 		}
 	}
 }
+
+func TestCtlsockACL(t *testing.T) {
+	acl, err := ctlsockACL([]string{"12345", "23456:status", "@34567:paths,admin", "23456:admin"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if acl.Uids[uint32(os.Getuid())] != ctlsocksrv.GrantAll ||
+		acl.Uids[12345] != ctlsocksrv.GrantAll ||
+		acl.Uids[23456] != ctlsocksrv.GrantStatus|ctlsocksrv.GrantAdmin ||
+		acl.Gids[34567] != ctlsocksrv.GrantPaths|ctlsocksrv.GrantAdmin {
+		t.Errorf("wrong ACL: %+v", acl)
+	}
+	for _, bad := range []string{"12345:bogus", ":all", "@", "12345:"} {
+		if _, err := ctlsockACL([]string{bad}); err == nil {
+			t.Errorf("%q should have been rejected", bad)
+		}
+	}
+}
@@ -6,6 +6,7 @@
 package ctlsock
 
 import (
+	"bufio"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -18,13 +19,32 @@ func (r *ResponseStruct) Error() string {
 
 // CtlSock encapsulates a control socket
 type CtlSock struct {
-	Conn net.Conn
+	Conn   net.Conn
+	reader *bufio.Reader
+	// lastID is the ID of the last request we have sent
+	lastID uint64
+	// version is the protocol version of the server, 0 if we have not
+	// asked yet
+	version      int
+	capabilities []string
 }
 
 // There was at least one user who hit the earlier 1 second timeout. Raise to 10
 // seconds which ought to be enough for anyone.
 const ctlsockTimeout = 10 * time.Second
 
+// Batch requests sent by EncryptPaths and DecryptPaths contain at most
+// batchMaxPaths paths with at most batchMaxBytes bytes in total. JSON
+// escaping can blow up a path up to six times, which still stays below
+// MaxRequestSize.
+const (
+	batchMaxPaths = 1000
+	batchMaxBytes = 512 * 1024
+)
+
+// changedMax is the ChangedMax that ChangedSince asks for
+const changedMax = 1000
+
 // New opens the socket at `socketPath` and stores it in a `CtlSock` object.
 func New(socketPath string) (*CtlSock, error) {
 	conn, err := net.DialTimeout("unix", socketPath, ctlsockTimeout)
@@ -34,31 +54,226 @@ func New(socketPath string) (*CtlSock, error) {
 	return &CtlSock{Conn: conn}, nil
 }
 
-// Query sends a request to the control socket returns the response.
-func (c *CtlSock) Query(req *RequestStruct) (*ResponseStruct, error) {
-	c.Conn.SetDeadline(time.Now().Add(ctlsockTimeout))
-	msg, err := json.Marshal(req)
+// send assigns the next ID to "req" and writes it to the socket
+func (c *CtlSock) send(req RequestStruct) (id uint64, err error) {
+	c.lastID++
+	req.ID = c.lastID
+	msg, err := json.Marshal(&req)
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
+	// Version 1 servers don't need the newline, but don't mind it either
+	msg = append(msg, '\n')
 	_, err = c.Conn.Write(msg)
-	if err != nil {
-		return nil, err
+	return req.ID, err
+}
+
+// receive reads the response to the request with ID "id"
+func (c *CtlSock) receive(id uint64) (*ResponseStruct, error) {
+	// Responses are terminated by a newline and can be bigger than one
+	// Read() call returns (think ChangedSince).
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.Conn)
 	}
-	buf := make([]byte, 5000)
-	n, err := c.Conn.Read(buf)
+	buf, err := c.reader.ReadBytes('\n')
 	if err != nil {
 		return nil, err
 	}
-	buf = buf[:n]
 	var resp ResponseStruct
 	json.Unmarshal(buf, &resp)
+	// Version 1 servers don't send the ID back
+	if resp.ID != 0 && resp.ID != id {
+		return nil, fmt.Errorf("got response ID %d, want %d", resp.ID, id)
+	}
 	if resp.ErrNo != 0 {
 		return nil, &resp
 	}
 	return &resp, nil
 }
 
+// Query sends a request to the control socket returns the response.
+func (c *CtlSock) Query(req *RequestStruct) (*ResponseStruct, error) {
+	c.Conn.SetDeadline(time.Now().Add(ctlsockTimeout))
+	id, err := c.send(*req)
+	if err != nil {
+		return nil, err
+	}
+	return c.receive(id)
+}
+
+// Hello returns the protocol version and the capabilities of the server,
+// see ProtocolVersion. Servers that do not know the Hello request are
+// reported as version 1 without capabilities.
+func (c *CtlSock) Hello() (version int, capabilities []string, err error) {
+	if c.version != 0 {
+		return c.version, c.capabilities, nil
+	}
+	resp, err := c.Query(&RequestStruct{Hello: true, Version: ProtocolVersion})
+	if _, ok := err.(*ResponseStruct); ok || (err == nil && resp.Version == 0) {
+		// Version 1 servers ignore "Hello" and complain about the missing path
+		c.version = 1
+		return c.version, nil, nil
+	} else if err != nil {
+		return 0, nil, err
+	}
+	c.version = resp.Version
+	c.capabilities = resp.Capabilities
+	return c.version, c.capabilities, nil
+}
+
+// ChangedSince asks a reverse mount for the ciphertext paths that have
+// changed since "since" (see RequestStruct.ChangedSince), and passes them to
+// "fn" in batches as the server finds them. Returns the timestamp for the
+// next call. After an error, the state of the connection is unknown and the
+// CtlSock should be closed.
+func (c *CtlSock) ChangedSince(since int64, fn func(changed []string) error) (timestamp int64, err error) {
+	c.Conn.SetDeadline(time.Now().Add(ctlsockTimeout))
+	// Version 1 servers ignore ChangedMax and send everything at once
+	id, err := c.send(RequestStruct{ChangedSince: since, ChangedMax: changedMax})
+	if err != nil {
+		return 0, err
+	}
+	for {
+		resp, err := c.receive(id)
+		if err != nil {
+			return 0, err
+		}
+		if err = fn(resp.Changed); err != nil {
+			return 0, err
+		}
+		if !resp.ChangedMore {
+			return resp.Timestamp, nil
+		}
+		c.Conn.SetDeadline(time.Now().Add(ctlsockTimeout))
+	}
+}
+
+// EncryptPaths encrypts "paths" and returns one result for each path.
+// Large numbers of paths are sent in batches without waiting for each
+// answer. With old servers that do not support batches, it falls back to
+// one request per path.
+func (c *CtlSock) EncryptPaths(paths []string) ([]PathResult, error) {
+	return c.translatePaths(paths, true)
+}
+
+// DecryptPaths is like EncryptPaths, but decrypts.
+func (c *CtlSock) DecryptPaths(paths []string) ([]PathResult, error) {
+	return c.translatePaths(paths, false)
+}
+
+// translatePaths implements EncryptPaths and DecryptPaths. After an error,
+// the state of the connection is unknown and the CtlSock should be closed.
+func (c *CtlSock) translatePaths(paths []string, encrypt bool) ([]PathResult, error) {
+	version, _, err := c.Hello()
+	if err != nil {
+		return nil, err
+	}
+	if version < 2 {
+		return c.translatePathsV1(paths, encrypt)
+	}
+	// Split into batches
+	var batches []RequestStruct
+	for len(paths) > 0 {
+		n, size := 0, 0
+		for n < len(paths) && n < batchMaxPaths && (n == 0 || size+len(paths[n]) <= batchMaxBytes) {
+			size += len(paths[n])
+			n++
+		}
+		var req RequestStruct
+		if encrypt {
+			req.EncryptPaths = paths[:n]
+		} else {
+			req.DecryptPaths = paths[:n]
+		}
+		batches = append(batches, req)
+		paths = paths[n:]
+	}
+	// Send the requests in the background so the server can work on the
+	// next batch while we read the answer to the previous one
+	firstID := c.lastID + 1
+	c.lastID += uint64(len(batches))
+	c.Conn.SetDeadline(time.Now().Add(ctlsockTimeout))
+	sendErr := make(chan error, 1)
+	go func() {
+		enc := json.NewEncoder(c.Conn)
+		for i := range batches {
+			batches[i].ID = firstID + uint64(i)
+			if err := enc.Encode(&batches[i]); err != nil {
+				sendErr <- err
+				return
+			}
+		}
+		sendErr <- nil
+	}()
+	var results []PathResult
+	for i, req := range batches {
+		resp, err := c.receive(firstID + uint64(i))
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Results) != len(req.EncryptPaths)+len(req.DecryptPaths) {
+			return nil, fmt.Errorf("got %d results for %d paths", len(resp.Results), len(req.EncryptPaths)+len(req.DecryptPaths))
+		}
+		results = append(results, resp.Results...)
+		c.Conn.SetDeadline(time.Now().Add(ctlsockTimeout))
+	}
+	return results, <-sendErr
+}
+
+// translatePathsV1 translates the paths one by one, for version 1 servers
+func (c *CtlSock) translatePathsV1(paths []string, encrypt bool) ([]PathResult, error) {
+	results := make([]PathResult, len(paths))
+	for i, p := range paths {
+		req := RequestStruct{DecryptPath: p}
+		if encrypt {
+			req = RequestStruct{EncryptPath: p}
+		}
+		resp, err := c.Query(&req)
+		if r, ok := err.(*ResponseStruct); ok {
+			resp = r
+		} else if err != nil {
+			return nil, err
+		}
+		results[i] = PathResult{
+			Result:   resp.Result,
+			ErrNo:    resp.ErrNo,
+			ErrText:  resp.ErrText,
+			WarnText: resp.WarnText,
+		}
+	}
+	return results, nil
+}
+
+// Unmount asks gocryptfs to unmount the filesystem and exit.
+func (c *CtlSock) Unmount() error {
+	_, err := c.Query(&RequestStruct{Unmount: true})
+	return err
+}
+
+// SetReadOnly switches the filesystem to read-only (ro = true) or back to
+// read-write (ro = false).
+func (c *CtlSock) SetReadOnly(ro bool) error {
+	_, err := c.Query(&RequestStruct{ReadOnly: ro, ReadWrite: !ro})
+	return err
+}
+
+// Flush asks gocryptfs to fsync all open files.
+func (c *CtlSock) Flush() error {
+	_, err := c.Query(&RequestStruct{Flush: true})
+	return err
+}
+
+// SetLogging changes the debug output of the mount and returns the new
+// state, see LogSettings. Pass an empty LogSettings to get the current
+// state.
+func (c *CtlSock) SetLogging(s LogSettings) (*LogStatus, error) {
+	resp, err := c.Query(&RequestStruct{Logging: &s})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Logging, nil
+}
+
 // Close closes the socket
 func (c *CtlSock) Close() {
 	c.Conn.Close()
@@ -1,17 +1,117 @@
 package ctlsock
 
+// ProtocolVersion is the version of the control socket protocol that this
+// package speaks.
+//
+// Version 1 servers read one request at a time and answer it with one
+// newline-terminated response. They do not know Hello, ID and the batch
+// requests.
+//
+// Version 2 servers read a stream of requests, usually separated by
+// newlines, and answer them in order. Clients may send more requests before
+// reading the responses. Hello tells the client the version and the
+// capabilities of the server.
+const ProtocolVersion = 2
+
+// MaxRequestSize is the size limit for a single request. The server closes
+// the connection when a request is bigger.
+const MaxRequestSize = 4 << 20
+
 // RequestStruct is sent by a client (encoded as JSON).
 // You cannot perform both encryption and decryption in the same request.
 type RequestStruct struct {
+	// ID is copied into the response. Clients that do not wait for each
+	// response before sending the next request can use it to match them up.
+	ID uint64 `json:",omitempty"`
+	// Hello asks for the protocol version and the capabilities of the
+	// server. Version is the protocol version of the client.
+	// Cannot be combined with the other requests.
+	Hello   bool `json:",omitempty"`
+	Version int  `json:",omitempty"`
 	// EncryptPath is the path that should be encrypted.
 	EncryptPath string
 	// DecryptPath is the path that should be decrypted.
 	DecryptPath string
+	// ChangedSince, if not zero, asks a reverse mount for the ciphertext
+	// paths that have changed since this point in time (Unix time in
+	// nanoseconds). Pass the Timestamp from the previous response to get
+	// incremental changes, or 1 to get everything.
+	// Cannot be combined with EncryptPath or DecryptPath.
+	ChangedSince int64 `json:",omitempty"`
+	// ChangedMax, if not zero, splits the answer to ChangedSince into
+	// several responses with at most ChangedMax paths each, sent while the
+	// tree is walked. All but the last have ChangedMore set, the last one
+	// carries the Timestamp. An error response also ends the sequence.
+	ChangedMax int `json:",omitempty"`
+	// ScrubStatus asks a forward mount that runs with "-scrub" for the
+	// state of the background scrubber and the corruptions it has found.
+	// Cannot be combined with the other requests.
+	ScrubStatus bool `json:",omitempty"`
+	// ListCorruptions asks a forward mount for the corruptions that have
+	// been found while accessing files, or by the scrubber.
+	// ClearCorruptions empties the list. When both are set, the list is
+	// returned and cleared in one step, so no event is lost.
+	// Cannot be combined with the other requests.
+	ListCorruptions  bool `json:",omitempty"`
+	ClearCorruptions bool `json:",omitempty"`
+	// Status asks for the configuration and statistics of the mount.
+	// Cannot be combined with the other requests.
+	Status bool `json:",omitempty"`
+	// Unmount asks gocryptfs to unmount the filesystem and exit. Fails
+	// if the filesystem is in use, like "fusermount -u" does.
+	// Cannot be combined with the other requests.
+	Unmount bool `json:",omitempty"`
+	// ReadOnly switches a forward mount to read-only: all operations that
+	// would modify the filesystem fail with EROFS. Operations that are
+	// still running are waited for, and open files are flushed, before the
+	// answer is sent. ReadWrite switches back.
+	// Cannot be combined with the other requests.
+	ReadOnly  bool `json:",omitempty"`
+	ReadWrite bool `json:",omitempty"`
+	// Flush asks a forward mount to fsync all open files.
+	// Cannot be combined with the other requests.
+	Flush bool `json:",omitempty"`
+	// EncryptPaths and DecryptPaths translate many paths in one request.
+	// Each path is handled like EncryptPath or DecryptPath.
+	// Cannot be combined with the other requests.
+	EncryptPaths []string `json:",omitempty"`
+	DecryptPaths []string `json:",omitempty"`
+	// Logging changes the debug output of the mount. An empty LogSettings
+	// only asks for the current state.
+	// Cannot be combined with the other requests.
+	Logging *LogSettings `json:",omitempty"`
+}
+
+// LogSettings is used in a Logging request. nil fields are left unchanged.
+type LogSettings struct {
+	// Debug switches debug messages on or off, like "-d"
+	Debug *bool `json:",omitempty"`
+	// OpTrace switches logging of every FUSE operation with its duration
+	OpTrace *bool `json:",omitempty"`
+	// FuseDebug is the go-fuse debug output ("-fusedebug"). It cannot be
+	// switched on a running mount, a request that tries fails.
+	FuseDebug *bool `json:",omitempty"`
+	// RevertAfter, if not zero, restores the previous state after this many
+	// seconds. Without RevertAfter, the changes are permanent and cancel a
+	// pending revert.
+	RevertAfter int64 `json:",omitempty"`
+}
+
+// LogStatus is the answer to a Logging request
+type LogStatus struct {
+	Debug     bool
+	OpTrace   bool
+	FuseDebug bool
+	// RevertAt is the Unix timestamp in seconds when the settings will be
+	// restored, or zero
+	RevertAt int64 `json:",omitempty"`
 }
 
 // ResponseStruct is sent by the server in response to a request
 // (encoded as JSON).
 type ResponseStruct struct {
+	// ID is the ID of the request
+	ID uint64 `json:",omitempty"`
 	// Result is the resulting decrypted or encrypted path. Empty on error.
 	Result string
 	// ErrNo is the error number as defined in errno.h.
@@ -23,4 +123,135 @@ type ResponseStruct struct {
 	// WarnText contains warnings that may have been encountered while
 	// processing the message.
 	WarnText string
+	// Changed is the list of changed ciphertext paths in response to a
+	// ChangedSince request. Directories are included when entries have been
+	// added, removed or renamed. The root directory is listed as ".".
+	// Deleted files are not listed.
+	Changed []string `json:",omitempty"`
+	// ChangedMore is set if more responses to the ChangedSince request
+	// follow, see ChangedMax.
+	ChangedMore bool `json:",omitempty"`
+	// Timestamp should be passed as ChangedSince in the next request.
+	Timestamp int64 `json:",omitempty"`
+	// Scrub is the answer to a ScrubStatus request.
+	Scrub *ScrubStatus `json:",omitempty"`
+	// Corruptions is the answer to a ListCorruptions request, oldest first.
+	Corruptions []CorruptionEvent `json:",omitempty"`
+	// CorruptionsDropped is the number of older events that did not fit
+	// into the list.
+	CorruptionsDropped int `json:",omitempty"`
+	// Status is the answer to a Status request.
+	Status *StatusStruct `json:",omitempty"`
+	// Version and Capabilities are the answer to a Hello request.
+	// Capabilities lists the request fields that the server supports, for
+	// example "DecryptPaths" or "ChangedSince".
+	Version      int      `json:",omitempty"`
+	Capabilities []string `json:",omitempty"`
+	// Results is the answer to an EncryptPaths or DecryptPaths request, one
+	// entry for each path, in the same order.
+	Results []PathResult `json:",omitempty"`
+	// Logging is the answer to a Logging request
+	Logging *LogStatus `json:",omitempty"`
+}
+
+// PathResult is the result of translating one path in a batch request.
+// The fields have the same meaning as in ResponseStruct.
+type PathResult struct {
+	Result   string
+	ErrNo    int32  `json:",omitempty"`
+	ErrText  string `json:",omitempty"`
+	WarnText string `json:",omitempty"`
+}
+
+// StatusStruct describes a mounted filesystem.
+type StatusStruct struct {
+	// Version is the gocryptfs version
+	Version    string
+	Cipherdir  string
+	Mountpoint string
+	Reverse    bool
+	// ConfigFile is the path to the config file. Empty if the master key
+	// has been passed directly (-masterkey, -zerokey).
+	ConfigFile string
+	// FeatureFlags from the config file
+	FeatureFlags []string
+	// AEADBackend is the content encryption algorithm and the library that
+	// implements it, for example "AES-GCM-256-OpenSSL"
+	AEADBackend string
+	// MountTime is a Unix timestamp in seconds
+	MountTime int64
+	// OpenFiles is the number of open files. Only in forward mode.
+	OpenFiles int
+	// Blocks encrypted and decrypted since mount, and their plaintext bytes.
+	// File holes are not counted.
+	BlocksEncrypted uint64
+	BytesEncrypted  uint64
+	BlocksDecrypted uint64
+	BytesDecrypted  uint64
+	// Directory cache lookups and hits since mount. Only in forward mode.
+	DirCacheLookups uint64
+	DirCacheHits    uint64
+	// IdleTimeout is the "-idle" setting in seconds, 0 if disabled.
+	IdleTimeout int64
+	// Idle is set if there has been no access and no file has been open
+	// since the last check of the "-idle" monitor. Always false without
+	// "-idle".
+	Idle bool
+}
+
+// CorruptionEvent is a corruption that gocryptfs has found in CIPHERDIR.
+type CorruptionEvent struct {
+	// Time is a Unix timestamp in seconds
+	Time int64
+	// Path is the plaintext path. For names that cannot be decrypted, the
+	// last element is the ciphertext name. Empty if the path is not known.
+	Path string
+	// Type is "name", "header", "block" or "xattr", or, for corruptions found
+	// by the scrubber, also "dir", "diriv" or "symlink"
+	Type string
+	// Item is the ciphertext name or ciphertext xattr name, if applicable
+	Item string `json:",omitempty"`
+	// Offset is the plaintext offset of a bad block
+	Offset int64 `json:",omitempty"`
+	Error  string
+}
+
+// ScrubStatus describes the state of the background scrubber.
+type ScrubStatus struct {
+	// Pass counts the scrub passes over the whole filesystem, including the
+	// one that is in progress. It is kept across mounts.
+	Pass int
+	// Running is true while a pass is in progress, and false while the
+	// scrubber waits for the next one.
+	Running bool
+	// Position is the plaintext path of the file or directory that is
+	// being scrubbed.
+	Position string
+	// PassStart and LastPassEnd are Unix timestamps in seconds.
+	// LastPassEnd is 0 if no pass has been completed yet.
+	PassStart   int64
+	LastPassEnd int64
+	// Files and plaintext Bytes checked in this pass
+	Files int64
+	Bytes int64
+	// FindingsTotal is the number of corruptions found since mount.
+	// Findings lists the most recent ones, oldest first.
+	FindingsTotal int
+	Findings      []ScrubFinding
+}
+
+// ScrubFinding is a corruption found by the background scrubber.
+type ScrubFinding struct {
+	// Time is a Unix timestamp in seconds
+	Time int64
+	// Path is the plaintext path. For names that cannot be decrypted, the
+	// last element is the ciphertext name.
+	Path string
+	// CipherPath is the ciphertext path, relative to CIPHERDIR
+	CipherPath string
+	// Type is "dir", "diriv", "name", "symlink", "header" or "block"
+	Type string
+	// Offset is the plaintext offset of a bad block
+	Offset int64 `json:",omitempty"`
+	Error  string
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+)
+
+// ctlsockGrants are the values allowed after the ":" in "-ctlsock-allow"
+var ctlsockGrants = map[string]ctlsocksrv.Grant{
+	"status": ctlsocksrv.GrantStatus,
+	"paths":  ctlsocksrv.GrantPaths,
+	"admin":  ctlsocksrv.GrantAdmin,
+	"all":    ctlsocksrv.GrantAll,
+}
+
+// ctlsockACL translates the "-ctlsock-allow" arguments into an ACL. Each
+// argument has the form USER[:GRANTS] or @GROUP[:GRANTS], where USER and
+// GROUP are names or numeric ids, and GRANTS is a comma-separated list of
+// "status", "paths", "admin" and "all" (the default).
+// The user running gocryptfs is always allowed everything.
+func ctlsockACL(specs []string) (*ctlsocksrv.ACL, error) {
+	acl := &ctlsocksrv.ACL{
+		Uids: map[uint32]ctlsocksrv.Grant{uint32(os.Getuid()): ctlsocksrv.GrantAll},
+		Gids: map[uint32]ctlsocksrv.Grant{},
+	}
+	for _, spec := range specs {
+		principal, grantList, found := strings.Cut(spec, ":")
+		grants := ctlsocksrv.GrantAll
+		if found {
+			grants = 0
+			for _, g := range strings.Split(grantList, ",") {
+				v, ok := ctlsockGrants[g]
+				if !ok {
+					return nil, fmt.Errorf("%q: unknown grant %q", spec, g)
+				}
+				grants |= v
+			}
+		}
+		if group, ok := strings.CutPrefix(principal, "@"); ok {
+			gid, err := lookupId(group, func(name string) (string, error) {
+				g, err := user.LookupGroup(name)
+				if err != nil {
+					return "", err
+				}
+				return g.Gid, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			acl.Gids[gid] |= grants
+		} else {
+			uid, err := lookupId(principal, func(name string) (string, error) {
+				u, err := user.Lookup(name)
+				if err != nil {
+					return "", err
+				}
+				return u.Uid, nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			acl.Uids[uid] |= grants
+		}
+	}
+	return acl, nil
+}
+
+// lookupId returns "name" if it is numeric, and calls "lookup" otherwise
+func lookupId(name string, lookup func(string) (string, error)) (uint32, error) {
+	if name == "" {
+		return 0, fmt.Errorf("empty user or group name")
+	}
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	idStr, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(idStr, 10, 32)
+	return uint32(id), err
+}
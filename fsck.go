@@ -9,106 +9,187 @@ import (
 	"path/filepath"
 	"sort"
 	"sync"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/offline"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
 type fsckObj struct {
-	rootNode *fusefrontend.RootNode
+	rootNode   *fusefrontend.RootNode
+	contentEnc *contentenc.ContentEnc
+	// offline is used to check CIPHERDIR directly for "-fsck -offline"
+	offline *offline.FS
+	// offlineCheck is set for "-fsck -offline"
+	offlineCheck bool
+	// cipherdir is the absolute path of CIPHERDIR
+	cipherdir string
 	// mnt is the mountpoint of the temporary mount
 	mnt string
 	// List of corrupt files
 	corruptList []string
 	// List of skipped files
 	skippedList []string
-	// Protects corruptList
+	// Details for the "-fsck-report" file
+	problems  []fsckProblem
+	skipped   []fsckSkipped
+	mitigated []fsckMitigated
+	// blockProblems maps paths to their problemBlock entry in "problems"
+	blockProblems map[string]int
+	// Protects the lists
 	listLock sync.Mutex
-	// stop a running watchMitigatedCorruptions thread
-	watchDone chan struct{}
+	// watchStart and watchDone tell collectMitigatedCorruptions() which
+	// walk operation is running
+	watchStart chan mitigationWatch
+	watchDone  chan struct{}
 	// Inode numbers of hard-linked files (Nlink > 1) that we have already checked
 	seenInodes map[uint64]struct{}
 	// abort the running fsck operation? Checked in a few long-running loops.
-	abort bool
+	abort atomic.Bool
+	// mitigationLock serializes the operations that may report transparently
+	// mitigated corruptions, so they can be attributed to the right path.
+	// Only the walk takes it, the workers just read file contents.
+	mitigationLock sync.Mutex
+	// jobs are the file ranges for the workers to read
+	jobs chan fsckJob
+	// workersDone is done when all workers have exited
+	workersDone sync.WaitGroup
+	progress    *fsckProgress
+	// checkpointFile is the "-fsck-checkpoint" file, or ""
+	checkpointFile string
+	// plainDir is set for "-fsck -reverse". It is the plaintext directory
+	// the mounted ciphertext copy is compared against.
+	plainDir string
+	// mergeDirs are the "-merge"d directories (top-level name -> path)
+	// for "-fsck -reverse".
+	mergeDirs map[string]string
+	// followSymlinks is set when the copy was made with "-follow-symlinks"
+	followSymlinks bool
+	// isExcluded reports if a relative plaintext path is hidden from the
+	// reverse view, and hence not expected in the copy.
+	isExcluded func(relPath string) bool
+	// List of files that are missing in the ciphertext copy
+	missingList []string
+	// List of files whose ciphertext copy does not match the plaintext
+	staleList []string
 }
 
-func runsAsRoot() bool {
-	return syscall.Geteuid() == 0
+// fsckChunkSize is the size of the ranges big files are split into, so
+// several workers can read them
+const fsckChunkSize = 64 * 1024 * 1024
+
+// fsckFile is a file that is being checked by the workers
+type fsckFile struct {
+	relPath string
+	f       *os.File
+	plain   *plainFile
+	// fileID is set for "-fsck -offline". "f" is the ciphertext file then.
+	fileID []byte
+	// seq is the number of the file in walk order, see fsckProgress
+	seq uint64
+	// chunks is the number of jobs that have not finished
+	chunks atomic.Int32
+	// corrupt is set once the file has been marked corrupt
+	corrupt atomic.Bool
 }
 
-func (ck *fsckObj) markCorrupt(path string) {
-	ck.listLock.Lock()
-	ck.corruptList = append(ck.corruptList, path)
-	ck.listLock.Unlock()
+// fsckJob is a range of a file for a worker to read. end < 0 means up to
+// the end of the file.
+type fsckJob struct {
+	file     *fsckFile
+	off, end int64
 }
 
-func (ck *fsckObj) markSkipped(path string) {
-	ck.listLock.Lock()
-	ck.skippedList = append(ck.skippedList, path)
-	ck.listLock.Unlock()
+func runsAsRoot() bool {
+	return syscall.Geteuid() == 0
 }
 
 func (ck *fsckObj) abs(relPath string) (absPath string) {
 	return filepath.Join(ck.mnt, relPath)
 }
 
-// Watch for mitigated corruptions that occur during OpenDir()
-func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
+// mitigationWatch handles the mitigated corruptions that an operation of
+// the walk causes, see collectMitigatedCorruptions()
+type mitigationWatch func(c fusefrontend.MitigatedCorruption)
+
+// collectMitigatedCorruptions reads the mitigated corruptions the mount
+// reports until "stop" is closed, and closes "done" then. While the walk
+// runs an operation, it sends a mitigationWatch on watchStart, and the
+// corruptions are passed to it until it sends on watchDone. The others come
+// from the workers reading file contents.
+func (ck *fsckObj) collectMitigatedCorruptions(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	var watch mitigationWatch
 	for {
 		select {
-		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, item)
-			ck.markCorrupt(filepath.Join(path, item))
+		case c := <-ck.rootNode.MitigatedCorruptions:
+			if watch != nil {
+				watch(c)
+				continue
+			}
+			// Reading file contents can only find an incomplete header
+			fmt.Printf("fsck: corrupt file %q (inode %s)\n", c.Path, c.Item)
+			ck.markMitigated(c.Path, problemHeader, c.Item)
+		case watch = <-ck.watchStart:
 		case <-ck.watchDone:
+			watch = nil
+		case <-stop:
 			return
 		}
 	}
 }
 
-// Recursively check dir for corruption
+// Watch for mitigated corruptions that occur during OpenDir()
+// Call with mitigationLock held.
+func (ck *fsckObj) watchMitigatedCorruptionsOpenDir(path string) {
+	ck.watchStart <- func(c fusefrontend.MitigatedCorruption) {
+		fmt.Printf("fsck: corrupt entry in dir %q: %q\n", path, c.Item)
+		ck.markMitigated(filepath.Join(path, c.Item), problemName, c.Item)
+	}
+}
+
+// Recursively check dir for corruption. Files are queued for the workers.
 func (ck *fsckObj) dir(relPath string) {
 	tlog.Debug.Printf("ck.dir %q\n", relPath)
-	ck.xattrs(relPath)
-	// Run OpenDir and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsOpenDir(relPath)
-	f, err := os.Open(ck.abs(relPath))
-	ck.watchDone <- struct{}{}
-	if err != nil {
-		fmt.Printf("fsck: error opening dir %q: %v\n", relPath, err)
-		if err == os.ErrPermission && !runsAsRoot() {
-			ck.markSkipped(relPath)
-		} else {
-			ck.markCorrupt(relPath)
-		}
-		return
+	// When resuming, we still have to list directories that have already
+	// been checked to get to the rest
+	if !ck.progress.isDone(relPath) {
+		seq := ck.progress.add(relPath)
+		ck.xattrs(relPath)
+		defer ck.progress.finish(seq)
 	}
-	go ck.watchMitigatedCorruptionsOpenDir(relPath)
-	entries, err := f.Readdirnames(0)
-	ck.watchDone <- struct{}{}
-	if err != nil {
-		fmt.Printf("fsck: error reading dir %q: %v\n", relPath, err)
-		ck.markCorrupt(relPath)
+	entries, ok := ck.readDir(relPath)
+	if !ok {
 		return
 	}
 	// Sort alphabetically to make fsck runs deterministic
 	sort.Strings(entries)
+	if ck.plainDir != "" {
+		entries = ck.verifyDir(relPath, entries)
+	}
 	for _, entry := range entries {
-		if ck.abort {
+		if ck.abort.Load() {
 			return
 		}
 		if entry == "." || entry == ".." {
 			continue
 		}
 		nextPath := filepath.Join(relPath, entry)
+		if ck.progress.canSkipTree(nextPath) {
+			continue
+		}
 		var st syscall.Stat_t
 		err := syscall.Lstat(ck.abs(nextPath), &st)
 		if err != nil {
-			ck.markCorrupt(filepath.Join(relPath, entry))
+			ck.markCorrupt(filepath.Join(relPath, entry), problemStat, err)
 			continue
 		}
 		filetype := st.Mode & syscall.S_IFMT
@@ -117,7 +198,7 @@ func (ck *fsckObj) dir(relPath string) {
 		case syscall.S_IFDIR:
 			ck.dir(nextPath)
 		case syscall.S_IFREG:
-			ck.file(nextPath)
+			ck.file(nextPath, &st)
 		case syscall.S_IFLNK:
 			ck.symlink(nextPath)
 		case syscall.S_IFIFO, syscall.S_IFSOCK, syscall.S_IFBLK, syscall.S_IFCHR:
@@ -128,37 +209,61 @@ func (ck *fsckObj) dir(relPath string) {
 	}
 }
 
+// readDir lists the directory "relPath" and catches transparently mitigated
+// corruptions. Returns false if the directory cannot be read.
+func (ck *fsckObj) readDir(relPath string) (entries []string, ok bool) {
+	ck.mitigationLock.Lock()
+	defer ck.mitigationLock.Unlock()
+	// Run OpenDir and catch transparently mitigated corruptions
+	ck.watchMitigatedCorruptionsOpenDir(relPath)
+	f, err := os.Open(ck.abs(relPath))
+	ck.watchDone <- struct{}{}
+	if err != nil {
+		fmt.Printf("fsck: error opening dir %q: %v\n", relPath, err)
+		if err == os.ErrPermission && !runsAsRoot() {
+			ck.markSkipped(relPath, err)
+		} else {
+			ck.markCorrupt(relPath, problemDir, err)
+		}
+		return nil, false
+	}
+	defer f.Close()
+	ck.watchMitigatedCorruptionsOpenDir(relPath)
+	entries, err = f.Readdirnames(0)
+	ck.watchDone <- struct{}{}
+	if err != nil {
+		fmt.Printf("fsck: error reading dir %q: %v\n", relPath, err)
+		ck.markCorrupt(relPath, problemDir, err)
+		return nil, false
+	}
+	return entries, true
+}
+
 func (ck *fsckObj) symlink(relPath string) {
-	_, err := os.Readlink(ck.abs(relPath))
+	target, err := os.Readlink(ck.abs(relPath))
 	if err != nil {
-		ck.markCorrupt(relPath)
+		ck.markCorrupt(relPath, problemSymlink, err)
 		fmt.Printf("fsck: error reading symlink %q: %v\n", relPath, err)
+		return
+	}
+	if ck.plainDir != "" {
+		ck.verifySymlink(relPath, target)
 	}
 }
 
 // Watch for mitigated corruptions that occur during Read()
+// Call with mitigationLock held.
 func (ck *fsckObj) watchMitigatedCorruptionsRead(path string) {
-	for {
-		select {
-		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, item)
-			ck.markCorrupt(path)
-		case <-ck.watchDone:
-			return
-		}
+	ck.watchStart <- func(c fusefrontend.MitigatedCorruption) {
+		fmt.Printf("fsck: corrupt file %q (inode %s)\n", path, c.Item)
+		ck.markMitigated(path, problemHeader, c.Item)
 	}
 }
 
-// Check file for corruption
-func (ck *fsckObj) file(relPath string) {
+// Check file for corruption. The first read happens here, under
+// mitigationLock, the rest of the file is queued for the workers.
+func (ck *fsckObj) file(relPath string, st *syscall.Stat_t) {
 	tlog.Debug.Printf("ck.file %q\n", relPath)
-	var st syscall.Stat_t
-	err := syscall.Lstat(ck.abs(relPath), &st)
-	if err != nil {
-		ck.markCorrupt(relPath)
-		fmt.Printf("fsck: error stating file %q: %v\n", relPath, err)
-		return
-	}
 	if st.Nlink > 1 {
 		// Due to hard links, we may have already checked this file.
 		if _, ok := ck.seenInodes[st.Ino]; ok {
@@ -167,77 +272,207 @@ func (ck *fsckObj) file(relPath string) {
 		}
 		ck.seenInodes[st.Ino] = struct{}{}
 	}
+	seq := ck.progress.add(relPath)
 	ck.xattrs(relPath)
 	f, err := os.Open(ck.abs(relPath))
 	if err != nil {
 		fmt.Printf("fsck: error opening file %q: %v\n", relPath, err)
 		if err == os.ErrPermission && !runsAsRoot() {
-			ck.markSkipped(relPath)
+			ck.markSkipped(relPath, err)
 		} else {
-			ck.markCorrupt(relPath)
+			ck.markCorrupt(relPath, problemRead, err)
 		}
+		ck.progress.finish(seq)
 		return
 	}
-	defer f.Close()
-	// 128 kiB of zeros
-	allZero := make([]byte, fuse.MAX_KERNEL_WRITE)
+	ff := &fsckFile{relPath: relPath, f: f, seq: seq}
+	// For "-fsck -reverse", we compare with the plaintext file while reading
+	if ck.plainDir != "" {
+		ff.plain = ck.openPlainFile(relPath, st.Size)
+	}
+	// The header is read and checked on the first read. If it is
+	// incomplete, the file reads as empty, and a mitigated corruption is
+	// reported.
+	ck.mitigationLock.Lock()
+	ck.watchMitigatedCorruptionsRead(relPath)
+	_, err = f.ReadAt(make([]byte, 1), 0)
+	ck.watchDone <- struct{}{}
+	ck.mitigationLock.Unlock()
+	if err != nil {
+		// io.EOF means the file is empty
+		if err != io.EOF {
+			ck.markCorrupt(relPath, problemRead, err)
+			fmt.Printf("fsck: error reading file %q (inum %d): %v\n", relPath, inum(f), err)
+		}
+		ck.fileDone(ff)
+		return
+	}
+	// Split big files, but not when comparing with a plaintext file, which
+	// is read sequentially
+	if ff.plain != nil {
+		ff.chunks.Store(1)
+		ck.jobs <- fsckJob{file: ff, off: 0, end: -1}
+		return
+	}
+	ck.queueChunks(ff, st.Size, func(off int64) (int64, error) {
+		const SEEK_DATA = 3
+		return syscall.Seek(int(f.Fd()), off, SEEK_DATA)
+	})
+}
+
+// queueChunks splits the file "ff" of plaintext size "size" into chunks for
+// the workers. Chunks that are all hole are skipped. "seekData" returns the
+// plaintext offset of the next data at or after "off", like SEEK_DATA.
+func (ck *fsckObj) queueChunks(ff *fsckFile, size int64, seekData func(off int64) (int64, error)) {
+	// The walk holds one reference, so the file cannot finish while we are
+	// still queueing chunks
+	ff.chunks.Store(1)
+	for off := int64(0); off < size; off += fsckChunkSize {
+		nextOff, err := seekData(off)
+		if err == syscall.ENXIO {
+			// Only a hole until EOF
+			ck.progress.bytes.Add(size - off)
+			break
+		} else if err == nil && nextOff >= off+fsckChunkSize {
+			skip := nextOff / fsckChunkSize * fsckChunkSize
+			ck.progress.bytes.Add(skip - off)
+			off = skip
+		}
+		end := off + fsckChunkSize
+		if end >= size {
+			end = -1
+		}
+		ff.chunks.Add(1)
+		ck.jobs <- fsckJob{file: ff, off: off, end: end}
+	}
+	if ff.chunks.Add(-1) == 0 {
+		ck.fileDone(ff)
+	}
+}
+
+// worker reads the file ranges from ck.jobs
+func (ck *fsckObj) worker() {
+	defer ck.workersDone.Done()
 	buf := make([]byte, fuse.MAX_KERNEL_WRITE)
-	var off int64
-	// Read() through the whole file and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsRead(relPath)
-	defer func() { ck.watchDone <- struct{}{} }()
-	for {
-		if ck.abort {
+	for j := range ck.jobs {
+		if j.file.fileID != nil {
+			ck.readCipherRange(j, buf)
+		} else {
+			ck.readRange(j, buf)
+		}
+		if j.file.chunks.Add(-1) == 0 {
+			ck.fileDone(j.file)
+		}
+	}
+}
+
+// fileDone closes the file "ff" after the last job has finished
+func (ck *fsckObj) fileDone(ff *fsckFile) {
+	ff.f.Close()
+	if ff.plain != nil {
+		ff.plain.Close()
+	}
+	if ck.abort.Load() {
+		// The file may not have been read completely. Don't let the
+		// checkpoint skip it.
+		return
+	}
+	ck.progress.files.Add(1)
+	ck.progress.finish(ff.seq)
+}
+
+// readRange reads through the range of the file in "j", using "buf".
+// Corrupt blocks return an error.
+func (ck *fsckObj) readRange(j fsckJob, buf []byte) {
+	ff := j.file
+	// 128 kiB of zeros
+	allZero := make([]byte, len(buf))
+	off := j.off
+	for j.end < 0 || off < j.end {
+		if ck.abort.Load() {
 			return
 		}
-		tlog.Debug.Printf("ck.file: read %d bytes from offset %d\n", len(buf), off)
-		n, err := f.ReadAt(buf, off)
+		b := buf
+		if j.end >= 0 && j.end-off < int64(len(b)) {
+			b = b[:j.end-off]
+		}
+		tlog.Debug.Printf("ck.file: read %d bytes from offset %d\n", len(b), off)
+		n, err := ff.f.ReadAt(b, off)
 		if err != nil && err != io.EOF {
-			ck.markCorrupt(relPath)
-			fmt.Printf("fsck: error reading file %q (inum %d): %v\n", relPath, inum(f), err)
+			fmt.Printf("fsck: error reading file %q (inum %d): %v\n", ff.relPath, inum(ff.f), err)
+			ck.findBadBlocks(ff, off, len(b), err)
 			return
 		}
+		ck.progress.bytes.Add(int64(n))
+		if ff.plain != nil {
+			ff.plain.compare(b[:n], off)
+		}
 		// EOF
 		if err == io.EOF {
 			return
 		}
 		off += int64(n)
 		// If we seem to be in the middle of a file hole, try to skip to the next
-		// data section.
-		data := buf[:n]
-		if bytes.Equal(data, allZero) {
+		// data section. Not when comparing with a plaintext file, which may
+		// have data where we have a hole.
+		data := b[:n]
+		if ff.plain == nil && n == len(buf) && bytes.Equal(data, allZero) {
 			tlog.Debug.Printf("ck.file: trying to skip file hole\n")
 			const SEEK_DATA = 3
-			nextOff, err := syscall.Seek(int(f.Fd()), off, SEEK_DATA)
-			if err == nil {
+			nextOff, err := syscall.Seek(int(ff.f.Fd()), off, SEEK_DATA)
+			if err == nil && nextOff > off {
+				if j.end >= 0 {
+					nextOff = min(nextOff, j.end)
+				}
+				ck.progress.bytes.Add(nextOff - off)
 				off = nextOff
 			}
 		}
 	}
 }
 
+// findBadBlocks reads the range of "length" bytes at "off", where reading
+// failed with "readErr", block by block to find the blocks that fail
+// authentication. The mount only returns EIO for the whole range.
+func (ck *fsckObj) findBadBlocks(ff *fsckFile, off int64, length int, readErr error) {
+	bs := int64(ck.contentEnc.PlainBS())
+	buf := make([]byte, bs)
+	found := false
+	for o := off / bs * bs; o < off+int64(length); o += bs {
+		_, err := ff.f.ReadAt(buf, o)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			ck.markBadBlock(ff.relPath, uint64(o/bs), err)
+			found = true
+		}
+	}
+	if !found && !ff.corrupt.Swap(true) {
+		ck.markCorrupt(ff.relPath, problemRead, readErr)
+	}
+}
+
 // Watch for mitigated corruptions that occur during ListXAttr()
+// Call with mitigationLock held.
 func (ck *fsckObj) watchMitigatedCorruptionsListXAttr(path string) {
-	for {
-		select {
-		case item := <-ck.rootNode.MitigatedCorruptions:
-			fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", path, item)
-			ck.markCorrupt(path + " xattr:" + item)
-		case <-ck.watchDone:
-			return
-		}
+	ck.watchStart <- func(c fusefrontend.MitigatedCorruption) {
+		fmt.Printf("fsck: corrupt xattr name on file %q: %q\n", path, c.Item)
+		ck.markMitigated(path+" xattr:"+c.Item, problemXattr, c.Item)
 	}
 }
 
 // Check xattrs on file/dir at path
 func (ck *fsckObj) xattrs(relPath string) {
 	// Run ListXAttr() and catch transparently mitigated corruptions
-	go ck.watchMitigatedCorruptionsListXAttr(relPath)
+	ck.mitigationLock.Lock()
+	ck.watchMitigatedCorruptionsListXAttr(relPath)
 	attrs, err := syscallcompat.Llistxattr(ck.abs(relPath))
 	ck.watchDone <- struct{}{}
+	ck.mitigationLock.Unlock()
 	if err != nil {
 		fmt.Printf("fsck: error listing xattrs on %q: %v\n", relPath, err)
-		ck.markCorrupt(relPath)
+		ck.markCorrupt(relPath, problemXattr, err)
 		return
 	}
 	// Try to read all xattr values
@@ -246,9 +481,9 @@ func (ck *fsckObj) xattrs(relPath string) {
 		if err != nil {
 			fmt.Printf("fsck: error reading xattr %q from %q: %v\n", a, relPath, err)
 			if err == syscall.EACCES && !runsAsRoot() {
-				ck.markSkipped(relPath)
+				ck.markSkipped(relPath, err)
 			} else {
-				ck.markCorrupt(relPath)
+				ck.markCorrupt(relPath, problemXattr, fmt.Errorf("xattr %q: %v", a, err))
 			}
 		}
 	}
@@ -256,26 +491,79 @@ func (ck *fsckObj) xattrs(relPath string) {
 
 // entrypoint from main()
 func fsck(args *argContainer) (exitcode int) {
+	var plainDir string
 	if args.reverse {
-		tlog.Fatal.Printf("Running -fsck with -reverse is not supported")
-		os.Exit(exitcodes.Usage)
+		// "-fsck -reverse PLAINDIR CIPHERCOPY": we mount CIPHERCOPY in
+		// forward mode, using the reverse config in PLAINDIR, and compare
+		// it with PLAINDIR.
+		plainDir = args.cipherdir
+		args.cipherdir, _ = filepath.Abs(flagSet.Arg(1))
+		if err := isDir(args.cipherdir); err != nil {
+			tlog.Fatal.Printf("Invalid ciphertext copy: %v", err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		args.reverse = false
 	}
 	args.allow_other = false
 	args.ro = true
 	var err error
-	args.mountpoint, err = os.MkdirTemp("", "gocryptfs.fsck.")
-	if err != nil {
-		tlog.Fatal.Printf("fsck: TmpDir: %v", err)
-		os.Exit(exitcodes.MountPoint)
-	}
-	pfs, wipeKeys := initFuseFrontend(args)
-	rn := pfs.(*fusefrontend.RootNode)
-	rn.MitigatedCorruptions = make(chan string)
-	ck := fsckObj{
-		mnt:        args.mountpoint,
-		rootNode:   rn,
-		watchDone:  make(chan struct{}),
-		seenInodes: make(map[uint64]struct{}),
+	if !args.offline {
+		args.mountpoint, err = os.MkdirTemp("", "gocryptfs.fsck.")
+		if err != nil {
+			tlog.Fatal.Printf("fsck: TmpDir: %v", err)
+			os.Exit(exitcodes.MountPoint)
+		}
+	}
+	frontendArgs, cCore, cEnc, nameTransform := initCrypto(args)
+	wipeKeys := cCore.Wipe
+	rn := fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+	rn.MitigatedCorruptions = make(chan fusefrontend.MitigatedCorruption)
+	if args.fsck_workers < 1 {
+		tlog.Fatal.Printf("-fsck-workers: must be at least 1")
+		os.Exit(exitcodes.Usage)
+	}
+	ck := &fsckObj{
+		mnt:            args.mountpoint,
+		rootNode:       rn,
+		contentEnc:     cEnc,
+		offline:        offline.New(offlineArgs(frontendArgs), cEnc, nameTransform),
+		cipherdir:      args.cipherdir,
+		watchStart:     make(chan mitigationWatch),
+		watchDone:      make(chan struct{}),
+		seenInodes:     make(map[uint64]struct{}),
+		jobs:           make(chan fsckJob, args.fsck_workers),
+		progress:       newFsckProgress(),
+		checkpointFile: args.fsck_checkpoint,
+		offlineCheck:   args.offline,
+	}
+	var repair *fsckRepair
+	if args.fsck_report != "" {
+		start := time.Now()
+		defer func() {
+			ck.writeReport(args.fsck_report, start, repair, exitcode)
+		}()
+	}
+	if ck.checkpointFile != "" {
+		ck.loadCheckpoint(args.cipherdir)
+	}
+	if plainDir != "" {
+		if args.offline {
+			tlog.Fatal.Printf("-offline does not work with -fsck -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		ck.initVerify(plainDir, args)
+	}
+	if args.repair {
+		if plainDir != "" {
+			tlog.Fatal.Printf("-repair does not work with -fsck -reverse")
+			os.Exit(exitcodes.Usage)
+		}
+		repair = newFsckRepair(args, ck.offline, cEnc)
+		defer repair.close()
+		// Names have to be repaired before mounting, a directory without
+		// gocryptfs.diriv cannot even be listed.
+		tlog.Info.Println(tlog.ColorGreen + "Repairing names..." + tlog.ColorReset)
+		repair.tree("")
 	}
 	if args.quiet {
 		// go-fuse throws a lot of these:
@@ -283,42 +571,95 @@ func fsck(args *argContainer) (exitcode int) {
 		// This is ugly and causes failures in xfstests. Hide them away in syslog.
 		tlog.SwitchLoggerToSyslog()
 	}
-	// Mount
-	srv := initGoFuse(pfs, args)
+	unmount := func() {}
+	if !args.offline {
+		// Mount
+		srv := initGoFuse(rn, nil, args)
+		var unmountOnce sync.Once
+		unmount = func() {
+			unmountOnce.Do(func() {
+				err := srv.Unmount()
+				if err != nil {
+					tlog.Warn.Printf("failed to unmount %q: %v", ck.mnt, err)
+				} else {
+					if err := syscall.Rmdir(ck.mnt); err != nil {
+						tlog.Warn.Printf("cleaning up %q failed: %v", ck.mnt, err)
+					}
+				}
+			})
+		}
+		defer unmount()
+	}
 	// Handle SIGINT & SIGTERM
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
 	signal.Notify(ch, syscall.SIGTERM)
 	go func() {
 		<-ch
-		ck.abort = true
-	}()
-	defer func() {
-		err = srv.Unmount()
-		if err != nil {
-			tlog.Warn.Printf("failed to unmount %q: %v", ck.mnt, err)
-		} else {
-			if err := syscall.Rmdir(ck.mnt); err != nil {
-				tlog.Warn.Printf("cleaning up %q failed: %v", ck.mnt, err)
-			}
-		}
+		ck.abort.Store(true)
 	}()
+	// Collect the mitigated corruptions for as long as the walk and the
+	// workers run
+	stopCollector := make(chan struct{})
+	collectorDone := make(chan struct{})
+	go ck.collectMitigatedCorruptions(stopCollector, collectorDone)
 	// Recursively check the root dir
 	tlog.Info.Println(tlog.ColorGreen + "Checking filesystem..." + tlog.ColorReset)
-	ck.dir("")
+	go ck.scan(args.cipherdir)
+	stopProgress := make(chan struct{})
+	go ck.progressLoop(args.fsck_progress, stopProgress)
+	for i := 0; i < args.fsck_workers; i++ {
+		ck.workersDone.Add(1)
+		go ck.worker()
+	}
+	if args.offline {
+		ck.cipherDir("", "")
+	} else {
+		ck.dir("")
+	}
+	close(ck.jobs)
+	ck.workersDone.Wait()
+	close(stopCollector)
+	<-collectorDone
+	close(stopProgress)
+	ck.corruptList = uniq(ck.corruptList)
+	ck.skippedList = uniq(ck.skippedList)
+	ck.missingList = uniq(ck.missingList)
+	ck.staleList = uniq(ck.staleList)
+	if ck.checkpointFile != "" {
+		if ck.abort.Load() {
+			ck.saveCheckpoint()
+			tlog.Info.Printf("fsck: checkpoint written to %q, run again to resume", ck.checkpointFile)
+		} else {
+			os.Remove(ck.checkpointFile)
+		}
+	}
+	if repair != nil && !ck.abort.Load() {
+		defer wipeKeys()
+		// The mount has cached dirIVs and inodes of CIPHERDIR, which
+		// the repair is about to modify
+		unmount()
+		return ck.finishRepair(repair)
+	}
 	// Report results
 	wipeKeys()
-	if ck.abort {
+	if ck.abort.Load() {
 		tlog.Info.Printf("fsck: aborted")
 		return exitcodes.Other
 	}
-	if len(ck.corruptList) == 0 && len(ck.skippedList) == 0 {
+	if len(ck.corruptList) == 0 && len(ck.skippedList) == 0 &&
+		len(ck.missingList) == 0 && len(ck.staleList) == 0 {
 		tlog.Info.Printf("fsck summary: no problems found\n")
 		return 0
 	}
 	if len(ck.skippedList) > 0 {
 		tlog.Warn.Printf("fsck: re-run this program as root to check all files!\n")
 	}
+	if ck.plainDir != "" {
+		fmt.Printf("fsck summary: %d corrupt files, %d files skipped, %d missing, %d stale\n",
+			len(ck.corruptList), len(ck.skippedList), len(ck.missingList), len(ck.staleList))
+		return exitcodes.FsckErrors
+	}
 	fmt.Printf("fsck summary: %d corrupt files, %d files skipped\n", len(ck.corruptList), len(ck.skippedList))
 	return exitcodes.FsckErrors
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// This file implements "-fsck -offline", which checks CIPHERDIR directly,
+// without mounting it. It also finds problems that a mount hides:
+// orphaned gocryptfs.longname.*.name files, invalid gocryptfs.diriv files
+// and leftover temporary files.
+
+// cipherDir recursively checks the ciphertext directory "cDir", whose
+// plaintext path is "relPath". Files are queued for the workers.
+func (ck *fsckObj) cipherDir(relPath string, cDir string) {
+	tlog.Debug.Printf("ck.cipherDir %q %q\n", relPath, cDir)
+	if !ck.progress.isDone(relPath) {
+		seq := ck.progress.add(relPath)
+		ck.cipherXattrs(relPath, cDir)
+		defer ck.progress.finish(seq)
+	}
+	c, err := ck.offline.CheckDir(cDir)
+	if err != nil {
+		fmt.Printf("fsck: error reading dir %q: %v\n", relPath, err)
+		if os.IsPermission(err) && !runsAsRoot() {
+			ck.markSkipped(relPath, err)
+		} else {
+			ck.markCorrupt(relPath, problemDir, err)
+		}
+		return
+	}
+	if c.DirIVErr != nil {
+		fmt.Printf("fsck: invalid gocryptfs.diriv in dir %q: %v\n", relPath, c.DirIVErr)
+		ck.markCorrupt(relPath, problemDirIV, c.DirIVErr)
+	}
+	for _, b := range c.Bad {
+		fmt.Printf("fsck: corrupt entry in dir %q: %q: %v\n", relPath, b.CName, b.Err)
+		ck.markCorrupt(filepath.Join(relPath, b.CName), problemName, b.Err)
+	}
+	for _, cName := range c.OrphanNames {
+		fmt.Printf("fsck: orphaned long name file in dir %q: %q\n", relPath, cName)
+		ck.markCorrupt(filepath.Join(relPath, cName), problemOrphanName, nil)
+	}
+	for _, cName := range c.TempFiles {
+		fmt.Printf("fsck: leftover temporary file in dir %q: %q\n", relPath, cName)
+		ck.markCorrupt(filepath.Join(relPath, cName), problemTempFile, nil)
+	}
+	for _, cName := range c.Foreign {
+		fmt.Printf("fsck: ignoring unencrypted file in dir %q: %q\n", relPath, cName)
+	}
+	// Sort alphabetically to make fsck runs deterministic, and to walk in the
+	// same order as the mounted check
+	sort.Slice(c.Entries, func(i, j int) bool {
+		return c.Entries[i].Name < c.Entries[j].Name
+	})
+	for _, e := range c.Entries {
+		if ck.abort.Load() {
+			return
+		}
+		nextPath := filepath.Join(relPath, e.Name)
+		if ck.progress.canSkipTree(nextPath) {
+			continue
+		}
+		cPath := filepath.Join(cDir, e.CName)
+		var st syscall.Stat_t
+		err := syscall.Lstat(filepath.Join(ck.cipherdir, cPath), &st)
+		if err != nil {
+			ck.markCorrupt(nextPath, problemStat, err)
+			continue
+		}
+		switch st.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			ck.cipherDir(nextPath, cPath)
+		case syscall.S_IFREG:
+			ck.cipherFile(nextPath, cPath, &st)
+		case syscall.S_IFLNK:
+			if _, err := ck.offline.Readlink(cPath); err != nil {
+				fmt.Printf("fsck: error reading symlink %q: %v\n", nextPath, err)
+				ck.markCorrupt(nextPath, problemSymlink, err)
+			}
+		}
+	}
+}
+
+// cipherXattrs checks the extended attributes of the ciphertext file "cPath"
+func (ck *fsckObj) cipherXattrs(relPath string, cPath string) {
+	bad, err := ck.offline.CheckXattrs(cPath)
+	for _, b := range bad {
+		fmt.Printf("fsck: corrupt xattr %q on %q: %v\n", b.CName, relPath, b.Err)
+		ck.markCorrupt(relPath+" xattr:"+b.CName, problemXattr, b.Err)
+	}
+	if err != nil {
+		fmt.Printf("fsck: error reading xattrs on %q: %v\n", relPath, err)
+		if os.IsPermission(err) && !runsAsRoot() {
+			ck.markSkipped(relPath, err)
+		} else {
+			ck.markCorrupt(relPath, problemXattr, err)
+		}
+	}
+}
+
+// cipherFile checks the header of the ciphertext file "cPath" and queues its
+// blocks for the workers.
+func (ck *fsckObj) cipherFile(relPath string, cPath string, st *syscall.Stat_t) {
+	tlog.Debug.Printf("ck.cipherFile %q\n", relPath)
+	if st.Nlink > 1 {
+		if _, ok := ck.seenInodes[st.Ino]; ok {
+			return
+		}
+		ck.seenInodes[st.Ino] = struct{}{}
+	}
+	seq := ck.progress.add(relPath)
+	ck.cipherXattrs(relPath, cPath)
+	f, err := os.Open(filepath.Join(ck.cipherdir, cPath))
+	if err != nil {
+		fmt.Printf("fsck: error opening file %q: %v\n", relPath, err)
+		if os.IsPermission(err) && !runsAsRoot() {
+			ck.markSkipped(relPath, err)
+		} else {
+			ck.markCorrupt(relPath, problemRead, err)
+		}
+		ck.progress.finish(seq)
+		return
+	}
+	ff := &fsckFile{relPath: relPath, f: f, seq: seq}
+	if st.Size == 0 {
+		ck.fileDone(ff)
+		return
+	}
+	headerBytes := make([]byte, contentenc.HeaderLen)
+	_, err = io.ReadFull(f, headerBytes)
+	var header *contentenc.FileHeader
+	if err == nil {
+		header, err = contentenc.ParseHeader(headerBytes)
+	} else if err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("incomplete file header: %d bytes", st.Size)
+	}
+	if err != nil {
+		fmt.Printf("fsck: corrupt file %q: %v\n", relPath, err)
+		ck.markCorrupt(relPath, problemHeader, err)
+		ck.fileDone(ff)
+		return
+	}
+	ff.fileID = header.ID
+	cBS := int64(ck.contentEnc.CipherBS())
+	pBS := int64(ck.contentEnc.PlainBS())
+	// Round up, so a truncated last block is checked as well
+	size := (st.Size - contentenc.HeaderLen + cBS - 1) / cBS * pBS
+	ck.queueChunks(ff, size, func(off int64) (int64, error) {
+		const SEEK_DATA = 3
+		cOff, err := syscall.Seek(int(f.Fd()), contentenc.HeaderLen+off/pBS*cBS, SEEK_DATA)
+		if err != nil {
+			return 0, err
+		}
+		return max(cOff-contentenc.HeaderLen, 0) / cBS * pBS, nil
+	})
+}
+
+// readCipherRange decrypts the blocks of the ciphertext file in "j" and
+// reports every block that fails authentication. The range is in plaintext
+// offsets, aligned to blocks.
+func (ck *fsckObj) readCipherRange(j fsckJob, buf []byte) {
+	ff := j.file
+	ce := ck.contentEnc
+	cBS := int(ce.CipherBS())
+	pBS := int64(ce.PlainBS())
+	// Read as many blocks at once as fit into "buf"
+	buf = buf[:len(buf)/cBS*cBS]
+	allZero := make([]byte, len(buf))
+	blockNo := uint64(j.off / pBS)
+	for j.end < 0 || int64(blockNo)*pBS < j.end {
+		if ck.abort.Load() {
+			return
+		}
+		b := buf
+		if j.end >= 0 {
+			b = b[:min(int64(len(b)), (j.end/pBS-int64(blockNo))*int64(cBS))]
+		}
+		cOff := contentenc.HeaderLen + int64(blockNo)*int64(cBS)
+		n, err := ff.f.ReadAt(b, cOff)
+		if err != nil && err != io.EOF {
+			fmt.Printf("fsck: error reading file %q: %v\n", ff.relPath, err)
+			if !ff.corrupt.Swap(true) {
+				ck.markCorrupt(ff.relPath, problemRead, err)
+			}
+			return
+		}
+		for i := 0; i < n; i += cBS {
+			block := b[i:min(i+cBS, n)]
+			plaintext, err := ce.DecryptBlock(block, blockNo, ff.fileID)
+			if err != nil {
+				fmt.Printf("fsck: corrupt block %d (plaintext offset %d) in file %q: %v\n",
+					blockNo, int64(blockNo)*pBS, ff.relPath, err)
+				ck.markBadBlock(ff.relPath, blockNo, err)
+			}
+			ck.progress.bytes.Add(int64(len(plaintext)))
+			blockNo++
+		}
+		if n < len(b) {
+			// EOF
+			return
+		}
+		// Skip over file holes
+		if n == len(buf) && bytes.Equal(b, allZero) {
+			const SEEK_DATA = 3
+			nextOff, err := syscall.Seek(int(ff.f.Fd()), cOff+int64(n), SEEK_DATA)
+			if err != nil {
+				// ENXIO: only a hole until EOF
+				if err == syscall.ENXIO {
+					return
+				}
+				continue
+			}
+			next := uint64(nextOff-contentenc.HeaderLen) / uint64(cBS)
+			if j.end >= 0 {
+				next = min(next, uint64(j.end/pBS))
+			}
+			if next > blockNo {
+				ck.progress.bytes.Add(int64(next-blockNo) * pBS)
+				blockNo = next
+			}
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// checkpointInterval is how often the "-fsck-checkpoint" file is written
+// when "-fsck-progress" is off.
+const checkpointInterval = 10 * time.Second
+
+// fsckProgress tracks how far the check has come. Entries are numbered in
+// walk order (depth-first, sorted by name) when the walk reaches them, and
+// finish in any order, because files are checked by several workers.
+type fsckProgress struct {
+	lock sync.Mutex
+	// nextSeq is the number of the next entry
+	nextSeq uint64
+	// All entries below lowWater have finished
+	lowWater uint64
+	// pending maps the numbers of entries that have not finished, or that
+	// finished out of order, to their paths
+	pending map[uint64]string
+	// finished marks entries >= lowWater that have finished
+	finished map[uint64]bool
+	// done is the path of the entry lowWater-1. Everything up to it has been
+	// checked. Starts with the value from the checkpoint.
+	done string
+	// resumeAfter is the "done" path from the checkpoint. Entries up to it
+	// are skipped.
+	resumeAfter string
+
+	// Files and plaintext bytes checked, including the resumed run
+	files atomic.Int64
+	bytes atomic.Int64
+	// bytesResumed is "bytes" from the checkpoint, to calculate the rate
+	bytesResumed int64
+	start        time.Time
+	// Totals from scanning CIPHERDIR, set when scanDone is
+	totalFiles atomic.Int64
+	totalBytes atomic.Int64
+	scanDone   atomic.Bool
+}
+
+func newFsckProgress() *fsckProgress {
+	return &fsckProgress{
+		pending:  make(map[uint64]string),
+		finished: make(map[uint64]bool),
+		start:    time.Now(),
+	}
+}
+
+// add registers the entry "relPath" that the walk has reached
+func (p *fsckProgress) add(relPath string) (seq uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	seq = p.nextSeq
+	p.nextSeq++
+	p.pending[seq] = relPath
+	return seq
+}
+
+// finish marks the entry "seq" as checked
+func (p *fsckProgress) finish(seq uint64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.finished[seq] = true
+	for p.finished[p.lowWater] {
+		p.done = p.pending[p.lowWater]
+		delete(p.pending, p.lowWater)
+		delete(p.finished, p.lowWater)
+		p.lowWater++
+	}
+}
+
+// isDone returns true if "relPath" has been checked in the run we resume
+func (p *fsckProgress) isDone(relPath string) bool {
+	return p.resumeAfter != "" && walkCompare(relPath, p.resumeAfter) <= 0
+}
+
+// canSkipTree returns true if the directory "relPath" and everything in it
+// has been checked in the run we resume
+func (p *fsckProgress) canSkipTree(relPath string) bool {
+	return p.isDone(relPath) && relPath != p.resumeAfter &&
+		!strings.HasPrefix(p.resumeAfter, relPath+"/")
+}
+
+// walkCompare compares the relative paths "a" and "b" in the order fsck
+// walks the tree: a directory comes before its contents, the entries of a
+// directory are sorted by name. Returns -1, 0 or 1.
+func walkCompare(a, b string) int {
+	if a == b {
+		return 0
+	}
+	if a == "" {
+		return -1
+	}
+	if b == "" {
+		return 1
+	}
+	return slices.Compare(strings.Split(a, "/"), strings.Split(b, "/"))
+}
+
+// scan counts the files in the ciphertext directory "cipherdir" and their
+// plaintext size, for the ETA.
+func (ck *fsckObj) scan(cipherdir string) {
+	p := ck.progress
+	filepath.WalkDir(cipherdir, func(path string, d fs.DirEntry, err error) error {
+		if ck.abort.Load() {
+			return filepath.SkipAll
+		}
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		name := d.Name()
+		if name == configfile.ConfDefaultName || name == nametransform.DirIVFilename ||
+			nametransform.NameType(name) == nametransform.LongNameFilename {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		p.totalFiles.Add(1)
+		// Good enough for the ETA. CipherSizeToPlainSize would warn about
+		// corrupt sizes, which the check reports anyway.
+		if size := fi.Size() - contentenc.HeaderLen; size > 0 {
+			p.totalBytes.Add(size * int64(ck.contentEnc.PlainBS()) / int64(ck.contentEnc.CipherBS()))
+		}
+		return nil
+	})
+	p.scanDone.Store(true)
+}
+
+// report prints a progress line like
+//
+//	fsck: progress: 1200/5000 files, 1204.10/5120.00 MB, 180.50 MB/s, ETA 21s
+func (p *fsckProgress) report() {
+	files := p.files.Load()
+	mb := float64(p.bytes.Load()) / 1e6
+	elapsed := time.Since(p.start).Seconds()
+	rate := (float64(p.bytes.Load()-p.bytesResumed) / 1e6) / elapsed
+	if !p.scanDone.Load() {
+		tlog.Info.Printf("fsck: progress: %d files, %.2f MB, %.2f MB/s, ETA unknown (still counting)",
+			files, mb, rate)
+		return
+	}
+	totalMB := float64(p.totalBytes.Load()) / 1e6
+	eta := "unknown"
+	if rate > 0 {
+		eta = (time.Duration(max(totalMB-mb, 0)/rate) * time.Second).String()
+	}
+	tlog.Info.Printf("fsck: progress: %d/%d files, %.2f/%.2f MB, %.2f MB/s, ETA %s",
+		files, p.totalFiles.Load(), mb, totalMB, rate, eta)
+}
+
+// progressLoop prints progress and writes the checkpoint until "stop" is
+// closed.
+func (ck *fsckObj) progressLoop(interval time.Duration, stop chan struct{}) {
+	tick := interval
+	if tick <= 0 {
+		tick = checkpointInterval
+	}
+	t := time.NewTicker(tick)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if interval > 0 {
+				ck.progress.report()
+			}
+			if ck.checkpointFile != "" {
+				ck.saveCheckpoint()
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// fsckCheckpoint is the content of the "-fsck-checkpoint" file
+type fsckCheckpoint struct {
+	// Cipherdir protects against resuming the check of another filesystem
+	Cipherdir string
+	// Done is the path up to which (in walk order) everything was checked
+	Done string
+	// Files and plaintext bytes that were checked
+	Files int64
+	Bytes int64
+	// Problems found so far
+	Corrupt   []fsckProblem
+	Skipped   []fsckSkipped
+	Mitigated []fsckMitigated
+	Missing   []string
+	Stale     []string
+}
+
+// loadCheckpoint resumes from the "-fsck-checkpoint" file, if it exists.
+// Calls os.Exit if it belongs to another CIPHERDIR.
+func (ck *fsckObj) loadCheckpoint(cipherdir string) {
+	js, err := os.ReadFile(ck.checkpointFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	var c fsckCheckpoint
+	if err == nil {
+		err = json.Unmarshal(js, &c)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-fsck-checkpoint: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	if c.Cipherdir != cipherdir {
+		tlog.Fatal.Printf("-fsck-checkpoint: %q belongs to %q, not %q", ck.checkpointFile, c.Cipherdir, cipherdir)
+		os.Exit(exitcodes.Usage)
+	}
+	p := ck.progress
+	p.resumeAfter = c.Done
+	p.done = c.Done
+	p.files.Store(c.Files)
+	p.bytes.Store(c.Bytes)
+	p.bytesResumed = c.Bytes
+	for _, p := range c.Corrupt {
+		if p.Type == problemBlock {
+			for _, b := range p.Blocks {
+				ck.markBadBlock(p.Path, b.BlockNo, errors.New(b.Error))
+			}
+			continue
+		}
+		ck.markCorrupt(p.Path, p.Type, errors.New(p.Error))
+	}
+	for _, sk := range c.Skipped {
+		ck.markSkipped(sk.Path, errors.New(sk.Reason))
+	}
+	for _, m := range c.Mitigated {
+		ck.markMitigated(m.Path, m.Type, m.Item)
+	}
+	ck.missingList = c.Missing
+	ck.staleList = c.Stale
+	tlog.Info.Printf("fsck: resuming after %q (%d files checked)", c.Done, c.Files)
+}
+
+// saveCheckpoint writes the "-fsck-checkpoint" file
+func (ck *fsckObj) saveCheckpoint() {
+	p := ck.progress
+	p.lock.Lock()
+	done := p.done
+	p.lock.Unlock()
+	ck.listLock.Lock()
+	c := fsckCheckpoint{
+		Cipherdir: ck.cipherdir,
+		Done:      done,
+		Files:     p.files.Load(),
+		Bytes:     p.bytes.Load(),
+		Corrupt:   slices.Clone(ck.problems),
+		Skipped:   slices.Clone(ck.skipped),
+		Mitigated: slices.Clone(ck.mitigated),
+		Missing:   slices.Clone(ck.missingList),
+		Stale:     slices.Clone(ck.staleList),
+	}
+	ck.listLock.Unlock()
+	js, err := json.MarshalIndent(c, "", "\t")
+	if err != nil {
+		tlog.Warn.Printf("fsck: checkpoint: %v", err)
+		return
+	}
+	// Write to a temporary file and rename, so an interruption cannot leave
+	// a truncated checkpoint behind
+	tmp := ck.checkpointFile + ".tmp"
+	err = os.WriteFile(tmp, js, 0600)
+	if err == nil {
+		err = os.Rename(tmp, ck.checkpointFile)
+	}
+	if err != nil {
+		tlog.Warn.Printf("fsck: checkpoint: %v", err)
+	}
+}
+
+// uniq sorts "list" and removes duplicates
+func uniq(list []string) []string {
+	slices.Sort(list)
+	return slices.Compact(list)
+}
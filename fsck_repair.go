@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/offline"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// lostFoundName is the plaintext name of the directory in the root of the
+// filesystem where "-fsck -repair" moves entries whose names cannot be
+// decrypted.
+const lostFoundName = "lost+found"
+
+// fsckRepair implements "-fsck -repair". Broken names are fixed directly in
+// CIPHERDIR before the check (tree), bad blocks in the files that the check
+// found to be corrupt after it (file).
+type fsckRepair struct {
+	fs   *offline.FS
+	cEnc *contentenc.ContentEnc
+	// cipherdir is the absolute path of CIPHERDIR
+	cipherdir string
+	// dryRun only logs what would be done
+	dryRun bool
+	// removeBadBlocks drops bad blocks instead of replacing them by zeros
+	removeBadBlocks bool
+	// dirIV allows recreating a missing or invalid gocryptfs.diriv
+	// ("-repair-diriv"), which moves all names in the directory to lost+found
+	dirIV bool
+	// logFile is the "-repair-log" file, or nil
+	logFile *os.File
+	// lostFound is the ciphertext path of lost+found, once it exists
+	lostFound string
+	// Number of repairs done (or, with dryRun, planned) and failed
+	repaired int
+	failed   int
+	// unrepaired counts the problems that have been left alone on purpose
+	unrepaired int
+}
+
+func newFsckRepair(args *argContainer, f *offline.FS, cEnc *contentenc.ContentEnc) *fsckRepair {
+	r := &fsckRepair{
+		fs:        f,
+		cEnc:      cEnc,
+		cipherdir: args.cipherdir,
+		dryRun:    args.dry_run,
+		dirIV:     args.repair_diriv,
+	}
+	switch args.repair_blocks {
+	case "zero":
+	case "remove":
+		r.removeBadBlocks = true
+	default:
+		tlog.Fatal.Printf("-repair-blocks: invalid value %q, must be \"zero\" or \"remove\"", args.repair_blocks)
+		os.Exit(exitcodes.Usage)
+	}
+	if args.repair_log != "" {
+		var err error
+		r.logFile, err = os.OpenFile(args.repair_log, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			tlog.Fatal.Printf("-repair-log: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	return r
+}
+
+// action logs and, unless in dry-run mode, runs a repair action
+func (r *fsckRepair) action(desc string, fn func() error) {
+	var err error
+	msg := desc
+	if r.dryRun {
+		msg = "would " + desc
+	} else {
+		err = fn()
+		if err != nil {
+			msg = fmt.Sprintf("failed to %s: %v", desc, err)
+		}
+	}
+	if err != nil {
+		r.failed++
+	} else {
+		r.repaired++
+	}
+	r.note(msg)
+}
+
+// note prints "msg" and writes it to the repair log
+func (r *fsckRepair) note(msg string) {
+	fmt.Printf("fsck: repair: %s\n", msg)
+	if r.logFile != nil {
+		fmt.Fprintf(r.logFile, "%s %s\n", time.Now().Format(time.RFC3339), msg)
+	}
+}
+
+func (r *fsckRepair) close() {
+	if r.logFile != nil {
+		r.logFile.Close()
+	}
+}
+
+// tree recursively repairs the names in the ciphertext directory "cDir"
+func (r *fsckRepair) tree(cDir string) {
+	c, err := r.fs.CheckDir(cDir)
+	if err != nil {
+		fmt.Printf("fsck: repair: cannot check dir %q: %v\n", cDir, err)
+		r.failed++
+		return
+	}
+	keepBad := false
+	if c.DirIVErr != nil && !r.dirIV {
+		// Without a valid diriv, no name in the directory can be decrypted.
+		// Moving them all to lost+found loses all names, only do it when
+		// asked to.
+		r.note(fmt.Sprintf("not recreating gocryptfs.diriv in %q (%v), this would move all %d entries "+
+			"to %s. Pass -repair-diriv to do it.", cDir, c.DirIVErr, len(c.Bad), lostFoundName))
+		r.unrepaired++
+		keepBad = true
+	} else if c.DirIVErr != nil {
+		var backup string
+		r.action(fmt.Sprintf("recreate gocryptfs.diriv in %q (%v)", cDir, c.DirIVErr), func() (err error) {
+			backup, err = r.fs.RecreateDirIV(cDir)
+			return err
+		})
+		if backup != "" {
+			r.note(fmt.Sprintf("kept damaged gocryptfs.diriv in %q as %q", cDir, backup))
+		}
+	}
+	for _, cName := range c.OrphanNames {
+		r.action(fmt.Sprintf("remove orphaned %q", filepath.Join(cDir, cName)), func() error {
+			return r.fs.RemoveOrphanName(cDir, cName)
+		})
+	}
+	for _, cName := range c.TempFiles {
+		cPath := filepath.Join(cDir, cName)
+		r.action(fmt.Sprintf("move leftover temporary file %q to %s", cPath, lostFoundName), func() error {
+			return r.moveToLostFound(cPath)
+		})
+	}
+	for _, b := range c.Bad {
+		cPath := filepath.Join(cDir, b.CName)
+		if keepBad {
+			if fi, err := os.Lstat(r.abs(cPath)); err == nil && fi.IsDir() {
+				r.tree(cPath)
+			}
+			continue
+		}
+		r.action(fmt.Sprintf("move undecryptable %q to %s", cPath, lostFoundName), func() error {
+			return r.moveToLostFound(cPath)
+		})
+	}
+	for _, e := range c.Entries {
+		cPath := filepath.Join(cDir, e.CName)
+		if fi, err := os.Lstat(r.abs(cPath)); err == nil && fi.IsDir() {
+			r.tree(cPath)
+		}
+	}
+}
+
+func (r *fsckRepair) abs(cPath string) string {
+	return filepath.Join(r.cipherdir, cPath)
+}
+
+// moveToLostFound moves the ciphertext entry "cPath" to lost+found. The
+// plaintext name there is the ciphertext name. File contents do not depend
+// on the name, so they can still be read.
+func (r *fsckRepair) moveToLostFound(cPath string) error {
+	if r.lostFound == "" {
+		cName, err := r.fs.CreateName("", lostFoundName)
+		if err != nil {
+			return err
+		}
+		err = r.fs.Mkdir(cName, 0700)
+		if err != nil && !errors.Is(err, os.ErrExist) {
+			return err
+		}
+		r.lostFound = cName
+	}
+	name := filepath.Base(cPath)
+	for i := 1; ; i++ {
+		cName, err := r.fs.EncryptName(r.lostFound, name)
+		if err != nil {
+			return err
+		}
+		if _, err = os.Lstat(r.abs(filepath.Join(r.lostFound, cName))); errors.Is(err, os.ErrNotExist) {
+			break
+		}
+		name = fmt.Sprintf("%s.%d", filepath.Base(cPath), i)
+	}
+	cNew, err := r.fs.Rename(cPath, r.lostFound, name)
+	if cNew != "" && errors.Is(err, syscall.ENOENT) {
+		// The entry has been moved, only deleting its
+		// gocryptfs.longname.*.name file failed. It was missing, which is
+		// why we are here.
+		return nil
+	}
+	return err
+}
+
+// file zeros or removes the blocks of the plaintext file "relPath" that
+// fail authentication.
+func (r *fsckRepair) file(relPath string) {
+	cPath, err := r.fs.EncryptPath(relPath)
+	if err != nil {
+		fmt.Printf("fsck: repair: cannot find ciphertext of %q: %v\n", relPath, err)
+		r.failed++
+		return
+	}
+	f, err := os.OpenFile(r.abs(cPath), os.O_RDWR, 0)
+	if err != nil {
+		fmt.Printf("fsck: repair: cannot open %q: %v\n", relPath, err)
+		r.failed++
+		return
+	}
+	defer f.Close()
+	headerBytes := make([]byte, contentenc.HeaderLen)
+	if _, err = io.ReadFull(f, headerBytes); err != nil {
+		fmt.Printf("fsck: repair: cannot repair %q: incomplete file header\n", relPath)
+		r.failed++
+		return
+	}
+	header, err := contentenc.ParseHeader(headerBytes)
+	if err != nil {
+		fmt.Printf("fsck: repair: cannot repair %q: %v\n", relPath, err)
+		r.failed++
+		return
+	}
+	cBS := int64(r.cEnc.CipherBS())
+	overhead := int(r.cEnc.BlockOverhead())
+	buf := make([]byte, cBS)
+	// After a removed block, the following good blocks are moved down to
+	// outBlock, and have to be encrypted again with their new block number.
+	var outBlock uint64
+	var removed bool
+	// end is where the last block we keep ends
+	end := int64(contentenc.HeaderLen)
+	for blockNo := uint64(0); ; blockNo++ {
+		off := contentenc.HeaderLen + int64(blockNo)*cBS
+		n, err := f.ReadAt(buf, off)
+		if n == 0 {
+			break
+		}
+		if err != nil && err != io.EOF {
+			fmt.Printf("fsck: repair: error reading %q: %v\n", relPath, err)
+			r.failed++
+			return
+		}
+		outOff := contentenc.HeaderLen + int64(outBlock)*cBS
+		plaintext, err := r.cEnc.DecryptBlock(buf[:n], blockNo, header.ID)
+		if err == nil {
+			if removed && !r.dryRun {
+				out := r.cEnc.EncryptBlock(plaintext, outBlock, header.ID)
+				if _, err := f.WriteAt(out, outOff); err != nil {
+					fmt.Printf("fsck: repair: error writing %q: %v\n", relPath, err)
+					r.failed++
+					return
+				}
+			}
+			outBlock++
+			end = outOff + int64(n)
+			continue
+		}
+		pOff := blockNo * r.cEnc.PlainBS()
+		if r.removeBadBlocks || n <= overhead {
+			r.action(fmt.Sprintf("remove bad block %d (plaintext offset %d) of %q", blockNo, pOff, relPath), func() error {
+				return nil
+			})
+			removed = true
+			continue
+		}
+		zeros := make([]byte, n-overhead)
+		r.action(fmt.Sprintf("zero bad block %d (plaintext offset %d) of %q", blockNo, pOff, relPath), func() error {
+			_, err := f.WriteAt(r.cEnc.EncryptBlock(zeros, outBlock, header.ID), outOff)
+			return err
+		})
+		outBlock++
+		end = outOff + int64(n)
+	}
+	if removed && !r.dryRun {
+		if err := f.Truncate(end); err != nil {
+			fmt.Printf("fsck: repair: error truncating %q: %v\n", relPath, err)
+			r.failed++
+		}
+	}
+}
+
+// finishRepair repairs the files that the check found to be corrupt, prints
+// the summary and returns the exit code.
+func (ck *fsckObj) finishRepair(r *fsckRepair) int {
+	// Corrupt directories and xattrs cannot be repaired
+	unrepaired := 0
+	seen := make(map[string]bool)
+	for _, p := range ck.corruptList {
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		cPath, err := r.fs.EncryptPath(p)
+		var fi os.FileInfo
+		if err == nil {
+			fi, err = os.Lstat(r.abs(cPath))
+		}
+		if err != nil || !fi.Mode().IsRegular() {
+			unrepaired++
+			continue
+		}
+		r.file(p)
+	}
+	if len(ck.skippedList) > 0 {
+		tlog.Warn.Printf("fsck: re-run this program as root to check all files!\n")
+	}
+	verb := "repaired"
+	if r.dryRun {
+		verb = "to repair"
+	}
+	fmt.Printf("fsck summary: %d corrupt files, %d files skipped, %d problems %s, %d repairs failed\n",
+		len(seen), len(ck.skippedList), r.repaired, verb, r.failed)
+	if unrepaired > 0 || r.unrepaired > 0 || r.failed > 0 || len(ck.skippedList) > 0 || r.dryRun && r.repaired > 0 {
+		return exitcodes.FsckErrors
+	}
+	return 0
+}
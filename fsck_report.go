@@ -0,0 +1,234 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Problem types in the "-fsck-report" file
+const (
+	// The directory cannot be opened or listed
+	problemDir = "dir"
+	// gocryptfs.diriv is missing or invalid
+	problemDirIV = "diriv"
+	// The name cannot be decrypted
+	problemName = "name"
+	// The entry cannot be stat'ed
+	problemStat = "stat"
+	// The file cannot be opened or read
+	problemRead = "read"
+	// The file header is invalid or incomplete
+	problemHeader = "header"
+	// Blocks fail authentication, see fsckProblem.Blocks
+	problemBlock = "block"
+	// The symlink target cannot be decrypted
+	problemSymlink = "symlink"
+	// Extended attributes cannot be listed, or a name or value cannot be
+	// decrypted
+	problemXattr = "xattr"
+	// A gocryptfs.longname.*.name file without its entry
+	problemOrphanName = "orphan_name"
+	// A leftover temporary file
+	problemTempFile = "temp_file"
+)
+
+// fsckReport is the content of the "-fsck-report" file
+type fsckReport struct {
+	Cipherdir string
+	// PlainDir is set for "-fsck -reverse"
+	PlainDir string `json:",omitempty"`
+	Offline  bool
+	Start    time.Time
+	End      time.Time
+	// Aborted is set if fsck was interrupted. The results are incomplete.
+	Aborted  bool
+	ExitCode int
+	Counters fsckCounters
+	Corrupt  []fsckProblem
+	Skipped  []fsckSkipped
+	// Mitigated are the corruptions that a mount hides, like entries whose
+	// names cannot be decrypted. They are not repeated in Corrupt.
+	Mitigated []fsckMitigated
+	// Missing and Stale are the results of "-fsck -reverse"
+	Missing []string `json:",omitempty"`
+	Stale   []string `json:",omitempty"`
+}
+
+// fsckCounters summarizes the report
+type fsckCounters struct {
+	// Files and plaintext bytes checked
+	Files int64
+	Bytes int64
+	// Corrupt is the number of corrupt paths, including the mitigated ones
+	Corrupt   int
+	Skipped   int
+	Mitigated int
+	Missing   int
+	Stale     int
+	// Repairs done (or, with -dry-run, planned) and failed
+	Repaired     int
+	RepairFailed int
+}
+
+// fsckProblem is something wrong with the file or directory at Path
+type fsckProblem struct {
+	// Path is the plaintext path. For entries whose names cannot be
+	// decrypted, the last element is the ciphertext name.
+	Path string
+	// Type is one of the problem* constants
+	Type  string
+	Error string
+	// Blocks that fail authentication, for Type "block"
+	Blocks []fsckBadBlock `json:",omitempty"`
+}
+
+// fsckBadBlock is a block that fails authentication
+type fsckBadBlock struct {
+	BlockNo uint64
+	// Offset is the plaintext offset of the block
+	Offset int64
+	Error  string
+}
+
+// fsckSkipped is a file that could not be checked
+type fsckSkipped struct {
+	Path   string
+	Reason string
+}
+
+// fsckMitigated is a corruption that gocryptfs reported through
+// RootNode.MitigatedCorruptions
+type fsckMitigated struct {
+	Path string
+	// Type is problemName, problemHeader or problemXattr
+	Type string
+	// Item is what the mount reported: the ciphertext name, the inode
+	// number or the ciphertext xattr name
+	Item string
+}
+
+// errString returns err.Error(), or "" for nil. The path is dropped from
+// *fs.PathError, it would be the path on the temporary mount.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	var pe *fs.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return err.Error()
+}
+
+// markCorrupt records a problem of type "typ" with "path"
+func (ck *fsckObj) markCorrupt(path string, typ string, err error) {
+	ck.listLock.Lock()
+	ck.corruptList = append(ck.corruptList, path)
+	ck.problems = append(ck.problems, fsckProblem{Path: path, Type: typ, Error: errString(err)})
+	ck.listLock.Unlock()
+}
+
+// markBadBlock records that block "blockNo" of the file "path" fails
+// authentication
+func (ck *fsckObj) markBadBlock(path string, blockNo uint64, err error) {
+	b := fsckBadBlock{
+		BlockNo: blockNo,
+		Offset:  int64(blockNo * ck.contentEnc.PlainBS()),
+		Error:   errString(err),
+	}
+	ck.listLock.Lock()
+	defer ck.listLock.Unlock()
+	if i, ok := ck.blockProblems[path]; ok {
+		ck.problems[i].Blocks = append(ck.problems[i].Blocks, b)
+		return
+	}
+	if ck.blockProblems == nil {
+		ck.blockProblems = make(map[string]int)
+	}
+	ck.blockProblems[path] = len(ck.problems)
+	ck.corruptList = append(ck.corruptList, path)
+	ck.problems = append(ck.problems, fsckProblem{Path: path, Type: problemBlock,
+		Error: b.Error, Blocks: []fsckBadBlock{b}})
+}
+
+// markSkipped records that "path" could not be checked because of "reason"
+func (ck *fsckObj) markSkipped(path string, reason error) {
+	ck.listLock.Lock()
+	ck.skippedList = append(ck.skippedList, path)
+	ck.skipped = append(ck.skipped, fsckSkipped{Path: path, Reason: errString(reason)})
+	ck.listLock.Unlock()
+}
+
+// markMitigated records a corruption reported by the mount
+func (ck *fsckObj) markMitigated(path string, typ string, item string) {
+	ck.listLock.Lock()
+	ck.corruptList = append(ck.corruptList, path)
+	ck.mitigated = append(ck.mitigated, fsckMitigated{Path: path, Type: typ, Item: item})
+	ck.listLock.Unlock()
+}
+
+// writeReport writes the "-fsck-report" file
+func (ck *fsckObj) writeReport(fn string, start time.Time, repair *fsckRepair, exitcode int) {
+	ck.listLock.Lock()
+	r := fsckReport{
+		Cipherdir: ck.cipherdir,
+		PlainDir:  ck.plainDir,
+		Offline:   ck.offlineCheck,
+		Start:     start,
+		End:       time.Now(),
+		Aborted:   ck.abort.Load(),
+		ExitCode:  exitcode,
+		Counters: fsckCounters{
+			Files:     ck.progress.files.Load(),
+			Bytes:     ck.progress.bytes.Load(),
+			Corrupt:   len(uniq(slices.Clone(ck.corruptList))),
+			Skipped:   len(uniq(slices.Clone(ck.skippedList))),
+			Mitigated: len(ck.mitigated),
+			Missing:   len(ck.missingList),
+			Stale:     len(ck.staleList),
+		},
+		Corrupt:   slices.Clone(ck.problems),
+		Skipped:   slices.Clone(ck.skipped),
+		Mitigated: slices.Clone(ck.mitigated),
+		Missing:   slices.Clone(ck.missingList),
+		Stale:     slices.Clone(ck.staleList),
+	}
+	ck.listLock.Unlock()
+	// Empty lists instead of null, for the benefit of the consumers
+	if r.Corrupt == nil {
+		r.Corrupt = []fsckProblem{}
+	}
+	if r.Skipped == nil {
+		r.Skipped = []fsckSkipped{}
+	}
+	if r.Mitigated == nil {
+		r.Mitigated = []fsckMitigated{}
+	}
+	if repair != nil {
+		r.Counters.Repaired = repair.repaired
+		r.Counters.RepairFailed = repair.failed
+	}
+	// Sort to make reports deterministic, the workers finish in any order
+	slices.SortStableFunc(r.Corrupt, func(a, b fsckProblem) int {
+		return walkCompare(a.Path, b.Path)
+	})
+	for _, p := range r.Corrupt {
+		slices.SortFunc(p.Blocks, func(a, b fsckBadBlock) int {
+			return cmp.Compare(a.BlockNo, b.BlockNo)
+		})
+	}
+	js, err := json.MarshalIndent(r, "", "\t")
+	if err == nil {
+		err = os.WriteFile(fn, append(js, '\n'), 0600)
+	}
+	if err != nil {
+		tlog.Warn.Printf("-fsck-report: %v", err)
+	}
+}
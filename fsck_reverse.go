@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_reverse"
+)
+
+// This file implements "-fsck -reverse PLAINDIR CIPHERCOPY". The normal fsck
+// code checks CIPHERCOPY for corruption, and the functions here compare
+// what we see with PLAINDIR to find missing and stale files.
+
+// initVerify sets up ck to compare the ciphertext copy with "plainDir".
+func (ck *fsckObj) initVerify(plainDir string, args *argContainer) {
+	ck.plainDir = plainDir
+	ck.mergeDirs = args._mergeDirs
+	ck.followSymlinks = args.follow_symlinks
+	excluder := fusefrontend_reverse.NewExcluder(fusefrontend.Args{
+		Exclude:         args.exclude,
+		ExcludeWildcard: args.excludeWildcard,
+		ExcludeFrom:     args.excludeFrom,
+	})
+	configCustom := args._configCustom
+	ck.isExcluded = func(relPath string) bool {
+		// .gocryptfs.reverse.conf shows up as gocryptfs.conf in the root dir
+		// of the copy, which is hidden in the forward mount.
+		if relPath == configfile.ConfReverseName && !configCustom {
+			return true
+		}
+		return excluder != nil && excluder(relPath)
+	}
+}
+
+func (ck *fsckObj) markMissing(path string) {
+	ck.listLock.Lock()
+	ck.missingList = append(ck.missingList, path)
+	ck.listLock.Unlock()
+}
+
+func (ck *fsckObj) markStale(path string) {
+	ck.listLock.Lock()
+	ck.staleList = append(ck.staleList, path)
+	ck.listLock.Unlock()
+}
+
+// plainAbs returns the absolute path of the plaintext file that the relative
+// path "relPath" in the copy was created from. Takes "-merge" into account.
+func (ck *fsckObj) plainAbs(relPath string) string {
+	top, rest, _ := strings.Cut(relPath, "/")
+	if dir, ok := ck.mergeDirs[top]; ok {
+		return filepath.Join(dir, rest)
+	}
+	return filepath.Join(ck.plainDir, relPath)
+}
+
+// plainFileType returns the S_IFMT bits of the plaintext file "relPath",
+// like the reverse mount presented it.
+func (ck *fsckObj) plainFileType(relPath string, copyType uint32) (uint32, error) {
+	var st syscall.Stat_t
+	err := syscall.Lstat(ck.plainAbs(relPath), &st)
+	if err != nil {
+		return 0, err
+	}
+	t := uint32(st.Mode) & syscall.S_IFMT
+	// With -follow-symlinks, the reverse mount presents most symlinks as
+	// their target
+	if t == syscall.S_IFLNK && copyType != syscall.S_IFLNK && ck.followSymlinks {
+		if err = syscall.Stat(ck.plainAbs(relPath), &st); err == nil {
+			t = uint32(st.Mode) & syscall.S_IFMT
+		}
+	}
+	return t, nil
+}
+
+// verifyDir compares the sorted entries of directory "relPath" of the copy
+// with the plaintext directory. Reports missing and stale entries and returns
+// the entries that should be checked further.
+func (ck *fsckObj) verifyDir(relPath string, entries []string) (checkEntries []string) {
+	plainEntries, err := os.ReadDir(ck.plainAbs(relPath))
+	if err != nil {
+		fmt.Printf("fsck: error reading plaintext dir %q: %v\n", relPath, err)
+		ck.markSkipped(relPath, err)
+		return nil
+	}
+	plainNames := make(map[string]struct{})
+	for _, e := range plainEntries {
+		plainNames[e.Name()] = struct{}{}
+	}
+	if relPath == "" {
+		for name := range ck.mergeDirs {
+			plainNames[name] = struct{}{}
+		}
+	}
+	copyNames := make(map[string]struct{})
+	for _, entry := range entries {
+		copyNames[entry] = struct{}{}
+		nextPath := filepath.Join(relPath, entry)
+		if _, ok := plainNames[entry]; !ok || ck.isExcluded(nextPath) {
+			fmt.Printf("fsck: stale entry %q: does not exist in plaintext dir\n", nextPath)
+			ck.markStale(nextPath)
+			continue
+		}
+		var st syscall.Stat_t
+		if err = syscall.Lstat(ck.abs(nextPath), &st); err != nil {
+			// Let the normal check report this
+			checkEntries = append(checkEntries, entry)
+			continue
+		}
+		copyType := uint32(st.Mode) & syscall.S_IFMT
+		plainType, err := ck.plainFileType(nextPath, copyType)
+		if err != nil {
+			fmt.Printf("fsck: error stating plaintext file %q: %v\n", nextPath, err)
+			ck.markSkipped(nextPath, err)
+			continue
+		}
+		if plainType != copyType {
+			fmt.Printf("fsck: stale entry %q: file type has changed\n", nextPath)
+			ck.markStale(nextPath)
+			continue
+		}
+		checkEntries = append(checkEntries, entry)
+	}
+	var missing []string
+	for name := range plainNames {
+		nextPath := filepath.Join(relPath, name)
+		if _, ok := copyNames[name]; ok || ck.isExcluded(nextPath) {
+			continue
+		}
+		missing = append(missing, nextPath)
+	}
+	// Sort to make fsck runs deterministic
+	sort.Strings(missing)
+	for _, p := range missing {
+		fmt.Printf("fsck: missing in ciphertext copy: %q\n", p)
+		ck.markMissing(p)
+	}
+	return checkEntries
+}
+
+// verifySymlink compares the symlink target "target" from the copy with the
+// plaintext symlink.
+func (ck *fsckObj) verifySymlink(relPath string, target string) {
+	plainTarget, err := os.Readlink(ck.plainAbs(relPath))
+	if err != nil {
+		fmt.Printf("fsck: error reading plaintext symlink %q: %v\n", relPath, err)
+		ck.markSkipped(relPath, err)
+		return
+	}
+	if plainTarget != target {
+		fmt.Printf("fsck: stale symlink %q: target has changed\n", relPath)
+		ck.markStale(relPath)
+	}
+}
+
+// plainFile is an open plaintext file that file content from the copy
+// is compared against.
+type plainFile struct {
+	*os.File
+	ck      *fsckObj
+	relPath string
+	buf     []byte
+	// stale is set once we have found a difference
+	stale bool
+}
+
+// openPlainFile opens the plaintext file for "relPath". Returns nil if there
+// is nothing to compare, because the file could not be opened or because
+// the size already differs from "copySize".
+func (ck *fsckObj) openPlainFile(relPath string, copySize int64) *plainFile {
+	f, err := os.Open(ck.plainAbs(relPath))
+	if err != nil {
+		fmt.Printf("fsck: error opening plaintext file %q: %v\n", relPath, err)
+		ck.markSkipped(relPath, err)
+		return nil
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		fmt.Printf("fsck: error stating plaintext file %q: %v\n", relPath, err)
+		ck.markSkipped(relPath, err)
+		f.Close()
+		return nil
+	}
+	if fi.Size() != copySize {
+		fmt.Printf("fsck: stale file %q: size has changed\n", relPath)
+		ck.markStale(relPath)
+		f.Close()
+		return nil
+	}
+	return &plainFile{File: f, ck: ck, relPath: relPath}
+}
+
+// compare compares "data" read from the copy at offset "off" with the
+// plaintext file.
+func (pf *plainFile) compare(data []byte, off int64) {
+	if pf.stale || len(data) == 0 {
+		return
+	}
+	if cap(pf.buf) < len(data) {
+		pf.buf = make([]byte, len(data))
+	}
+	buf := pf.buf[:len(data)]
+	n, err := pf.ReadAt(buf, off)
+	if err != nil && err != io.EOF {
+		fmt.Printf("fsck: error reading plaintext file %q: %v\n", pf.relPath, err)
+		pf.ck.markSkipped(pf.relPath, err)
+		pf.stale = true
+		return
+	}
+	if !bytes.Equal(buf[:n], data) {
+		fmt.Printf("fsck: stale file %q: content differs at offset %d\n", pf.relPath, off)
+		pf.ck.markStale(pf.relPath)
+		pf.stale = true
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// opRecorder is passed to go-fuse's RecordLatencies and sees every FUSE
+// operation after it has been handled.
+type opRecorder struct {
+	// trace logs every operation with its duration. Switched on and off
+	// through the control socket.
+	trace atomic.Bool
+	// metrics collects the counts and latencies for "-metrics", nil if
+	// disabled
+	metrics *metrics.Ops
+}
+
+var _ fuse.LatencyMap = &opRecorder{} // Verify that interface is implemented.
+
+// Add implements fuse.LatencyMap
+func (r *opRecorder) Add(name string, dt time.Duration) {
+	if r.metrics != nil {
+		r.metrics.Add(name, dt)
+	}
+	if r.trace.Load() {
+		tlog.Info.Printf("optrace: %s %v", name, dt)
+	}
+}
+
+// logToggles implements ctlsocksrv.LogToggles
+type logToggles struct {
+	ops *opRecorder
+	// fuseDebug is set if the mount runs with -fusedebug
+	fuseDebug bool
+}
+
+var _ ctlsocksrv.LogToggles = &logToggles{} // Verify that interface is implemented.
+
+func (l *logToggles) OpTrace() bool {
+	return l.ops.trace.Load()
+}
+
+func (l *logToggles) SetOpTrace(on bool) {
+	l.ops.trace.Store(on)
+}
+
+func (l *logToggles) FuseDebug() bool {
+	return l.fuseDebug
+}
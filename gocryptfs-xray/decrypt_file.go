@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// decryptFile decrypts the ciphertext file "fn" block by block and writes the
+// plaintext to stdout. Blocks that fail authentication are reported on stderr
+// with their offsets, and are either skipped or, with -zero-bad-blocks,
+// written as zeros so the offsets of the following blocks stay intact.
+// Exits with code 1 if there were bad blocks.
+func decryptFile(args *argContainer, fn string) {
+	// Our output goes to stdout
+	tlog.Info.SetEnabled(false)
+	cEnc, _, _ := loadCrypto(args, fn)
+	defer cEnc.Wipe()
+	f, err := os.Open(fn)
+	if err != nil {
+		errExit(err)
+	}
+	defer f.Close()
+	out := bufio.NewWriter(os.Stdout)
+	defer out.Flush()
+
+	headerBytes := make([]byte, contentenc.HeaderLen)
+	n, err := io.ReadFull(f, headerBytes)
+	if n == 0 && err == io.EOF {
+		// Empty file
+		return
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "incomplete file header: read %d bytes, want %d\n", n, contentenc.HeaderLen)
+		os.Exit(1)
+	}
+	header, err := contentenc.ParseHeader(headerBytes)
+	if err != nil {
+		errExit(err)
+	}
+	overhead := int(cEnc.CipherBS() - cEnc.PlainBS())
+	buf := make([]byte, cEnc.CipherBS())
+	bad := 0
+	for blockNo := uint64(0); ; blockNo++ {
+		n, err := io.ReadFull(f, buf)
+		if n == 0 {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			errExit(err)
+		}
+		plaintext, err := cEnc.DecryptBlock(buf[:n], blockNo, header.ID)
+		if err != nil {
+			bad++
+			cOff := contentenc.HeaderLen + blockNo*cEnc.CipherBS()
+			pOff := blockNo * cEnc.PlainBS()
+			fmt.Fprintf(os.Stderr, "Block %d: ciphertext offset %d, plaintext offset %d, len %d: %v\n",
+				blockNo, cOff, pOff, n, err)
+			if !*args.zeroBadBlocks {
+				continue
+			}
+			plaintext = make([]byte, max(n-overhead, 0))
+		}
+		if _, err = out.Write(plaintext); err != nil {
+			errExit(err)
+		}
+	}
+	if bad > 0 {
+		out.Flush()
+		action := "skipped"
+		if *args.zeroBadBlocks {
+			action = "replaced by zeros"
+		}
+		fmt.Fprintf(os.Stderr, "%d bad blocks %s\n", bad, action)
+		os.Exit(1)
+	}
+}
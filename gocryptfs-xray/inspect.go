@@ -0,0 +1,292 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+)
+
+// Values for xrayReport.AlgoSource
+const (
+	algoFromConfig  = "config"
+	algoFromFlag    = "flag"
+	algoFromDefault = "default"
+)
+
+// xrayReport describes an encrypted file. It is printed as JSON with -json.
+type xrayReport struct {
+	// Config summarizes the config file the algorithm was read from.
+	Config *configSummary `json:",omitempty"`
+	// Algo is the content encryption algorithm, for example "AES-GCM-256".
+	Algo string
+	// AlgoSource is "config", "flag" (-aessiv or -xchacha) or "default".
+	AlgoSource string
+	// Header is nil for an empty file.
+	Header *headerInfo
+	// Blocks lists the data blocks, leaving out holes.
+	Blocks []blockInfo
+	// Holes lists runs of all-zero blocks, as created by writing past the
+	// end of a file.
+	Holes []holeInfo
+	// Error is set when the file could not be parsed to the end.
+	Error string `json:",omitempty"`
+}
+
+type headerInfo struct {
+	Version uint16
+	// ID is the hex-encoded file ID
+	ID string
+}
+
+type blockInfo struct {
+	Block  int64
+	Offset int64
+	Len    int
+	// IV and Tag are hex-encoded
+	IV  string
+	Tag string
+}
+
+type holeInfo struct {
+	// FirstBlock is the number of the first all-zero block
+	FirstBlock int64
+	Blocks     int64
+	Offset     int64
+	Len        int64
+}
+
+// configSummary is the config file content without the sensitive data,
+// like "gocryptfs -info" shows it.
+type configSummary struct {
+	Path              string
+	Creator           string
+	Version           uint16
+	FeatureFlags      []string
+	ContentEncryption string
+	LongNameMax       uint8 `json:",omitempty"`
+	EncryptedKeyLen   int
+	Scrypt            scryptSummary
+}
+
+type scryptSummary struct {
+	SaltLen int
+	N       int
+	R       int
+	P       int
+	KeyLen  int
+}
+
+func summarizeConfig(path string, cf *configfile.ConfFile) *configSummary {
+	algo, _ := cf.ContentEncryption()
+	s := cf.ScryptObject
+	return &configSummary{
+		Path:              path,
+		Creator:           cf.Creator,
+		Version:           cf.Version,
+		FeatureFlags:      cf.FeatureFlags,
+		ContentEncryption: algo.Algo,
+		LongNameMax:       cf.LongNameMax,
+		EncryptedKeyLen:   len(cf.EncryptedKey),
+		Scrypt:            scryptSummary{len(s.Salt), s.N, s.R, s.P, s.KeyLen},
+	}
+}
+
+// isConfigFile returns true if "fn" has the name of a gocryptfs config file
+func isConfigFile(fn string) bool {
+	base := filepath.Base(fn)
+	return base == configfile.ConfDefaultName || base == configfile.ConfReverseName
+}
+
+// selectAlgo returns the content encryption algorithm for "fn". It is read
+// from the config file if there is one, otherwise -aessiv and -xchacha select
+// it. Also returns the config summary, or nil.
+func selectAlgo(args *argContainer, fn string) (algo cryptocore.AEADTypeEnum, source string, conf *configSummary) {
+	algo = argsAlgo(args)
+	source = algoFromDefault
+	if *args.aessiv || *args.xchacha {
+		source = algoFromFlag
+	}
+	confPath := *args.config
+	if confPath == "" {
+		confPath = findConfig(fn)
+	}
+	if confPath == "" {
+		return algo, source, nil
+	}
+	cf, err := configfile.Load(confPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: ignoring %s: %v\n", confPath, err)
+		return algo, source, nil
+	}
+	confAlgo, err := cf.ContentEncryption()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "warning: ignoring %s: %v\n", confPath, err)
+		return algo, source, nil
+	}
+	if source == algoFromFlag && confAlgo.Algo != algo.Algo {
+		fmt.Fprintf(os.Stderr, "warning: %s says %s, ignoring -aessiv/-xchacha\n", confPath, confAlgo.Algo)
+	}
+	return confAlgo, algoFromConfig, summarizeConfig(confPath, cf)
+}
+
+// inspect prints the header and the blocks of the encrypted file "fn",
+// or the summary if "fn" is a config file.
+func inspect(args *argContainer, fn string) {
+	if isConfigFile(fn) {
+		inspectConfig(args, fn)
+		return
+	}
+	fd, err := os.Open(fn)
+	if err != nil {
+		errExit(err)
+	}
+	defer fd.Close()
+	algo, source, conf := selectAlgo(args, fn)
+	r := inspectCiphertext(fd, algo)
+	r.Config = conf
+	r.AlgoSource = source
+	if *args.json {
+		printJSON(r)
+	} else {
+		printReport(r)
+	}
+	if r.Error != "" {
+		os.Exit(1)
+	}
+}
+
+func inspectConfig(args *argContainer, fn string) {
+	cf, err := configfile.Load(fn)
+	if err != nil {
+		errExit(err)
+	}
+	c := summarizeConfig(fn, cf)
+	if *args.json {
+		printJSON(c)
+		return
+	}
+	fmt.Printf("Config: %s, Creator: %s, Version: %d, contentEncryption: %s\n",
+		c.Path, c.Creator, c.Version, c.ContentEncryption)
+	fmt.Printf("FeatureFlags: %s\n", strings.Join(c.FeatureFlags, " "))
+}
+
+// inspectCiphertext parses the encrypted file "fd" assuming algorithm "algo"
+func inspectCiphertext(fd *os.File, algo cryptocore.AEADTypeEnum) *xrayReport {
+	r := &xrayReport{
+		Algo:   algo.Algo,
+		Blocks: []blockInfo{},
+		Holes:  []holeInfo{},
+	}
+	headerBytes := make([]byte, contentenc.HeaderLen)
+	n, err := fd.ReadAt(headerBytes, 0)
+	if err == io.EOF && n == 0 {
+		return r
+	} else if err == io.EOF {
+		r.Error = fmt.Sprintf("incomplete file header: read %d bytes, want %d", n, contentenc.HeaderLen)
+		return r
+	} else if err != nil {
+		errExit(err)
+	}
+	header, err := contentenc.ParseHeader(headerBytes)
+	if err != nil {
+		r.Error = err.Error()
+		return r
+	}
+	r.Header = &headerInfo{
+		Version: header.Version,
+		ID:      hex.EncodeToString(header.ID),
+	}
+	bs := blockSize(algo)
+	buf := make([]byte, bs)
+	zeros := make([]byte, bs)
+	for i := int64(0); ; i++ {
+		off := contentenc.HeaderLen + i*int64(bs)
+		n, err := fd.ReadAt(buf, off)
+		if err != nil && err != io.EOF {
+			errExit(err)
+		}
+		if n == 0 && err == io.EOF {
+			break
+		}
+		data := buf[:n]
+		if bytes.Equal(data, zeros[:n]) {
+			// gocryptfs reads all-zero blocks as zeros without decrypting them
+			if h := len(r.Holes) - 1; h >= 0 && r.Holes[h].FirstBlock+r.Holes[h].Blocks == i {
+				r.Holes[h].Blocks++
+				r.Holes[h].Len += int64(n)
+			} else {
+				r.Holes = append(r.Holes, holeInfo{FirstBlock: i, Blocks: 1, Offset: off, Len: int64(n)})
+			}
+			continue
+		}
+		// A block contains at least the IV, the Auth Tag and 1 data byte
+		if n < algo.NonceSize+cryptocore.AuthTagLen+1 {
+			r.Error = fmt.Sprintf("corrupt block: truncated data, len=%d", n)
+			break
+		}
+		// Parse block data
+		iv := data[:algo.NonceSize]
+		tag := data[len(data)-cryptocore.AuthTagLen:]
+		if algo.Algo == cryptocore.BackendAESSIV.Algo {
+			tag = data[algo.NonceSize : algo.NonceSize+cryptocore.AuthTagLen]
+		}
+		r.Blocks = append(r.Blocks, blockInfo{
+			Block:  i,
+			Offset: off,
+			Len:    n,
+			IV:     hex.EncodeToString(iv),
+			Tag:    hex.EncodeToString(tag),
+		})
+	}
+	return r
+}
+
+func printJSON(v any) {
+	js, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		errExit(err)
+	}
+	fmt.Println(string(js))
+}
+
+// printReport prints "r" for humans
+func printReport(r *xrayReport) {
+	if r.Header == nil {
+		if r.Error != "" {
+			fmt.Fprintln(os.Stderr, r.Error)
+		} else {
+			fmt.Println("empty file")
+		}
+		return
+	}
+	fmt.Printf("Header: Version: %d, Id: %s, assuming %s mode\n", r.Header.Version, r.Header.ID, r.Algo)
+	// Blocks and holes in file order
+	h := 0
+	for _, b := range r.Blocks {
+		for ; h < len(r.Holes) && r.Holes[h].FirstBlock < b.Block; h++ {
+			printHole(r.Holes[h])
+		}
+		fmt.Printf("Block %2d: IV: %s, Tag: %s, Offset: %5d Len: %d\n",
+			b.Block, b.IV, b.Tag, b.Offset, b.Len)
+	}
+	for ; h < len(r.Holes); h++ {
+		printHole(r.Holes[h])
+	}
+	if r.Error != "" {
+		fmt.Println(r.Error)
+	}
+}
+
+func printHole(h holeInfo) {
+	fmt.Printf("Hole  %2d: %d all-zero blocks, Offset: %5d Len: %d\n",
+		h.FirstBlock, h.Blocks, h.Offset, h.Len)
+}
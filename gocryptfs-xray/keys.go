@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/offline"
+	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// findConfig looks for gocryptfs.conf in "fn" (if it is a directory) or in
+// the directory of "fn". If it is not there, the parent directories are
+// searched as long as they belong to the same CIPHERDIR, which we know from
+// the gocryptfs.diriv file in every directory. Without directory IVs
+// (-plaintextnames, -deterministic-names), -config is needed for files in
+// subdirectories. A config file found in a parent directory is printed to
+// stderr. Returns "" if there is none.
+func findConfig(fn string) string {
+	dir, err := filepath.Abs(fn)
+	if err != nil {
+		return ""
+	}
+	if fi, err := os.Stat(dir); err != nil || !fi.IsDir() {
+		dir = filepath.Dir(dir)
+	}
+	start := dir
+	for {
+		p := filepath.Join(dir, configfile.ConfDefaultName)
+		if _, err := os.Stat(p); err == nil {
+			if dir != start {
+				fmt.Fprintf(os.Stderr, "using config file %s\n", p)
+			}
+			return p
+		}
+		if _, err := os.Stat(filepath.Join(dir, nametransform.DirIVFilename)); err != nil {
+			// Not part of a CIPHERDIR (anymore)
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// loadMasterKey asks for the password (or uses the FIDO2 token) and decrypts
+// the master key from "cf". Calls os.Exit on errors.
+func loadMasterKey(cf *configfile.ConfFile, fido2Path string) []byte {
+	var pw []byte
+	var err error
+	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
+		if fido2Path == "" {
+			tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
+			os.Exit(exitcodes.Usage)
+		}
+		pw = fido2.Secret(fido2Path, cf.FIDO2.AssertOptions, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
+	} else {
+		pw, err = readpassword.Once(nil, nil, "")
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.ReadPassword)
+		}
+	}
+	masterkey, err := cf.DecryptMasterKey(pw)
+	// Purge password from memory
+	for i := range pw {
+		pw[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Println(err)
+		os.Exit(exitcodes.LoadConf)
+	}
+	return masterkey
+}
+
+// parseMasterKey converts a hex-encoded master key, as printed by
+// "gocryptfs -init", to binary. Calls os.Exit on errors.
+func parseMasterKey(s string) []byte {
+	key, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err == nil && len(key) != cryptocore.KeyLen {
+		err = fmt.Errorf("length is %d, want %d", len(key), cryptocore.KeyLen)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("Could not parse master key: %v", err)
+		os.Exit(exitcodes.MasterKey)
+	}
+	return key
+}
+
+// loadCrypto returns the crypto helpers for the gocryptfs filesystem that
+// "fn" belongs to, and the name encryption settings for offline.New (without
+// Cipherdir). The settings are read from the config file. Without a config
+// file (-masterkey), -aessiv, -xchacha, -deterministic-names and -raw64
+// select them, and HKDF is assumed.
+// Calls os.Exit on errors.
+func loadCrypto(args *argContainer, fn string) (*contentenc.ContentEnc, *nametransform.NameTransform, offline.Args) {
+	confPath := *args.config
+	if confPath == "" {
+		confPath = findConfig(fn)
+	}
+	var cf *configfile.ConfFile
+	if confPath != "" {
+		var err error
+		cf, err = configfile.Load(confPath)
+		if err != nil {
+			tlog.Fatal.Println(err)
+			exitcodes.Exit(err)
+		}
+	} else if *args.masterkey == "" {
+		tlog.Fatal.Printf("%s: no %s found, pass -config or -masterkey", fn, configfile.ConfDefaultName)
+		os.Exit(exitcodes.LoadConf)
+	}
+	var masterkey []byte
+	if *args.masterkey != "" {
+		masterkey = parseMasterKey(*args.masterkey)
+	} else {
+		masterkey = loadMasterKey(cf, *args.fido2)
+	}
+	algo := argsAlgo(args)
+	useHKDF := true
+	raw64 := *args.raw64
+	var longNameMax uint8
+	oArgs := offline.Args{
+		DeterministicNames: *args.deterministicNames,
+		LongNames:          true,
+		ConfigCustom:       *args.config != "",
+	}
+	if cf != nil {
+		var err error
+		algo, err = cf.ContentEncryption()
+		if err != nil {
+			tlog.Fatal.Println(err)
+			os.Exit(exitcodes.DeprecatedFS)
+		}
+		useHKDF = cf.IsFeatureFlagSet(configfile.FlagHKDF)
+		raw64 = cf.IsFeatureFlagSet(configfile.FlagRaw64)
+		longNameMax = cf.LongNameMax
+		oArgs.PlaintextNames = cf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+		oArgs.DeterministicNames = !cf.IsFeatureFlagSet(configfile.FlagDirIV)
+		oArgs.LongNames = cf.IsFeatureFlagSet(configfile.FlagLongNames)
+	}
+	cCore := cryptocore.New(masterkey, algo, algo.NonceSize*8, useHKDF)
+	// cryptocore.New has derived the subkeys
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	nameTransform := nametransform.New(cCore.EMECipher, oArgs.LongNames, longNameMax,
+		raw64, nil, oArgs.DeterministicNames)
+	return contentenc.New(cCore, contentenc.DefaultBS), nameTransform, oArgs
+}
+
+// argsAlgo returns the algorithm selected by -aessiv and -xchacha
+func argsAlgo(args *argContainer) cryptocore.AEADTypeEnum {
+	if *args.aessiv {
+		return cryptocore.BackendAESSIV
+	} else if *args.xchacha {
+		return cryptocore.BackendXChaCha20Poly1305
+	}
+	return cryptocore.BackendGoGCM
+}
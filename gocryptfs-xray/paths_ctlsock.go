@@ -8,30 +8,76 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 )
 
+// pathTransform encrypts or decrypts a batch of paths. It returns one
+// result for each path.
+type pathTransform func(in []string) ([]ctlsock.PathResult, error)
+
+// transformBatchSize is the maximum number of input lines that are passed to
+// pathTransform at once. Smaller batches are passed when no more input is
+// available right now, so results show up without delay when the paths are
+// written one at a time (think "tail -f log | gocryptfs-xray -decrypt-paths").
+const transformBatchSize = 10000
+
 func decryptPaths(socketPath string, sep0 bool) {
-	var req ctlsock.RequestStruct
-	transformPaths(socketPath, &req, &req.DecryptPath, sep0)
+	transformPaths(ctlsockTransform(socketPath, true), sep0)
 }
 
 func encryptPaths(socketPath string, sep0 bool) {
-	var req ctlsock.RequestStruct
-	transformPaths(socketPath, &req, &req.EncryptPath, sep0)
+	transformPaths(ctlsockTransform(socketPath, false), sep0)
 }
 
-func transformPaths(socketPath string, req *ctlsock.RequestStruct, in *string, sep0 bool) {
-	errorCount := 0
+// ctlsockTransform returns a pathTransform that queries the gocryptfs control
+// socket at "socketPath".
+func ctlsockTransform(socketPath string, decrypt bool) pathTransform {
 	c, err := ctlsock.New(socketPath)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
 		os.Exit(1)
 	}
+	if decrypt {
+		return c.DecryptPaths
+	}
+	return c.EncryptPaths
+}
+
+// transformPaths reads paths from stdin, transforms them and prints the
+// results. Exits with code 1 if any path could not be transformed.
+func transformPaths(transform pathTransform, sep0 bool) {
+	errorCount := 0
 	line := 1
 	var separator byte = '\n'
 	if sep0 {
 		separator = '\000'
 	}
-	r := bufio.NewReader(os.Stdin)
-	for eof := false; !eof; line++ {
+	r := bufio.NewReaderSize(os.Stdin, 256*1024)
+	w := bufio.NewWriter(os.Stdout)
+	var batch []string
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		results, err := transform(batch)
+		if err != nil {
+			w.Flush()
+			fmt.Fprintf(os.Stderr, "fatal: %v\n", err)
+			os.Exit(1)
+		}
+		for i, res := range results {
+			in := batch[i]
+			if res.ErrNo != 0 {
+				fmt.Fprintf(os.Stderr, "error at input line %d %q: %v\n", line, in, res.ErrText)
+				errorCount++
+			} else {
+				if res.WarnText != "" {
+					fmt.Fprintf(os.Stderr, "warning at input line %d %q: %v\n", line, in, res.WarnText)
+				}
+				fmt.Fprintf(w, "%s%c", res.Result, separator)
+			}
+			line++
+		}
+		batch = batch[:0]
+	}
+	for eof := false; !eof; {
 		val, err := r.ReadBytes(separator)
 		if len(val) == 0 {
 			break
@@ -43,18 +89,17 @@ func transformPaths(socketPath string, req *ctlsock.RequestStruct, in *string, s
 			// drop trailing separator
 			val = val[:len(val)-1]
 		}
-		*in = string(val)
-		resp, err := c.Query(req)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error at input line %d %q: %v\n", line, *in, err)
-			errorCount++
-			continue
-		}
-		if resp.WarnText != "" {
-			fmt.Fprintf(os.Stderr, "warning at input line %d %q: %v\n", line, *in, resp.WarnText)
+		batch = append(batch, string(val))
+		if len(batch) >= transformBatchSize {
+			flush()
+		} else if r.Buffered() == 0 {
+			// The next read may block
+			flush()
+			w.Flush()
 		}
-		fmt.Printf("%s%c", resp.Result, separator)
 	}
+	flush()
+	w.Flush()
 	if errorCount == 0 {
 		os.Exit(0)
 	}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/offline"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// offlinePaths implements "-decrypt-paths CIPHERDIR" and
+// "-encrypt-paths CIPHERDIR". Like a mount, it reads the gocryptfs.diriv and
+// gocryptfs.longname.*.name files, but directly from CIPHERDIR.
+func offlinePaths(args *argContainer, cipherdir string, decrypt bool) {
+	// Our output goes to stdout
+	tlog.Info.SetEnabled(false)
+	cEnc, nameTransform, oArgs := loadCrypto(args, cipherdir)
+	defer cEnc.Wipe()
+	var err error
+	oArgs.Cipherdir, err = filepath.Abs(cipherdir)
+	if err != nil {
+		errExit(err)
+	}
+	f := offline.New(oArgs, cEnc, nameTransform)
+	transformPaths(func(batch []string) ([]ctlsock.PathResult, error) {
+		results := make([]ctlsock.PathResult, len(batch))
+		for i, in := range batch {
+			// Canonicalize like the control socket does
+			clean := ctlsocksrv.SanitizePath(in)
+			r := &results[i]
+			if clean != in {
+				r.WarnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", in, clean)
+			}
+			if clean == "" {
+				r.ErrNo, r.ErrText = -1, "empty input after canonicalization"
+				continue
+			}
+			if decrypt {
+				r.Result, err = f.DecryptPath(clean)
+			} else {
+				r.Result, err = f.EncryptPath(clean)
+			}
+			if err != nil {
+				r.Result = ""
+				r.ErrNo, r.ErrText = -1, err.Error()
+			}
+		}
+		return results, nil
+	}, *args.sep0)
+}
+
+// isDir returns true if "fn" is a directory
+func isDir(fn string) bool {
+	fi, err := os.Stat(fn)
+	return err == nil && fi.IsDir()
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/hex"
 	"flag"
 	"fmt"
-	"io"
 	"os"
 	"runtime"
 
@@ -12,8 +11,6 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
-	"github.com/rfjakob/gocryptfs/v2/internal/fido2"
-	"github.com/rfjakob/gocryptfs/v2/internal/readpassword"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -37,11 +34,6 @@ func errExit(err error) {
 	os.Exit(1)
 }
 
-func prettyPrintHeader(h *contentenc.FileHeader, algo cryptocore.AEADTypeEnum) {
-	id := hex.EncodeToString(h.ID)
-	fmt.Printf("Header: Version: %d, Id: %s, assuming %s mode\n", h.Version, id, algo.Algo)
-}
-
 // printVersion prints a version string like this:
 // gocryptfs v1.7-32-gcf99cfd; go-fuse v1.0.0-174-g22a9cb9; 2019-05-12 go1.12 linux/amd64
 func printVersion() {
@@ -61,8 +53,11 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "\n"+
 		"Examples:\n"+
 		"  gocryptfs-xray myfs/mCXnISiv7nEmyc0glGuhTQ\n"+
+		"  gocryptfs-xray -json myfs/mCXnISiv7nEmyc0glGuhTQ\n"+
 		"  gocryptfs-xray -dumpmasterkey myfs/gocryptfs.conf\n"+
-		"  gocryptfs-xray -encrypt-paths myfs.sock\n")
+		"  gocryptfs-xray -decrypt myfs/mCXnISiv7nEmyc0glGuhTQ > plaintext\n"+
+		"  gocryptfs-xray -encrypt-paths myfs.sock\n"+
+		"  gocryptfs-xray -decrypt-paths myfs < ciphertext-paths.txt\n")
 }
 
 // sum counts the number of true values
@@ -84,18 +79,34 @@ type argContainer struct {
 	sep0          *bool
 	fido2         *string
 	version       *bool
+	decrypt       *bool
+	zeroBadBlocks *bool
+	config        *string
+	masterkey     *string
+	// Name encryption settings for offline -decrypt-paths/-encrypt-paths
+	// without a config file
+	deterministicNames *bool
+	raw64              *bool
+	json               *bool
 }
 
 func main() {
 	var args argContainer
 	args.dumpmasterkey = flag.Bool("dumpmasterkey", false, "Decrypt and dump the master key")
-	args.decryptPaths = flag.Bool("decrypt-paths", false, "Decrypt file paths using gocryptfs control socket")
-	args.encryptPaths = flag.Bool("encrypt-paths", false, "Encrypt file paths using gocryptfs control socket")
+	args.decryptPaths = flag.Bool("decrypt-paths", false, "Decrypt file paths using gocryptfs control socket or CIPHERDIR")
+	args.encryptPaths = flag.Bool("encrypt-paths", false, "Encrypt file paths using gocryptfs control socket or CIPHERDIR")
 	args.sep0 = flag.Bool("0", false, "Use \\0 instead of \\n as separator")
-	args.aessiv = flag.Bool("aessiv", false, "Assume AES-SIV mode instead of AES-GCM")
-	args.xchacha = flag.Bool("xchacha", false, "Assume XChaCha20-Poly1305 mode instead of AES-GCM")
+	args.aessiv = flag.Bool("aessiv", false, "Assume AES-SIV mode instead of AES-GCM (without config file)")
+	args.xchacha = flag.Bool("xchacha", false, "Assume XChaCha20-Poly1305 mode instead of AES-GCM (without config file)")
 	args.fido2 = flag.String("fido2", "", "Protect the masterkey using a FIDO2 token instead of a password")
 	args.version = flag.Bool("version", false, "Print version information")
+	args.decrypt = flag.Bool("decrypt", false, "Decrypt FILE to stdout, reporting blocks that fail authentication")
+	args.zeroBadBlocks = flag.Bool("zero-bad-blocks", false, "With -decrypt, write bad blocks as zeros instead of skipping them")
+	args.config = flag.String("config", "", "Use specified config file instead of searching gocryptfs.conf next to FILE")
+	args.masterkey = flag.String("masterkey", "", "Use a hex-encoded master key instead of the password")
+	args.deterministicNames = flag.Bool("deterministic-names", false, "With -masterkey and no config file: filesystem has no gocryptfs.diriv files")
+	args.json = flag.Bool("json", false, "Print the header, blocks and holes of FILE, or the config summary, as JSON")
+	args.raw64 = flag.Bool("raw64", true, "With -masterkey and no config file: filesystem uses unpadded base64 for file names")
 
 	flag.Usage = usage
 	flag.Parse()
@@ -105,7 +116,7 @@ func main() {
 		os.Exit(0)
 	}
 
-	s := sum(args.dumpmasterkey, args.decryptPaths, args.encryptPaths)
+	s := sum(args.dumpmasterkey, args.decryptPaths, args.encryptPaths, args.decrypt)
 	if s > 1 {
 		fmt.Fprintf(os.Stderr, "fatal: %d operations were requested\n", s)
 		os.Exit(1)
@@ -115,107 +126,37 @@ func main() {
 		os.Exit(1)
 	}
 	fn := flag.Arg(0)
+	if (*args.decryptPaths || *args.encryptPaths) && isDir(fn) {
+		offlinePaths(&args, fn, *args.decryptPaths)
+	}
 	if *args.decryptPaths {
 		decryptPaths(fn, *args.sep0)
 	}
 	if *args.encryptPaths {
 		encryptPaths(fn, *args.sep0)
 	}
-	f, err := os.Open(fn)
-	if err != nil {
-		errExit(err)
+	if *args.decrypt {
+		decryptFile(&args, fn)
+		os.Exit(0)
 	}
-	defer f.Close()
 	if *args.dumpmasterkey {
 		dumpMasterKey(fn, *args.fido2)
 	} else {
-		inspectCiphertext(&args, f)
+		inspect(&args, fn)
 	}
 }
 
 func dumpMasterKey(fn string, fido2Path string) {
-	tlog.Info.Enabled = false
+	tlog.Info.SetEnabled(false)
 	cf, err := configfile.Load(fn)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		exitcodes.Exit(err)
 	}
-	var pw []byte
-	if cf.IsFeatureFlagSet(configfile.FlagFIDO2) {
-		if fido2Path == "" {
-			tlog.Fatal.Printf("Masterkey encrypted using FIDO2 token; need to use the --fido2 option.")
-			os.Exit(exitcodes.Usage)
-		}
-		pw = fido2.Secret(fido2Path, cf.FIDO2.AssertOptions, cf.FIDO2.CredentialID, cf.FIDO2.HMACSalt)
-	} else {
-		pw, err = readpassword.Once(nil, nil, "")
-		if err != nil {
-			tlog.Fatal.Println(err)
-			os.Exit(exitcodes.ReadPassword)
-		}
-	}
-	masterkey, err := cf.DecryptMasterKey(pw)
-	// Purge password from memory
-	for i := range pw {
-		pw[i] = 0
-	}
-	if err != nil {
-		tlog.Fatal.Println(err)
-		os.Exit(exitcodes.LoadConf)
-	}
+	masterkey := loadMasterKey(cf, fido2Path)
 	fmt.Println(hex.EncodeToString(masterkey))
 	// Purge masterkey from memory
 	for i := range masterkey {
 		masterkey[i] = 0
 	}
 }
-
-func inspectCiphertext(args *argContainer, fd *os.File) {
-	algo := cryptocore.BackendGoGCM
-	if *args.aessiv {
-		algo = cryptocore.BackendAESSIV
-	} else if *args.xchacha {
-		algo = cryptocore.BackendXChaCha20Poly1305
-	}
-	headerBytes := make([]byte, contentenc.HeaderLen)
-	n, err := fd.ReadAt(headerBytes, 0)
-	if err == io.EOF && n == 0 {
-		fmt.Println("empty file")
-		os.Exit(0)
-	} else if err == io.EOF {
-		fmt.Fprintf(os.Stderr, "incomplete file header: read %d bytes, want %d\n", n, contentenc.HeaderLen)
-		os.Exit(1)
-	} else if err != nil {
-		errExit(err)
-	}
-	header, err := contentenc.ParseHeader(headerBytes)
-	if err != nil {
-		errExit(err)
-	}
-	prettyPrintHeader(header, algo)
-	var i int64
-	buf := make([]byte, blockSize(algo))
-	for i = 0; ; i++ {
-		off := contentenc.HeaderLen + i*int64(blockSize(algo))
-		n, err := fd.ReadAt(buf, off)
-		if err != nil && err != io.EOF {
-			errExit(err)
-		}
-		if n == 0 && err == io.EOF {
-			break
-		}
-		// A block contains at least the IV, the Auth Tag and 1 data byte
-		if n < algo.NonceSize+cryptocore.AuthTagLen+1 {
-			errExit(fmt.Errorf("corrupt block: truncated data, len=%d", n))
-		}
-		data := buf[:n]
-		// Parse block data
-		iv := data[:algo.NonceSize]
-		tag := data[len(data)-cryptocore.AuthTagLen:]
-		if *args.aessiv {
-			tag = data[algo.NonceSize : algo.NonceSize+cryptocore.AuthTagLen]
-		}
-		fmt.Printf("Block %2d: IV: %s, Tag: %s, Offset: %5d Len: %d\n",
-			i, hex.EncodeToString(iv), hex.EncodeToString(tag), off, len(data))
-	}
-}
@@ -1,11 +1,17 @@
 package xray_tests
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/json"
 	"fmt"
+	"io/fs"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
 )
@@ -108,3 +114,309 @@ func TestEncryptPaths(t *testing.T) {
 		}
 	}
 }
+
+// TestEncryptPathsStreaming checks that each path is answered right away
+// when the input comes in one line at a time, like from "tail -f".
+func TestEncryptPathsStreaming(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+
+	cmd := exec.Command("../gocryptfs-xray", "-encrypt-paths", sock)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer stdin.Close()
+	r := bufio.NewReader(stdout)
+	for _, p := range []string{"test1", "test2"} {
+		fmt.Fprintln(stdin, p)
+		line := make(chan string, 1)
+		go func() {
+			l, _ := r.ReadString('\n')
+			line <- l
+		}()
+		select {
+		case l := <-line:
+			if l == "" {
+				t.Fatalf("%s: no output", p)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no answer while stdin is still open", p)
+		}
+	}
+}
+
+// runXray runs gocryptfs-xray with password "test" on stdin and returns
+// stdout, stderr and the exit code.
+func runXray(t *testing.T, args ...string) (stdout []byte, stderr string, code int) {
+	return runXrayStdin(t, "test", args...)
+}
+
+// runXrayStdin is like runXray, but passes "stdin" instead of the password.
+func runXrayStdin(t *testing.T, stdin string, args ...string) (stdout []byte, stderr string, code int) {
+	cmd := exec.Command("../gocryptfs-xray", args...)
+	cmd.Stdin = bytes.NewBufferString(stdin)
+	var outBuf, errBuf bytes.Buffer
+	cmd.Stdout = &outBuf
+	cmd.Stderr = &errBuf
+	err := cmd.Run()
+	return outBuf.Bytes(), errBuf.String(), test_helpers.ExtractCmdExitCode(err)
+}
+
+func TestDecryptFile(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	content := make([]byte, 10000)
+	for i := range content {
+		content[i] = byte(i)
+	}
+	err := os.WriteFile(pDir+"/file", content, 0600)
+	test_helpers.UnmountPanic(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cFile string
+	for _, e := range entries {
+		if e.Name() != "gocryptfs.conf" && e.Name() != "gocryptfs.diriv" {
+			cFile = cDir + "/" + e.Name()
+		}
+	}
+
+	out, stderr, code := runXray(t, "-decrypt", cFile)
+	if code != 0 || !bytes.Equal(out, content) {
+		t.Fatalf("intact file: code=%d, %d bytes, stderr=%q", code, len(out), stderr)
+	}
+
+	// Corrupt block 1. An AES-GCM block is 4096 bytes plus 32 bytes overhead,
+	// the file header is 18 bytes.
+	f, err := os.OpenFile(cFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.WriteAt([]byte{0xff, 0xff}, 18+4128+100)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, stderr, code = runXray(t, "-decrypt", "-zero-bad-blocks", cFile)
+	want := append([]byte{}, content...)
+	clear(want[4096:8192])
+	if code != 1 || !bytes.Equal(out, want) {
+		t.Errorf("-zero-bad-blocks: code=%d, %d bytes", code, len(out))
+	}
+	if !strings.Contains(stderr, "Block 1: ciphertext offset 4146, plaintext offset 4096") {
+		t.Errorf("bad block not reported: %q", stderr)
+	}
+	out, _, code = runXray(t, "-decrypt", cFile)
+	want = append(append([]byte{}, content[:4096]...), content[8192:]...)
+	if code != 1 || !bytes.Equal(out, want) {
+		t.Errorf("skip bad blocks: code=%d, %d bytes", code, len(out))
+	}
+}
+
+// TestOfflinePaths checks that -encrypt-paths and -decrypt-paths work on an
+// unmounted CIPHERDIR, including long names.
+func TestOfflinePaths(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	long := strings.Repeat("x", 200)
+	err := os.Mkdir(pDir+"/dir", 0700)
+	if err == nil {
+		err = os.WriteFile(pDir+"/dir/"+long, nil, 0600)
+	}
+	test_helpers.UnmountPanic(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Collect the ciphertext paths
+	var cPaths []string
+	err = filepath.WalkDir(cDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(cDir, path)
+		switch {
+		case rel == ".", d.Name() == "gocryptfs.conf", d.Name() == "gocryptfs.diriv",
+			strings.HasSuffix(d.Name(), ".name"):
+			return nil
+		}
+		cPaths = append(cPaths, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cPaths) != 2 {
+		t.Fatalf("unexpected ciphertext paths: %q", cPaths)
+	}
+
+	out, stderr, code := runXrayStdin(t, "test\ndir\ndir/"+long+"\n", "-encrypt-paths", cDir)
+	if code != 0 {
+		t.Fatalf("-encrypt-paths: code=%d stderr=%q", code, stderr)
+	}
+	if have := strings.Join(cPaths, "\n") + "\n"; string(out) != have {
+		t.Errorf("-encrypt-paths: want %q, have %q", have, out)
+	}
+	out, stderr, code = runXrayStdin(t, "test\n"+strings.Join(cPaths, "\n"), "-decrypt-paths", cDir)
+	if code != 0 {
+		t.Fatalf("-decrypt-paths: code=%d stderr=%q", code, stderr)
+	}
+	if want := "dir\ndir/" + long + "\n"; string(out) != want {
+		t.Errorf("-decrypt-paths: want %q, have %q", want, out)
+	}
+	// Non-existing directory
+	_, _, code = runXrayStdin(t, "test\nnonexisting/foo", "-encrypt-paths", cDir)
+	if code != 1 {
+		t.Errorf("nonexisting: want code 1, have %d", code)
+	}
+}
+
+// TestAlgoFromConfig checks that the algorithm is read from gocryptfs.conf
+// when -aessiv is not passed.
+func TestAlgoFromConfig(t *testing.T) {
+	expected, err := os.ReadFile("aessiv_fs.xray.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, stderr, code := runXray(t, "aessiv_fs/klepPXQJIaEDaIx-yurAqQ")
+	if code != 0 || !bytes.Equal(out, expected) {
+		t.Errorf("code=%d stderr=%q\nexpected:\n%s\nhave:\n%s", code, stderr, expected, out)
+	}
+}
+
+// copyFiles copies the files "src" to "dst", creating the directories
+// on the way
+func copyFiles(t *testing.T, files map[string]string) {
+	for dst, src := range files {
+		data, err := os.ReadFile(src)
+		if err == nil {
+			err = os.MkdirAll(filepath.Dir(dst), 0700)
+		}
+		if err == nil {
+			err = os.WriteFile(dst, data, 0600)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestFindConfig checks that gocryptfs.conf is only searched in parent
+// directories that belong to the CIPHERDIR of the file.
+func TestFindConfig(t *testing.T) {
+	// An AES-GCM file in a directory that is not part of the AES-SIV
+	// CIPHERDIR above it
+	dir := t.TempDir()
+	copyFiles(t, map[string]string{
+		dir + "/gocryptfs.conf":                       "aessiv_fs/gocryptfs.conf",
+		dir + "/plain/VnvoeSetPaOFjZDaZAh0lA":         "aesgcm_fs/VnvoeSetPaOFjZDaZAh0lA",
+		dir + "/cipherdir/gocryptfs.conf":             "aessiv_fs/gocryptfs.conf",
+		dir + "/cipherdir/gocryptfs.diriv":            "aessiv_fs/gocryptfs.diriv",
+		dir + "/cipherdir/sub/gocryptfs.diriv":        "aessiv_fs/gocryptfs.diriv",
+		dir + "/cipherdir/sub/klepPXQJIaEDaIx-yurAqQ": "aessiv_fs/klepPXQJIaEDaIx-yurAqQ",
+	})
+	expected, err := os.ReadFile("aesgcm_fs.xray.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, stderr, code := runXray(t, dir+"/plain/VnvoeSetPaOFjZDaZAh0lA")
+	if code != 0 || !bytes.Equal(out, expected) {
+		t.Errorf("outside of CIPHERDIR: code=%d stderr=%q\nexpected:\n%s\nhave:\n%s", code, stderr, expected, out)
+	}
+	// A file in a subdirectory of the CIPHERDIR
+	expected, err = os.ReadFile("aessiv_fs.xray.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, stderr, code = runXray(t, dir+"/cipherdir/sub/klepPXQJIaEDaIx-yurAqQ")
+	if code != 0 || !bytes.Equal(out, expected) {
+		t.Errorf("subdirectory: code=%d stderr=%q\nexpected:\n%s\nhave:\n%s", code, stderr, expected, out)
+	}
+	if want := "using config file " + dir + "/cipherdir/gocryptfs.conf"; !strings.Contains(stderr, want) {
+		t.Errorf("subdirectory: stderr %q does not contain %q", stderr, want)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	// Block 0 and 3 contain data, 1 and 2 are a hole
+	f, err := os.Create(pDir + "/sparse")
+	if err == nil {
+		_, err = f.WriteAt([]byte("x"), 0)
+	}
+	if err == nil {
+		_, err = f.WriteAt([]byte("y"), 3*4096)
+		f.Close()
+	}
+	test_helpers.UnmountPanic(pDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir(cDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cFile string
+	for _, e := range entries {
+		if !strings.HasPrefix(e.Name(), "gocryptfs.") {
+			cFile = cDir + "/" + e.Name()
+		}
+	}
+	out, stderr, code := runXray(t, "-json", cFile)
+	if code != 0 {
+		t.Fatalf("code=%d stderr=%q", code, stderr)
+	}
+	var r struct {
+		Config struct {
+			ContentEncryption string
+		}
+		Algo       string
+		AlgoSource string
+		Header     struct{ Version uint16 }
+		Blocks     []struct {
+			Block  int64
+			Offset int64
+			Len    int
+		}
+		Holes []struct {
+			FirstBlock int64
+			Blocks     int64
+		}
+	}
+	if err := json.Unmarshal(out, &r); err != nil {
+		t.Fatalf("%v\n%s", err, out)
+	}
+	if r.Algo != "AES-GCM-256" || r.AlgoSource != "config" || r.Config.ContentEncryption != r.Algo {
+		t.Errorf("wrong algo: %+v", r)
+	}
+	if r.Header.Version != 2 {
+		t.Errorf("wrong header version %d", r.Header.Version)
+	}
+	if len(r.Blocks) != 2 || r.Blocks[0].Block != 0 || r.Blocks[1].Block != 3 ||
+		r.Blocks[1].Offset != 18+3*4128 || r.Blocks[1].Len != 16+1+16 {
+		t.Errorf("wrong blocks: %+v", r.Blocks)
+	}
+	if len(r.Holes) != 1 || r.Holes[0].FirstBlock != 1 || r.Holes[0].Blocks != 2 {
+		t.Errorf("wrong holes: %+v", r.Holes)
+	}
+}
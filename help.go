@@ -8,7 +8,8 @@ import (
 
 const tUsage = "" +
 	"Usage: " + tlog.ProgramName + " -init|-passwd|-info [OPTIONS] CIPHERDIR\n" +
-	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n"
+	"  or   " + tlog.ProgramName + " [OPTIONS] CIPHERDIR MOUNTPOINT\n" +
+	"  or   " + tlog.ProgramName + " -status MOUNTPOINT|SOCKET\n"
 
 // helpShort is what gets displayed when passed "-h" or on syntax error.
 func helpShort() {
@@ -40,6 +41,7 @@ Common Options (use -hh to show all):
   -reverse           Enable reverse mode
   -ro                Mount read-only
   -speed             Run crypto speed test
+  -status            Display the status of a mounted filesystem
   -version           Print version information
   --                 Stop option parsing
 `)
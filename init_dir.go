@@ -109,6 +109,7 @@ func initDir(args *argContainer) {
 			XChaCha20Poly1305:  args.xchacha,
 			LongNameMax:        args.longnamemax,
 			Masterkey:          handleArgsMasterkey(args),
+			StableIVs:          args.stable_ivs,
 		})
 		if err != nil {
 			tlog.Fatal.Println(err)
@@ -0,0 +1,168 @@
+// Package audit writes the audit log of file operations, one JSON object
+// per line, to a file or to syslog.
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// Syslog is the destination that sends the records to syslog
+const Syslog = "syslog"
+
+// Record describes one file operation
+type Record struct {
+	Time time.Time
+	// Op is the operation: "open", "create", "unlink", "rename", ...
+	Op string
+	// Path is the plaintext path relative to the mountpoint
+	Path string
+	// NewPath is the target of a rename, or of a hard link
+	NewPath string `json:",omitempty"`
+	// Detail depends on Op: the access mode for "open" and "create", the
+	// changed attributes for "setattr", the attribute name for
+	// "setxattr" and "removexattr"
+	Detail string `json:",omitempty"`
+	// The calling process, as reported by the kernel
+	Uid uint32
+	Gid uint32
+	Pid uint32
+	// Errno is 0 on success
+	Errno int32
+	// Result is "OK" or the error message
+	Result string
+}
+
+// Logger writes records to the audit log. It is safe for concurrent use.
+type Logger struct {
+	sync.Mutex
+	// w is the open log file or the syslog connection
+	w io.Writer
+	// The following fields are only used for log files
+	file *os.File
+	// fileName is the path of the log file
+	fileName string
+	// size is the current size of the log file
+	size int64
+	// maxSize is the size at which the log file is rotated, 0 means never
+	maxSize int64
+	// keep is the number of rotated files that are kept
+	keep int
+	// failed is set after a write error, so we warn only once until
+	// writing works again
+	failed bool
+}
+
+// Open opens the audit log "dest", which is either Syslog or a file name.
+// Log files are rotated once they reach "maxSize" bytes, keeping "keep"
+// old files named "dest.1" (the most recent) to "dest.KEEP".
+func Open(dest string, maxSize int64, keep int) (*Logger, error) {
+	if dest == Syslog {
+		w, err := syslog.New(syslog.LOG_AUTHPRIV|syslog.LOG_NOTICE, "gocryptfs-audit")
+		if err != nil {
+			return nil, err
+		}
+		return &Logger{w: w}, nil
+	}
+	if maxSize < 0 || keep < 0 {
+		return nil, fmt.Errorf("invalid rotation settings: size=%d keep=%d", maxSize, keep)
+	}
+	l := &Logger{
+		fileName: dest,
+		maxSize:  maxSize,
+		keep:     keep,
+	}
+	if err := l.openFile(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// openFile opens or creates the log file for appending. Caller must hold
+// the lock, if it is needed.
+func (l *Logger) openFile() error {
+	f, err := os.OpenFile(l.fileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file = f
+	l.w = f
+	l.size = fi.Size()
+	return nil
+}
+
+// rotate moves the log file out of the way and starts a new one. Caller
+// must hold the lock.
+func (l *Logger) rotate() error {
+	l.file.Close()
+	l.file = nil
+	l.w = nil
+	if l.keep == 0 {
+		os.Remove(l.fileName)
+	} else {
+		// The oldest file is overwritten by the rename
+		for i := l.keep - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.fileName, i), fmt.Sprintf("%s.%d", l.fileName, i+1))
+		}
+		if err := os.Rename(l.fileName, l.fileName+".1"); err != nil {
+			return err
+		}
+	}
+	return l.openFile()
+}
+
+// Log writes "r" to the log. Errors are reported via tlog.Warn.
+func (l *Logger) Log(r *Record) {
+	js, err := json.Marshal(r)
+	if err != nil {
+		tlog.Warn.Printf("audit log: %v", err)
+		return
+	}
+	js = append(js, '\n')
+	l.Lock()
+	defer l.Unlock()
+	if l.file != nil && l.maxSize > 0 && l.size > 0 && l.size+int64(len(js)) > l.maxSize {
+		err = l.rotate()
+	}
+	if err == nil && l.w == nil {
+		// An earlier rotation has failed, try again
+		err = l.openFile()
+	}
+	if err == nil {
+		var n int
+		n, err = l.w.Write(js)
+		l.size += int64(n)
+	}
+	if err != nil {
+		if !l.failed {
+			tlog.Warn.Printf("audit log: %v", err)
+		}
+		l.failed = true
+		return
+	}
+	l.failed = false
+}
+
+// Close closes the log
+func (l *Logger) Close() error {
+	l.Lock()
+	defer l.Unlock()
+	if c, ok := l.w.(io.Closer); ok {
+		l.w = nil
+		l.file = nil
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// readRecords reads the records in log file "fn"
+func readRecords(t *testing.T, fn string) (records []Record) {
+	f, err := os.Open(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, r)
+	}
+	return records
+}
+
+func TestRotate(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "audit.log")
+	// A record is about 100 bytes, so every file holds two records
+	l, err := Open(fn, 250, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, p := range []string{"a", "b", "c", "d", "e", "f", "g"} {
+		l.Log(&Record{Op: "open", Path: p, Result: "OK"})
+	}
+	want := map[string][]string{
+		fn:        {"g"},
+		fn + ".1": {"e", "f"},
+		fn + ".2": {"c", "d"},
+	}
+	for name, paths := range want {
+		records := readRecords(t, name)
+		if len(records) != len(paths) {
+			t.Errorf("%s: want %d records, have %d", name, len(paths), len(records))
+			continue
+		}
+		for i := range records {
+			if records[i].Path != paths[i] {
+				t.Errorf("%s: record %d: want path %q, have %q", name, i, paths[i], records[i].Path)
+			}
+		}
+	}
+	if _, err := os.Stat(fn + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 should not exist: %v", fn, err)
+	}
+}
+
+func TestAppend(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "audit.log")
+	for i := 0; i < 2; i++ {
+		l, err := Open(fn, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Log(&Record{Op: "unlink", Path: "x", Errno: 2, Result: "no such file or directory"})
+		l.Close()
+	}
+	records := readRecords(t, fn)
+	if len(records) != 2 || records[1].Op != "unlink" || records[1].Errno != 2 {
+		t.Errorf("wrong records: %+v", records)
+	}
+}
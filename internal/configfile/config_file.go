@@ -76,6 +76,7 @@ type CreateArgs struct {
 	XChaCha20Poly1305  bool
 	LongNameMax        uint8
 	Masterkey          []byte
+	StableIVs          bool
 }
 
 // Create - create a new config with a random key encrypted with
@@ -115,6 +116,9 @@ func Create(args *CreateArgs) error {
 	if args.AESSIV {
 		cf.setFeatureFlag(FlagAESSIV)
 	}
+	if args.StableIVs {
+		cf.setFeatureFlag(FlagStableIVs)
+	}
 	if len(args.Fido2CredentialID) > 0 {
 		cf.setFeatureFlag(FlagFIDO2)
 		cf.FIDO2 = &FIDO2Params{
@@ -223,9 +227,9 @@ func (cf *ConfFile) DecryptMasterKey(password []byte) (masterkey []byte, err err
 	useHKDF := cf.IsFeatureFlagSet(FlagHKDF)
 	ce := getKeyEncrypter(scryptHash, useHKDF)
 
-	tlog.Warn.Enabled = false // Silence DecryptBlock() error messages on incorrect password
+	tlog.Warn.SetEnabled(false) // Silence DecryptBlock() error messages on incorrect password
 	masterkey, err = ce.DecryptBlock(cf.EncryptedKey, 0, nil)
-	tlog.Warn.Enabled = true
+	tlog.Warn.SetEnabled(true)
 
 	// Purge scrypt-derived key
 	for i := range scryptHash {
@@ -37,7 +37,7 @@ func TestLoadV2(t *testing.T) {
 
 func TestLoadV2PwdError(t *testing.T) {
 	if !testing.Verbose() {
-		tlog.Warn.Enabled = false
+		tlog.Warn.SetEnabled(false)
 	}
 	_, _, err := LoadAndDecrypt("config_test/v2.conf", []byte("wrongpassword"))
 	if err == nil {
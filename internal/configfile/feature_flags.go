@@ -38,6 +38,10 @@ const (
 	FlagFIDO2
 	// FlagXChaCha20Poly1305 means we use XChaCha20-Poly1305 file content encryption
 	FlagXChaCha20Poly1305
+	// FlagStableIVs means that "-stable-ivs" was used when creating the
+	// filesystem. Reverse mode derives the file content IVs from a per-file ID
+	// stored in an xattr instead of from the path.
+	FlagStableIVs
 )
 
 // knownFlags stores the known feature flags and their string representation
@@ -53,6 +57,7 @@ var knownFlags = map[flagIota]string{
 	FlagHKDF:              "HKDF",
 	FlagFIDO2:             "FIDO2",
 	FlagXChaCha20Poly1305: "XChaCha20Poly1305",
+	FlagStableIVs:         "StableIVs",
 }
 
 // isFeatureFlagKnown verifies that we understand a feature flag.
@@ -9,6 +9,7 @@ import (
 	"log"
 	"runtime"
 	"sync"
+	"sync/atomic"
 
 	"github.com/hanwen/go-fuse/v2/fuse"
 
@@ -54,6 +55,35 @@ type ContentEnc struct {
 	CReqPool bPool
 	// Plaintext request data pool. Slice have size fuse.MAX_KERNEL_WRITE.
 	PReqPool bPool
+
+	// Counters for Stats()
+	blocksEncrypted atomic.Uint64
+	bytesEncrypted  atomic.Uint64
+	blocksDecrypted atomic.Uint64
+	bytesDecrypted  atomic.Uint64
+	authFailures    atomic.Uint64
+}
+
+// Stats counts the blocks that have been encrypted and decrypted, and their
+// plaintext bytes. File holes are not counted. AuthFailures counts the
+// blocks that failed authentication on decryption.
+type Stats struct {
+	BlocksEncrypted uint64
+	BytesEncrypted  uint64
+	BlocksDecrypted uint64
+	BytesDecrypted  uint64
+	AuthFailures    uint64
+}
+
+// Stats returns the counters since New()
+func (be *ContentEnc) Stats() Stats {
+	return Stats{
+		BlocksEncrypted: be.blocksEncrypted.Load(),
+		BytesEncrypted:  be.bytesEncrypted.Load(),
+		BlocksDecrypted: be.blocksDecrypted.Load(),
+		BytesDecrypted:  be.bytesDecrypted.Load(),
+		AuthFailures:    be.authFailures.Load(),
+	}
 }
 
 // New returns an initialized ContentEnc instance.
@@ -172,10 +202,13 @@ func (be *ContentEnc) DecryptBlock(ciphertext []byte, blockNo uint64, fileID []b
 	plaintext, err := be.cryptoCore.AEADCipher.Open(plaintext, nonce, ciphertext, aData)
 
 	if err != nil {
+		be.authFailures.Add(1)
 		tlog.Debug.Printf("DecryptBlock: %s, len=%d", err.Error(), len(ciphertextOrig))
 		tlog.Debug.Println(hex.Dump(ciphertextOrig))
 		return nil, err
 	}
+	be.blocksDecrypted.Add(1)
+	be.bytesDecrypted.Add(uint64(len(plaintext)))
 
 	return plaintext, nil
 }
@@ -288,6 +321,8 @@ func (be *ContentEnc) doEncryptBlock(plaintext []byte, blockNo uint64, fileID []
 		log.Panicf("unexpected ciphertext length: plaintext=%d, overhead=%d, ciphertext=%d",
 			len(plaintext), overhead, len(ciphertext))
 	}
+	be.blocksEncrypted.Add(1)
+	be.bytesEncrypted.Add(uint64(len(plaintext)))
 	return ciphertext
 }
 
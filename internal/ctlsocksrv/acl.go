@@ -0,0 +1,80 @@
+package ctlsocksrv
+
+import (
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+// Grant is a set of request types that a peer may send
+type Grant uint8
+
+const (
+	// GrantStatus allows Status requests, and Logging requests that only
+	// ask for the current state
+	GrantStatus Grant = 1 << iota
+	// GrantPaths allows all requests that return paths: EncryptPath(s),
+	// DecryptPath(s), ChangedSince, ScrubStatus and ListCorruptions
+	GrantPaths
+	// GrantAdmin allows the requests that change the state of the mount:
+	// Unmount, ReadOnly, ReadWrite, Flush, ClearCorruptions and Logging
+	// requests that change something
+	GrantAdmin
+	// GrantAll allows everything
+	GrantAll = GrantStatus | GrantPaths | GrantAdmin
+)
+
+// ACL decides which requests a peer may send, based on the uid and gid
+// the kernel has recorded for the connection. The grants of a peer are the
+// union of the grants for its uid and its gid. A peer without grants cannot
+// connect at all.
+type ACL struct {
+	Uids map[uint32]Grant
+	Gids map[uint32]Grant
+}
+
+// grants returns the grants for a peer with "uid" and "gid"
+func (a *ACL) grants(uid uint32, gid uint32) Grant {
+	return a.Uids[uid] | a.Gids[gid]
+}
+
+// requiredGrant returns the grants needed for request "in". Hello needs
+// none, every peer that may connect can send it.
+func requiredGrant(in *ctlsock.RequestStruct) (g Grant) {
+	if in.Status {
+		g |= GrantStatus
+	}
+	if in.EncryptPath != "" || in.DecryptPath != "" || len(in.EncryptPaths) > 0 || len(in.DecryptPaths) > 0 ||
+		in.ChangedSince != 0 || in.ScrubStatus || in.ListCorruptions {
+		g |= GrantPaths
+	}
+	if in.Unmount || in.ReadOnly || in.ReadWrite || in.Flush || in.ClearCorruptions {
+		g |= GrantAdmin
+	}
+	if in.Logging != nil {
+		if logSettingsChange(in.Logging) {
+			g |= GrantAdmin
+		} else {
+			g |= GrantStatus
+		}
+	}
+	return g
+}
+
+// capabilityGrants maps the capabilities reported by Hello to the grants
+// they need
+var capabilityGrants = map[string]Grant{
+	"EncryptPath":      GrantPaths,
+	"DecryptPath":      GrantPaths,
+	"EncryptPaths":     GrantPaths,
+	"DecryptPaths":     GrantPaths,
+	"ChangedSince":     GrantPaths,
+	"ChangedMax":       GrantPaths,
+	"ScrubStatus":      GrantPaths,
+	"ListCorruptions":  GrantPaths,
+	"ClearCorruptions": GrantAdmin,
+	"Status":           GrantStatus,
+	"Unmount":          GrantAdmin,
+	"ReadOnly":         GrantAdmin,
+	"ReadWrite":        GrantAdmin,
+	"Flush":            GrantAdmin,
+	"Logging":          GrantStatus,
+}
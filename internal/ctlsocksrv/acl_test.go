@@ -0,0 +1,86 @@
+package ctlsocksrv
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+)
+
+// fakeFS implements Interface and echoes the paths back
+type fakeFS struct{}
+
+func (fakeFS) EncryptPath(p string) (string, error) { return p, nil }
+func (fakeFS) DecryptPath(p string) (string, error) { return p, nil }
+
+// serveACL starts a control socket server with "acl" and returns the path
+// of the socket
+func serveACL(t *testing.T, acl *ACL) string {
+	sock := filepath.Join(t.TempDir(), "sock")
+	l, err := Listen(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go Serve(l, fakeFS{}, Options{ACL: acl})
+	return sock
+}
+
+func TestACLGrants(t *testing.T) {
+	uid := uint32(os.Getuid())
+	sock := serveACL(t, &ACL{Uids: map[uint32]Grant{uid: GrantStatus}})
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_, caps, err := c.Hello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// fakeFS does not implement StatusReporter, so only Logging is left
+	if len(caps) != 1 || caps[0] != "Logging" {
+		t.Errorf("capabilities: %v", caps)
+	}
+	_, err = c.Query(&ctlsock.RequestStruct{DecryptPath: "foo"})
+	if resp, ok := err.(*ctlsock.ResponseStruct); !ok || resp.ErrNo != int32(syscall.EPERM) {
+		t.Errorf("DecryptPath: want EPERM, got %v", err)
+	}
+	_, err = c.Query(&ctlsock.RequestStruct{Status: true})
+	if resp, ok := err.(*ctlsock.ResponseStruct); !ok || resp.ErrNo != int32(syscall.ENOTSUP) {
+		t.Errorf("Status: want ENOTSUP, got %v", err)
+	}
+}
+
+func TestACLReject(t *testing.T) {
+	// Nobody may connect
+	sock := serveACL(t, &ACL{})
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err = c.Query(&ctlsock.RequestStruct{Hello: true}); err == nil {
+		t.Error("the connection should have been closed")
+	}
+}
+
+func TestRequiredGrant(t *testing.T) {
+	testCases := []struct {
+		in   ctlsock.RequestStruct
+		want Grant
+	}{
+		{ctlsock.RequestStruct{Hello: true}, 0},
+		{ctlsock.RequestStruct{Status: true}, GrantStatus},
+		{ctlsock.RequestStruct{DecryptPaths: []string{"x"}}, GrantPaths},
+		{ctlsock.RequestStruct{ListCorruptions: true, ClearCorruptions: true}, GrantPaths | GrantAdmin},
+		{ctlsock.RequestStruct{Unmount: true}, GrantAdmin},
+	}
+	for _, tc := range testCases {
+		if have := requiredGrant(&tc.in); have != tc.want {
+			t.Errorf("%+v: have %d, want %d", tc.in, have, tc.want)
+		}
+	}
+}
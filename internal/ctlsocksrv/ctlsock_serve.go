@@ -8,10 +8,13 @@ import (
 	"fmt"
 	"io"
 	"net"
-	"os"
+	"slices"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
@@ -21,21 +24,101 @@ type Interface interface {
 	DecryptPath(string) (string, error)
 }
 
+// ChangeFeed is optionally implemented by fusefrontend_reverse to answer
+// ChangedSince requests.
+type ChangeFeed interface {
+	// ChangedSince passes the ciphertext paths that have changed since
+	// "since" to "fn", and returns the timestamp to use for the next call.
+	// An error returned by "fn" aborts the walk and is returned.
+	ChangedSince(since time.Time, fn func(cPath string) error) (next time.Time, err error)
+}
+
+// Scrubber is optionally implemented by fusefrontend to answer ScrubStatus
+// requests.
+type Scrubber interface {
+	// ScrubStatus returns the state of the background scrubber. It fails
+	// with ENOTSUP if scrubbing is not enabled.
+	ScrubStatus() (*ctlsock.ScrubStatus, error)
+}
+
+// CorruptionLog is optionally implemented by fusefrontend to answer
+// ListCorruptions and ClearCorruptions requests.
+type CorruptionLog interface {
+	// ListCorruptions returns the logged corruptions and the number of
+	// events that have been dropped from the list. It clears the log if
+	// "clear" is set.
+	ListCorruptions(clear bool) (events []ctlsock.CorruptionEvent, dropped int)
+}
+
+// StatusReporter is optionally implemented by fusefrontend[_reverse] to
+// answer Status requests.
+type StatusReporter interface {
+	Status() *ctlsock.StatusStruct
+}
+
+// Controller is optionally implemented by fusefrontend to answer ReadOnly,
+// ReadWrite and Flush requests.
+type Controller interface {
+	// SetReadOnly makes all operations that modify the filesystem fail
+	// with EROFS (ro = true), or allows them again (ro = false).
+	SetReadOnly(ro bool) error
+	// Flush fsyncs all open files.
+	Flush() error
+}
+
+// Options for Serve
+type Options struct {
+	// Unmount is called to answer Unmount requests. It should block until
+	// the filesystem has been unmounted. May be nil.
+	Unmount func() error
+	// ACL decides who may connect and send which requests. nil allows
+	// everything.
+	ACL *ACL
+	// Logging lets Logging requests switch OpTrace and FuseDebug. May be
+	// nil.
+	Logging LogToggles
+}
+
 type ctlSockHandler struct {
-	fs     Interface
-	socket *net.UnixListener
+	fs      Interface
+	socket  *net.UnixListener
+	opts    Options
+	logging logState
 }
 
+// unmountWG tracks the Unmount requests that have not been answered yet,
+// see WaitUnmount().
+var unmountWG sync.WaitGroup
+
+// unmountLock protects unmountDone and makes sure that unmountWG.Add()
+// does not run concurrently with unmountWG.Wait().
+var unmountLock sync.Mutex
+
+// unmountDone is set once WaitUnmount() has been called. Unmount requests
+// that come in after that are not tracked anymore.
+var unmountDone bool
+
 // Serve serves incoming connections on "sock". This call blocks so you
 // probably want to run it in a new goroutine.
-func Serve(sock net.Listener, fs Interface) {
+func Serve(sock net.Listener, fs Interface, opts Options) {
 	handler := ctlSockHandler{
 		fs:     fs,
 		socket: sock.(*net.UnixListener),
+		opts:   opts,
 	}
 	handler.acceptLoop()
 }
 
+// WaitUnmount waits until the answers to all Unmount requests have been sent.
+// Call it after the filesystem has been unmounted, otherwise the process
+// may exit before the client gets its answer.
+func WaitUnmount() {
+	unmountLock.Lock()
+	unmountDone = true
+	unmountLock.Unlock()
+	unmountWG.Wait()
+}
+
 func (ch *ctlSockHandler) acceptLoop() {
 	for {
 		conn, err := ch.socket.Accept()
@@ -50,109 +133,405 @@ func (ch *ctlSockHandler) acceptLoop() {
 	}
 }
 
-// ReadBufSize is the size of the request read buffer.
-// The longest possible path is 4096 bytes on Linux and 1024 on Mac OS X so
-// 5000 bytes should be enough to hold the whole JSON request. This
-// assumes that the path does not contain too many characters that had to be
-// be escaped in JSON (for example, a null byte blows up to "\u0000").
-// We abort the connection if the request is bigger than this.
-const ReadBufSize = 5000
+// reqConn is the connection a request came in on
+type reqConn struct {
+	*net.UnixConn
+	// id is the ID of the request, it is copied into the response
+	id uint64
+	// uid and gid of the peer
+	uid, gid uint32
+	// grants are the requests the peer may send
+	grants Grant
+}
+
+// errRequestTooBig is returned by limitReader
+var errRequestTooBig = fmt.Errorf("request too big (max = %d bytes)", ctlsock.MaxRequestSize)
 
-// handleConnection reads and parses JSON requests from "conn"
+// limitReader is like io.LimitedReader, but fails with errRequestTooBig
+// instead of io.EOF. handleConnection() resets "n" for every request.
+type limitReader struct {
+	r io.Reader
+	n int
+}
+
+func (l *limitReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errRequestTooBig
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= n
+	return n, err
+}
+
+// handleConnection reads and parses JSON requests from "conn".
+//
+// Version 1 clients send one JSON object and wait for the response, version
+// 2 clients send newline-separated JSON objects and may send more requests
+// before reading the responses. json.Decoder handles both, it does not
+// need a separator after an object.
 func (ch *ctlSockHandler) handleConnection(conn *net.UnixConn) {
-	buf := make([]byte, ReadBufSize)
-	for {
-		n, err := conn.Read(buf)
-		if err == io.EOF {
-			conn.Close()
-			return
-		} else if err != nil {
-			tlog.Warn.Printf("ctlsock: Read error: %#v", err)
-			conn.Close()
+	defer conn.Close()
+	rc := &reqConn{UnixConn: conn, grants: GrantAll}
+	if ch.opts.ACL != nil {
+		var err error
+		rc.uid, rc.gid, err = syscallcompat.PeerCred(conn)
+		if err != nil {
+			tlog.Warn.Printf("ctlsock: cannot get peer credentials: %v", err)
 			return
 		}
-		if n == ReadBufSize {
-			tlog.Warn.Printf("ctlsock: request too big (max = %d bytes)", ReadBufSize-1)
-			conn.Close()
+		rc.grants = ch.opts.ACL.grants(rc.uid, rc.gid)
+		if rc.grants == 0 {
+			tlog.Warn.Printf("ctlsock: rejected connection from uid %d gid %d", rc.uid, rc.gid)
 			return
 		}
-		data := buf[:n]
+	}
+	lr := &limitReader{r: conn}
+	dec := json.NewDecoder(lr)
+	for {
+		lr.n = ctlsock.MaxRequestSize
 		var in ctlsock.RequestStruct
-		err = json.Unmarshal(data, &in)
-		if err != nil {
+		err := dec.Decode(&in)
+		rc.id = in.ID
+		if err == io.EOF {
+			return
+		}
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			// The decoder has skipped the offending value, we can go on
+			// with the next request
 			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
-			err = errors.New("JSON Unmarshal error: " + err.Error())
-			sendResponse(conn, err, "", "")
+			sendResponse(rc, errors.New("JSON Unmarshal error: "+err.Error()), "", "")
 			continue
 		}
-		ch.handleRequest(&in, conn)
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			// We cannot find the start of the next request, give up
+			tlog.Warn.Printf("ctlsock: JSON Unmarshal error: %#v", err)
+			sendResponse(rc, errors.New("JSON Unmarshal error: "+err.Error()), "", "")
+			return
+		}
+		if err != nil {
+			tlog.Warn.Printf("ctlsock: Read error: %v", err)
+			return
+		}
+		ch.handleRequest(&in, rc)
 	}
 }
 
 // handleRequest handles an already-unmarshaled JSON request
-func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *net.UnixConn) {
-	var err error
-	var inPath, outPath, clean, warnText string
+func (ch *ctlSockHandler) handleRequest(in *ctlsock.RequestStruct, conn *reqConn) {
+	if need := requiredGrant(in); need&conn.grants != need {
+		tlog.Info.Printf("ctlsock: uid %d gid %d: request not permitted", conn.uid, conn.gid)
+		sendResponse(conn, syscall.EPERM, "", "")
+		return
+	}
+	if in.Hello {
+		ch.handleHello(in, conn)
+		return
+	}
+	if in.ChangedSince != 0 {
+		ch.handleChangedSince(in, conn)
+		return
+	}
+	if in.ScrubStatus {
+		ch.handleScrubStatus(in, conn)
+		return
+	}
+	if in.ListCorruptions || in.ClearCorruptions {
+		ch.handleCorruptions(in, conn)
+		return
+	}
+	if in.Status {
+		ch.handleStatus(in, conn)
+		return
+	}
+	if in.Unmount {
+		ch.handleUnmount(in, conn)
+		return
+	}
+	if in.ReadOnly || in.ReadWrite || in.Flush {
+		ch.handleControl(in, conn)
+		return
+	}
+	if len(in.EncryptPaths) > 0 || len(in.DecryptPaths) > 0 {
+		ch.handleBatch(in, conn)
+		return
+	}
+	if in.Logging != nil {
+		ch.handleLogging(in, conn)
+		return
+	}
 	// You cannot perform both decryption and encryption in one request
 	if in.DecryptPath != "" && in.EncryptPath != "" {
-		err = errors.New("Ambiguous")
-		sendResponse(conn, err, "", "")
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
 		return
 	}
 	// Neither encryption nor encryption has been requested, makes no sense
 	if in.DecryptPath == "" && in.EncryptPath == "" {
-		err = errors.New("empty input")
-		sendResponse(conn, err, "", "")
+		sendResponse(conn, errors.New("empty input"), "", "")
 		return
 	}
-	// Canonicalize input path
+	var outPath, warnText string
+	var err error
 	if in.EncryptPath != "" {
-		inPath = in.EncryptPath
+		outPath, warnText, err = ch.translatePath(in.EncryptPath, true)
 	} else {
-		inPath = in.DecryptPath
+		outPath, warnText, err = ch.translatePath(in.DecryptPath, false)
 	}
-	clean = SanitizePath(inPath)
+	sendResponse(conn, err, outPath, warnText)
+}
+
+// translatePath canonicalizes "inPath" and encrypts or decrypts it
+func (ch *ctlSockHandler) translatePath(inPath string, encrypt bool) (outPath string, warnText string, err error) {
+	clean := SanitizePath(inPath)
 	// Warn if a non-canonical path was passed
 	if inPath != clean {
 		warnText = fmt.Sprintf("Non-canonical input path '%s' has been interpreted as '%s'.", inPath, clean)
 	}
 	// Error out if the canonical path is now empty
 	if clean == "" {
-		err = errors.New("empty input after canonicalization")
-		sendResponse(conn, err, "", warnText)
-		return
+		return "", warnText, errors.New("empty input after canonicalization")
 	}
 	// Actual encrypt or decrypt operation
-	if in.EncryptPath != "" {
+	if encrypt {
 		outPath, err = ch.fs.EncryptPath(clean)
 	} else {
 		outPath, err = ch.fs.DecryptPath(clean)
 	}
-	sendResponse(conn, err, outPath, warnText)
+	return outPath, warnText, err
+}
+
+// handleBatch handles EncryptPaths and DecryptPaths requests
+func (ch *ctlSockHandler) handleBatch(in *ctlsock.RequestStruct, conn *reqConn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" || (len(in.EncryptPaths) > 0 && len(in.DecryptPaths) > 0) {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	paths, encrypt := in.DecryptPaths, false
+	if len(in.EncryptPaths) > 0 {
+		paths, encrypt = in.EncryptPaths, true
+	}
+	results := make([]ctlsock.PathResult, len(paths))
+	for i, p := range paths {
+		r := &results[i]
+		var err error
+		r.Result, r.WarnText, err = ch.translatePath(p, encrypt)
+		if err != nil {
+			r.Result = ""
+			r.ErrNo, r.ErrText = errNo(err), err.Error()
+		}
+	}
+	writeResponse(conn, &ctlsock.ResponseStruct{Results: results})
+}
+
+// handleHello handles a Hello request
+func (ch *ctlSockHandler) handleHello(in *ctlsock.RequestStruct, conn *reqConn) {
+	caps := []string{"EncryptPath", "DecryptPath", "EncryptPaths", "DecryptPaths"}
+	if _, ok := ch.fs.(ChangeFeed); ok {
+		caps = append(caps, "ChangedSince", "ChangedMax")
+	}
+	if _, ok := ch.fs.(Scrubber); ok {
+		caps = append(caps, "ScrubStatus")
+	}
+	if _, ok := ch.fs.(CorruptionLog); ok {
+		caps = append(caps, "ListCorruptions", "ClearCorruptions")
+	}
+	if _, ok := ch.fs.(StatusReporter); ok {
+		caps = append(caps, "Status")
+	}
+	if ch.opts.Unmount != nil {
+		caps = append(caps, "Unmount")
+	}
+	if _, ok := ch.fs.(Controller); ok {
+		caps = append(caps, "ReadOnly", "ReadWrite", "Flush")
+	}
+	caps = append(caps, "Logging")
+	// Only report what the peer may use
+	caps = slices.DeleteFunc(caps, func(c string) bool {
+		need := capabilityGrants[c]
+		return need&conn.grants != need
+	})
+	writeResponse(conn, &ctlsock.ResponseStruct{
+		Version:      ctlsock.ProtocolVersion,
+		Capabilities: caps,
+	})
+}
+
+// handleChangedSince handles a ChangedSince request
+func (ch *ctlSockHandler) handleChangedSince(in *ctlsock.RequestStruct, conn *reqConn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	feed, ok := ch.fs.(ChangeFeed)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "ChangedSince is only supported in reverse mode")
+		return
+	}
+	if in.ChangedMax < 0 {
+		sendResponse(conn, syscall.EINVAL, "", "ChangedMax must not be negative")
+		return
+	}
+	// With ChangedMax, send the paths as we find them, so neither we nor
+	// the client have to hold all of them
+	changed := []string{}
+	next, err := feed.ChangedSince(time.Unix(0, in.ChangedSince), func(cPath string) error {
+		changed = append(changed, cPath)
+		if in.ChangedMax == 0 || len(changed) < in.ChangedMax {
+			return nil
+		}
+		err := writeResponse(conn, &ctlsock.ResponseStruct{Changed: changed, ChangedMore: true})
+		changed = changed[:0]
+		return err
+	})
+	if err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	msg := ctlsock.ResponseStruct{
+		Changed:   changed,
+		Timestamp: next.UnixNano(),
+	}
+	writeResponse(conn, &msg)
+}
+
+// handleScrubStatus handles a ScrubStatus request
+func (ch *ctlSockHandler) handleScrubStatus(in *ctlsock.RequestStruct, conn *reqConn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	scrubber, ok := ch.fs.(Scrubber)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "ScrubStatus is only supported in forward mode")
+		return
+	}
+	status, err := scrubber.ScrubStatus()
+	if err != nil {
+		sendResponse(conn, err, "", "")
+		return
+	}
+	writeResponse(conn, &ctlsock.ResponseStruct{Scrub: status})
+}
+
+// handleCorruptions handles ListCorruptions and ClearCorruptions requests
+func (ch *ctlSockHandler) handleCorruptions(in *ctlsock.RequestStruct, conn *reqConn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	log, ok := ch.fs.(CorruptionLog)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "The corruption log is only supported in forward mode")
+		return
+	}
+	events, dropped := log.ListCorruptions(in.ClearCorruptions)
+	msg := ctlsock.ResponseStruct{}
+	if in.ListCorruptions {
+		msg.Corruptions = events
+		msg.CorruptionsDropped = dropped
+	}
+	writeResponse(conn, &msg)
+}
+
+// handleStatus handles a Status request
+func (ch *ctlSockHandler) handleStatus(in *ctlsock.RequestStruct, conn *reqConn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	r, ok := ch.fs.(StatusReporter)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	writeResponse(conn, &ctlsock.ResponseStruct{Status: r.Status()})
+}
+
+// handleUnmount handles an Unmount request
+func (ch *ctlSockHandler) handleUnmount(in *ctlsock.RequestStruct, conn *reqConn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	if ch.opts.Unmount == nil {
+		sendResponse(conn, syscall.ENOTSUP, "", "")
+		return
+	}
+	unmountLock.Lock()
+	if unmountDone {
+		unmountLock.Unlock()
+		// The filesystem has already been unmounted
+		sendResponse(conn, syscall.EINVAL, "", "")
+		return
+	}
+	unmountWG.Add(1)
+	unmountLock.Unlock()
+	defer unmountWG.Done()
+	tlog.Info.Printf("ctlsock: unmount requested")
+	err := ch.opts.Unmount()
+	if err != nil {
+		tlog.Info.Printf("ctlsock: unmount failed: %v", err)
+	}
+	sendResponse(conn, err, "", "")
+}
+
+// handleControl handles ReadOnly, ReadWrite and Flush requests
+func (ch *ctlSockHandler) handleControl(in *ctlsock.RequestStruct, conn *reqConn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" || (in.ReadOnly && in.ReadWrite) {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	c, ok := ch.fs.(Controller)
+	if !ok {
+		sendResponse(conn, syscall.ENOTSUP, "", "ReadOnly, ReadWrite and Flush are only supported in forward mode")
+		return
+	}
+	var err error
+	switch {
+	case in.ReadOnly:
+		err = c.SetReadOnly(true)
+	case in.ReadWrite:
+		err = c.SetReadOnly(false)
+	}
+	if err == nil && in.Flush {
+		err = c.Flush()
+	}
+	sendResponse(conn, err, "", "")
 }
 
 // sendResponse sends a JSON response message
-func sendResponse(conn *net.UnixConn, err error, result string, warnText string) {
+func sendResponse(conn *reqConn, err error, result string, warnText string) {
 	msg := ctlsock.ResponseStruct{
 		Result:   result,
 		WarnText: warnText,
 	}
 	if err != nil {
 		msg.ErrText = err.Error()
-		msg.ErrNo = -1
-		// Try to extract the actual error number
-		if pe, ok := err.(*os.PathError); ok {
-			if se, ok := pe.Err.(syscall.Errno); ok {
-				msg.ErrNo = int32(se)
-			}
-		} else if err == syscall.ENOENT {
-			msg.ErrNo = int32(syscall.ENOENT)
-		}
+		msg.ErrNo = errNo(err)
 	}
+	writeResponse(conn, &msg)
+}
+
+// errNo extracts the error number from "err", or returns -1
+func errNo(err error) int32 {
+	var se syscall.Errno
+	if errors.As(err, &se) {
+		return int32(se)
+	}
+	return -1
+}
+
+// writeResponse marshals "msg" and writes it to "conn"
+func writeResponse(conn *reqConn, msg *ctlsock.ResponseStruct) error {
+	msg.ID = conn.id
 	jsonMsg, err := json.Marshal(msg)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Marshal failed: %v", err)
-		return
+		return err
 	}
 	// For convenience for the user, add a newline at the end.
 	jsonMsg = append(jsonMsg, '\n')
@@ -160,4 +539,5 @@ func sendResponse(conn *net.UnixConn, err error, result string, warnText string)
 	if err != nil {
 		tlog.Warn.Printf("ctlsock: Write failed: %v", err)
 	}
+	return err
 }
@@ -0,0 +1,123 @@
+package ctlsocksrv
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// LogToggles is passed in Options to let Logging requests switch the debug
+// output that lives outside of tlog.
+type LogToggles interface {
+	// OpTrace reports if every FUSE operation is logged
+	OpTrace() bool
+	SetOpTrace(on bool)
+	// FuseDebug reports if the go-fuse debug output is on. go-fuse cannot
+	// switch it on a running server, so it is fixed at mount time
+	// (-fusedebug).
+	FuseDebug() bool
+}
+
+// logState implements the Logging request
+type logState struct {
+	sync.Mutex
+	// revertTimer restores "revertTo" when it fires, nil if no revert is
+	// pending
+	revertTimer *time.Timer
+	revertTo    ctlsock.LogStatus
+	revertAt    time.Time
+}
+
+// currentLogStatus returns the current settings. Caller must hold the lock.
+func (ch *ctlSockHandler) currentLogStatus() ctlsock.LogStatus {
+	s := ctlsock.LogStatus{Debug: tlog.Debug.Enabled()}
+	if t := ch.opts.Logging; t != nil {
+		s.OpTrace = t.OpTrace()
+		s.FuseDebug = t.FuseDebug()
+	}
+	if ch.logging.revertTimer != nil {
+		s.RevertAt = ch.logging.revertAt.Unix()
+	}
+	return s
+}
+
+// applyLogStatus switches to "s". Caller must hold the lock.
+func (ch *ctlSockHandler) applyLogStatus(s ctlsock.LogStatus) {
+	tlog.Debug.SetEnabled(s.Debug)
+	if t := ch.opts.Logging; t != nil {
+		t.SetOpTrace(s.OpTrace)
+	}
+}
+
+// revertLogging is called by the revert timer
+func (ch *ctlSockHandler) revertLogging(timer *time.Timer) {
+	ch.logging.Lock()
+	defer ch.logging.Unlock()
+	// The timer may have been replaced while we were waiting for the lock
+	if ch.logging.revertTimer != timer {
+		return
+	}
+	ch.logging.revertTimer = nil
+	ch.applyLogStatus(ch.logging.revertTo)
+	tlog.Info.Printf("ctlsock: log settings reverted: %+v", ch.logging.revertTo)
+}
+
+// handleLogging handles a Logging request
+func (ch *ctlSockHandler) handleLogging(in *ctlsock.RequestStruct, conn *reqConn) {
+	if in.DecryptPath != "" || in.EncryptPath != "" {
+		sendResponse(conn, errors.New("Ambiguous"), "", "")
+		return
+	}
+	req := in.Logging
+	if req.RevertAfter < 0 {
+		sendResponse(conn, errors.New("RevertAfter must not be negative"), "", "")
+		return
+	}
+	ch.logging.Lock()
+	defer ch.logging.Unlock()
+	if logSettingsChange(req) {
+		if (req.OpTrace != nil || req.FuseDebug != nil) && ch.opts.Logging == nil {
+			sendResponse(conn, errors.New("OpTrace and FuseDebug are not supported by this mount"), "", "")
+			return
+		}
+		cur := ch.currentLogStatus()
+		if req.FuseDebug != nil && *req.FuseDebug != cur.FuseDebug {
+			sendResponse(conn, errors.New("FuseDebug cannot be switched at runtime, use -fusedebug"), "", "")
+			return
+		}
+		if ch.logging.revertTimer != nil {
+			// Keep the state from before the first temporary change
+			ch.logging.revertTimer.Stop()
+			ch.logging.revertTimer = nil
+		} else {
+			ch.logging.revertTo = cur
+		}
+		next := cur
+		if req.Debug != nil {
+			next.Debug = *req.Debug
+		}
+		if req.OpTrace != nil {
+			next.OpTrace = *req.OpTrace
+		}
+		ch.applyLogStatus(next)
+		if req.RevertAfter > 0 {
+			d := time.Duration(req.RevertAfter) * time.Second
+			ch.logging.revertAt = time.Now().Add(d)
+			var timer *time.Timer
+			timer = time.AfterFunc(d, func() { ch.revertLogging(timer) })
+			ch.logging.revertTimer = timer
+		}
+		tlog.Info.Printf("ctlsock: log settings changed: %+v", ch.currentLogStatus())
+	}
+	s := ch.currentLogStatus()
+	writeResponse(conn, &ctlsock.ResponseStruct{Logging: &s})
+}
+
+// logSettingsChange returns true if "s" changes something, as opposed to
+// only asking for the current state
+func logSettingsChange(s *ctlsock.LogSettings) bool {
+	return s.Debug != nil || s.OpTrace != nil || s.FuseDebug != nil
+}
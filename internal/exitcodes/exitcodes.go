@@ -72,6 +72,14 @@ const (
 	DevNull = 30
 	// FIDO2Error - an error was encountered while interacting with a FIDO2 token
 	FIDO2Error = 31
+	// OfflineTree - "-decrypt-tree", "-encrypt-tree" or "-tar" failed
+	OfflineTree = 32
+	// WebDAV - the "-webdav" server could not be started
+	WebDAV = 33
+	// Metrics - the "-metrics" listener could not be opened
+	Metrics = 34
+	// AuditLog - the "-audit-log" could not be opened
+	AuditLog = 35
 )
 
 // Err wraps an error with an associated numeric exit code
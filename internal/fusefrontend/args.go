@@ -2,6 +2,9 @@ package fusefrontend
 
 import (
 	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/audit"
 )
 
 // Args is a container for arguments that are passed from main() to fusefrontend
@@ -53,4 +56,32 @@ type Args struct {
 	DeterministicNames bool
 	// NoXattr disables extended attribute operations
 	NoXattr bool
+	// StableIVs makes reverse mode derive the file content IVs from a random
+	// per-file ID that is stored in an xattr, instead of from the path.
+	// Only applicable to reverse mode.
+	StableIVs bool
+	// MergeDirs maps top-level directory names to additional plaintext
+	// directories (absolute paths) that are presented under that name,
+	// enabled via cli flag "-merge".
+	// Only applicable to reverse mode.
+	MergeDirs map[string]string
+	// FollowSymlinks makes reverse mode present the target of a symlink
+	// in place of the symlink, enabled via cli flag "-follow-symlinks".
+	// Only applicable to reverse mode.
+	FollowSymlinks bool
+	// Scrub, if not nil, enables the background scrubber, enabled via cli
+	// flag "-scrub". It is started by RootNode.StartScrubber().
+	// Only applicable to forward mode.
+	Scrub *ScrubArgs
+	// CorruptionLog is the file the corruption log is kept in across
+	// mounts, enabled via cli flag "-corruption-log". Empty means the log
+	// is only kept in memory.
+	CorruptionLog string
+	// AuditLog, if not nil, receives a record for every operation that
+	// opens or modifies a file, enabled via cli flag "-audit-log".
+	// Only applicable to forward mode.
+	AuditLog *audit.Logger
+	// Status is the static part of the answer to the "Status" control
+	// socket request. The frontends fill in the statistics.
+	Status ctlsock.StatusStruct
 }
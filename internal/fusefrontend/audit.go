@@ -0,0 +1,107 @@
+package fusefrontend
+
+import (
+	"context"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/audit"
+)
+
+// auditRecord returns a new audit log record for operation "op" on the
+// plaintext path "relPath", or nil if the audit log is disabled. Pass the
+// record to auditDone once the result is known:
+//
+//	r := rn.auditRecord(ctx, "unlink", n.childPath(name))
+//	defer rn.auditDone(r, &errno)
+//
+// "relPath" is a function so that the path is only built when it is
+// needed.
+func (rn *RootNode) auditRecord(ctx context.Context, op string, relPath func() string) *audit.Record {
+	if rn.args.AuditLog == nil {
+		return nil
+	}
+	r := &audit.Record{
+		Time: time.Now(),
+		Op:   op,
+		Path: relPath(),
+	}
+	if caller, ok := fuse.FromContext(ctx); ok {
+		r.Uid = caller.Uid
+		r.Gid = caller.Gid
+		r.Pid = caller.Pid
+	}
+	return r
+}
+
+// auditDone writes "r" to the audit log with the result "errno". "r" may be
+// nil.
+func (rn *RootNode) auditDone(r *audit.Record, errno *syscall.Errno) {
+	if r == nil {
+		return
+	}
+	r.Errno = int32(*errno)
+	r.Result = "OK"
+	if *errno != 0 {
+		r.Result = errno.Error()
+	}
+	rn.args.AuditLog.Log(r)
+}
+
+// childPath returns a function that returns the plaintext path of the
+// child "name" of n, for auditRecord
+func (n *Node) childPath(name string) func() string {
+	return func() string {
+		return path.Join(n.Path(), name)
+	}
+}
+
+// accessMode describes the access mode in the open flags "flags", for the
+// Detail field of audit records
+func accessMode(flags uint32) string {
+	var m []string
+	switch flags & syscall.O_ACCMODE {
+	case syscall.O_RDONLY:
+		m = append(m, "O_RDONLY")
+	case syscall.O_WRONLY:
+		m = append(m, "O_WRONLY")
+	default:
+		m = append(m, "O_RDWR")
+	}
+	if flags&syscall.O_APPEND != 0 {
+		m = append(m, "O_APPEND")
+	}
+	if flags&syscall.O_TRUNC != 0 {
+		m = append(m, "O_TRUNC")
+	}
+	return strings.Join(m, "|")
+}
+
+// changedAttrs lists the attributes that "in" changes, for the Detail field
+// of audit records
+func changedAttrs(in *fuse.SetAttrIn) string {
+	var a []string
+	if _, ok := in.GetMode(); ok {
+		a = append(a, "mode")
+	}
+	if _, ok := in.GetUID(); ok {
+		a = append(a, "uid")
+	}
+	if _, ok := in.GetGID(); ok {
+		a = append(a, "gid")
+	}
+	if _, ok := in.GetSize(); ok {
+		a = append(a, "size")
+	}
+	if _, ok := in.GetATime(); ok {
+		a = append(a, "atime")
+	}
+	if _, ok := in.GetMTime(); ok {
+		a = append(a, "mtime")
+	}
+	return strings.Join(a, ",")
+}
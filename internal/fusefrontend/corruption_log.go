@@ -0,0 +1,194 @@
+package fusefrontend
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+var _ ctlsocksrv.CorruptionLog = &RootNode{} // Verify that interface is implemented.
+
+// Corruption types in the corruption log
+const (
+	// The name cannot be decrypted, or the gocryptfs.longname.*.name file
+	// is missing
+	corruptName = "name"
+	// The file header is invalid or incomplete
+	corruptHeader = "header"
+	// A block fails authentication
+	corruptBlock = "block"
+	// An extended attribute name cannot be decrypted
+	corruptXattr = "xattr"
+	// Found by the scrubber, see scrub.go
+	corruptDir     = "dir"
+	corruptDirIV   = "diriv"
+	corruptSymlink = "symlink"
+)
+
+// corruptionLogMax is the number of events kept in memory, and on disk
+// after compaction
+const corruptionLogMax = 1000
+
+// corruptionLog keeps the most recent corruption events. When a file name
+// is given, the events are also appended to it, one JSON object per line,
+// and loaded from it on the next mount.
+type corruptionLog struct {
+	sync.Mutex
+	events []ctlsock.CorruptionEvent
+	// dropped counts the events that have been pushed out of "events"
+	dropped int
+	// file is the on-disk log, or nil
+	file *os.File
+	// fileLines is the number of lines in "file"
+	fileLines int
+}
+
+// open opens or creates the on-disk log "fn" and loads the
+// events in it. Errors are logged, the in-memory log still works then.
+func (l *corruptionLog) open(fn string) {
+	f, err := os.OpenFile(fn, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		tlog.Warn.Printf("corruption log: %v", err)
+		return
+	}
+	l.file = f
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		l.fileLines++
+		var ev ctlsock.CorruptionEvent
+		if err := json.Unmarshal(scanner.Bytes(), &ev); err != nil {
+			// A crash can leave a partial last line behind
+			tlog.Info.Printf("corruption log: %q line %d: %v", fn, l.fileLines, err)
+			continue
+		}
+		l.append(ev)
+	}
+	if err := scanner.Err(); err != nil {
+		tlog.Warn.Printf("corruption log: %v", err)
+	}
+	if l.fileLines > corruptionLogMax {
+		l.compact()
+	}
+}
+
+// append adds "ev" to the in-memory log. Caller must hold the lock.
+func (l *corruptionLog) append(ev ctlsock.CorruptionEvent) {
+	l.events = append(l.events, ev)
+	if len(l.events) > corruptionLogMax {
+		n := len(l.events) - corruptionLogMax
+		l.events = slices.Delete(l.events, 0, n)
+		l.dropped += n
+	}
+}
+
+// compact rewrites the on-disk log with the in-memory events. Caller must
+// hold the lock.
+func (l *corruptionLog) compact() {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for i := range l.events {
+		enc.Encode(&l.events[i])
+	}
+	err := l.file.Truncate(0)
+	if err == nil {
+		// O_APPEND writes go to the end no matter what the file offset is
+		_, err = l.file.Write(buf.Bytes())
+	}
+	if err != nil {
+		tlog.Warn.Printf("corruption log: %v", err)
+	}
+	l.fileLines = len(l.events)
+}
+
+// add records a new event
+func (l *corruptionLog) add(ev ctlsock.CorruptionEvent) {
+	l.Lock()
+	defer l.Unlock()
+	l.append(ev)
+	if l.file == nil {
+		return
+	}
+	if l.fileLines >= 2*corruptionLogMax {
+		l.compact()
+		return
+	}
+	js, _ := json.Marshal(&ev)
+	if _, err := l.file.Write(append(js, '\n')); err != nil {
+		tlog.Warn.Printf("corruption log: %v", err)
+		return
+	}
+	l.fileLines++
+}
+
+// list returns the events and the number of dropped events, and clears
+// the log if "clear" is set
+func (l *corruptionLog) list(clear bool) ([]ctlsock.CorruptionEvent, int) {
+	l.Lock()
+	defer l.Unlock()
+	events, dropped := l.events, l.dropped
+	if !clear {
+		return slices.Clone(events), dropped
+	}
+	l.events = nil
+	l.dropped = 0
+	if l.file != nil {
+		if err := l.file.Truncate(0); err != nil {
+			tlog.Warn.Printf("corruption log: %v", err)
+		}
+		l.fileLines = 0
+	}
+	return events, dropped
+}
+
+// close closes the on-disk log
+func (l *corruptionLog) close() {
+	l.Lock()
+	defer l.Unlock()
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+// logCorruption records a corruption in the corruption log. "relPath" is
+// the plaintext path. For names that cannot be decrypted, pass the path of
+// the parent directory and the ciphertext name as "item".
+func (rn *RootNode) logCorruption(relPath string, typ string, item string, off int64, err error) {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	ev := ctlsock.CorruptionEvent{
+		Time:   time.Now().Unix(),
+		Path:   relPath,
+		Type:   typ,
+		Item:   item,
+		Offset: off,
+	}
+	if typ == corruptName {
+		ev.Path = path.Join(relPath, item)
+	}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	rn.corruptions.add(ev)
+}
+
+// ListCorruptions implements ctlsocksrv.CorruptionLog
+func (rn *RootNode) ListCorruptions(clear bool) (events []ctlsock.CorruptionEvent, dropped int) {
+	events, dropped = rn.corruptions.list(clear)
+	if events == nil {
+		events = []ctlsock.CorruptionEvent{}
+	}
+	return events, dropped
+}
@@ -0,0 +1,68 @@
+package fusefrontend
+
+import (
+	"syscall"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+var _ ctlsocksrv.Controller = &RootNode{} // Verify that interface is implemented.
+
+// SetReadOnly implements ctlsocksrv.Controller. When switching to read-only,
+// it waits for the modifying operations that are still running, and then
+// flushes the open files so the backing files are consistent on disk.
+func (rn *RootNode) SetReadOnly(ro bool) error {
+	rn.modifyLock.Lock()
+	changed := rn.readOnly.Swap(ro) != ro
+	rn.modifyLock.Unlock()
+	if !changed {
+		return nil
+	}
+	if !ro {
+		tlog.Info.Printf("ctlsock: switched to read-write")
+		return nil
+	}
+	tlog.Info.Printf("ctlsock: switched to read-only")
+	return rn.Flush()
+}
+
+// Flush implements ctlsocksrv.Controller. It fsyncs all open files and
+// returns the first error.
+func (rn *RootNode) Flush() (err error) {
+	rn.openFiles.Range(func(key, _ any) bool {
+		f := key.(*File)
+		f.fdLock.RLock()
+		defer f.fdLock.RUnlock()
+		if f.released {
+			return true
+		}
+		if err2 := syscall.Fsync(f.intFd()); err2 != nil && err == nil {
+			tlog.Warn.Printf("ino%d: Flush: fsync failed: %v", f.qIno.Ino, err2)
+			err = err2
+		}
+		return true
+	})
+	return err
+}
+
+// beginModify returns EROFS if the filesystem has been switched to read-only
+// via the control socket. Otherwise, it returns 0, and the caller must call
+// endModify() when it is done. Call it at the top of every operation that
+// modifies the filesystem, so SetReadOnly() can wait for the operation to
+// finish. Operations must not call each other between beginModify() and
+// endModify(), as a waiting SetReadOnly() would deadlock them.
+func (rn *RootNode) beginModify() syscall.Errno {
+	rn.modifyLock.RLock()
+	if rn.readOnly.Load() {
+		rn.modifyLock.RUnlock()
+		return syscall.EROFS
+	}
+	return 0
+}
+
+// endModify marks the end of an operation that has been started with
+// beginModify().
+func (rn *RootNode) endModify() {
+	rn.modifyLock.RUnlock()
+}
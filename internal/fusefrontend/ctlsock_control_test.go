@@ -0,0 +1,39 @@
+package fusefrontend
+
+import (
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestSetReadOnlyWaits checks that SetReadOnly(true) only returns after the
+// modifying operations that are still running have finished.
+func TestSetReadOnlyWaits(t *testing.T) {
+	rn := newTestFS(Args{})
+	if errno := rn.beginModify(); errno != 0 {
+		t.Fatal(errno)
+	}
+	done := make(chan error)
+	go func() {
+		done <- rn.SetReadOnly(true)
+	}()
+	select {
+	case <-done:
+		t.Fatal("SetReadOnly returned while an operation was running")
+	case <-time.After(100 * time.Millisecond):
+	}
+	rn.endModify()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if errno := rn.beginModify(); errno != syscall.EROFS {
+		t.Fatalf("want EROFS, got %v", errno)
+	}
+	if err := rn.SetReadOnly(false); err != nil {
+		t.Fatal(err)
+	}
+	if errno := rn.beginModify(); errno != 0 {
+		t.Fatal(errno)
+	}
+	rn.endModify()
+}
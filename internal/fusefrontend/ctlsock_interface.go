@@ -3,16 +3,20 @@ package fusefrontend
 import (
 	"path"
 	"path/filepath"
+	"slices"
 	"strings"
 	"syscall"
 
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
 var _ ctlsocksrv.Interface = &RootNode{} // Verify that interface is implemented.
+var _ ctlsocksrv.StatusReporter = &RootNode{}
 
 // EncryptPath implements ctlsock.Backend
 //
@@ -110,3 +114,18 @@ func (rn *RootNode) DecryptPath(cipherPath string) (plainPath string, err error)
 	}
 	return plainPath, nil
 }
+
+// Status implements ctlsocksrv.StatusReporter
+func (rn *RootNode) Status() *ctlsock.StatusStruct {
+	s := rn.args.Status
+	s.FeatureFlags = slices.Clone(s.FeatureFlags)
+	s.OpenFiles = openfiletable.CountOpenFiles()
+	cs := rn.contentEnc.Stats()
+	s.BlocksEncrypted = cs.BlocksEncrypted
+	s.BytesEncrypted = cs.BytesEncrypted
+	s.BlocksDecrypted = cs.BlocksDecrypted
+	s.BytesDecrypted = cs.BytesDecrypted
+	s.DirCacheLookups, s.DirCacheHits = rn.dirCache.hitStats()
+	s.Idle = s.IdleTimeout > 0 && rn.IsIdle.Load() && s.OpenFiles == 0
+	return &s
+}
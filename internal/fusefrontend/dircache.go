@@ -59,7 +59,8 @@ type dirCache struct {
 	// On the first Lookup(), the expire thread is started, and this flag is set
 	// to true.
 	expireThreadRunning bool
-	// Hit rate stats. Evaluated and reset by the expire thread.
+	// Hit rate stats. Printed and reset by stats() if enableStats is set,
+	// reported by hitStats() otherwise.
 	lookups uint64
 	hits    uint64
 }
@@ -111,9 +112,7 @@ func (d *dirCache) Store(node *Node, fd int, iv []byte) {
 func (d *dirCache) Lookup(node *Node) (fd int, iv []byte) {
 	d.Lock()
 	defer d.Unlock()
-	if enableStats {
-		d.lookups++
-	}
+	d.lookups++
 	var e *dirCacheEntry
 	for i := range d.entries {
 		e = &d.entries[i]
@@ -138,9 +137,7 @@ func (d *dirCache) Lookup(node *Node) (fd int, iv []byte) {
 		d.dbg("dirCache.Lookup %p miss\n", node)
 		return -1, nil
 	}
-	if enableStats {
-		d.hits++
-	}
+	d.hits++
 	if fd <= 0 || len(iv) != d.ivLen {
 		log.Panicf("Lookup sanity check failed: fd=%d len=%d", fd, len(iv))
 	}
@@ -174,6 +171,25 @@ func (d *dirCache) stats() {
 	}
 }
 
+// hitStats returns the number of lookups and hits
+func (d *dirCache) hitStats() (lookups uint64, hits uint64) {
+	d.Lock()
+	defer d.Unlock()
+	return d.lookups, d.hits
+}
+
+// len returns the number of cached directories
+func (d *dirCache) len() (n int) {
+	d.Lock()
+	defer d.Unlock()
+	for i := range d.entries {
+		if d.entries[i].fd > 0 {
+			n++
+		}
+	}
+	return n
+}
+
 // dbg prints a debug message. Usually disabled.
 func (d *dirCache) dbg(format string, a ...interface{}) {
 	if enableDebugMessages {
@@ -50,6 +50,9 @@ type File struct {
 	rootNode *RootNode
 	// If this open file is a directory, dirHandle will be set, otherwise it's nil.
 	dirHandle *DirHandle
+	// node is the Node this file has been opened on. Used to report the
+	// plaintext path of corruptions.
+	node *Node
 }
 
 // NewFile returns a new go-fuse File instance based on an already-open file
@@ -75,9 +78,18 @@ func NewFile(fd int, cName string, rn *RootNode) (f *File, st *syscall.Stat_t, e
 		fileTableEntry: e,
 		rootNode:       rn,
 	}
+	rn.openFiles.Store(f, nil)
 	return f, st, 0
 }
 
+// path returns the relative plaintext path of the file, or "" if unknown
+func (f *File) path() string {
+	if f.node == nil {
+		return ""
+	}
+	return f.node.Path()
+}
+
 // intFd - return the backing file descriptor as an integer.
 func (f *File) intFd() int {
 	return int(f.fd.Fd())
@@ -96,7 +108,8 @@ func (f *File) readFileID() ([]byte, error) {
 		if err == io.EOF && n != 0 {
 			tlog.Warn.Printf("readFileID %d: incomplete file, got %d instead of %d bytes",
 				f.qIno.Ino, n, readLen)
-			f.rootNode.reportMitigatedCorruption(fmt.Sprint(f.qIno.Ino))
+			f.rootNode.reportMitigatedCorruption(f.path(), corruptHeader, fmt.Sprint(f.qIno.Ino),
+				fmt.Errorf("incomplete file header: %d bytes", n))
 		}
 		return nil, err
 	}
@@ -164,6 +177,7 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 			hexdump := hex.EncodeToString(buf)
 			tlog.Warn.Printf("doRead %d: corrupt header: %v\nFile hexdump (%d bytes): %s",
 				f.qIno.Ino, err, n, hexdump)
+			f.rootNode.logCorruption(f.path(), corruptHeader, "", 0, err)
 			return nil, syscall.EIO
 		}
 		// Save into the file table
@@ -208,6 +222,8 @@ func (f *File) doRead(dst []byte, off uint64, length uint64) ([]byte, syscall.Er
 	if err != nil {
 		corruptBlockNo := firstBlockNo + f.rootNode.contentEnc.PlainOffToBlockNo(uint64(len(plaintext)))
 		tlog.Warn.Printf("doRead %d: corrupt block #%d: %v", f.qIno.Ino, corruptBlockNo, err)
+		f.rootNode.logCorruption(f.path(), corruptBlock, "",
+			int64(corruptBlockNo*f.rootNode.contentEnc.PlainBS()), err)
 		return nil, syscall.EIO
 	}
 
@@ -275,6 +291,7 @@ func (f *File) doWrite(data []byte, off int64) (uint32, syscall.Errno) {
 		} else if err != nil {
 			// Other errors mean readFileID() found a corrupt header
 			tlog.Warn.Printf("doWrite %d: corrupt header: %v", f.qIno.Ino, err)
+			f.rootNode.logCorruption(f.path(), corruptHeader, "", 0, err)
 			return 0, syscall.EIO
 		}
 		if err != nil {
@@ -358,6 +375,10 @@ func (f *File) isConsecutiveWrite(off int64) bool {
 //
 // If the write creates a hole, pads the file to the next block boundary.
 func (f *File) Write(ctx context.Context, data []byte, off int64) (uint32, syscall.Errno) {
+	if errno := f.rootNode.beginModify(); errno != 0 {
+		return 0, errno
+	}
+	defer f.rootNode.endModify()
 	if len(data) > fuse.MAX_KERNEL_WRITE {
 		// This would crash us due to our fixed-size buffer pool
 		tlog.Warn.Printf("Write: rejecting oversized request with EMSGSIZE, len=%d", len(data))
@@ -398,6 +419,7 @@ func (f *File) Release(ctx context.Context) syscall.Errno {
 	}
 	f.released = true
 	openfiletable.Unregister(f.qIno)
+	f.rootNode.openFiles.Delete(f)
 	err := f.fd.Close()
 	f.fdLock.Unlock()
 	return fs.ToErrno(err)
@@ -37,7 +37,13 @@ var allocateWarnOnce sync.Once
 // complicated and hard to get right.
 //
 // Other modes (hole punching, zeroing) are not supported.
-func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) syscall.Errno {
+func (f *File) Allocate(ctx context.Context, off uint64, sz uint64, mode uint32) (errno syscall.Errno) {
+	ar := f.rootNode.auditRecord(ctx, "fallocate", f.path)
+	defer f.rootNode.auditDone(ar, &errno)
+	if errno := f.rootNode.beginModify(); errno != 0 {
+		return errno
+	}
+	defer f.rootNode.endModify()
 	if mode != FALLOC_DEFAULT && mode != FALLOC_FL_KEEP_SIZE {
 		f := func() {
 			tlog.Info.Printf("fallocate: only mode 0 (default) and 1 (keep size) are supported")
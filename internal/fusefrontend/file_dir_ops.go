@@ -61,6 +61,7 @@ func (n *Node) OpendirHandle(ctx context.Context, flags uint32) (fh fs.FileHandl
 		goto err_out
 	}
 
+	file.node = n
 	file.dirHandle = &DirHandle{
 		ds:        ds,
 		dirIV:     dirIV,
@@ -154,7 +155,7 @@ func (f *File) Readdirent(ctx context.Context) (entry *fuse.DirEntry, errno sysc
 			if err != nil {
 				tlog.Warn.Printf("Readdirent: incomplete entry %q: Could not read .name: %v",
 					cName, err)
-				f.rootNode.reportMitigatedCorruption(cName)
+				f.rootNode.reportMitigatedCorruption(f.path(), corruptName, cName, err)
 				continue
 			}
 			cName = cNameLong
@@ -166,7 +167,7 @@ func (f *File) Readdirent(ctx context.Context) (entry *fuse.DirEntry, errno sysc
 		if err != nil {
 			tlog.Warn.Printf("Readdirent: could not decrypt entry %q: %v",
 				cName, err)
-			f.rootNode.reportMitigatedCorruption(cName)
+			f.rootNode.reportMitigatedCorruption(f.path(), corruptName, cName, err)
 			continue
 		}
 		// Override the ciphertext name with the plaintext name but reuse the rest
@@ -0,0 +1,38 @@
+package fusefrontend
+
+import (
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+)
+
+var _ metrics.Source = &RootNode{} // Verify that interface is implemented.
+
+// WriteMetrics implements metrics.Source
+func (rn *RootNode) WriteMetrics(w *metrics.Writer) {
+	WriteContentStats(w, rn.contentEnc.Stats())
+	lookups, hits := rn.dirCache.hitStats()
+	w.Counter("dircache_lookups_total", "Directory cache lookups since mount.", lookups)
+	w.Counter("dircache_hits_total", "Directory cache hits since mount.", hits)
+	w.Gauge("dircache_entries", "Directories in the directory cache.", int64(rn.dirCache.len()))
+	namespaces, spilled := rn.inoMap.Len()
+	w.Gauge("inomap_namespaces", "Device namespaces in the inode number map.", int64(namespaces))
+	w.Gauge("inomap_spilled", "Inode numbers in the spill map of the inode number map.", int64(spilled))
+	var handles int64
+	rn.openFiles.Range(func(k, v any) bool {
+		handles++
+		return true
+	})
+	w.Gauge("open_file_handles", "Open file handles.", handles)
+	w.Gauge("open_files", "Files that have at least one open handle.", int64(openfiletable.CountOpenFiles()))
+}
+
+// WriteContentStats writes the content encryption counters to "w". Also used
+// by the reverse frontend.
+func WriteContentStats(w *metrics.Writer, s contentenc.Stats) {
+	w.Counter("blocks_encrypted_total", "Blocks encrypted since mount.", s.BlocksEncrypted)
+	w.Counter("encrypted_bytes_total", "Plaintext bytes encrypted since mount.", s.BytesEncrypted)
+	w.Counter("blocks_decrypted_total", "Blocks decrypted since mount.", s.BlocksDecrypted)
+	w.Counter("decrypted_bytes_total", "Plaintext bytes decrypted since mount.", s.BytesDecrypted)
+	w.Counter("auth_failures_total", "Blocks that failed authentication on decryption.", s.AuthFailures)
+}
@@ -140,6 +140,12 @@ func (n *Node) Access(ctx context.Context, mode uint32) syscall.Errno {
 //
 // Symlink-safe through use of Unlinkat().
 func (n *Node) Unlink(ctx context.Context, name string) (errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "unlink", n.childPath(name))
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno = n.rootNode().beginModify(); errno != 0 {
+		return
+	}
+	defer n.rootNode().endModify()
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -176,6 +182,15 @@ func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
 
 // Setattr - FUSE call. Called for chmod, truncate, utimens, ...
 func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn, out *fuse.AttrOut) (errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "setattr", n.Path)
+	if ar != nil {
+		ar.Detail = changedAttrs(in)
+	}
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno = n.rootNode().beginModify(); errno != 0 {
+		return
+	}
+	defer n.rootNode().endModify()
 	// Use the fd if the kernel gave us one
 	if f != nil {
 		f2 := f.(*File)
@@ -240,11 +255,11 @@ func (n *Node) Setattr(ctx context.Context, f fs.FileHandle, in *fuse.SetAttrIn,
 	// For truncate, the user has to have write permissions. That means we can
 	// depend on opening a RDWR fd and letting the File handle truncate.
 	if sz, ok := in.GetSize(); ok {
-		f, _, errno := n.Open(ctx, syscall.O_RDWR)
+		// Not Open(), we are already between beginModify() and endModify()
+		f2, _, errno := n.open(syscall.O_RDWR)
 		if errno != 0 {
 			return errno
 		}
-		f2 := f.(*File)
 		defer f2.Release(ctx)
 		errno = syscall.Errno(f2.truncate(sz))
 		if errno != 0 {
@@ -274,6 +289,12 @@ func (n *Node) Statfs(ctx context.Context, out *fuse.StatfsOut) syscall.Errno {
 //
 // Symlink-safe through use of Mknodat().
 func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "mknod", n.childPath(name))
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno = n.rootNode().beginModify(); errno != 0 {
+		return
+	}
+	defer n.rootNode().endModify()
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -329,6 +350,15 @@ func (n *Node) Mknod(ctx context.Context, name string, mode, rdev uint32, out *f
 //
 // Symlink-safe through use of Linkat().
 func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "link", toNode(target).Path)
+	if ar != nil {
+		ar.NewPath = n.childPath(name)()
+	}
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno = n.rootNode().beginModify(); errno != 0 {
+		return
+	}
+	defer n.rootNode().endModify()
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -379,6 +409,12 @@ func (n *Node) Link(ctx context.Context, target fs.InodeEmbedder, name string, o
 //
 // Symlink-safe through use of Symlinkat.
 func (n *Node) Symlink(ctx context.Context, target, name string, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "symlink", n.childPath(name))
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno = n.rootNode().beginModify(); errno != 0 {
+		return
+	}
+	defer n.rootNode().endModify()
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -447,6 +483,15 @@ func rejectRenameFlags(flags uint32) syscall.Errno {
 //
 // Symlink-safe through Renameat().
 func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedder, newName string, flags uint32) (errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "rename", n.childPath(name))
+	if ar != nil {
+		ar.NewPath = toNode(newParent).childPath(newName)()
+	}
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno = n.rootNode().beginModify(); errno != 0 {
+		return errno
+	}
+	defer n.rootNode().endModify()
 	if errno = rejectRenameFlags(flags); errno != 0 {
 		return errno
 	}
@@ -493,7 +538,7 @@ func (n *Node) Rename(ctx context.Context, name string, newParent fs.InodeEmbedd
 		// We handle that by trying to fs.Rmdir() the target directory and trying
 		// again.
 		tlog.Debug.Printf("Rename: Handling ENOTEMPTY")
-		if n2.Rmdir(ctx, newName) == 0 {
+		if n2.rmdir(newName) == 0 {
 			err = syscallcompat.Renameat2(dirfd, cName, dirfd2, cName2, uint(flags))
 		}
 	}
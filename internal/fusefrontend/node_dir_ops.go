@@ -69,7 +69,13 @@ func (n *Node) mkdirWithIv(dirfd int, cName string, mode uint32, context *fuse.C
 // Mkdir - FUSE call. Create a directory at "newPath" with permissions "mode".
 //
 // Symlink-safe through use of Mkdirat().
-func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (*fs.Inode, syscall.Errno) {
+func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "mkdir", n.childPath(name))
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno := n.rootNode().beginModify(); errno != 0 {
+		return nil, errno
+	}
+	defer n.rootNode().endModify()
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return nil, errno
@@ -161,6 +167,18 @@ func (n *Node) Mkdir(ctx context.Context, name string, mode uint32, out *fuse.En
 //
 // Symlink-safe through Unlinkat() + AT_REMOVEDIR.
 func (n *Node) Rmdir(ctx context.Context, name string) (code syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "rmdir", n.childPath(name))
+	defer n.rootNode().auditDone(ar, &code)
+	if code = n.rootNode().beginModify(); code != 0 {
+		return
+	}
+	defer n.rootNode().endModify()
+	return n.rmdir(name)
+}
+
+// rmdir removes the directory "name". Unlike Rmdir(), it does not check for
+// read-only mode.
+func (n *Node) rmdir(name string) (code syscall.Errno) {
 	rn := n.rootNode()
 	parentDirFd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
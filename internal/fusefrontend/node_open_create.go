@@ -41,6 +41,27 @@ func mangleOpenCreateFlags(flags uint32) (newFlags int) {
 //
 // Symlink-safe through Openat().
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "open", n.Path)
+	if ar != nil {
+		ar.Detail = accessMode(flags)
+	}
+	defer n.rootNode().auditDone(ar, &errno)
+	if flags&syscall.O_ACCMODE != syscall.O_RDONLY || flags&syscall.O_TRUNC != 0 {
+		if errno = n.rootNode().beginModify(); errno != 0 {
+			return
+		}
+		defer n.rootNode().endModify()
+	}
+	f, fuseFlags, errno := n.open(flags)
+	if errno != 0 {
+		return
+	}
+	return f, fuseFlags, 0
+}
+
+// open opens the backing file of "n" and returns it as a *File. Unlike
+// Open(), it does not check for read-only mode.
+func (n *Node) open(flags uint32) (f *File, fuseFlags uint32, errno syscall.Errno) {
 	dirfd, cName, errno := n.prepareAtSyscallMyself()
 	if errno != 0 {
 		return
@@ -75,14 +96,27 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		errno = fs.ToErrno(err)
 		return
 	}
-	fh, _, errno = NewFile(fd, cName, rn)
-	return fh, fuseFlags, errno
+	f, _, errno = NewFile(fd, cName, rn)
+	if errno != 0 {
+		return
+	}
+	f.node = n
+	return f, fuseFlags, 0
 }
 
 // Create - FUSE call. Creates a new file.
 //
 // Symlink-safe through the use of Openat().
 func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint32, out *fuse.EntryOut) (inode *fs.Inode, fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "create", n.childPath(name))
+	if ar != nil {
+		ar.Detail = accessMode(flags)
+	}
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno = n.rootNode().beginModify(); errno != 0 {
+		return
+	}
+	defer n.rootNode().endModify()
 	dirfd, cName, errno := n.prepareAtSyscall(name)
 	if errno != 0 {
 		return
@@ -124,16 +158,17 @@ func (n *Node) Create(ctx context.Context, name string, flags uint32, mode uint3
 		return nil, nil, 0, fs.ToErrno(err)
 	}
 
-	fh, st, errno := NewFile(fd, cName, rn)
+	f, st, errno := NewFile(fd, cName, rn)
 	if errno != 0 {
 		return
 	}
 
 	inode = n.newChild(ctx, st, out)
+	f.node = toNode(inode.Operations())
 
 	if rn.args.ForceOwner != nil {
 		out.Owner = *rn.args.ForceOwner
 	}
 
-	return inode, fh, fuseFlags, errno
+	return inode, f, fuseFlags, errno
 }
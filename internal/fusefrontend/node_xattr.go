@@ -4,6 +4,7 @@ package fusefrontend
 import (
 	"bytes"
 	"context"
+	"errors"
 	"strings"
 	"syscall"
 
@@ -79,7 +80,16 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 // SetXAttr - FUSE call. Set extended attribute.
 //
 // This function is symlink-safe through Fsetxattr.
-func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) syscall.Errno {
+func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uint32) (errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "setxattr", n.Path)
+	if ar != nil {
+		ar.Detail = attr
+	}
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno := n.rootNode().beginModify(); errno != 0 {
+		return errno
+	}
+	defer n.rootNode().endModify()
 	rn := n.rootNode()
 	// If -noxattr is enabled, fail all setxattr calls
 	if rn.args.NoXattr {
@@ -108,7 +118,16 @@ func (n *Node) Setxattr(ctx context.Context, attr string, data []byte, flags uin
 // RemoveXAttr - FUSE call.
 //
 // This function is symlink-safe through Fremovexattr.
-func (n *Node) Removexattr(ctx context.Context, attr string) syscall.Errno {
+func (n *Node) Removexattr(ctx context.Context, attr string) (errno syscall.Errno) {
+	ar := n.rootNode().auditRecord(ctx, "removexattr", n.Path)
+	if ar != nil {
+		ar.Detail = attr
+	}
+	defer n.rootNode().auditDone(ar, &errno)
+	if errno := n.rootNode().beginModify(); errno != 0 {
+		return errno
+	}
+	defer n.rootNode().endModify()
 	rn := n.rootNode()
 	// If -noxattr is enabled, fail all removexattr calls
 	if rn.args.NoXattr {
@@ -153,13 +172,13 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 		name, err := rn.decryptXattrName(curName)
 		if err != nil {
 			tlog.Warn.Printf("ListXAttr: invalid xattr name %q: %v", curName, err)
-			rn.reportMitigatedCorruption(curName)
+			rn.reportMitigatedCorruption(n.Path(), corruptXattr, curName, err)
 			continue
 		}
 		// We *used to* encrypt ACLs, which caused a lot of problems.
 		if isAcl(name) {
 			tlog.Warn.Printf("ListXAttr: ignoring deprecated encrypted ACL %q = %q", curName, name)
-			rn.reportMitigatedCorruption(curName)
+			rn.reportMitigatedCorruption(n.Path(), corruptXattr, curName, errors.New("deprecated encrypted ACL"))
 			continue
 		}
 		buf.WriteString(name + "\000")
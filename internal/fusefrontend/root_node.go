@@ -39,7 +39,7 @@ type RootNode struct {
 	// reportMitigatedCorruption().
 	// "gocryptfs -fsck" reads from the channel to also catch these transparently-
 	// mitigated corruptions.
-	MitigatedCorruptions chan string
+	MitigatedCorruptions chan MitigatedCorruption
 	// IsIdle flag is set to zero each time fs.isFiltered() is called
 	// (uint32 so that it can be reset with CompareAndSwapUint32).
 	// When -idle was used when mounting, idleMonitor() sets it to 1
@@ -61,6 +61,19 @@ type RootNode struct {
 	quirks uint64
 	// rootIno is the inode number that we report for the root node on mount
 	rootIno uint64
+	// scrubber is set if Args.Scrub is set
+	scrubber *scrubber
+	// corruptions keeps the corruptions we have found, see logCorruption()
+	corruptions corruptionLog
+	// readOnly is set by the ctlsock "ReadOnly" request. Operations that
+	// modify the filesystem fail with EROFS while it is set.
+	readOnly atomic.Bool
+	// modifyLock is held for reading by the operations that modify the
+	// filesystem, and for writing when readOnly is changed. See beginModify().
+	modifyLock sync.RWMutex
+	// openFiles contains all *File that have not been released yet, so the
+	// ctlsock "Flush" request can fsync them. The values are unused.
+	openFiles sync.Map
 }
 
 func NewRootNode(args Args, c *contentenc.ContentEnc, n *nametransform.NameTransform) *RootNode {
@@ -100,25 +113,44 @@ func NewRootNode(args Args, c *contentenc.ContentEnc, n *nametransform.NameTrans
 		rn.inoMap.TranslateStat(&st)
 		rn.rootIno = st.Ino
 	}
+	if args.CorruptionLog != "" {
+		rn.corruptions.open(args.CorruptionLog)
+	}
+	if args.Scrub != nil {
+		rn.scrubber = newScrubber(rn, *args.Scrub)
+	}
 	return rn
 }
 
 // main.doMount() calls this after unmount
 func (rn *RootNode) AfterUnmount() {
+	rn.stopScrubber()
+	rn.corruptions.close()
 	// print stats before we exit
 	rn.dirCache.stats()
 }
 
+// MitigatedCorruption is a corruption reported through the
+// MitigatedCorruptions channel
+type MitigatedCorruption struct {
+	// Path is the plaintext path of the file or directory, if known
+	Path string
+	// Item is the name of the corrupt item
+	Item string
+}
+
 // reportMitigatedCorruption is used to report a corruption that was transparently
 // mitigated and did not return an error to the user. Pass the name of the corrupt
 // item (filename for OpenDir(), xattr name for ListXAttr() etc).
 // See the MitigatedCorruptions channel for more info.
-func (rn *RootNode) reportMitigatedCorruption(item string) {
+// The corruption is also recorded in the corruption log, see logCorruption().
+func (rn *RootNode) reportMitigatedCorruption(relPath string, typ string, item string, err error) {
+	rn.logCorruption(relPath, typ, item, 0, err)
 	if rn.MitigatedCorruptions == nil {
 		return
 	}
 	select {
-	case rn.MitigatedCorruptions <- item:
+	case rn.MitigatedCorruptions <- MitigatedCorruption{Path: relPath, Item: item}:
 	case <-time.After(1 * time.Second):
 		tlog.Warn.Printf("BUG: reportCorruptItem: timeout")
 		//debug.PrintStack()
@@ -0,0 +1,519 @@
+package fusefrontend
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/offline"
+	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+var _ ctlsocksrv.Scrubber = &RootNode{} // Verify that interface is implemented.
+
+// ScrubArgs configures the background scrubber, enabled via cli flag "-scrub"
+type ScrubArgs struct {
+	// BwLimit is the maximum read rate in bytes per second
+	BwLimit float64
+	// Interval is the time from the start of one pass to the start of the
+	// next one
+	Interval time.Duration
+	// StateFile stores the progress across mounts. Empty disables this.
+	StateFile string
+}
+
+const (
+	// Blocks read under one ContentLock
+	scrubBatchBlocks = 32
+	// How often the state file is written during a pass
+	scrubSaveInterval = 30 * time.Second
+	// Number of findings kept for ScrubStatus
+	scrubMaxFindings = 100
+)
+
+// scrubState is the content of ScrubArgs.StateFile
+type scrubState struct {
+	Cipherdir   string
+	Pass        int
+	PassStart   time.Time
+	LastPassEnd time.Time
+	// InProgress is set while a pass is running
+	InProgress bool
+	// Pos is the ciphertext path of the file that is being scrubbed, and
+	// Off the plaintext offset in it. The next mount resumes there.
+	Pos   string
+	Off   int64
+	Files int64
+	Bytes int64
+}
+
+// scrubber slowly walks the cipherdir and checks that every name can be
+// decrypted and every block passes authentication.
+type scrubber struct {
+	args ScrubArgs
+	rn   *RootNode
+	fs   *offline.FS
+	// started is set by StartScrubber()
+	started bool
+	// stop is closed on unmount, done when run() has returned
+	stop chan struct{}
+	done chan struct{}
+	// resume is the ciphertext path to skip forward to after a restart
+	resume   string
+	lastSave time.Time
+	// mu protects the fields below
+	mu            sync.Mutex
+	st            scrubState
+	plainPos      string
+	findings      []ctlsock.ScrubFinding
+	findingsTotal int
+}
+
+// newScrubber returns a scrubber for "rn" that has not been started yet
+func newScrubber(rn *RootNode, a ScrubArgs) *scrubber {
+	s := &scrubber{
+		args: a,
+		rn:   rn,
+		fs: offline.New(offline.Args{
+			Cipherdir:          rn.args.Cipherdir,
+			PlaintextNames:     rn.args.PlaintextNames,
+			DeterministicNames: rn.args.DeterministicNames,
+			LongNames:          rn.args.LongNames,
+			ConfigCustom:       rn.args.ConfigCustom,
+		}, rn.contentEnc, rn.nameTransform),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	s.load()
+	return s
+}
+
+// StartScrubber starts scrubbing in the background, if enabled in
+// Args.Scrub. It keeps running until AfterUnmount().
+func (rn *RootNode) StartScrubber() {
+	if rn.scrubber == nil || rn.scrubber.started {
+		return
+	}
+	rn.scrubber.started = true
+	go rn.scrubber.run()
+}
+
+// stopScrubber stops the scrubber and waits until the state has been saved
+func (rn *RootNode) stopScrubber() {
+	if rn.scrubber == nil || !rn.scrubber.started {
+		return
+	}
+	close(rn.scrubber.stop)
+	<-rn.scrubber.done
+}
+
+// ScrubStatus implements ctlsocksrv.Scrubber
+func (rn *RootNode) ScrubStatus() (*ctlsock.ScrubStatus, error) {
+	s := rn.scrubber
+	if s == nil {
+		return nil, fmt.Errorf("scrubbing is not enabled (-scrub): %w", syscall.ENOTSUP)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status := &ctlsock.ScrubStatus{
+		Pass:          s.st.Pass,
+		Running:       s.st.InProgress,
+		Position:      s.plainPos,
+		PassStart:     unixOrZero(s.st.PassStart),
+		LastPassEnd:   unixOrZero(s.st.LastPassEnd),
+		Files:         s.st.Files,
+		Bytes:         s.st.Bytes,
+		FindingsTotal: s.findingsTotal,
+		Findings:      slices.Clone(s.findings),
+	}
+	if status.Findings == nil {
+		status.Findings = []ctlsock.ScrubFinding{}
+	}
+	return status, nil
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+// load reads the state file. A missing file, or one that belongs to a
+// different cipherdir, means that we start from scratch.
+func (s *scrubber) load() {
+	if s.args.StateFile == "" {
+		return
+	}
+	js, err := os.ReadFile(s.args.StateFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			tlog.Warn.Printf("scrub: %v", err)
+		}
+		return
+	}
+	var st scrubState
+	if err := json.Unmarshal(js, &st); err != nil {
+		tlog.Warn.Printf("scrub: invalid state file %q: %v", s.args.StateFile, err)
+		return
+	}
+	if st.Cipherdir != s.rn.args.Cipherdir {
+		tlog.Info.Printf("scrub: state file %q belongs to %q, ignoring it", s.args.StateFile, st.Cipherdir)
+		return
+	}
+	s.st = st
+}
+
+// save writes the state file
+func (s *scrubber) save() {
+	s.lastSave = time.Now()
+	if s.args.StateFile == "" {
+		return
+	}
+	s.mu.Lock()
+	s.st.Cipherdir = s.rn.args.Cipherdir
+	js, err := json.MarshalIndent(s.st, "", "\t")
+	s.mu.Unlock()
+	if err != nil {
+		tlog.Warn.Printf("scrub: %v", err)
+		return
+	}
+	if err = os.MkdirAll(filepath.Dir(s.args.StateFile), 0700); err != nil {
+		tlog.Warn.Printf("scrub: %v", err)
+		return
+	}
+	// Write to a temporary file and rename, so that a crash cannot leave a
+	// truncated state file behind
+	tmp := s.args.StateFile + ".tmp"
+	if err = os.WriteFile(tmp, append(js, '\n'), 0600); err == nil {
+		err = os.Rename(tmp, s.args.StateFile)
+	}
+	if err != nil {
+		tlog.Warn.Printf("scrub: %v", err)
+	}
+}
+
+// stopped returns true once the scrubber has been asked to stop
+func (s *scrubber) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for "d". It returns false if the scrubber has been stopped
+// in the meantime.
+func (s *scrubber) sleep(d time.Duration) bool {
+	if d <= 0 {
+		return !s.stopped()
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-s.stop:
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// throttle sleeps as long as reading "n" bytes takes at ScrubArgs.BwLimit
+func (s *scrubber) throttle(n int) bool {
+	if s.args.BwLimit <= 0 {
+		return !s.stopped()
+	}
+	return s.sleep(time.Duration(float64(n) / s.args.BwLimit * float64(time.Second)))
+}
+
+// run is the scrubber main loop
+func (s *scrubber) run() {
+	defer close(s.done)
+	// The thread is not unlocked, so it exits together with this goroutine
+	// and the lowered priority does not leak to other goroutines.
+	runtime.LockOSThread()
+	if err := syscallcompat.SetIdlePriority(); err != nil {
+		tlog.Info.Printf("scrub: could not lower priority: %v", err)
+	}
+	for {
+		s.mu.Lock()
+		inProgress := s.st.InProgress
+		next := s.st.PassStart.Add(s.args.Interval)
+		s.mu.Unlock()
+		if !inProgress {
+			tlog.Debug.Printf("scrub: next pass at %v", next)
+			if !s.sleep(time.Until(next)) {
+				return
+			}
+			s.mu.Lock()
+			s.st.Pass++
+			s.st.PassStart = time.Now()
+			s.st.InProgress = true
+			s.st.Pos = ""
+			s.st.Off = 0
+			s.st.Files = 0
+			s.st.Bytes = 0
+			s.mu.Unlock()
+			s.save()
+		}
+		s.resume = s.st.Pos
+		if s.resume != "" {
+			tlog.Info.Printf("scrub: resuming pass %d", s.st.Pass)
+		} else {
+			tlog.Info.Printf("scrub: starting pass %d", s.st.Pass)
+		}
+		s.dir("", "")
+		if s.stopped() {
+			s.save()
+			return
+		}
+		s.mu.Lock()
+		s.st.InProgress = false
+		s.st.LastPassEnd = time.Now()
+		s.st.Pos = ""
+		s.st.Off = 0
+		s.plainPos = ""
+		total := s.findingsTotal
+		s.mu.Unlock()
+		s.save()
+		tlog.Info.Printf("scrub: pass %d done: %d files, %d bytes, %d corruptions found since mount",
+			s.st.Pass, s.st.Files, s.st.Bytes, total)
+	}
+}
+
+// report logs a corruption, keeps it for ScrubStatus and adds it to the
+// corruption log
+func (s *scrubber) report(relPath string, cPath string, typ string, off int64, err error) {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	if typ == corruptBlock {
+		tlog.Warn.Printf("scrub: corrupt block at offset %d in file %q (%q): %v", off, relPath, cPath, err)
+	} else {
+		tlog.Warn.Printf("scrub: corrupt %s %q (%q): %v", typ, relPath, cPath, err)
+	}
+	if typ == corruptName {
+		s.rn.logCorruption(filepath.Dir(relPath), typ, filepath.Base(cPath), off, err)
+	} else {
+		s.rn.logCorruption(relPath, typ, "", off, err)
+	}
+	f := ctlsock.ScrubFinding{
+		Time:       time.Now().Unix(),
+		Path:       relPath,
+		CipherPath: cPath,
+		Type:       typ,
+		Offset:     off,
+		Error:      err.Error(),
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.findingsTotal++
+	s.findings = append(s.findings, f)
+	if len(s.findings) > scrubMaxFindings {
+		s.findings = slices.Delete(s.findings, 0, len(s.findings)-scrubMaxFindings)
+	}
+}
+
+// setPos records the current position
+func (s *scrubber) setPos(relPath string, cPath string, off int64) {
+	s.mu.Lock()
+	s.plainPos = relPath
+	s.st.Pos = cPath
+	s.st.Off = off
+	s.mu.Unlock()
+	if time.Since(s.lastSave) >= scrubSaveInterval {
+		s.save()
+	}
+}
+
+// pathBefore returns true if the ciphertext path "a" comes before "b" in
+// walk order, and is not a parent directory of "b".
+func pathBefore(a string, b string) bool {
+	if strings.HasPrefix(b, a+"/") {
+		return false
+	}
+	return slices.Compare(strings.Split(a, "/"), strings.Split(b, "/")) < 0
+}
+
+// checkDir runs offline.CheckDir on "cDir". Problems are checked a second
+// time, after a moment, so that we do not report a directory that is
+// being modified through the mount.
+func (s *scrubber) checkDir(cDir string) (*offline.DirCheck, error) {
+	check := func() (*offline.DirCheck, error) {
+		s.rn.dirIVLock.RLock()
+		defer s.rn.dirIVLock.RUnlock()
+		return s.fs.CheckDir(cDir)
+	}
+	c, err := check()
+	if err == nil && c.DirIVErr == nil && len(c.Bad) == 0 {
+		return c, nil
+	}
+	if !s.sleep(time.Second) {
+		return nil, err
+	}
+	return check()
+}
+
+// dir scrubs the ciphertext directory "cDir", whose plaintext path is
+// "relPath", recursively
+func (s *scrubber) dir(relPath string, cDir string) {
+	c, err := s.checkDir(cDir)
+	if err != nil {
+		// Deleted through the mount in the meantime
+		if !errors.Is(err, syscall.ENOENT) && !s.stopped() {
+			s.report(relPath, cDir, corruptDir, 0, err)
+		}
+		return
+	}
+	if c.DirIVErr != nil {
+		s.report(relPath, cDir, corruptDirIV, 0, c.DirIVErr)
+	} else {
+		for _, b := range c.Bad {
+			s.report(filepath.Join(relPath, b.CName), filepath.Join(cDir, b.CName), corruptName, 0, b.Err)
+		}
+	}
+	// Walk in a fixed order so that we can resume
+	sort.Slice(c.Entries, func(i, j int) bool {
+		return c.Entries[i].CName < c.Entries[j].CName
+	})
+	for _, e := range c.Entries {
+		if s.stopped() {
+			return
+		}
+		cPath := filepath.Join(cDir, e.CName)
+		if s.resume != "" && pathBefore(cPath, s.resume) {
+			continue
+		}
+		plainPath := filepath.Join(relPath, e.Name)
+		var st syscall.Stat_t
+		if err := syscall.Lstat(filepath.Join(s.rn.args.Cipherdir, cPath), &st); err != nil {
+			continue
+		}
+		switch st.Mode & syscall.S_IFMT {
+		case syscall.S_IFDIR:
+			s.setPos(plainPath, cPath, 0)
+			s.dir(plainPath, cPath)
+		case syscall.S_IFREG:
+			var off int64
+			if cPath == s.resume {
+				off = s.st.Off
+			}
+			s.resume = ""
+			s.file(plainPath, cPath, off)
+		case syscall.S_IFLNK:
+			s.resume = ""
+			if _, err := s.fs.Readlink(cPath); err != nil && !errors.Is(err, syscall.ENOENT) {
+				s.report(plainPath, cPath, corruptSymlink, 0, err)
+			}
+		}
+	}
+}
+
+// file scrubs the ciphertext file "cPath", starting at the plaintext
+// offset "off"
+func (s *scrubber) file(relPath string, cPath string, off int64) {
+	fd, err := syscallcompat.Open(filepath.Join(s.rn.args.Cipherdir, cPath), syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		// Deleted in the meantime, or not readable (write-only files)
+		tlog.Debug.Printf("scrub: %q: %v", relPath, err)
+		return
+	}
+	f := os.NewFile(uintptr(fd), cPath)
+	defer f.Close()
+	var st syscall.Stat_t
+	if err := syscall.Fstat(fd, &st); err != nil || st.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		return
+	}
+	qi := inomap.QInoFromStat(&st)
+	ce := s.rn.contentEnc
+	cBS := int(ce.CipherBS())
+	pBS := int64(ce.PlainBS())
+	buf := make([]byte, scrubBatchBlocks*cBS)
+	header := make([]byte, contentenc.HeaderLen)
+	blockNo := uint64(off / pBS)
+	for {
+		if s.stopped() {
+			return
+		}
+		s.setPos(relPath, cPath, int64(blockNo)*pBS)
+		// Hold the content lock while reading, like File.Read does, so that
+		// we never see a half-written block or a header that is being
+		// replaced.
+		e := openfiletable.Register(qi)
+		e.ContentLock.RLock()
+		hn, herr := f.ReadAt(header, 0)
+		n, err := f.ReadAt(buf, contentenc.HeaderLen+int64(blockNo)*int64(cBS))
+		e.ContentLock.RUnlock()
+		openfiletable.Unregister(qi)
+		if hn == 0 && herr == io.EOF {
+			// Empty file
+			break
+		}
+		var fh *contentenc.FileHeader
+		if herr == nil {
+			fh, herr = contentenc.ParseHeader(header)
+		} else if herr == io.EOF {
+			herr = fmt.Errorf("incomplete file header: %d bytes", hn)
+		}
+		if herr != nil {
+			s.report(relPath, cPath, corruptHeader, 0, herr)
+			break
+		}
+		if err != nil && err != io.EOF {
+			tlog.Debug.Printf("scrub: %q: %v", relPath, err)
+			break
+		}
+		b := buf[:n]
+		for i := 0; i < n; i += cBS {
+			block := b[i:min(i+cBS, n)]
+			if _, err := ce.DecryptBlock(block, blockNo, fh.ID); err != nil {
+				s.report(relPath, cPath, corruptBlock, int64(blockNo)*pBS, err)
+			}
+			blockNo++
+		}
+		s.mu.Lock()
+		s.st.Bytes += int64(n) / int64(cBS) * pBS
+		s.mu.Unlock()
+		if !s.throttle(n) {
+			return
+		}
+		if n < len(buf) {
+			// EOF
+			break
+		}
+		// Skip over file holes
+		if bytes.Equal(b, make([]byte, len(b))) {
+			const SEEK_DATA = 3
+			cOff := contentenc.HeaderLen + int64(blockNo)*int64(cBS)
+			nextOff, err := syscall.Seek(fd, cOff, SEEK_DATA)
+			if err == syscall.ENXIO {
+				// Only a hole until EOF
+				break
+			} else if err == nil {
+				blockNo = max(blockNo, uint64(nextOff-contentenc.HeaderLen)/uint64(cBS))
+			}
+		}
+	}
+	s.mu.Lock()
+	s.st.Files++
+	s.mu.Unlock()
+}
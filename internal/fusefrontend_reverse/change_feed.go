@@ -0,0 +1,98 @@
+package fusefrontend_reverse
+
+import (
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// Verify that the interface is implemented.
+var _ ctlsocksrv.ChangeFeed = &RootNode{}
+
+// changeFeedSlack is subtracted from the timestamp that ChangedSince returns.
+// The kernel uses a coarse clock for file timestamps, so a file modified
+// just after we started the scan may get a timestamp that lies slightly
+// before the start.
+const changeFeedSlack = time.Second
+
+// ChangedSince implements ctlsocksrv.ChangeFeed. It walks the plaintext tree
+// and passes the relative ciphertext paths of everything whose mtime or
+// ctime is not older than "since" to "fn":
+//   - Changed files, plus their gocryptfs.longname.*.name file
+//   - Changed directories (entries added, removed or renamed), plus
+//     their gocryptfs.diriv file. The root directory is returned as ".".
+//   - Everything below a changed directory, unless the ciphertext does not
+//     depend on the path. A renamed directory looks like a changed one, and
+//     the names and contents below it are encrypted with IVs derived from
+//     its path.
+//
+// Deleted files are not returned, but their parent directory is.
+// The returned timestamp should be passed as "since" in the next call.
+// An error returned by "fn" aborts the walk.
+func (rn *RootNode) ChangedSince(since time.Time, fn func(cPath string) error) (next time.Time, err error) {
+	next = time.Now().Add(-changeFeedSlack)
+	w := changeWalker{
+		rn:    rn,
+		since: since.UnixNano(),
+		fn:    fn,
+		// Names depend on the path unless there are no directory IVs, and
+		// contents unless -stable-ivs is used
+		pathIVs: !rn.args.StableIVs || !(rn.args.PlaintextNames || rn.args.DeterministicNames),
+	}
+	return next, rn.walkPlain(w.visit)
+}
+
+// changeWalker holds the state of one ChangedSince tree walk.
+type changeWalker struct {
+	rn    *RootNode
+	since int64
+	fn    func(cPath string) error
+	// pathIVs is set if the ciphertext of an entry changes when one of its
+	// parent directories is renamed
+	pathIVs bool
+}
+
+// isChanged returns true if "st" has a mtime or ctime not older than w.since.
+func (w *changeWalker) isChanged(st *unix.Stat_t) bool {
+	return unix.TimespecToNsec(st.Mtim) >= w.since || unix.TimespecToNsec(st.Ctim) >= w.since
+}
+
+// visit reports "e" if it has changed. A directory is marked if everything
+// in it has to be reported.
+func (w *changeWalker) visit(e *walkEntry) error {
+	rn := w.rn
+	st := e.st
+	// The symlink itself may have been changed to point somewhere else
+	if e.followed && unix.TimespecToNsec(e.lst.Ctim) > unix.TimespecToNsec(st.Ctim) {
+		st.Ctim = e.lst.Ctim
+	}
+	all := e.parent != nil && e.parent.mark
+	isDir := st.Mode&syscall.S_IFMT == syscall.S_IFDIR
+	if isDir {
+		e.mark = all || w.pathIVs && w.isChanged(&st)
+	}
+	if !all && !w.isChanged(&st) {
+		return nil
+	}
+	cPath := e.cPath
+	if cPath == "" {
+		cPath = "."
+	}
+	if err := w.fn(cPath); err != nil {
+		return err
+	}
+	if isDir && !rn.args.PlaintextNames && !rn.args.DeterministicNames {
+		if err := w.fn(filepath.Join(e.cPath, nametransform.DirIVFilename)); err != nil {
+			return err
+		}
+	}
+	if e.cFullName != "" {
+		return w.fn(cPath + nametransform.LongNameSuffix)
+	}
+	return nil
+}
@@ -2,15 +2,18 @@ package fusefrontend_reverse
 
 import (
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"golang.org/x/sys/unix"
 
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/internal/ctlsocksrv"
 )
 
 // Verify that the interface is implemented.
 var _ ctlsocksrv.Interface = &RootNode{}
+var _ ctlsocksrv.StatusReporter = &RootNode{}
 
 // EncryptPath implements ctlsock.Backend.
 // This is used for the control socket and for the "-exclude" logic.
@@ -21,21 +24,43 @@ func (rn *RootNode) EncryptPath(plainPath string) (string, error) {
 	cipherPath := ""
 	parts := strings.Split(plainPath, "/")
 	for _, part := range parts {
-		dirIV := rn.deriveDirIV(cipherPath)
-		encryptedPart, err := rn.nameTransform.EncryptName(part, dirIV)
+		encryptedPart, err := rn.encryptChildName(cipherPath, part)
 		if err != nil {
 			return "", err
 		}
-		if rn.args.LongNames && (len(encryptedPart) > unix.NAME_MAX || len(encryptedPart) > rn.nameTransform.GetLongNameMax()) {
-			encryptedPart = rn.nameTransform.HashLongName(encryptedPart)
-		}
 		cipherPath = filepath.Join(cipherPath, encryptedPart)
 	}
 	return cipherPath, nil
 }
 
+// encryptChildName encrypts the plaintext name "pName" of an entry of the
+// directory "cDir" (relative ciphertext path). Long names are hashed.
+func (rn *RootNode) encryptChildName(cDir string, pName string) (string, error) {
+	dirIV := rn.deriveDirIV(cDir)
+	cName, err := rn.nameTransform.EncryptName(pName, dirIV)
+	if err != nil {
+		return "", err
+	}
+	if rn.args.LongNames && (len(cName) > unix.NAME_MAX || len(cName) > rn.nameTransform.GetLongNameMax()) {
+		cName = rn.nameTransform.HashLongName(cName)
+	}
+	return cName, nil
+}
+
 // DecryptPath implements ctlsock.Backend
 func (rn *RootNode) DecryptPath(cipherPath string) (string, error) {
 	p, err := rn.decryptPath(cipherPath)
 	return p, err
 }
+
+// Status implements ctlsocksrv.StatusReporter
+func (rn *RootNode) Status() *ctlsock.StatusStruct {
+	s := rn.args.Status
+	s.FeatureFlags = slices.Clone(s.FeatureFlags)
+	cs := rn.contentEnc.Stats()
+	s.BlocksEncrypted = cs.BlocksEncrypted
+	s.BytesEncrypted = cs.BytesEncrypted
+	s.BlocksDecrypted = cs.BlocksDecrypted
+	s.BytesDecrypted = cs.BytesDecrypted
+	return &s
+}
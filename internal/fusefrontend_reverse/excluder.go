@@ -22,6 +22,18 @@ func prepareExcluder(args fusefrontend.Args) *ignore.GitIgnore {
 	return ignore.CompileIgnoreLines(patterns...)
 }
 
+// NewExcluder returns a function that reports whether the relative
+// plaintext path "pPath" is excluded by -exclude, -exclude-wildcard or
+// -exclude-from. Returns nil if no exclusions are configured.
+// This is for users outside of a reverse mount, like "-fsck -reverse".
+func NewExcluder(args fusefrontend.Args) func(pPath string) bool {
+	if len(args.Exclude) == 0 && len(args.ExcludeWildcard) == 0 && len(args.ExcludeFrom) == 0 {
+		return nil
+	}
+	excluder := prepareExcluder(args)
+	return excluder.MatchesPath
+}
+
 // getExclusionPatters prepares a list of patterns to be excluded.
 // Patterns passed in the -exclude command line option are prefixed
 // with a leading '/' to preserve backwards compatibility (before
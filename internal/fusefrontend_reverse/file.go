@@ -21,6 +21,8 @@ type File struct {
 	block0IV []byte
 	// Content encryption helper
 	contentEnc *contentenc.ContentEnc
+	// rootNode counts the open files
+	rootNode *RootNode
 }
 
 // Read - FUSE call
@@ -66,6 +68,7 @@ func (f *File) Read(ctx context.Context, buf []byte, ioff int64) (resultData fus
 
 // Release - FUSE call, close file
 func (f *File) Release(context.Context) syscall.Errno {
+	f.rootNode.openFiles.Add(-1)
 	return fs.ToErrno(f.fd.Close())
 }
 
@@ -2,16 +2,187 @@ package fusefrontend_reverse
 
 import (
 	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
 	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
 var inodeTable sync.Map
 
+// fileIDTable maps the -stable-ivs file IDs we have handed out to the inode
+// (device and inode number) that owns them. Used to detect duplicate IDs.
+var fileIDTable sync.Map
+
+// fileIDLock serializes creating and replacing file IDs, so concurrent
+// opens of the same file agree on its ID.
+var fileIDLock sync.Mutex
+
+// stableIVsFallbackOnce makes sure we only log the "-stable-ivs" fallback
+// warning once.
+var stableIVsFallbackOnce sync.Once
+
+// fileIVs returns the file ID and the block #0 IV for the backing file "fd",
+// which is presented as the relative ciphertext path "cPath".
+// "st" must be the result of Fstat() on "fd". "viaSymlink" is set if "cPath"
+// passes through a followed symlink (-follow-symlinks).
+//
+// Normally, the IVs are derived from "cPath". With -stable-ivs,
+// they are derived from a random per-file ID stored in an xattr on the backing
+// file, so renaming the file does not change the ciphertext. If the ID can not
+// be stored (read-only filesystem, no permission, ...), we fall back to the
+// path.
+func (rn *RootNode) fileIVs(fd int, st *syscall.Stat_t, cPath string, viaSymlink bool) pathiv.FileIVs {
+	if rn.args.StableIVs {
+		id, err := getOrCreateFileID(fd, st)
+		if err == nil {
+			return pathiv.DeriveFileFromID(id)
+		}
+		stableIVsFallbackOnce.Do(func() {
+			tlog.Warn.Printf("-stable-ivs: could not store file ID in xattr %q (%v), "+
+				"falling back to path-derived IVs for affected files", fileIDXattr, err)
+		})
+		tlog.Debug.Printf("ino%d: fileIVs: getOrCreateFileID: %v", st.Ino, err)
+	}
+	if viaSymlink {
+		// If the file can also be reached without symlinks, use that
+		// path, so the IVs do not depend on which path is used first
+		if c, ok := rn.canonicalCPath(fd); ok {
+			cPath, viaSymlink = c, false
+		}
+	}
+	// See if we have that inode already in the table
+	// (even if Nlink has dropped to 1)
+	qi := inomap.QInoFromStat(st)
+	v, found := inodeTable.Load(qi)
+	if found {
+		tlog.Debug.Printf("ino%d: newFile: found in the inode table", st.Ino)
+		return v.(pathiv.FileIVs)
+	}
+	derivedIVs := pathiv.DeriveFile(cPath)
+	// Nlink > 1 means there is more than one path to this file. A file
+	// that is only reachable through symlinks may have several of them.
+	// Store the derived values so we always return the same data,
+	// regardless of the path that is used to access the file.
+	// This means that the first path wins. Other files are not stored, so
+	// the table does not grow with every file that is read.
+	if st.Nlink > 1 || viaSymlink {
+		v, found = inodeTable.LoadOrStore(qi, derivedIVs)
+		if found {
+			// Another thread has stored a different value before we could.
+			derivedIVs = v.(pathiv.FileIVs)
+		} else {
+			tlog.Debug.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
+		}
+	}
+	return derivedIVs
+}
+
+// canonicalCPath returns the ciphertext path of the backing file "fd" on a
+// path without symlinks, if the file lies in one of our backing directories.
+// Only works on Linux, where /proc/self/fd tells us the path.
+func (rn *RootNode) canonicalCPath(fd int) (cPath string, ok bool) {
+	realPath, err := os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	if err != nil {
+		return "", false
+	}
+	bases := map[string]string{"": rn.args.Cipherdir}
+	for name, dir := range rn.args.MergeDirs {
+		bases[name] = dir
+	}
+	for top, base := range bases {
+		base, err = filepath.EvalSymlinks(base)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(base, realPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if top == "" {
+			first, _, _ := strings.Cut(rel, "/")
+			if _, shadowed := rn.args.MergeDirs[first]; shadowed || rel == configfile.ConfReverseName {
+				continue
+			}
+		}
+		pPath := filepath.Join(top, rel)
+		if rn.isExcludedPlain(pPath) {
+			continue
+		}
+		if cPath, err = rn.EncryptPath(pPath); err == nil {
+			return cPath, true
+		}
+	}
+	return "", false
+}
+
+// getOrCreateFileID returns the per-file ID of the backing file "fd" with the
+// Fstat() result "st". The fileIDXattr xattr stores the ID followed by the
+// inode number of the file it has been created for. If the xattr does not
+// exist, is damaged, belongs to a different inode (the file has been copied
+// including its xattrs), or the ID is already used by another file, a new
+// random ID is created and stored.
+func getOrCreateFileID(fd int, st *syscall.Stat_t) ([]byte, error) {
+	if id, ok := checkFileID(fd, st); ok {
+		return id, nil
+	}
+	fileIDLock.Lock()
+	defer fileIDLock.Unlock()
+	// Another thread may have stored a new ID while we waited for the lock
+	if id, ok := checkFileID(fd, st); ok {
+		return id, nil
+	}
+	_, err := syscallcompat.Fgetxattr(fd, fileIDXattr)
+	replace := err == nil
+	if err != nil && err != noSuchAttributeError {
+		return nil, err
+	}
+	val := make([]byte, fileIDLen+8)
+	copy(val, cryptocore.RandBytes(fileIDLen))
+	binary.LittleEndian.PutUint64(val[fileIDLen:], st.Ino)
+	if err = setFileIDXattr(fd, val, replace); err != nil {
+		return nil, err
+	}
+	if replace {
+		tlog.Debug.Printf("ino%d: getOrCreateFileID: replaced invalid or duplicate file ID", st.Ino)
+	}
+	id := val[:fileIDLen]
+	fileIDTable.Store(string(id), inomap.QInoFromStat(st))
+	return id, nil
+}
+
+// checkFileID reads the file ID from the fileIDXattr xattr of "fd" and
+// returns it if it is valid for the file with the Fstat() result "st".
+func checkFileID(fd int, st *syscall.Stat_t) ([]byte, bool) {
+	val, err := syscallcompat.Fgetxattr(fd, fileIDXattr)
+	if err != nil || len(val) != fileIDLen+8 {
+		return nil, false
+	}
+	if binary.LittleEndian.Uint64(val[fileIDLen:]) != st.Ino {
+		// Copied from another file
+		return nil, false
+	}
+	id := val[:fileIDLen]
+	qi := inomap.QInoFromStat(st)
+	if v, found := fileIDTable.LoadOrStore(string(id), qi); found && v.(inomap.QIno) != qi {
+		// Same inode number, but on a different device
+		return nil, false
+	}
+	return id, true
+}
+
 // encryptBlocks - encrypt "plaintext" into a number of ciphertext blocks.
 // "plaintext" must already be block-aligned.
 func (rf *File) encryptBlocks(plaintext []byte, firstBlockNo uint64, fileID []byte, block0IV []byte) []byte {
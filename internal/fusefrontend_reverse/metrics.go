@@ -0,0 +1,17 @@
+package fusefrontend_reverse
+
+import (
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
+)
+
+var _ metrics.Source = &RootNode{} // Verify that interface is implemented.
+
+// WriteMetrics implements metrics.Source
+func (rn *RootNode) WriteMetrics(w *metrics.Writer) {
+	fusefrontend.WriteContentStats(w, rn.contentEnc.Stats())
+	namespaces, spilled := rn.inoMap.Len()
+	w.Gauge("inomap_namespaces", "Device namespaces in the inode number map.", int64(namespaces))
+	w.Gauge("inomap_spilled", "Inode numbers in the spill map of the inode number map.", int64(spilled))
+	w.Gauge("open_file_handles", "Open file handles.", rn.openFiles.Load())
+}
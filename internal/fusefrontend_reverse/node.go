@@ -13,7 +13,6 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
-	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
@@ -24,8 +23,11 @@ type Node struct {
 	fs.Inode
 	// isOtherFilesystem is used for --one-filesystem.
 	// It is set when the device number of this file or directory
-	// is different from n.rootNode().rootDev.
+	// is different from n.rootNode().rootDevOf().
 	isOtherFilesystem bool
+	// followed is used for -follow-symlinks. It is set when this node is a
+	// symlink in the backing directory that is presented as its target.
+	followed bool
 }
 
 // Lookup - FUSE call for discovering a file.
@@ -62,8 +64,16 @@ func (n *Node) Lookup(ctx context.Context, cName string, out *fuse.EntryOut) (ch
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
+	// With -follow-symlinks, present the link target instead of the link
+	followed := false
+	if rn.args.FollowSymlinks && st.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		var stTarget *syscall.Stat_t
+		if stTarget, followed = n.followSymlink(d.dirfd, d.pName, d.pPath); followed {
+			st = stTarget
+		}
+	}
 	// Create new inode and fill `out`
-	ch = n.newChild(ctx, st, out)
+	ch = n.newChild(ctx, d.pPath, st, followed, out)
 	// Translate ciphertext size in `out.Attr.Size` to plaintext size
 	if t == typeReal {
 		n.translateSize(d.dirfd, cName, d.pName, &out.Attr)
@@ -104,7 +114,7 @@ func (n *Node) Getattr(ctx context.Context, f fs.FileHandle, out *fuse.AttrOut)
 	}
 	defer syscall.Close(d.dirfd)
 
-	st, err := syscallcompat.Fstatat2(d.dirfd, d.pName, unix.AT_SYMLINK_NOFOLLOW)
+	st, err := n.fstatat(d.dirfd, d.pName)
 	if err != nil {
 		return fs.ToErrno(err)
 	}
@@ -139,7 +149,7 @@ func (n *Node) Readlink(ctx context.Context) (out []byte, errno syscall.Errno) {
 
 // Open - FUSE call. Open already-existing file.
 //
-// Symlink-safe through Openat().
+// Symlink-safe through Openat(), unless -follow-symlinks is active.
 func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFlags uint32, errno syscall.Errno) {
 	d, errno := n.prepareAtSyscall("")
 	if errno != 0 {
@@ -147,7 +157,7 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 	}
 	defer syscall.Close(d.dirfd)
 
-	fd, err := syscallcompat.Openat(d.dirfd, d.pName, syscall.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	fd, err := n.openat(d.dirfd, d.pName, syscall.O_RDONLY)
 	if err != nil {
 		errno = fs.ToErrno(err)
 		return
@@ -170,40 +180,20 @@ func (n *Node) Open(ctx context.Context, flags uint32) (fh fs.FileHandle, fuseFl
 		errno = syscall.EACCES
 		return
 	}
-	// See if we have that inode number already in the table
-	// (even if Nlink has dropped to 1)
-	var derivedIVs pathiv.FileIVs
-	v, found := inodeTable.Load(st.Ino)
-	if found {
-		tlog.Debug.Printf("ino%d: newFile: found in the inode table", st.Ino)
-		derivedIVs = v.(pathiv.FileIVs)
-	} else {
-		p := n.Path()
-		derivedIVs = pathiv.DeriveFile(p)
-		// Nlink > 1 means there is more than one path to this file.
-		// Store the derived values so we always return the same data,
-		// regardless of the path that is used to access the file.
-		// This means that the first path wins.
-		if st.Nlink > 1 {
-			v, found = inodeTable.LoadOrStore(st.Ino, derivedIVs)
-			if found {
-				// Another thread has stored a different value before we could.
-				derivedIVs = v.(pathiv.FileIVs)
-			} else {
-				tlog.Debug.Printf("ino%d: newFile: Nlink=%d, stored in the inode table", st.Ino, st.Nlink)
-			}
-		}
-	}
+	derivedIVs := n.rootNode().fileIVs(fd, &st, n.Path(), n.viaSymlink())
 	header := contentenc.FileHeader{
 		Version: contentenc.CurrentVersion,
 		ID:      derivedIVs.ID,
 	}
+	rn := n.rootNode()
 	fh = &File{
 		fd:         os.NewFile(uintptr(fd), fmt.Sprintf("fd%d", fd)),
 		header:     header,
 		block0IV:   derivedIVs.Block0IV,
-		contentEnc: n.rootNode().contentEnc,
+		contentEnc: rn.contentEnc,
+		rootNode:   rn,
 	}
+	rn.openFiles.Add(1)
 	return
 }
 
@@ -42,7 +42,7 @@ func (n *Node) Readdir(ctx context.Context) (stream fs.DirStream, errno syscall.
 
 	// Read plaintext directory
 	var entries []fuse.DirEntry
-	fd, err := syscallcompat.Openat(d.dirfd, d.pName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	fd, err := n.openat(d.dirfd, d.pName, syscall.O_RDONLY|syscall.O_DIRECTORY)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -51,6 +51,14 @@ func (n *Node) Readdir(ctx context.Context) (stream fs.DirStream, errno syscall.
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
+	if rn.args.FollowSymlinks {
+		n.followDirEntries(fd, d.pPath, entries)
+	}
+
+	// Add "-merge"d directories
+	if n.isRoot() {
+		entries = rn.mergeDirEntries(entries)
+	}
 
 	// Filter out excluded entries
 	entries = rn.excludeDirEntries(d, entries)
@@ -12,8 +12,10 @@ import (
 	"github.com/hanwen/go-fuse/v2/fuse"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
 	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
 )
 
 const (
@@ -53,7 +55,8 @@ type dirfdPlus struct {
 	dirfd int
 	// Relative plaintext path
 	pPath string
-	// Plaintext basename: filepath.Base(pPath)
+	// Plaintext name relative to dirfd: filepath.Base(pPath), or "." for
+	// the root of a backing directory
 	pName string
 	// Relative ciphertext path
 	cPath string
@@ -74,28 +77,30 @@ func (n *Node) prepareAtSyscall(child string) (d *dirfdPlus, errno syscall.Errno
 		cPath = filepath.Join(cPath, child)
 	}
 	rn := n.rootNode()
-	dirfd, pPath, err := rn.openBackingDir(cPath)
+	dirfd, pPath, pName, err := rn.openBackingDir(cPath)
 	if err != nil {
 		errno = fs.ToErrno(err)
 	}
 	d = &dirfdPlus{
 		dirfd: dirfd,
 		pPath: pPath,
-		pName: filepath.Base(pPath),
+		pName: pName,
 		cPath: cPath,
 		cName: filepath.Base(cPath),
 	}
 	return
 }
 
-// newChild attaches a new child inode to n.
+// newChild attaches a new child inode to n. `pPath` is the relative plaintext
+// path of the child, `followed` is true if the child is a symlink that is
+// presented as its target (see followSymlink).
 // The passed-in `st` will be modified to get a unique inode number.
 //
 // This function is not used for virtual files. See lookupLongnameName(),
 // lookupDiriv() instead.
-func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.EntryOut) *fs.Inode {
+func (n *Node) newChild(ctx context.Context, pPath string, st *syscall.Stat_t, followed bool, out *fuse.EntryOut) *fs.Inode {
 	rn := n.rootNode()
-	isOtherFilesystem := (uint64(st.Dev) != rn.rootDev)
+	isOtherFilesystem := (uint64(st.Dev) != rn.rootDevOf(pPath))
 	// Get unique inode number
 	rn.inoMap.TranslateStat(st)
 	out.Attr.FromStat(st)
@@ -103,10 +108,97 @@ func (n *Node) newChild(ctx context.Context, st *syscall.Stat_t, out *fuse.Entry
 	id := rn.uniqueStableAttr(uint32(st.Mode), st.Ino)
 	node := &Node{
 		isOtherFilesystem: isOtherFilesystem,
+		followed:          followed,
 	}
 	return n.NewInode(ctx, node, id)
 }
 
+// fstatat stats the backing file of this node, "pName" in "dirfd".
+// Symlinks are not followed, unless this node is a followed symlink
+// (-follow-symlinks).
+func (n *Node) fstatat(dirfd int, pName string) (*syscall.Stat_t, error) {
+	if n.followed {
+		return syscallcompat.Fstatat2Follow(dirfd, pName)
+	}
+	return syscallcompat.Fstatat2(dirfd, pName, unix.AT_SYMLINK_NOFOLLOW)
+}
+
+// openat opens the backing file of this node, "pName" in "dirfd".
+// Symlinks are not followed, unless this node is a followed symlink
+// (-follow-symlinks).
+func (n *Node) openat(dirfd int, pName string, flags int) (int, error) {
+	return openatMaybeFollow(dirfd, pName, flags, n.followed)
+}
+
+// openatMaybeFollow opens "pName" in "dirfd". A symlink in the last path
+// component is only followed if "follow" is set.
+func openatMaybeFollow(dirfd int, pName string, flags int, follow bool) (int, error) {
+	if follow {
+		return syscallcompat.OpenatFollow(dirfd, pName, flags)
+	}
+	return syscallcompat.Openat(dirfd, pName, flags|syscall.O_NOFOLLOW, 0)
+}
+
+// followSymlink decides if the symlink "pName" in the directory "dirfd",
+// a child of n, should be presented as its target (-follow-symlinks).
+// "pPath" is the relative plaintext path of the symlink.
+//
+// Returns the stat data of the target and true if the link should be
+// followed. Dangling links, links to another filesystem (with
+// -one-file-system) and links to a directory that is an ancestor of the link
+// (which would create an endless directory tree) are not followed and stay
+// symlinks.
+func (n *Node) followSymlink(dirfd int, pName string, pPath string) (*syscall.Stat_t, bool) {
+	rn := n.rootNode()
+	st, err := syscallcompat.Fstatat2Follow(dirfd, pName)
+	if err != nil {
+		tlog.Debug.Printf("followSymlink %q: not following: %v", pPath, err)
+		return nil, false
+	}
+	if rn.args.OneFileSystem && uint64(st.Dev) != rn.rootDevOf(pPath) {
+		tlog.Debug.Printf("followSymlink %q: not following: other filesystem", pPath)
+		return nil, false
+	}
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		// Inode numbers of our nodes are translated by inoMap, so we have
+		// to translate the target's inode number to compare them.
+		ino := rn.inoMap.Translate(inomap.QInoFromStat(st))
+		for p := &n.Inode; p != nil; _, p = p.Parent() {
+			if p.StableAttr().Ino == ino {
+				tlog.Debug.Printf("followSymlink %q: not following: directory loop", pPath)
+				return nil, false
+			}
+		}
+	}
+	return st, true
+}
+
+// viaSymlink returns true if n, or one of its parents, is a followed
+// symlink (-follow-symlinks)
+func (n *Node) viaSymlink() bool {
+	for p := &n.Inode; p != nil; _, p = p.Parent() {
+		if node, ok := p.Operations().(*Node); ok && node.followed {
+			return true
+		}
+	}
+	return false
+}
+
+// followDirEntries fixes up the file type of directory entries that are
+// followed symlinks (-follow-symlinks). "fd" is the plaintext directory
+// "pDir", which is n, the entries come from.
+func (n *Node) followDirEntries(fd int, pDir string, entries []fuse.DirEntry) {
+	for i := range entries {
+		if entries[i].Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			continue
+		}
+		st, followed := n.followSymlink(fd, entries[i].Name, filepath.Join(pDir, entries[i].Name))
+		if followed {
+			entries[i].Mode = uint32(st.Mode) & syscall.S_IFMT
+		}
+	}
+}
+
 // isRoot returns true if this node is the root node
 func (n *Node) isRoot() bool {
 	rn := n.rootNode()
@@ -122,7 +214,7 @@ func (n *Node) lookupLongnameName(ctx context.Context, nameFile string, out *fus
 
 	// Find the file the gocryptfs.longname.XYZ.name file belongs to in the
 	// directory listing
-	fd, err := syscallcompat.Openat(d.dirfd, d.pName, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	fd, err := n.openat(d.dirfd, d.pName, syscall.O_RDONLY|syscall.O_DIRECTORY)
 	if err != nil {
 		errno = fs.ToErrno(err)
 		return
@@ -169,7 +261,7 @@ func (n *Node) lookupDiriv(ctx context.Context, out *fuse.EntryOut) (ch *fs.Inod
 		return
 	}
 	defer syscall.Close(d.dirfd)
-	st, err := syscallcompat.Fstatat2(d.dirfd, d.pName, unix.AT_SYMLINK_NOFOLLOW)
+	st, err := n.fstatat(d.dirfd, d.pName)
 	if err != nil {
 		errno = fs.ToErrno(err)
 		return
@@ -217,13 +309,17 @@ func (n *Node) readlink(dirfd int, cName string, pName string) (out []byte, errn
 		errno = fs.ToErrno(err)
 		return
 	}
-	rn := n.rootNode()
+	return n.rootNode().encryptSymlinkTarget(filepath.Join(n.Path(), cName), plainTarget)
+}
+
+// encryptSymlinkTarget encrypts the target of the symlink that is presented
+// as the relative ciphertext path "cPath".
+func (rn *RootNode) encryptSymlinkTarget(cPath string, plainTarget string) (out []byte, errno syscall.Errno) {
 	if rn.args.PlaintextNames {
 		return []byte(plainTarget), 0
 	}
 	// Nonce is derived from the relative *ciphertext* path
-	p := filepath.Join(n.Path(), cName)
-	nonce := pathiv.Derive(p, pathiv.PurposeSymlinkIV)
+	nonce := pathiv.Derive(cPath, pathiv.PurposeSymlinkIV)
 	// Symlinks are encrypted like file contents and base64-encoded
 	cBinTarget := rn.contentEnc.EncryptBlockNonce([]byte(plainTarget), 0, nil, nonce)
 	cTarget := rn.nameTransform.B64EncodeToString(cBinTarget)
@@ -13,6 +13,14 @@ import (
 // encrypted original name.
 var xattrStorePrefix = "user.gocryptfs."
 
+// fileIDXattr stores the random per-file ID used by -stable-ivs on the
+// plaintext file, followed by the 8-byte inode number of the file. It is
+// internal to gocryptfs and never shown in the encrypted view.
+const fileIDXattr = "user.gocryptfs.reverse.fileid"
+
+// fileIDLen is the length of the random per-file ID stored in fileIDXattr.
+const fileIDLen = 16
+
 // isAcl returns true if the attribute name is for storing ACLs
 //
 // ACLs are passed through without encryption
@@ -39,7 +47,7 @@ func (n *Node) Getxattr(ctx context.Context, attr string, dest []byte) (uint32,
 		}
 	} else {
 		pAttr, err := rn.decryptXattrName(attr)
-		if err != nil {
+		if err != nil || pAttr == fileIDXattr {
 			return 0, noSuchAttributeError
 		}
 		pData, errno := n.getXAttr(pAttr)
@@ -76,6 +84,9 @@ func (n *Node) Listxattr(ctx context.Context, dest []byte) (uint32, syscall.Errn
 			buf.WriteString(pName + "\000")
 			continue
 		}
+		if pName == fileIDXattr {
+			continue
+		}
 		cName, err := rn.encryptXattrName(pName)
 		if err != nil {
 			continue
@@ -3,6 +3,8 @@ package fusefrontend_reverse
 import (
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/hanwen/go-fuse/v2/fs"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
@@ -18,14 +20,7 @@ func (n *Node) getXAttr(cAttr string) (out []byte, errno syscall.Errno) {
 	}
 	defer syscall.Close(d.dirfd)
 
-	// O_NONBLOCK to not block on FIFOs.
-	fd, err := syscallcompat.Openat(d.dirfd, d.pName, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
-	if err != nil {
-		return nil, fs.ToErrno(err)
-	}
-	defer syscall.Close(fd)
-
-	cData, err := syscallcompat.Fgetxattr(fd, cAttr)
+	cData, err := getXAttrAt(d.dirfd, d.pName, cAttr, n.followed)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -40,16 +35,42 @@ func (n *Node) listXAttr() (out []string, errno syscall.Errno) {
 	}
 	defer syscall.Close(d.dirfd)
 
-	// O_NONBLOCK to not block on FIFOs.
-	fd, err := syscallcompat.Openat(d.dirfd, d.pName, syscall.O_RDONLY|syscall.O_NONBLOCK|syscall.O_NOFOLLOW, 0)
+	pNames, err := listXAttrAt(d.dirfd, d.pName, n.followed)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
+	return pNames, 0
+}
+
+// getXAttrAt reads the xattr "attr" of "pName" in "dirfd". A symlink in the
+// last path component is only followed if "follow" is set.
+func getXAttrAt(dirfd int, pName string, attr string, follow bool) ([]byte, error) {
+	// O_NONBLOCK to not block on FIFOs.
+	fd, err := openatMaybeFollow(dirfd, pName, syscall.O_RDONLY|syscall.O_NONBLOCK, follow)
+	if err != nil {
+		return nil, err
+	}
 	defer syscall.Close(fd)
+	return syscallcompat.Fgetxattr(fd, attr)
+}
 
-	pNames, err := syscallcompat.Flistxattr(fd)
+// listXAttrAt lists the xattrs of "pName" in "dirfd", see getXAttrAt.
+func listXAttrAt(dirfd int, pName string, follow bool) ([]string, error) {
+	// O_NONBLOCK to not block on FIFOs.
+	fd, err := openatMaybeFollow(dirfd, pName, syscall.O_RDONLY|syscall.O_NONBLOCK, follow)
 	if err != nil {
-		return nil, fs.ToErrno(err)
+		return nil, err
 	}
-	return pNames, 0
+	defer syscall.Close(fd)
+	return syscallcompat.Flistxattr(fd)
+}
+
+// setFileIDXattr stores "val" in the fileIDXattr xattr of "fd". If "replace"
+// is false, it fails with EEXIST if the xattr already exists.
+func setFileIDXattr(fd int, val []byte, replace bool) error {
+	flags := unix.XATTR_CREATE
+	if replace {
+		flags = unix.XATTR_REPLACE
+	}
+	return unix.Fsetxattr(fd, fileIDXattr, val, flags)
 }
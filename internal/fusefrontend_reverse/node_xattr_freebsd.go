@@ -15,3 +15,18 @@ func (n *Node) listXAttr() (out []string, errno unix.Errno) {
 	// TODO
 	return nil, unix.EOPNOTSUPP
 }
+
+func getXAttrAt(dirfd int, pName string, attr string, follow bool) ([]byte, error) {
+	// TODO
+	return nil, unix.EOPNOTSUPP
+}
+
+func listXAttrAt(dirfd int, pName string, follow bool) ([]string, error) {
+	// TODO
+	return nil, unix.EOPNOTSUPP
+}
+
+func setFileIDXattr(fd int, val []byte, replace bool) error {
+	// TODO
+	return unix.EOPNOTSUPP
+}
@@ -4,6 +4,8 @@ import (
 	"fmt"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
 	"github.com/hanwen/go-fuse/v2/fs"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
@@ -19,8 +21,7 @@ func (n *Node) getXAttr(cAttr string) (out []byte, errno syscall.Errno) {
 	}
 	defer syscall.Close(d.dirfd)
 
-	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", d.dirfd, d.pName)
-	pData, err := syscallcompat.Lgetxattr(procPath, cAttr)
+	pData, err := getXAttrAt(d.dirfd, d.pName, cAttr, n.followed)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
@@ -34,10 +35,38 @@ func (n *Node) listXAttr() (out []string, errno syscall.Errno) {
 	}
 	defer syscall.Close(d.dirfd)
 
-	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", d.dirfd, d.pName)
-	pNames, err := syscallcompat.Llistxattr(procPath)
+	pNames, err := listXAttrAt(d.dirfd, d.pName, n.followed)
 	if err != nil {
 		return nil, fs.ToErrno(err)
 	}
 	return pNames, 0
 }
+
+// getXAttrAt reads the xattr "attr" of "pName" in "dirfd". A symlink in the
+// last path component is only followed if "follow" is set.
+func getXAttrAt(dirfd int, pName string, attr string, follow bool) ([]byte, error) {
+	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, pName)
+	if follow {
+		return syscallcompat.Getxattr(procPath, attr)
+	}
+	return syscallcompat.Lgetxattr(procPath, attr)
+}
+
+// listXAttrAt lists the xattrs of "pName" in "dirfd", see getXAttrAt.
+func listXAttrAt(dirfd int, pName string, follow bool) ([]string, error) {
+	procPath := fmt.Sprintf("/proc/self/fd/%d/%s", dirfd, pName)
+	if follow {
+		return syscallcompat.Listxattr(procPath)
+	}
+	return syscallcompat.Llistxattr(procPath)
+}
+
+// setFileIDXattr stores "val" in the fileIDXattr xattr of "fd". If "replace"
+// is false, it fails with EEXIST if the xattr already exists.
+func setFileIDXattr(fd int, val []byte, replace bool) error {
+	flags := unix.XATTR_CREATE
+	if replace {
+		flags = unix.XATTR_REPLACE
+	}
+	return unix.Fsetxattr(fd, fileIDXattr, val, flags)
+}
@@ -4,6 +4,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"syscall"
@@ -42,6 +43,9 @@ type RootNode struct {
 	// rootDev stores the device number of the backing directory. Used for
 	// --one-file-system.
 	rootDev uint64
+	// mergeDevs stores the device numbers of the "-merge"d directories,
+	// indexed by their top-level name. Used for --one-file-system.
+	mergeDevs map[string]uint64
 	// If a file name length is shorter than shortNameMax, there is no need to
 	// hash it.
 	shortNameMax int
@@ -54,6 +58,8 @@ type RootNode struct {
 	gen atomic.Uint64
 	// rootIno is the inode number that we report for the root node on mount
 	rootIno uint64
+	// openFiles counts the *File that have not been released yet
+	openFiles atomic.Int64
 }
 
 // NewRootNode returns an encrypted FUSE overlay filesystem.
@@ -89,6 +95,26 @@ func NewRootNode(args fusefrontend.Args, c *contentenc.ContentEnc, n *nametransf
 		rn.inoMap.TranslateStat(&st)
 		rn.rootIno = st.Ino
 	}
+	if len(args.MergeDirs) > 0 {
+		rn.mergeDevs = make(map[string]uint64)
+	}
+	for name, dir := range args.MergeDirs {
+		if !args.PlaintextNames && len(name) > shortNameMax {
+			// Would need a gocryptfs.longname.*.name file in the root
+			// directory, which findLongnameParent cannot find.
+			tlog.Fatal.Printf("-merge: directory name %q is too long, max %d bytes", name, shortNameMax)
+			os.Exit(exitcodes.Usage)
+		}
+		var mst syscall.Stat_t
+		if err := syscall.Stat(dir, &mst); err != nil {
+			tlog.Fatal.Printf("-merge: could not stat %q: %v", dir, err)
+			os.Exit(exitcodes.CipherDir)
+		}
+		rn.mergeDevs[name] = uint64(mst.Dev)
+		if _, err := os.Lstat(filepath.Join(args.Cipherdir, name)); err == nil {
+			tlog.Warn.Printf("-merge: %q shadows %q", dir, filepath.Join(args.Cipherdir, name))
+		}
+	}
 	if len(args.Exclude) > 0 || len(args.ExcludeWildcard) > 0 || len(args.ExcludeFrom) > 0 {
 		rn.excluder = prepareExcluder(args)
 	}
@@ -181,6 +207,42 @@ func (rn *RootNode) uniqueStableAttr(mode uint32, ino uint64) fs.StableAttr {
 	}
 }
 
+// rootDevOf returns the device number of the backing directory that the
+// relative plaintext path "pPath" lives in. Used for --one-file-system.
+func (rn *RootNode) rootDevOf(pPath string) uint64 {
+	if len(rn.mergeDevs) > 0 {
+		top, _, _ := strings.Cut(pPath, "/")
+		if dev, ok := rn.mergeDevs[top]; ok {
+			return dev
+		}
+	}
+	return rn.rootDev
+}
+
+// mergeDirEntries replaces directory entries of the root directory that
+// are shadowed by "-merge"d directories and adds the merged directories.
+func (rn *RootNode) mergeDirEntries(entries []fuse.DirEntry) []fuse.DirEntry {
+	if len(rn.args.MergeDirs) == 0 {
+		return entries
+	}
+	filtered := make([]fuse.DirEntry, 0, len(entries)+len(rn.args.MergeDirs))
+	for _, entry := range entries {
+		if _, shadowed := rn.args.MergeDirs[entry.Name]; shadowed {
+			continue
+		}
+		filtered = append(filtered, entry)
+	}
+	names := make([]string, 0, len(rn.args.MergeDirs))
+	for name := range rn.args.MergeDirs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		filtered = append(filtered, fuse.DirEntry{Mode: syscall.S_IFDIR, Name: name})
+	}
+	return filtered
+}
+
 func (rn *RootNode) RootIno() uint64 {
 	return rn.rootIno
 }
@@ -4,9 +4,13 @@ import (
 	"encoding/base64"
 	"log"
 	"path/filepath"
+	"slices"
 	"strings"
 	"syscall"
 
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
 	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
@@ -36,12 +40,15 @@ func (rfs *RootNode) rDecryptName(cName string, dirIV []byte, pDir string) (pNam
 			return "", err
 		}
 	} else if nameType == nametransform.LongNameContent {
-		dirfd, err := syscallcompat.OpenDirNofollow(rfs.args.Cipherdir, filepath.Dir(pDir))
+		baseDir, relDir := rfs.backingDir(pDir)
+		// openDir checks the symlinks on the way (-follow-symlinks)
+		dirfd, err := rfs.openDir(baseDir, relDir)
 		if err != nil {
 			return "", err
 		}
 		defer syscall.Close(dirfd)
-		fd, err := syscallcompat.Openat(dirfd, filepath.Base(pDir), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+		// We have an O_PATH fd, but need to read the directory
+		fd, err := syscallcompat.Openat(dirfd, ".", syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
 		if err != nil {
 			return "", err
 		}
@@ -95,14 +102,91 @@ func (rn *RootNode) deriveDirIV(cPath string) []byte {
 	return pathiv.Derive(cPath, pathiv.PurposeDirIV)
 }
 
-// openBackingDir receives an already decrypted relative path
-// "pRelPath", opens the directory that contains the target file/dir
-// and returns the fd to the directory and the decrypted name of the
-// target file. The fd/name pair is intended for use with fchownat and
-// friends.
-func (rn *RootNode) openBackingDir(cPath string) (dirfd int, pPath string, err error) {
+// backingDir splits the relative plaintext path "pPath" into the absolute
+// path of the backing directory it lives in and the path relative to that
+// directory.
+// Normally, this is args.Cipherdir and "pPath" itself. Paths inside a
+// "-merge"d top-level directory live in the merged directory instead.
+func (rn *RootNode) backingDir(pPath string) (baseDir string, relPath string) {
+	if len(rn.args.MergeDirs) > 0 {
+		top, rest, _ := strings.Cut(pPath, "/")
+		if dir, ok := rn.args.MergeDirs[top]; ok {
+			return dir, rest
+		}
+	}
+	return rn.args.Cipherdir, pPath
+}
+
+// openDir opens the directory "relPath" inside "baseDir" with O_PATH.
+// Symlinks in "relPath" are only followed if -follow-symlinks is active,
+// see openDirFollow.
+func (rn *RootNode) openDir(baseDir string, relPath string) (int, error) {
+	if rn.args.FollowSymlinks {
+		return rn.openDirFollow(baseDir, relPath)
+	}
+	return syscallcompat.OpenDirNofollow(baseDir, relPath)
+}
+
+// openDirFollow is like OpenDirNofollow, but follows symlinks to
+// directories like the reverse view presents them (-follow-symlinks). The
+// path is walked one component at a time with openat, and where a symlink
+// has been followed, the opened directory is checked like followSymlink()
+// does: it must not be one of the directories we have passed (a directory
+// loop) and, with -one-file-system, must be on the same filesystem.
+// Otherwise, the view shows a symlink, and we fail with ENOTDIR.
+// Because the check is done on the opened fd, a symlink that is replaced
+// while we walk cannot lead us anywhere else.
+func (rn *RootNode) openDirFollow(baseDir string, relPath string) (int, error) {
+	dirfd, err := syscallcompat.OpenDirNofollow(baseDir, "")
+	if err != nil {
+		return -1, err
+	}
+	var st unix.Stat_t
+	if err = unix.Fstat(dirfd, &st); err != nil {
+		syscall.Close(dirfd)
+		return -1, err
+	}
+	rootDev := uint64(st.Dev)
+	passed := []inomap.QIno{inomap.NewQIno(uint64(st.Dev), 0, uint64(st.Ino))}
+	for _, name := range strings.Split(relPath, "/") {
+		if name == "" || name == "." {
+			continue
+		}
+		fd, err := syscallcompat.Openat(dirfd, name, syscall.O_NOFOLLOW|syscall.O_DIRECTORY|syscallcompat.O_PATH, 0)
+		followed := false
+		if err == syscall.ENOTDIR || err == syscall.ELOOP {
+			// Probably a symlink
+			fd, err = syscallcompat.OpenatFollow(dirfd, name, syscall.O_DIRECTORY|syscallcompat.O_PATH)
+			followed = true
+		}
+		syscall.Close(dirfd)
+		if err != nil {
+			return -1, err
+		}
+		dirfd = fd
+		if err = unix.Fstat(dirfd, &st); err != nil {
+			syscall.Close(dirfd)
+			return -1, err
+		}
+		qino := inomap.NewQIno(uint64(st.Dev), 0, uint64(st.Ino))
+		if followed && (slices.Contains(passed, qino) || rn.args.OneFileSystem && uint64(st.Dev) != rootDev) {
+			tlog.Debug.Printf("openDirFollow %q: not following symlink %q", relPath, name)
+			syscall.Close(dirfd)
+			return -1, syscall.ENOTDIR
+		}
+		passed = append(passed, qino)
+	}
+	return dirfd, nil
+}
+
+// openBackingDir receives a relative ciphertext path "cPath", decrypts it,
+// opens the directory that contains the target file/dir
+// and returns the fd to the directory, the decrypted path and the
+// name of the target file relative to the fd. The fd/name pair is intended
+// for use with fchownat and friends.
+func (rn *RootNode) openBackingDir(cPath string) (dirfd int, pPath string, pName string, err error) {
 	defer func() {
-		tlog.Debug.Printf("openBackingDir %q -> %d %q %v\n", cPath, dirfd, pPath, err)
+		tlog.Debug.Printf("openBackingDir %q -> %d %q %q %v\n", cPath, dirfd, pPath, pName, err)
 	}()
 	dirfd = -1
 	pPath, err = rn.decryptPath(cPath)
@@ -114,10 +198,11 @@ func (rn *RootNode) openBackingDir(cPath string) (dirfd int, pPath string, err e
 		return
 	}
 	// Open directory, safe against symlink races
-	pDir := filepath.Dir(pPath)
-	dirfd, err = syscallcompat.OpenDirNofollow(rn.args.Cipherdir, pDir)
+	baseDir, relPath := rn.backingDir(pPath)
+	dirfd, err = rn.openDir(baseDir, filepath.Dir(relPath))
 	if err != nil {
 		return
 	}
-	return dirfd, pPath, nil
+	// filepath.Base returns "." for the root of the backing directory
+	return dirfd, pPath, filepath.Base(relPath), nil
 }
@@ -0,0 +1,266 @@
+package fusefrontend_reverse
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/offline"
+	"github.com/rfjakob/gocryptfs/v2/internal/pathiv"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// virtualFileTimeOffset is added to the timestamps of gocryptfs.diriv and
+// gocryptfs.longname.*.name files, like newVirtualMemNode does.
+const virtualFileTimeOffset = 10 * time.Second
+
+// WriteTar walks the plaintext tree and writes the ciphertext view, as a
+// reverse mount presents it, to "w" as a tar stream. No FUSE mount is
+// needed. Extracting the tar gives a cipherdir that can be mounted in
+// forward mode.
+//
+// Files that change while we read them are stored with the size they had
+// when we started reading them.
+func (rn *RootNode) WriteTar(w io.Writer) error {
+	t := tarWalker{
+		rn: rn,
+		tw: offline.NewTarWriter(w),
+	}
+	if err := rn.walkPlain(t.visit); err != nil {
+		return err
+	}
+	return t.tw.Close()
+}
+
+// tarWalker holds the state of one WriteTar tree walk.
+type tarWalker struct {
+	rn *RootNode
+	tw *offline.TarWriter
+}
+
+// entry returns a tar entry for the ciphertext path "cPath", with the
+// attributes from "st".
+func (t *tarWalker) entry(cPath string, st *unix.Stat_t) *offline.Entry {
+	e := offline.EntryFromStat(cPath, st)
+	if t.rn.args.ForceOwner != nil {
+		e.Uid = t.rn.args.ForceOwner.Uid
+		e.Gid = t.rn.args.ForceOwner.Gid
+	}
+	return e
+}
+
+// virtualFile writes a gocryptfs.diriv or gocryptfs.longname.*.name file
+// with the given content. Owner and timestamps are taken from "st", the
+// stat of the directory or file it belongs to.
+func (t *tarWalker) virtualFile(cPath string, content []byte, st *unix.Stat_t) error {
+	e := t.entry(cPath, st)
+	e.Mode = virtualFileMode
+	e.Size = int64(len(content))
+	e.Atime = e.Atime.Add(virtualFileTimeOffset)
+	e.Mtime = e.Mtime.Add(virtualFileTimeOffset)
+	e.Xattrs = nil
+	return t.tw.WriteEntry(e, bytes.NewReader(content))
+}
+
+// visit writes the plaintext tree entry "we".
+func (t *tarWalker) visit(we *walkEntry) error {
+	var err error
+	switch we.st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		err = t.dir(we)
+	case syscall.S_IFREG:
+		err = t.file(we)
+	case syscall.S_IFLNK:
+		err = t.symlink(we)
+	default:
+		e := t.entry(we.cPath, &we.st)
+		e.Xattrs = t.xattrs(we, -1)
+		err = t.tw.WriteEntry(e, nil)
+	}
+	if err != nil {
+		return err
+	}
+	if we.cFullName != "" {
+		err = t.virtualFile(we.cPath+nametransform.LongNameSuffix, []byte(we.cFullName), &we.st)
+	}
+	return err
+}
+
+// dir writes the directory "we". Its contents are visited after that.
+func (t *tarWalker) dir(we *walkEntry) error {
+	e := t.entry(we.cPath, &we.st)
+	e.Xattrs = t.xattrs(we, we.fd)
+	if err := t.tw.WriteEntry(e, nil); err != nil {
+		return err
+	}
+	if t.rn.args.PlaintextNames || t.rn.args.DeterministicNames {
+		return nil
+	}
+	return t.virtualFile(filepath.Join(we.cPath, nametransform.DirIVFilename), t.rn.deriveDirIV(we.cPath), &we.st)
+}
+
+// symlink writes the symlink "we" with an encrypted target.
+func (t *tarWalker) symlink(we *walkEntry) error {
+	target, err := syscallcompat.Readlinkat(we.dirfd, we.name)
+	if err != nil {
+		return &os.PathError{Op: "readlink", Path: we.pPath, Err: err}
+	}
+	// Node.Readlink is called on the symlink node itself and derives the
+	// nonce from its path plus its name. Do the same to get the same
+	// ciphertext.
+	cTarget, errno := t.rn.encryptSymlinkTarget(filepath.Join(we.cPath, filepath.Base(we.cPath)), target)
+	if errno != 0 {
+		return &os.PathError{Op: "readlink", Path: we.pPath, Err: errno}
+	}
+	e := t.entry(we.cPath, &we.st)
+	e.Target = string(cTarget)
+	return t.tw.WriteEntry(e, nil)
+}
+
+// file writes the regular file "we". The content is encrypted unless the
+// file is the config file.
+func (t *tarWalker) file(we *walkEntry) error {
+	rn := t.rn
+	fd, err := openatMaybeFollow(we.dirfd, we.name, syscall.O_RDONLY, we.followed)
+	if err != nil {
+		return &os.PathError{Op: "open", Path: we.pPath, Err: err}
+	}
+	f := os.NewFile(uintptr(fd), we.pPath)
+	defer f.Close()
+	var fst syscall.Stat_t
+	if err = syscall.Fstat(fd, &fst); err != nil {
+		return err
+	}
+	if fst.Mode&syscall.S_IFMT != syscall.S_IFREG {
+		// Replaced by something else while we walk the tree
+		tlog.Warn.Printf("WriteTar: %q is not a regular file anymore, skipping", we.pPath)
+		return nil
+	}
+	e := t.entry(we.cPath, &we.st)
+	e.Size = fst.Size
+	// Read exactly the size we have seen in Fstat. A file that shrinks is
+	// padded with zeros.
+	plain := io.LimitReader(io.MultiReader(f, zeroReader{}), fst.Size)
+	var content io.Reader = plain
+	if !we.isConf {
+		e.Xattrs = t.xattrs(we, fd)
+		e.Size = int64(rn.contentEnc.PlainSizeToCipherSize(uint64(fst.Size)))
+		ivs := rn.fileIVs(fd, &fst, we.cPath, we.viaSymlink)
+		content = newEncryptingReader(rn.contentEnc, plain, ivs, fst.Size)
+	}
+	if err = t.tw.WriteEntry(e, content); err != nil {
+		return err
+	}
+	var fst2 syscall.Stat_t
+	if syscall.Fstat(fd, &fst2) == nil && fst2.Size != fst.Size {
+		tlog.Warn.Printf("WriteTar: %q: file changed as we read it", we.pPath)
+	}
+	return nil
+}
+
+// xattrs returns the encrypted extended attributes of "we", like Listxattr
+// and Getxattr present them. They are read from "fd" if it is not -1.
+// Errors are logged and skipped, like "tar --xattrs" does.
+func (t *tarWalker) xattrs(we *walkEntry, fd int) map[string][]byte {
+	rn := t.rn
+	if rn.args.NoXattr {
+		return nil
+	}
+	listxattr := func() ([]string, error) { return listXAttrAt(we.dirfd, we.name, we.followed) }
+	getxattr := func(attr string) ([]byte, error) { return getXAttrAt(we.dirfd, we.name, attr, we.followed) }
+	if fd >= 0 {
+		listxattr = func() ([]string, error) { return syscallcompat.Flistxattr(fd) }
+		getxattr = func(attr string) ([]byte, error) { return syscallcompat.Fgetxattr(fd, attr) }
+	}
+	pNames, err := listxattr()
+	if err != nil || len(pNames) == 0 {
+		return nil
+	}
+	out := make(map[string][]byte)
+	for _, pName := range pNames {
+		if pName == fileIDXattr {
+			continue
+		}
+		data, err := getxattr(pName)
+		if err != nil {
+			tlog.Warn.Printf("WriteTar: %q: cannot read xattr %q: %v", we.pPath, pName, err)
+			continue
+		}
+		// ACLs are passed through without encryption
+		if isAcl(pName) {
+			out[pName] = data
+			continue
+		}
+		cName, err := rn.encryptXattrName(pName)
+		if err != nil {
+			continue
+		}
+		nonce := pathiv.Derive(we.cPath+"\000"+cName, pathiv.PurposeXattrIV)
+		out[cName] = rn.encryptXattrValue(data, nonce)
+	}
+	return out
+}
+
+// zeroReader returns an endless stream of zeros
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// tarReadBlocks is the number of blocks encryptingReader encrypts at once
+const tarReadBlocks = 32
+
+// encryptingReader returns the ciphertext of a file, like File.Read does: the
+// file header, followed by the encrypted blocks. An empty file stays empty.
+type encryptingReader struct {
+	f     File
+	plain io.Reader
+	// blockNo is the number of the next block to encrypt
+	blockNo uint64
+	// pending is ciphertext that has not been returned yet
+	pending []byte
+	buf     []byte
+}
+
+func newEncryptingReader(c *contentenc.ContentEnc, plain io.Reader, ivs pathiv.FileIVs, size int64) *encryptingReader {
+	r := &encryptingReader{
+		f: File{
+			header:     contentenc.FileHeader{Version: contentenc.CurrentVersion, ID: ivs.ID},
+			block0IV:   ivs.Block0IV,
+			contentEnc: c,
+		},
+		plain: plain,
+		buf:   make([]byte, tarReadBlocks*c.PlainBS()),
+	}
+	if size > 0 {
+		r.pending = r.f.header.Pack()
+	}
+	return r
+}
+
+func (r *encryptingReader) Read(p []byte) (int, error) {
+	if len(r.pending) == 0 {
+		n, err := io.ReadFull(r.plain, r.buf)
+		if n == 0 {
+			if err == io.ErrUnexpectedEOF {
+				err = io.EOF
+			}
+			return 0, err
+		}
+		r.pending = r.f.encryptBlocks(r.buf[:n], r.blockNo, r.f.header.ID, r.f.block0IV)
+		r.blockNo += tarReadBlocks
+	}
+	n := copy(p, r.pending)
+	r.pending = r.pending[n:]
+	return n, nil
+}
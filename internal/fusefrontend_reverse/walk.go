@@ -0,0 +1,248 @@
+package fusefrontend_reverse
+
+import (
+	"path/filepath"
+	"sort"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/inomap"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// walkEntry is an entry of the plaintext tree, as passed to the visit
+// function of walkPlain.
+type walkEntry struct {
+	// parent is the directory the entry lives in, nil for the root directory
+	parent *walkEntry
+	// pPath is the relative plaintext path, cPath the relative ciphertext
+	// path. Both are "" for the root directory.
+	pPath string
+	cPath string
+	// cFullName is the encrypted name if cPath ends in a hashed
+	// gocryptfs.longname.* name, otherwise "".
+	cFullName string
+	// dirfd and name locate the entry for the *at syscalls. For the root
+	// directory and "-merge"d directories, dirfd is the directory itself and
+	// name is ".".
+	dirfd int
+	name  string
+	// fd is an O_RDONLY fd of the entry if it is a directory, otherwise -1.
+	// Only valid during the visit.
+	fd int
+	// st is the stat data like the reverse mount presents it, lst the stat
+	// data of the entry itself.
+	st  unix.Stat_t
+	lst unix.Stat_t
+	// followed is set if the entry is a symlink that is presented as its
+	// target (-follow-symlinks). viaSymlink is set if the entry or one of
+	// its parents is.
+	followed   bool
+	viaSymlink bool
+	// isConf is set for ".gocryptfs.reverse.conf", which is presented as
+	// "gocryptfs.conf" and not encrypted.
+	isConf bool
+	// mark can be set when visiting a directory, and is seen by its
+	// contents through "parent".
+	mark bool
+}
+
+// plainWalker holds the state of one walkPlain tree walk.
+type plainWalker struct {
+	rn    *RootNode
+	visit func(e *walkEntry) error
+	// ancestors contains the directories we are currently inside of. Used to
+	// detect directory loops with -follow-symlinks.
+	ancestors map[inomap.QIno]struct{}
+}
+
+// walkPlain walks the plaintext tree like the reverse mount presents it and
+// calls "visit" for every entry, for directories before their contents.
+// -exclude, -merge, -one-file-system and -follow-symlinks are applied, and
+// directory loops are presented as symlinks. An error returned by "visit"
+// aborts the walk.
+//
+// Like the FUSE operations, the walk does not use paths: directories are
+// opened with openat relative to their parent, and entries are stat'ed with
+// fstatat, so a directory that is replaced by a symlink while we walk cannot
+// lead us out of the tree. Entries that disappear while we walk are skipped.
+func (rn *RootNode) walkPlain(visit func(e *walkEntry) error) error {
+	w := plainWalker{
+		rn:        rn,
+		visit:     visit,
+		ancestors: make(map[inomap.QIno]struct{}),
+	}
+	root := &walkEntry{}
+	if err := w.openTop(root, rn.args.Cipherdir); err != nil {
+		return err
+	}
+	return w.dir(root)
+}
+
+// openTop opens "dir", the root directory or a "-merge"d directory, for the
+// entry "e".
+func (w *plainWalker) openTop(e *walkEntry, dir string) error {
+	fd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	if err = unix.Fstat(fd, &e.st); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	e.lst = e.st
+	e.fd, e.dirfd, e.name = fd, fd, "."
+	return nil
+}
+
+// dir visits the directory "e" and its contents, and closes e.fd.
+func (w *plainWalker) dir(e *walkEntry) error {
+	defer syscall.Close(e.fd)
+	rn := w.rn
+	if err := w.visit(e); err != nil {
+		return err
+	}
+	// -one-file-system: directories on other filesystems are presented as
+	// empty directories
+	if rn.args.OneFileSystem && e.pPath != "" && uint64(e.st.Dev) != rn.rootDevOf(e.pPath) {
+		return nil
+	}
+	qino := inomap.NewQIno(uint64(e.st.Dev), 0, uint64(e.st.Ino))
+	w.ancestors[qino] = struct{}{}
+	defer delete(w.ancestors, qino)
+
+	entries, err := syscallcompat.Getdents(e.fd)
+	if err != nil {
+		return err
+	}
+	if e.parent == nil {
+		entries = rn.mergeDirEntries(entries)
+	}
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name)
+	}
+	// Sort to make the result deterministic
+	sort.Strings(names)
+	for _, pName := range names {
+		c, err := w.child(e, pName)
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+		if c.fd >= 0 {
+			err = w.dir(c)
+		} else {
+			err = w.visit(c)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// child returns the entry "pName" of the directory "parent". Returns nil if
+// the entry is not presented, or has disappeared.
+func (w *plainWalker) child(parent *walkEntry, pName string) (*walkEntry, error) {
+	rn := w.rn
+	e := &walkEntry{
+		parent:     parent,
+		pPath:      filepath.Join(parent.pPath, pName),
+		dirfd:      parent.fd,
+		name:       pName,
+		fd:         -1,
+		viaSymlink: parent.viaSymlink,
+	}
+	if rn.isExcludedPlain(e.pPath) {
+		return nil, nil
+	}
+	isRoot := parent.parent == nil
+	var cName string
+	if isRoot && !rn.args.ConfigCustom && pName == configfile.ConfReverseName {
+		// ".gocryptfs.reverse.conf" in the root directory is mapped to
+		// "gocryptfs.conf"
+		cName = configfile.ConfDefaultName
+		e.isConf = true
+	} else if rn.args.PlaintextNames {
+		if isRoot && !rn.args.ConfigCustom && pName == configfile.ConfDefaultName {
+			tlog.Debug.Printf("walkPlain: skipping %q, it collides with the config file", e.pPath)
+			return nil, nil
+		}
+		cName = pName
+	} else {
+		var err error
+		cName, err = rn.encryptChildName(parent.cPath, pName)
+		if err == nil && nametransform.IsLongContent(cName) {
+			// The gocryptfs.longname.*.name file holds the full name
+			e.cFullName, err = rn.nameTransform.EncryptName(pName, rn.deriveDirIV(parent.cPath))
+		}
+		if err != nil {
+			tlog.Warn.Printf("walkPlain: cannot encrypt name %q: %v", e.pPath, err)
+			return nil, nil
+		}
+	}
+	e.cPath = filepath.Join(parent.cPath, cName)
+
+	if dir, ok := rn.args.MergeDirs[pName]; ok && isRoot {
+		if err := w.openTop(e, dir); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+	err := syscallcompat.Fstatat(e.dirfd, pName, &e.lst, unix.AT_SYMLINK_NOFOLLOW)
+	if err == syscall.ENOENT {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	e.st = e.lst
+	if e.isConf || rn.args.FollowSymlinks && e.lst.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		var tst unix.Stat_t
+		// Like followSymlink, dangling symlinks and symlinks to another
+		// filesystem (with -one-file-system) stay symlinks.
+		// syscallcompat.Fstatat always adds AT_SYMLINK_NOFOLLOW.
+		if unix.Fstatat(e.dirfd, pName, &tst, 0) == nil &&
+			(e.isConf || !rn.args.OneFileSystem || uint64(tst.Dev) == rn.rootDevOf(e.pPath)) {
+			e.st = tst
+			e.followed = true
+		}
+	}
+	if e.st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		e.viaSymlink = e.viaSymlink || e.followed
+		return e, nil
+	}
+	if _, loop := w.ancestors[inomap.NewQIno(uint64(e.st.Dev), 0, uint64(e.st.Ino))]; loop {
+		// Directory loop through a symlink. The reverse mount presents it
+		// as a symlink.
+		e.st = e.lst
+		e.followed = false
+		return e, nil
+	}
+	e.viaSymlink = e.viaSymlink || e.followed
+	fd, err := openatMaybeFollow(e.dirfd, pName, syscall.O_RDONLY|syscall.O_DIRECTORY, e.followed)
+	if err == syscall.ENOENT || err == syscall.ENOTDIR || err == syscall.ELOOP {
+		// Replaced while we walk the tree
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var fst unix.Stat_t
+	if err = unix.Fstat(fd, &fst); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	if fst.Dev != e.st.Dev || fst.Ino != e.st.Ino {
+		// Replaced while we walk the tree
+		syscall.Close(fd)
+		return nil, nil
+	}
+	e.fd = fd
+	return e, nil
+}
@@ -122,6 +122,14 @@ func (m *InoMap) Translate(in QIno) (out uint64) {
 	return out
 }
 
+// Len returns the number of namespaces and the number of inode numbers in
+// the spill map
+func (m *InoMap) Len() (namespaces int, spilled int) {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.namespaceMap), len(m.spillMap)
+}
+
 // TranslateStat translates (device, ino) pair contained in "st" into a unique
 // inode number and overwrites the ino in "st" with it.
 // Convenience wrapper around Translate().
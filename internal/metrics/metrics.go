@@ -0,0 +1,87 @@
+// Package metrics serves counters and latency histograms in the Prometheus
+// text exposition format, see
+// https://prometheus.io/docs/instrumenting/exposition_formats/ .
+// There are no dependencies on the Prometheus client libraries, the format
+// is simple enough to write by hand.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// Prefix is prepended to all metric names
+const Prefix = "gocryptfs_"
+
+// Source is implemented by the FUSE frontends. WriteMetrics writes the
+// current values of their counters and gauges.
+type Source interface {
+	WriteMetrics(w *Writer)
+}
+
+// Writer writes metrics in the text exposition format. Write errors are
+// remembered and returned by Err().
+type Writer struct {
+	w   io.Writer
+	err error
+}
+
+// NewWriter returns a Writer that writes to "w"
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Err returns the first write error
+func (w *Writer) Err() error {
+	return w.err
+}
+
+func (w *Writer) printf(format string, a ...any) {
+	if w.err != nil {
+		return
+	}
+	_, w.err = fmt.Fprintf(w.w, format, a...)
+}
+
+// header writes the HELP and TYPE lines for metric "name"
+func (w *Writer) header(name string, help string, typ string) {
+	w.printf("# HELP %s%s %s\n# TYPE %s%s %s\n", Prefix, name, help, Prefix, name, typ)
+}
+
+// Counter writes a counter, a value that only goes up. "name" should end
+// in "_total".
+func (w *Writer) Counter(name string, help string, v uint64) {
+	w.header(name, help, "counter")
+	w.printf("%s%s %d\n", Prefix, name, v)
+}
+
+// Gauge writes a gauge, a value that can go up and down
+func (w *Writer) Gauge(name string, help string, v int64) {
+	w.header(name, help, "gauge")
+	w.printf("%s%s %d\n", Prefix, name, v)
+}
+
+// formatFloat formats "f" like Prometheus does
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Serve answers HTTP GET requests for "/metrics" on "l" until "l" is closed.
+// "ops" may be nil.
+func Serve(l net.Listener, ops *Ops, src Source) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /metrics", func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w := NewWriter(rw)
+		if ops != nil {
+			ops.WriteMetrics(w)
+		}
+		if src != nil {
+			src.WriteMetrics(w)
+		}
+	})
+	return http.Serve(l, mux)
+}
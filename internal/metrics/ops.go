@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hanwen/go-fuse/v2/fuse"
+)
+
+// latencyBuckets are the upper bounds of the latency histogram buckets
+var latencyBuckets = [...]time.Duration{
+	10 * time.Microsecond,
+	100 * time.Microsecond,
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// opStats is the latency histogram of one FUSE operation
+type opStats struct {
+	// buckets[i] counts the operations that took at most latencyBuckets[i],
+	// and longer than latencyBuckets[i-1]. The last element counts the rest.
+	buckets [len(latencyBuckets) + 1]atomic.Uint64
+	// sum of the durations in nanoseconds
+	sum atomic.Uint64
+}
+
+// Ops counts FUSE operations and their latencies, per operation type. It is
+// passed to go-fuse's RecordLatencies.
+type Ops struct {
+	// ops maps the operation name ("LOOKUP", "READ", ...) to *opStats
+	ops sync.Map
+}
+
+var _ fuse.LatencyMap = &Ops{} // Verify that interface is implemented.
+
+// Add implements fuse.LatencyMap
+func (o *Ops) Add(name string, dt time.Duration) {
+	v, ok := o.ops.Load(name)
+	if !ok {
+		v, _ = o.ops.LoadOrStore(name, &opStats{})
+	}
+	s := v.(*opStats)
+	i, _ := slices.BinarySearch(latencyBuckets[:], dt)
+	s.buckets[i].Add(1)
+	s.sum.Add(uint64(dt))
+}
+
+// WriteMetrics writes one histogram with an "op" label for each operation
+// that has been seen
+func (o *Ops) WriteMetrics(w *Writer) {
+	var names []string
+	o.ops.Range(func(k, v any) bool {
+		names = append(names, k.(string))
+		return true
+	})
+	slices.Sort(names)
+	const name = Prefix + "fuse_op_duration_seconds"
+	w.header("fuse_op_duration_seconds", "Time it took to handle FUSE operations.", "histogram")
+	for _, op := range names {
+		v, _ := o.ops.Load(op)
+		s := v.(*opStats)
+		var count uint64
+		for i, b := range latencyBuckets {
+			count += s.buckets[i].Load()
+			w.printf("%s_bucket{op=%q,le=%q} %d\n", name, op, formatFloat(b.Seconds()), count)
+		}
+		count += s.buckets[len(latencyBuckets)].Load()
+		w.printf("%s_bucket{op=%q,le=\"+Inf\"} %d\n", name, op, count)
+		w.printf("%s_sum{op=%q} %s\n", name, op, formatFloat(time.Duration(s.sum.Load()).Seconds()))
+		w.printf("%s_count{op=%q} %d\n", name, op, count)
+	}
+}
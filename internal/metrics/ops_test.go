@@ -0,0 +1,47 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestOpsHistogram(t *testing.T) {
+	var o Ops
+	o.Add("READ", 5*time.Microsecond)
+	o.Add("READ", time.Millisecond)
+	o.Add("READ", time.Minute)
+	o.Add("LOOKUP", 50*time.Microsecond)
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	o.WriteMetrics(w)
+	if w.Err() != nil {
+		t.Fatal(w.Err())
+	}
+	want := `# HELP gocryptfs_fuse_op_duration_seconds Time it took to handle FUSE operations.
+# TYPE gocryptfs_fuse_op_duration_seconds histogram
+gocryptfs_fuse_op_duration_seconds_bucket{op="LOOKUP",le="1e-05"} 0
+gocryptfs_fuse_op_duration_seconds_bucket{op="LOOKUP",le="0.0001"} 1
+gocryptfs_fuse_op_duration_seconds_bucket{op="LOOKUP",le="0.001"} 1
+gocryptfs_fuse_op_duration_seconds_bucket{op="LOOKUP",le="0.01"} 1
+gocryptfs_fuse_op_duration_seconds_bucket{op="LOOKUP",le="0.1"} 1
+gocryptfs_fuse_op_duration_seconds_bucket{op="LOOKUP",le="1"} 1
+gocryptfs_fuse_op_duration_seconds_bucket{op="LOOKUP",le="10"} 1
+gocryptfs_fuse_op_duration_seconds_bucket{op="LOOKUP",le="+Inf"} 1
+gocryptfs_fuse_op_duration_seconds_sum{op="LOOKUP"} 5e-05
+gocryptfs_fuse_op_duration_seconds_count{op="LOOKUP"} 1
+gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="1e-05"} 1
+gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="0.0001"} 1
+gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="0.001"} 2
+gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="0.01"} 2
+gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="0.1"} 2
+gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="1"} 2
+gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="10"} 2
+gocryptfs_fuse_op_duration_seconds_bucket{op="READ",le="+Inf"} 3
+gocryptfs_fuse_op_duration_seconds_sum{op="READ"} 60.001005
+gocryptfs_fuse_op_duration_seconds_count{op="READ"} 3
+`
+	if buf.String() != want {
+		t.Errorf("wrong output:\n%s", buf.String())
+	}
+}
@@ -0,0 +1,194 @@
+package offline
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// BadEntry is a directory entry whose name cannot be decrypted
+type BadEntry struct {
+	// CName is the ciphertext name on disk
+	CName string
+	Err   error
+}
+
+// DirCheck is the result of CheckDir
+type DirCheck struct {
+	// DirIVErr is set if gocryptfs.diriv is missing or invalid. All
+	// entries are in Bad then.
+	DirIVErr error
+	// Entries have been decrypted successfully
+	Entries []DirEntry
+	// Bad entries cannot be decrypted, or have no readable
+	// gocryptfs.longname.*.name file
+	Bad []BadEntry
+	// OrphanNames are gocryptfs.longname.*.name files whose entry is gone
+	OrphanNames []string
+	// TempFiles are leftovers of interrupted gocryptfs operations:
+	// gocryptfs.*.tmp and gocryptfs.diriv.rmdir.* files
+	TempFiles []string
+	// Foreign are names starting with a dot, which encrypted names never do.
+	// They belong to other programs (sync clients, NFS, rsync) and are left
+	// alone.
+	Foreign []string
+}
+
+// CheckDir checks the names in the ciphertext directory "cDir". Internal
+// files starting with "gocryptfs." (other than long names and temporary
+// files) are ignored.
+func (f *FS) CheckDir(cDir string) (*DirCheck, error) {
+	dir, err := f.openDir(cDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	cNames, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var c DirCheck
+	var dirIV []byte
+	if !f.args.PlaintextNames {
+		dirIV, c.DirIVErr = f.nameTransform.ReadDirIVAt(int(dir.Fd()))
+	}
+	present := make(map[string]bool, len(cNames))
+	for _, cName := range cNames {
+		present[cName] = true
+	}
+	for _, cName := range cNames {
+		if cDir == "" && cName == configfile.ConfDefaultName && !f.args.ConfigCustom {
+			continue
+		}
+		if f.args.PlaintextNames {
+			c.Entries = append(c.Entries, DirEntry{Name: cName, CName: cName})
+			continue
+		}
+		if isTempFile(cName) {
+			c.TempFiles = append(c.TempFiles, cName)
+			continue
+		}
+		if strings.HasPrefix(cName, ".") {
+			c.Foreign = append(c.Foreign, cName)
+			continue
+		}
+		isLong := nametransform.LongNameNone
+		if f.args.LongNames {
+			isLong = nametransform.NameType(cName)
+		}
+		if isLong == nametransform.LongNameFilename {
+			if !present[strings.TrimSuffix(cName, nametransform.LongNameSuffix)] {
+				c.OrphanNames = append(c.OrphanNames, cName)
+			}
+			continue
+		}
+		if isLong == nametransform.LongNameNone && strings.HasPrefix(cName, "gocryptfs.") {
+			continue
+		}
+		if c.DirIVErr != nil {
+			c.Bad = append(c.Bad, BadEntry{cName, c.DirIVErr})
+			continue
+		}
+		cNameFull := cName
+		if isLong == nametransform.LongNameContent {
+			cNameFull, err = nametransform.ReadLongNameAt(int(dir.Fd()), cName)
+			if err != nil {
+				c.Bad = append(c.Bad, BadEntry{cName, err})
+				continue
+			}
+		}
+		name, err := f.nameTransform.DecryptName(cNameFull, dirIV)
+		if err != nil {
+			c.Bad = append(c.Bad, BadEntry{cName, err})
+			continue
+		}
+		c.Entries = append(c.Entries, DirEntry{Name: name, CName: cName})
+	}
+	return &c, nil
+}
+
+// isTempFile returns true if "cName" is a temporary file gocryptfs itself
+// creates: "gocryptfs.conf.tmp" while writing the config, and
+// "gocryptfs.diriv.rmdir.XYZ" while deleting a directory.
+func isTempFile(cName string) bool {
+	if strings.HasPrefix(cName, nametransform.DirIVFilename+".rmdir.") {
+		return true
+	}
+	return strings.HasPrefix(cName, "gocryptfs.") && strings.HasSuffix(cName, ".tmp")
+}
+
+// RecreateDirIV creates a new gocryptfs.diriv file in the ciphertext
+// directory "cDir". An existing, damaged one is not deleted but renamed to
+// "gocryptfs.diriv.bad.XYZ", whose name is returned in "backup", because it
+// may still hold the IV the names were encrypted with. The names that were
+// encrypted with the old IV cannot be decrypted any more.
+func (f *FS) RecreateDirIV(cDir string) (backup string, err error) {
+	if f.args.PlaintextNames || f.args.DeterministicNames {
+		return "", nil
+	}
+	dir, err := f.openDir(cDir)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+	dirfd := int(dir.Fd())
+	var st unix.Stat_t
+	err = unix.Fstatat(dirfd, nametransform.DirIVFilename, &st, unix.AT_SYMLINK_NOFOLLOW)
+	if err == nil {
+		backup = fmt.Sprintf("%s.bad.%d", nametransform.DirIVFilename, cryptocore.RandUint64())
+		err = syscallcompat.Renameat(dirfd, nametransform.DirIVFilename, dirfd, backup)
+		if err != nil {
+			return "", &os.LinkError{Op: "rename", Old: filepath.Join(f.abs(cDir), nametransform.DirIVFilename),
+				New: filepath.Join(f.abs(cDir), backup), Err: err}
+		}
+	} else if !errors.Is(err, syscall.ENOENT) {
+		return "", &os.PathError{Op: "stat", Path: filepath.Join(f.abs(cDir), nametransform.DirIVFilename), Err: err}
+	}
+	return backup, nametransform.WriteDirIVAt(dirfd)
+}
+
+// RemoveOrphanName deletes the gocryptfs.longname.*.name file "cName" in
+// the ciphertext directory "cDir".
+func (f *FS) RemoveOrphanName(cDir string, cName string) error {
+	return syscall.Unlink(filepath.Join(f.abs(cDir), cName))
+}
+
+// CheckXattrs returns the extended attributes of the ciphertext file "cPath"
+// whose name or value cannot be decrypted.
+func (f *FS) CheckXattrs(cPath string) ([]BadEntry, error) {
+	cNames, err := syscallcompat.Llistxattr(f.abs(cPath))
+	if err != nil {
+		if err == syscall.EOPNOTSUPP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var bad []BadEntry
+	for _, cAttr := range cNames {
+		if isAcl(cAttr) || !strings.HasPrefix(cAttr, xattrStorePrefix) {
+			continue
+		}
+		if _, err := f.nameTransform.DecryptXattrName(cAttr[len(xattrStorePrefix):]); err != nil {
+			bad = append(bad, BadEntry{cAttr, err})
+			continue
+		}
+		cData, err := syscallcompat.Lgetxattr(f.abs(cPath), cAttr)
+		if err != nil {
+			return bad, err
+		}
+		if _, err := f.decryptXattrValue(cData); err != nil {
+			bad = append(bad, BadEntry{cAttr, err})
+		}
+	}
+	return bad, nil
+}
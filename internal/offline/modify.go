@@ -0,0 +1,277 @@
+package offline
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// isLong returns true if "cName" is a hashed long name
+func (f *FS) isLong(cName string) bool {
+	return !f.args.PlaintextNames && nametransform.IsLongContent(cName)
+}
+
+// CreateName encrypts the plaintext name "name" for a new entry in the
+// ciphertext directory "cDir". For long names, the
+// gocryptfs.longname.*.name file is created as well.
+func (f *FS) CreateName(cDir string, name string) (cName string, err error) {
+	cName, err = f.EncryptName(cDir, name)
+	if err != nil || !f.isLong(cName) {
+		return cName, err
+	}
+	dir, err := f.openDir(cDir)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+	err = f.nameTransform.WriteLongNameAt(int(dir.Fd()), cName, name)
+	if err != nil && !errors.Is(err, syscall.EEXIST) {
+		return "", err
+	}
+	return cName, nil
+}
+
+// DeleteName deletes the gocryptfs.longname.*.name file of "cName" in the
+// ciphertext directory "cDir". Does nothing for short names.
+func (f *FS) DeleteName(cDir string, cName string) error {
+	if !f.isLong(cName) {
+		return nil
+	}
+	dir, err := f.openDir(cDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return nametransform.DeleteLongNameAt(int(dir.Fd()), cName)
+}
+
+// Mkdir creates the ciphertext directory "cPath" with permissions "mode",
+// and its gocryptfs.diriv file. The name must have been created with
+// CreateName.
+func (f *FS) Mkdir(cPath string, mode uint32) error {
+	// We need write and execute permissions to create gocryptfs.diriv
+	err := os.Mkdir(f.abs(cPath), 0700)
+	if err != nil {
+		return err
+	}
+	if !f.args.PlaintextNames && !f.args.DeterministicNames {
+		dir, err := f.openDir(cPath)
+		if err == nil {
+			err = nametransform.WriteDirIVAt(int(dir.Fd()))
+			dir.Close()
+		}
+		if err != nil {
+			// Delete inconsistent directory (missing gocryptfs.diriv!)
+			syscall.Rmdir(f.abs(cPath))
+			return err
+		}
+	}
+	return syscall.Chmod(f.abs(cPath), mode&07777)
+}
+
+// Rmdir deletes the empty ciphertext directory "cPath" and its
+// gocryptfs.diriv file.
+func (f *FS) Rmdir(cPath string) error {
+	return f.replaceEmptyDir(cPath, func() error {
+		return syscall.Rmdir(f.abs(cPath))
+	})
+}
+
+// replaceEmptyDir runs "fn", which deletes or replaces the ciphertext
+// directory "cPath", after checking that it is empty. Like fusefrontend,
+// gocryptfs.diriv is moved out of the way first, so we can roll back if "fn"
+// fails, for example because the directory gained new entries in the
+// meantime.
+func (f *FS) replaceEmptyDir(cPath string, fn func() error) error {
+	if f.args.PlaintextNames || f.args.DeterministicNames {
+		return fn()
+	}
+	abs := f.abs(cPath)
+	dir, err := f.openDir(cPath)
+	if err != nil {
+		return err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return err
+	}
+	for _, n := range names {
+		if n != nametransform.DirIVFilename {
+			return syscall.ENOTEMPTY
+		}
+	}
+	if len(names) == 0 {
+		return fn()
+	}
+	tmp := filepath.Join(filepath.Dir(abs),
+		fmt.Sprintf("%s.rmdir.%d", nametransform.DirIVFilename, cryptocore.RandUint64()))
+	if err = os.Rename(filepath.Join(abs, nametransform.DirIVFilename), tmp); err != nil {
+		return err
+	}
+	if err = fn(); err != nil {
+		os.Rename(tmp, filepath.Join(abs, nametransform.DirIVFilename))
+		return err
+	}
+	return syscall.Unlink(tmp)
+}
+
+// Remove deletes the ciphertext file or empty directory "cPath".
+func (f *FS) Remove(cPath string) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(f.abs(cPath), &st); err != nil {
+		return err
+	}
+	var err error
+	if st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		err = f.Rmdir(cPath)
+	} else {
+		err = syscall.Unlink(f.abs(cPath))
+	}
+	if err != nil {
+		return err
+	}
+	return f.DeleteName(filepath.Dir(cPath), filepath.Base(cPath))
+}
+
+// Rename moves the ciphertext entry "cOld" to the plaintext name "newName"
+// in the ciphertext directory "cNewDir". An existing file, or an empty
+// directory, at the destination is replaced. A file cannot replace a
+// directory (EISDIR). Returns the new ciphertext path.
+func (f *FS) Rename(cOld string, cNewDir string, newName string) (cNew string, err error) {
+	cName, err := f.CreateName(cNewDir, newName)
+	if err != nil {
+		return "", err
+	}
+	cNew = filepath.Join(cNewDir, cName)
+	if cNew == cOld {
+		return cNew, nil
+	}
+	var st unix.Stat_t
+	existed := unix.Lstat(f.abs(cNew), &st) == nil
+	// os.Rename refuses to replace directories, so use the syscall
+	rename := func() error {
+		if err := syscall.Rename(f.abs(cOld), f.abs(cNew)); err != nil {
+			return &os.LinkError{Op: "rename", Old: f.abs(cOld), New: f.abs(cNew), Err: err}
+		}
+		return nil
+	}
+	if existed && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+		var srcSt unix.Stat_t
+		if err = unix.Lstat(f.abs(cOld), &srcSt); err != nil {
+			return "", err
+		}
+		if srcSt.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+			return "", syscall.EISDIR
+		}
+		// The destination contains gocryptfs.diriv, so the kernel would
+		// refuse to replace it
+		err = f.replaceEmptyDir(cNew, rename)
+	} else {
+		err = rename()
+	}
+	if err != nil {
+		if !existed {
+			f.DeleteName(cNewDir, cName)
+		}
+		return "", err
+	}
+	return cNew, f.DeleteName(filepath.Dir(cOld), filepath.Base(cOld))
+}
+
+// Symlink creates the ciphertext symlink "cPath" pointing to the plaintext
+// target "target".
+func (f *FS) Symlink(target string, cPath string) error {
+	return os.Symlink(f.encryptSymlinkTarget(target), f.abs(cPath))
+}
+
+// FileWriter writes the plaintext that is passed to Write() encrypted into a
+// ciphertext file. It only supports sequential writes. Call Close() when
+// done, otherwise the last partial block is lost.
+type FileWriter struct {
+	fs      *FS
+	fd      *os.File
+	fileID  []byte
+	blockNo uint64
+	// buf holds the plaintext of a partial block
+	buf []byte
+}
+
+// Create creates or truncates the ciphertext file "cPath" and returns a
+// FileWriter for it.
+func (f *FS) Create(cPath string, mode uint32) (*FileWriter, error) {
+	fd, err := syscallcompat.Open(f.abs(cPath),
+		syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC|syscall.O_NOFOLLOW, mode&07777)
+	if err != nil {
+		return nil, &os.PathError{Op: "create", Path: f.abs(cPath), Err: err}
+	}
+	return &FileWriter{
+		fs: f,
+		fd: os.NewFile(uintptr(fd), f.abs(cPath)),
+	}, nil
+}
+
+// Write implements io.Writer
+func (w *FileWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	ce := w.fs.contentEnc
+	if w.fileID == nil {
+		// Empty files have no header, so we only write it now
+		h := contentenc.RandomHeader()
+		if _, err := w.fd.Write(h.Pack()); err != nil {
+			return 0, err
+		}
+		w.fileID = h.ID
+	}
+	bs := int(ce.PlainBS())
+	w.buf = append(w.buf, p...)
+	full := len(w.buf) / bs * bs
+	if full == 0 {
+		return len(p), nil
+	}
+	if err := w.writeBlocks(w.buf[:full]); err != nil {
+		return 0, err
+	}
+	w.buf = append(w.buf[:0], w.buf[full:]...)
+	return len(p), nil
+}
+
+// writeBlocks encrypts and writes "data", which is a sequence of full
+// blocks, except when called from Close().
+func (w *FileWriter) writeBlocks(data []byte) error {
+	ce := w.fs.contentEnc
+	bs := int(ce.PlainBS())
+	var blocks [][]byte
+	for off := 0; off < len(data); off += bs {
+		blocks = append(blocks, data[off:min(off+bs, len(data))])
+	}
+	cData := ce.EncryptBlocks(blocks, w.blockNo, w.fileID)
+	_, err := w.fd.Write(cData)
+	ce.CReqPool.Put(cData)
+	w.blockNo += uint64(len(blocks))
+	return err
+}
+
+// Close writes the last partial block and closes the file
+func (w *FileWriter) Close() error {
+	var err error
+	if len(w.buf) > 0 {
+		err = w.writeBlocks(w.buf)
+		w.buf = nil
+	}
+	if err2 := w.fd.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
@@ -0,0 +1,90 @@
+// Package offline reads and writes forward-mode gocryptfs filesystems
+// directly, without a FUSE mount. It is used by "-decrypt-tree" and
+// "-encrypt-tree", for machines that have no /dev/fuse, and by the public
+// "volume" package.
+package offline
+
+import (
+	"io"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+// Args is the subset of fusefrontend.Args that applies to offline access.
+type Args struct {
+	// Cipherdir is the absolute path to the ciphertext directory
+	Cipherdir string
+	// PlaintextNames disables filename encryption
+	PlaintextNames bool
+	// DeterministicNames disables gocryptfs.diriv files
+	DeterministicNames bool
+	// LongNames enables the gocryptfs.longname.* handling
+	LongNames bool
+	// ConfigCustom is true when the config file is not gocryptfs.conf in
+	// the root directory. gocryptfs.conf is hidden otherwise.
+	ConfigCustom bool
+}
+
+// FS gives access to the files in a gocryptfs cipherdir. Paths passed to
+// and returned from FS are relative to Args.Cipherdir.
+type FS struct {
+	args          Args
+	contentEnc    *contentenc.ContentEnc
+	nameTransform *nametransform.NameTransform
+}
+
+// New returns an FS for the cipherdir in "args".
+func New(args Args, c *contentenc.ContentEnc, n *nametransform.NameTransform) *FS {
+	return &FS{
+		args:          args,
+		contentEnc:    c,
+		nameTransform: n,
+	}
+}
+
+// abs returns the absolute path of the relative ciphertext path "cPath"
+func (f *FS) abs(cPath string) string {
+	return filepath.Join(f.args.Cipherdir, cPath)
+}
+
+// Entry describes a file, directory, symlink or device node in a tree that
+// is passed to a TreeWriter.
+type Entry struct {
+	// Path is the relative plaintext path. The root of the tree is "".
+	Path string
+	// Mode contains the file type (S_IFMT) and permission bits
+	Mode uint32
+	Uid  uint32
+	Gid  uint32
+	// Rdev is the device number of device nodes
+	Rdev uint64
+	// Size is the plaintext size of regular files
+	Size  int64
+	Atime time.Time
+	Mtime time.Time
+	// Target is the plaintext symlink target
+	Target string
+	// Xattrs maps plaintext extended attribute names to values
+	Xattrs map[string][]byte
+}
+
+// IsDir returns true if e is a directory
+func (e *Entry) IsDir() bool {
+	return e.Mode&syscall.S_IFMT == syscall.S_IFDIR
+}
+
+// TreeWriter receives the entries of a tree in depth-first order.
+// Each directory is passed to WriteEntry before and to DirDone after its
+// contents.
+type TreeWriter interface {
+	// WriteEntry creates "e". For regular files, "content" returns the
+	// plaintext content.
+	WriteEntry(e *Entry, content io.Reader) error
+	// DirDone is called after all entries of directory "e" have been
+	// written. This is where the directory timestamps are set.
+	DirDone(e *Entry) error
+}
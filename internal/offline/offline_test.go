@@ -0,0 +1,227 @@
+package offline
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+func newTestFS(t *testing.T) *FS {
+	key := make([]byte, cryptocore.KeyLen)
+	cCore := cryptocore.New(key, cryptocore.BackendGoGCM, contentenc.DefaultIVBits, true)
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	nameTransform := nametransform.New(cCore.EMECipher, true, 0, false, nil, false)
+	cipherdir := t.TempDir()
+	dirfd, err := syscall.Open(cipherdir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = nametransform.WriteDirIVAt(dirfd); err != nil {
+		t.Fatal(err)
+	}
+	return New(Args{Cipherdir: cipherdir, LongNames: true}, cEnc, nameTransform)
+}
+
+// testTree creates a plaintext tree and returns its path
+func testTree(t *testing.T) string {
+	dir := t.TempDir()
+	long := strings.Repeat("x", 240)
+	if err := os.MkdirAll(dir+"/sub/"+long, 0755); err != nil {
+		t.Fatal(err)
+	}
+	big := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	files := map[string][]byte{
+		"empty":              nil,
+		"small":              []byte("hello"),
+		"sub/big":            big,
+		"sub/" + long + "/f": []byte("in long dir"),
+	}
+	for p, content := range files {
+		if err := os.WriteFile(dir+"/"+p, content, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("../small", dir+"/sub/link"); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Setxattr(dir+"/small", "user.foo", []byte("bar"), 0); err != nil {
+		t.Logf("xattrs not supported: %v", err)
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	if err := os.Chtimes(dir+"/sub", mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// compareTrees checks that the trees "a" and "b" have the same content,
+// modes, symlinks, mtimes and xattrs.
+func compareTrees(t *testing.T, a string, b string) {
+	err := filepath.Walk(a, func(path string, fiA os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(a, path)
+		fiB, err := os.Lstat(filepath.Join(b, rel))
+		if err != nil {
+			t.Errorf("%s: %v", rel, err)
+			return nil
+		}
+		if fiA.Mode() != fiB.Mode() {
+			t.Errorf("%s: mode %v != %v", rel, fiA.Mode(), fiB.Mode())
+		}
+		if !fiA.ModTime().Equal(fiB.ModTime()) {
+			t.Errorf("%s: mtime %v != %v", rel, fiA.ModTime(), fiB.ModTime())
+		}
+		switch {
+		case fiA.Mode().IsRegular():
+			ca, _ := os.ReadFile(path)
+			cb, _ := os.ReadFile(filepath.Join(b, rel))
+			if !bytes.Equal(ca, cb) {
+				t.Errorf("%s: content differs", rel)
+			}
+			xa, _ := readXattrs(path)
+			xb, _ := readXattrs(filepath.Join(b, rel))
+			if len(xa) != len(xb) || !bytes.Equal(xa["user.foo"], xb["user.foo"]) {
+				t.Errorf("%s: xattrs %v != %v", rel, xa, xb)
+			}
+		case fiA.Mode()&os.ModeSymlink != 0:
+			la, _ := os.Readlink(path)
+			lb, _ := os.Readlink(filepath.Join(b, rel))
+			if la != lb {
+				t.Errorf("%s: symlink target %q != %q", rel, la, lb)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestRoundTrip encrypts a tree and decrypts it again
+func TestRoundTrip(t *testing.T) {
+	f := newTestFS(t)
+	plain := testTree(t)
+	w, err := f.NewTreeWriter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WalkDir(plain, w); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(t.TempDir(), "out")
+	if err = f.DecryptTree("", NewDirWriter(out)); err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, plain, out)
+
+	// Subtree
+	sub := filepath.Join(t.TempDir(), "sub")
+	if err = f.DecryptTree("sub", NewDirWriter(sub)); err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, filepath.Join(plain, "sub"), sub)
+
+	// Encrypting into an existing cipherdir replaces files
+	if err = os.WriteFile(plain+"/small", []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, _ = f.NewTreeWriter("")
+	if err = WalkDir(plain, w); err != nil {
+		t.Fatal(err)
+	}
+	out2 := filepath.Join(t.TempDir(), "out2")
+	if err = f.DecryptTree("", NewDirWriter(out2)); err != nil {
+		t.Fatal(err)
+	}
+	compareTrees(t, plain, out2)
+}
+
+// TestTar checks the tar output of DecryptTree
+func TestTar(t *testing.T) {
+	f := newTestFS(t)
+	plain := testTree(t)
+	w, _ := f.NewTreeWriter("")
+	if err := WalkDir(plain, w); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	tw := NewTarWriter(&buf)
+	if err := f.DecryptTree("", tw); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(&buf)
+	seen := make(map[string]*tar.Header)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[hdr.Name] = hdr
+		if hdr.Name == "./sub/big" {
+			content, _ := io.ReadAll(tr)
+			want, _ := os.ReadFile(plain + "/sub/big")
+			if !bytes.Equal(content, want) {
+				t.Errorf("sub/big: content differs")
+			}
+		}
+	}
+	for _, name := range []string{"./", "./empty", "./small", "./sub/", "./sub/big", "./sub/link"} {
+		if seen[name] == nil {
+			t.Errorf("%q missing in tar", name)
+		}
+	}
+	if hdr := seen["./sub/link"]; hdr != nil && hdr.Linkname != "../small" {
+		t.Errorf("wrong symlink target %q", hdr.Linkname)
+	}
+}
+
+// TestEncryptDecryptPath checks that DecryptPath reverses EncryptPath,
+// including paths with long names.
+func TestEncryptDecryptPath(t *testing.T) {
+	f := newTestFS(t)
+	w, err := f.NewTreeWriter("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = WalkDir(testTree(t), w); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("x", 240)
+	for _, pPath := range []string{"small", "sub/big", "sub/" + long, "sub/" + long + "/f"} {
+		cPath, err := f.EncryptPath(pPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = os.Lstat(f.abs(cPath)); err != nil {
+			t.Errorf("%q: %v", pPath, err)
+		}
+		have, err := f.DecryptPath(cPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != pPath {
+			t.Errorf("DecryptPath(%q) = %q, want %q", cPath, have, pPath)
+		}
+	}
+}
@@ -0,0 +1,440 @@
+package offline
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// We store encrypted xattrs under this prefix plus the base64-encoded
+// encrypted original name. Same as in fusefrontend.
+const xattrStorePrefix = "user.gocryptfs."
+
+// isAcl returns true if the attribute name is for storing ACLs.
+// ACLs are passed through without encryption.
+func isAcl(attr string) bool {
+	return attr == "system.posix_acl_access" || attr == "system.posix_acl_default"
+}
+
+// DirEntry is a decrypted directory entry
+type DirEntry struct {
+	// Name is the plaintext name
+	Name string
+	// CName is the ciphertext name on disk
+	CName string
+}
+
+// openDir opens the ciphertext directory "cDir"
+func (f *FS) openDir(cDir string) (*os.File, error) {
+	fd, err := syscallcompat.Open(f.abs(cDir), syscall.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: f.abs(cDir), Err: err}
+	}
+	return os.NewFile(uintptr(fd), f.abs(cDir)), nil
+}
+
+// readDirIV returns the directory IV of the ciphertext directory "cDir".
+func (f *FS) readDirIV(cDir string) ([]byte, error) {
+	dir, err := f.openDir(cDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	return f.nameTransform.ReadDirIVAt(int(dir.Fd()))
+}
+
+// ReadDir returns the decrypted entries of the ciphertext directory "cDir",
+// sorted by plaintext name. Like in a mount, entries whose names cannot be
+// decrypted are skipped with a warning.
+func (f *FS) ReadDir(cDir string) ([]DirEntry, error) {
+	dir, err := f.openDir(cDir)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	cNames, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	var dirIV []byte
+	if !f.args.PlaintextNames {
+		dirIV, err = f.nameTransform.ReadDirIVAt(int(dir.Fd()))
+		if err != nil {
+			return nil, err
+		}
+	}
+	entries := make([]DirEntry, 0, len(cNames))
+	for _, cName := range cNames {
+		if cDir == "" && cName == configfile.ConfDefaultName && !f.args.ConfigCustom {
+			// silently ignore "gocryptfs.conf" in the top level dir
+			continue
+		}
+		if f.args.PlaintextNames {
+			entries = append(entries, DirEntry{Name: cName, CName: cName})
+			continue
+		}
+		if !f.args.DeterministicNames && cName == nametransform.DirIVFilename {
+			continue
+		}
+		cNameFull := cName
+		isLong := nametransform.LongNameNone
+		if f.args.LongNames {
+			isLong = nametransform.NameType(cName)
+		}
+		if isLong == nametransform.LongNameContent {
+			cNameFull, err = nametransform.ReadLongNameAt(int(dir.Fd()), cName)
+			if err != nil {
+				tlog.Warn.Printf("ReadDir %q: incomplete entry %q: Could not read .name: %v",
+					cDir, cName, err)
+				continue
+			}
+		} else if isLong == nametransform.LongNameFilename {
+			continue
+		}
+		name, err := f.nameTransform.DecryptName(cNameFull, dirIV)
+		if err != nil {
+			tlog.Warn.Printf("ReadDir %q: could not decrypt entry %q: %v", cDir, cName, err)
+			continue
+		}
+		entries = append(entries, DirEntry{Name: name, CName: cName})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name < entries[j].Name
+	})
+	return entries, nil
+}
+
+// EncryptName encrypts the plaintext name "name" of an entry in the
+// ciphertext directory "cDir". Long names are hashed.
+func (f *FS) EncryptName(cDir string, name string) (cName string, err error) {
+	if f.args.PlaintextNames {
+		return name, nil
+	}
+	dirIV, err := f.readDirIV(cDir)
+	if err != nil {
+		return "", err
+	}
+	if f.args.LongNames {
+		return f.nameTransform.EncryptAndHashName(name, dirIV)
+	}
+	return f.nameTransform.EncryptName(name, dirIV)
+}
+
+// EncryptPath returns the relative ciphertext path of the relative
+// plaintext path "pPath". The parent directories must exist.
+func (f *FS) EncryptPath(pPath string) (cPath string, err error) {
+	if f.args.PlaintextNames || pPath == "" {
+		return pPath, nil
+	}
+	for _, part := range strings.Split(pPath, "/") {
+		cName, err := f.EncryptName(cPath, part)
+		if err != nil {
+			return "", err
+		}
+		cPath = filepath.Join(cPath, cName)
+	}
+	return cPath, nil
+}
+
+// DecryptPath returns the relative plaintext path of the relative
+// ciphertext path "cPath". The gocryptfs.diriv and
+// gocryptfs.longname.*.name files of the parent directories must exist.
+func (f *FS) DecryptPath(cPath string) (pPath string, err error) {
+	if f.args.PlaintextNames || cPath == "" {
+		return cPath, nil
+	}
+	cDir := ""
+	for _, cName := range strings.Split(cPath, "/") {
+		name, err := f.decryptName(cDir, cName)
+		if err != nil {
+			return "", err
+		}
+		pPath = filepath.Join(pPath, name)
+		cDir = filepath.Join(cDir, cName)
+	}
+	return pPath, nil
+}
+
+// decryptName decrypts the name "cName" of an entry in the ciphertext
+// directory "cDir".
+func (f *FS) decryptName(cDir string, cName string) (string, error) {
+	dir, err := f.openDir(cDir)
+	if err != nil {
+		return "", err
+	}
+	defer dir.Close()
+	dirIV, err := f.nameTransform.ReadDirIVAt(int(dir.Fd()))
+	if err != nil {
+		return "", err
+	}
+	if f.args.LongNames && nametransform.IsLongContent(cName) {
+		cName, err = nametransform.ReadLongNameAt(int(dir.Fd()), cName)
+		if err != nil {
+			return "", err
+		}
+	}
+	return f.nameTransform.DecryptName(cName, dirIV)
+}
+
+// Lstat returns the stat data of the ciphertext file "cPath". Sizes are
+// translated to plaintext sizes.
+func (f *FS) Lstat(cPath string) (*unix.Stat_t, error) {
+	var st unix.Stat_t
+	err := unix.Lstat(f.abs(cPath), &st)
+	if err != nil {
+		return nil, &os.PathError{Op: "lstat", Path: f.abs(cPath), Err: err}
+	}
+	switch st.Mode & syscall.S_IFMT {
+	case syscall.S_IFREG:
+		st.Size = int64(f.contentEnc.CipherSizeToPlainSize(uint64(st.Size)))
+	case syscall.S_IFLNK:
+		target, err := f.Readlink(cPath)
+		if err != nil {
+			return nil, err
+		}
+		st.Size = int64(len(target))
+	}
+	return &st, nil
+}
+
+// Readlink returns the decrypted target of the ciphertext symlink "cPath".
+func (f *FS) Readlink(cPath string) (string, error) {
+	cTarget, err := os.Readlink(f.abs(cPath))
+	if err != nil {
+		return "", err
+	}
+	if f.args.PlaintextNames || cTarget == "" {
+		return cTarget, nil
+	}
+	cData, err := f.nameTransform.B64DecodeString(cTarget)
+	if err != nil {
+		return "", fmt.Errorf("symlink %q: %w", cPath, err)
+	}
+	data, err := f.contentEnc.DecryptBlock(cData, 0, nil)
+	if err != nil {
+		return "", fmt.Errorf("symlink %q: %w", cPath, err)
+	}
+	return string(data), nil
+}
+
+// Xattrs returns the decrypted extended attributes of the ciphertext file
+// "cPath". Attributes that cannot be decrypted are skipped with a warning.
+func (f *FS) Xattrs(cPath string) (map[string][]byte, error) {
+	cNames, err := syscallcompat.Llistxattr(f.abs(cPath))
+	if err != nil {
+		if err == syscall.EOPNOTSUPP {
+			return nil, nil
+		}
+		return nil, err
+	}
+	xattrs := make(map[string][]byte)
+	for _, cAttr := range cNames {
+		cData, err := syscallcompat.Lgetxattr(f.abs(cPath), cAttr)
+		if err != nil {
+			return nil, err
+		}
+		if isAcl(cAttr) {
+			xattrs[cAttr] = cData
+			continue
+		}
+		if !strings.HasPrefix(cAttr, xattrStorePrefix) {
+			continue
+		}
+		attr, err := f.nameTransform.DecryptXattrName(cAttr[len(xattrStorePrefix):])
+		if err != nil {
+			tlog.Warn.Printf("Xattrs %q: invalid xattr name %q: %v", cPath, cAttr, err)
+			continue
+		}
+		data, err := f.decryptXattrValue(cData)
+		if err != nil {
+			tlog.Warn.Printf("Xattrs %q: could not decrypt %q: %v", cPath, attr, err)
+			continue
+		}
+		xattrs[attr] = data
+	}
+	return xattrs, nil
+}
+
+// decryptXattrValue decrypts the xattr value "cData". Like fusefrontend,
+// it accepts base64-encoded values from old filesystems.
+func (f *FS) decryptXattrValue(cData []byte) ([]byte, error) {
+	if len(cData) == 0 {
+		return []byte{}, nil
+	}
+	data, err1 := f.contentEnc.DecryptBlock(cData, 0, nil)
+	if err1 == nil {
+		return data, nil
+	}
+	cData, err2 := f.nameTransform.B64DecodeString(string(cData))
+	if err2 != nil {
+		return nil, err1
+	}
+	return f.contentEnc.DecryptBlock(cData, 0, nil)
+}
+
+// File is an open ciphertext file that is decrypted on read.
+type File struct {
+	fs     *FS
+	fd     *os.File
+	cPath  string
+	fileID []byte
+	// size is the plaintext size
+	size int64
+	// off is the position for Read()
+	off int64
+	// cacheMu protects the cache of the last decrypted block, which makes
+	// small reads fast
+	cacheMu      sync.Mutex
+	cache        []byte
+	cacheBlockNo uint64
+}
+
+// Verify that the interfaces are implemented.
+var _ io.ReaderAt = &File{}
+var _ io.Reader = &File{}
+
+// Open opens the ciphertext file "cPath" for reading.
+func (f *FS) Open(cPath string) (*File, error) {
+	fd, err := os.OpenFile(f.abs(cPath), os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+	file := &File{
+		fs:    f,
+		fd:    fd,
+		cPath: cPath,
+		size:  int64(f.contentEnc.CipherSizeToPlainSize(uint64(fi.Size()))),
+	}
+	if fi.Size() == 0 {
+		// Empty files have no header
+		return file, nil
+	}
+	buf := make([]byte, contentenc.HeaderLen)
+	if _, err = fd.ReadAt(buf, 0); err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("file %q: reading header: %w", cPath, err)
+	}
+	h, err := contentenc.ParseHeader(buf)
+	if err != nil {
+		fd.Close()
+		return nil, fmt.Errorf("file %q: %w", cPath, err)
+	}
+	file.fileID = h.ID
+	return file, nil
+}
+
+// Size returns the plaintext size of the file
+func (fl *File) Size() int64 {
+	return fl.size
+}
+
+// readChunk is the maximum plaintext length we decrypt in one go
+const readChunk = 128 * 1024
+
+// ReadAt implements io.ReaderAt.
+func (fl *File) ReadAt(p []byte, off int64) (n int, err error) {
+	for n < len(p) {
+		if off >= fl.size {
+			return n, io.EOF
+		}
+		length := min(len(p)-n, readChunk, int(fl.size-off))
+		var m int
+		var err error
+		if length < int(fl.fs.contentEnc.PlainBS()) {
+			m, err = fl.readCached(p[n:n+length], off)
+		} else {
+			m, err = fl.readAt(p[n:n+length], off)
+		}
+		n += m
+		off += int64(m)
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// readCached copies plaintext at offset "off" into "p", from the block that
+// contains "off". Stops at the end of the block.
+func (fl *File) readCached(p []byte, off int64) (int, error) {
+	ce := fl.fs.contentEnc
+	blockNo := ce.PlainOffToBlockNo(uint64(off))
+	blockOff := int64(ce.BlockNoToPlainOff(blockNo))
+	fl.cacheMu.Lock()
+	defer fl.cacheMu.Unlock()
+	if fl.cache == nil || fl.cacheBlockNo != blockNo {
+		buf := make([]byte, min(int64(ce.PlainBS()), fl.size-blockOff))
+		n, err := fl.readAt(buf, blockOff)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		fl.cache = buf[:n]
+		fl.cacheBlockNo = blockNo
+	}
+	if off-blockOff >= int64(len(fl.cache)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return copy(p, fl.cache[off-blockOff:]), nil
+}
+
+// readAt decrypts at most readChunk bytes at offset "off" into "p".
+func (fl *File) readAt(p []byte, off int64) (int, error) {
+	ce := fl.fs.contentEnc
+	blocks := ce.ExplodePlainRange(uint64(off), uint64(len(p)))
+	alignedOffset, alignedLength := blocks[0].JointCiphertextRange(blocks)
+	ciphertext := make([]byte, alignedLength)
+	n, err := fl.fd.ReadAt(ciphertext, int64(alignedOffset))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	firstBlockNo := blocks[0].BlockNo
+	plaintext, err := ce.DecryptBlocks(ciphertext[:n], firstBlockNo, fl.fileID)
+	if err != nil {
+		corruptBlockNo := firstBlockNo + ce.PlainOffToBlockNo(uint64(len(plaintext)))
+		return 0, fmt.Errorf("file %q: corrupt block #%d at offset %d: %w",
+			fl.cPath, corruptBlockNo, ce.BlockNoToPlainOff(corruptBlockNo), err)
+	}
+	skip := int(blocks[0].Skip)
+	if len(plaintext) <= skip {
+		// File has shrunk since we opened it
+		return 0, io.ErrUnexpectedEOF
+	}
+	m := copy(p, plaintext[skip:])
+	if m < len(p) {
+		return m, io.ErrUnexpectedEOF
+	}
+	return m, nil
+}
+
+// Read implements io.Reader.
+func (fl *File) Read(p []byte) (int, error) {
+	n, err := fl.ReadAt(p, fl.off)
+	fl.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Close closes the file
+func (fl *File) Close() error {
+	return fl.fd.Close()
+}
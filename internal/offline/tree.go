@@ -0,0 +1,359 @@
+package offline
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// EntryFromStat returns an Entry for the tree path "p" filled from "st".
+func EntryFromStat(p string, st *unix.Stat_t) *Entry {
+	return &Entry{
+		Path:  p,
+		Mode:  uint32(st.Mode),
+		Uid:   st.Uid,
+		Gid:   st.Gid,
+		Rdev:  uint64(st.Rdev),
+		Size:  st.Size,
+		Atime: time.Unix(st.Atim.Unix()),
+		Mtime: time.Unix(st.Mtim.Unix()),
+	}
+}
+
+// DecryptTree decrypts the directory "pSubdir" (relative plaintext path,
+// "" is the root directory) and passes its contents to "w".
+func (f *FS) DecryptTree(pSubdir string, w TreeWriter) error {
+	cPath, err := f.EncryptPath(pSubdir)
+	if err != nil {
+		return err
+	}
+	st, err := f.Lstat(cPath)
+	if err != nil {
+		return err
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return fmt.Errorf("%q is not a directory", pSubdir)
+	}
+	return f.decryptEntry(cPath, "", st, w)
+}
+
+func (f *FS) decryptEntry(cPath string, p string, st *unix.Stat_t, w TreeWriter) error {
+	e := EntryFromStat(p, st)
+	var err error
+	e.Xattrs, err = f.Xattrs(cPath)
+	if err != nil {
+		return err
+	}
+	switch e.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		if err = w.WriteEntry(e, nil); err != nil {
+			return err
+		}
+		entries, err := f.ReadDir(cPath)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			cChild := filepath.Join(cPath, entry.CName)
+			cst, err := f.Lstat(cChild)
+			if err != nil {
+				return err
+			}
+			if err = f.decryptEntry(cChild, filepath.Join(p, entry.Name), cst, w); err != nil {
+				return err
+			}
+		}
+		return w.DirDone(e)
+	case syscall.S_IFREG:
+		file, err := f.Open(cPath)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return w.WriteEntry(e, file)
+	case syscall.S_IFLNK:
+		e.Target, err = f.Readlink(cPath)
+		if err != nil {
+			return err
+		}
+		return w.WriteEntry(e, nil)
+	default:
+		return w.WriteEntry(e, nil)
+	}
+}
+
+// WalkDir passes the contents of the plaintext directory "dir" to "w".
+func WalkDir(dir string, w TreeWriter) error {
+	var st unix.Stat_t
+	if err := unix.Stat(dir, &st); err != nil {
+		return &os.PathError{Op: "stat", Path: dir, Err: err}
+	}
+	if st.Mode&syscall.S_IFMT != syscall.S_IFDIR {
+		return fmt.Errorf("%q is not a directory", dir)
+	}
+	return walkEntry(dir, "", &st, w)
+}
+
+func walkEntry(dir string, p string, st *unix.Stat_t, w TreeWriter) error {
+	abs := filepath.Join(dir, p)
+	e := EntryFromStat(p, st)
+	var err error
+	e.Xattrs, err = readXattrs(abs)
+	if err != nil {
+		return err
+	}
+	switch e.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		if err = w.WriteEntry(e, nil); err != nil {
+			return err
+		}
+		d, err := os.Open(abs)
+		if err != nil {
+			return err
+		}
+		names, err := d.Readdirnames(-1)
+		d.Close()
+		if err != nil {
+			return err
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			var cst unix.Stat_t
+			child := filepath.Join(p, name)
+			if err = unix.Lstat(filepath.Join(dir, child), &cst); err != nil {
+				return &os.PathError{Op: "lstat", Path: filepath.Join(dir, child), Err: err}
+			}
+			if err = walkEntry(dir, child, &cst, w); err != nil {
+				return err
+			}
+		}
+		return w.DirDone(e)
+	case syscall.S_IFREG:
+		file, err := os.OpenFile(abs, os.O_RDONLY|syscall.O_NOFOLLOW, 0)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return w.WriteEntry(e, file)
+	case syscall.S_IFLNK:
+		e.Target, err = os.Readlink(abs)
+		if err != nil {
+			return err
+		}
+		return w.WriteEntry(e, nil)
+	default:
+		return w.WriteEntry(e, nil)
+	}
+}
+
+// readXattrs returns the extended attributes of the plaintext file "path"
+func readXattrs(path string) (map[string][]byte, error) {
+	names, err := syscallcompat.Llistxattr(path)
+	if err != nil {
+		if err == syscall.EOPNOTSUPP {
+			return nil, nil
+		}
+		return nil, &os.PathError{Op: "listxattr", Path: path, Err: err}
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range names {
+		val, err := syscallcompat.Lgetxattr(path, name)
+		if err != nil {
+			return nil, &os.PathError{Op: "getxattr " + name, Path: path, Err: err}
+		}
+		xattrs[name] = val
+	}
+	return xattrs, nil
+}
+
+// applyMeta sets owner (when running as root), permissions and timestamps
+// of "path" to the values in "e".
+func applyMeta(path string, e *Entry) error {
+	isLink := e.Mode&syscall.S_IFMT == syscall.S_IFLNK
+	if os.Getuid() == 0 {
+		if err := os.Lchown(path, int(e.Uid), int(e.Gid)); err != nil {
+			return err
+		}
+	}
+	if !isLink {
+		// chown clears the setuid bits, so chmod comes after
+		if err := syscall.Chmod(path, e.Mode&07777); err != nil {
+			return &os.PathError{Op: "chmod", Path: path, Err: err}
+		}
+	}
+	err := syscallcompat.UtimesNanoAtNofollow(unix.AT_FDCWD, path, &e.Atime, &e.Mtime)
+	if err != nil {
+		return &os.PathError{Op: "utimes", Path: path, Err: err}
+	}
+	return nil
+}
+
+// dirWriter is a TreeWriter that writes plaintext to a local directory
+type dirWriter struct {
+	dir string
+}
+
+// NewDirWriter returns a TreeWriter that writes the tree into the
+// directory "dir". "dir" is created if it does not exist. Existing files
+// are not overwritten.
+func NewDirWriter(dir string) TreeWriter {
+	return &dirWriter{dir: dir}
+}
+
+// WriteEntry implements TreeWriter
+func (w *dirWriter) WriteEntry(e *Entry, content io.Reader) error {
+	path := filepath.Join(w.dir, e.Path)
+	var err error
+	switch e.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		err = os.Mkdir(path, 0700)
+		if os.IsExist(err) && e.Path == "" {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		// Permissions and timestamps are set in DirDone
+		return setPlainXattrs(path, e)
+	case syscall.S_IFREG:
+		var out *os.File
+		out, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL|syscall.O_NOFOLLOW, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(out, content)
+		if err2 := out.Close(); err == nil {
+			err = err2
+		}
+	case syscall.S_IFLNK:
+		err = os.Symlink(e.Target, path)
+	default:
+		err = syscallcompat.Mknodat(unix.AT_FDCWD, path, e.Mode, int(e.Rdev))
+		if err != nil {
+			err = &os.PathError{Op: "mknod", Path: path, Err: err}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if err = setPlainXattrs(path, e); err != nil {
+		return err
+	}
+	return applyMeta(path, e)
+}
+
+// DirDone implements TreeWriter
+func (w *dirWriter) DirDone(e *Entry) error {
+	return applyMeta(filepath.Join(w.dir, e.Path), e)
+}
+
+// setPlainXattrs stores the extended attributes of "e" on "path".
+func setPlainXattrs(path string, e *Entry) error {
+	if e.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		// Linux does not allow user xattrs on symlinks
+		return nil
+	}
+	for attr, data := range e.Xattrs {
+		err := unix.Lsetxattr(path, attr, data, 0)
+		if err == syscall.EPERM || err == syscall.EOPNOTSUPP {
+			// Like "cp -a", we do not fail because of xattrs that we may not
+			// set, for example "trusted.*" when not running as root.
+			tlog.Warn.Printf("%s: cannot set xattr %q: %v", path, attr, err)
+			continue
+		}
+		if err != nil {
+			return &os.PathError{Op: "setxattr " + attr, Path: path, Err: err}
+		}
+	}
+	return nil
+}
+
+// TarWriter is a TreeWriter that writes a tar stream. Extended attributes
+// are stored as PAX records, like GNU tar does.
+type TarWriter struct {
+	tw *tar.Writer
+}
+
+// NewTarWriter returns a TarWriter that writes to "w". Call Close() when
+// done.
+func NewTarWriter(w io.Writer) *TarWriter {
+	return &TarWriter{tw: tar.NewWriter(w)}
+}
+
+// WriteEntry implements TreeWriter
+func (w *TarWriter) WriteEntry(e *Entry, content io.Reader) error {
+	hdr := &tar.Header{
+		Name:       "./" + e.Path,
+		Mode:       int64(e.Mode & 07777),
+		Uid:        int(e.Uid),
+		Gid:        int(e.Gid),
+		ModTime:    e.Mtime,
+		AccessTime: e.Atime,
+		Format:     tar.FormatPAX,
+	}
+	switch e.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		hdr.Typeflag = tar.TypeDir
+		if e.Path != "" {
+			hdr.Name += "/"
+		}
+	case syscall.S_IFREG:
+		hdr.Typeflag = tar.TypeReg
+		hdr.Size = e.Size
+	case syscall.S_IFLNK:
+		hdr.Typeflag = tar.TypeSymlink
+		hdr.Linkname = e.Target
+	case syscall.S_IFCHR, syscall.S_IFBLK:
+		hdr.Typeflag = tar.TypeChar
+		if e.Mode&syscall.S_IFMT == syscall.S_IFBLK {
+			hdr.Typeflag = tar.TypeBlock
+		}
+		hdr.Devmajor = int64(unix.Major(e.Rdev))
+		hdr.Devminor = int64(unix.Minor(e.Rdev))
+	case syscall.S_IFIFO:
+		hdr.Typeflag = tar.TypeFifo
+	default:
+		tlog.Warn.Printf("%s: cannot store file type %#o in tar, skipping", e.Path, e.Mode&syscall.S_IFMT)
+		return nil
+	}
+	if len(e.Xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string)
+		for attr, data := range e.Xattrs {
+			hdr.PAXRecords["SCHILY.xattr."+attr] = string(data)
+		}
+	}
+	if err := w.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag == tar.TypeReg {
+		// The file must not grow or shrink while we read it
+		n, err := io.Copy(w.tw, content)
+		if err != nil {
+			return err
+		}
+		if n != e.Size {
+			return fmt.Errorf("%s: size changed from %d to %d", e.Path, e.Size, n)
+		}
+	}
+	return nil
+}
+
+// DirDone implements TreeWriter
+func (w *TarWriter) DirDone(e *Entry) error {
+	return nil
+}
+
+// Close writes the tar trailer
+func (w *TarWriter) Close() error {
+	return w.tw.Close()
+}
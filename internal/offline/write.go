@@ -0,0 +1,170 @@
+package offline
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+)
+
+// cipherWriter is a TreeWriter that encrypts into a cipherdir
+type cipherWriter struct {
+	fs *FS
+	// pSubdir is the plaintext path in the cipherdir that receives the tree
+	pSubdir string
+	// cRootParent is the ciphertext path of the parent directory of pSubdir
+	cRootParent string
+	// cDirs maps tree paths of the directories we have written to their
+	// ciphertext paths
+	cDirs map[string]string
+}
+
+// NewTreeWriter returns a TreeWriter that encrypts a tree into the
+// cipherdir, at the relative plaintext path "pSubdir". The parent of
+// "pSubdir" must exist. Existing directories are merged, existing files
+// are replaced.
+func (f *FS) NewTreeWriter(pSubdir string) (TreeWriter, error) {
+	w := &cipherWriter{
+		fs:      f,
+		pSubdir: pSubdir,
+		cDirs:   make(map[string]string),
+	}
+	if pSubdir != "" {
+		var err error
+		w.cRootParent, err = f.EncryptPath(nametransform.Dir(pSubdir))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return w, nil
+}
+
+// cPath creates the ciphertext name for the tree path "p" (and its
+// gocryptfs.longname.*.name file, if needed) and returns the ciphertext path.
+func (w *cipherWriter) cPath(p string) (string, error) {
+	var cDir, name string
+	if p == "" {
+		if w.pSubdir == "" {
+			return "", nil
+		}
+		cDir, name = w.cRootParent, filepath.Base(w.pSubdir)
+	} else {
+		var ok bool
+		cDir, ok = w.cDirs[nametransform.Dir(p)]
+		if !ok {
+			return "", fmt.Errorf("BUG: parent of %q has not been written", p)
+		}
+		name = filepath.Base(p)
+	}
+	cName, err := w.fs.CreateName(cDir, name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(cDir, cName), nil
+}
+
+// WriteEntry implements TreeWriter
+func (w *cipherWriter) WriteEntry(e *Entry, content io.Reader) error {
+	f := w.fs
+	cPath, err := w.cPath(e.Path)
+	if err != nil {
+		return err
+	}
+	abs := f.abs(cPath)
+	var st unix.Stat_t
+	if err = unix.Lstat(abs, &st); err == nil {
+		if e.IsDir() && st.Mode&syscall.S_IFMT == syscall.S_IFDIR {
+			// Merge into the existing directory
+			w.cDirs[e.Path] = cPath
+			return f.setXattrs(cPath, e)
+		}
+		if err = os.Remove(abs); err != nil {
+			return err
+		}
+	}
+	switch e.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		if err = f.Mkdir(cPath, 0700); err != nil {
+			return err
+		}
+		w.cDirs[e.Path] = cPath
+		// Permissions and timestamps are set in DirDone
+		return f.setXattrs(cPath, e)
+	case syscall.S_IFREG:
+		err = f.writeFile(cPath, content)
+	case syscall.S_IFLNK:
+		err = f.Symlink(e.Target, cPath)
+	default:
+		err = syscallcompat.Mknodat(unix.AT_FDCWD, abs, e.Mode, int(e.Rdev))
+	}
+	if err != nil {
+		return err
+	}
+	if err = f.setXattrs(cPath, e); err != nil {
+		return err
+	}
+	return applyMeta(abs, e)
+}
+
+// DirDone implements TreeWriter
+func (w *cipherWriter) DirDone(e *Entry) error {
+	return applyMeta(w.fs.abs(w.cDirs[e.Path]), e)
+}
+
+// writeFile creates the ciphertext file "cPath" with the encrypted
+// plaintext from "content".
+func (f *FS) writeFile(cPath string, content io.Reader) error {
+	w, err := f.Create(cPath, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, content)
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// encryptSymlinkTarget encrypts "target" like fusefrontend does
+func (f *FS) encryptSymlinkTarget(target string) string {
+	if f.args.PlaintextNames || target == "" {
+		return target
+	}
+	cData := f.contentEnc.EncryptBlock([]byte(target), 0, nil)
+	return f.nameTransform.B64EncodeToString(cData)
+}
+
+// setXattrs encrypts the extended attributes of "e" and stores them on
+// "cPath". ACLs are stored without encryption, like fusefrontend does.
+func (f *FS) setXattrs(cPath string, e *Entry) error {
+	if e.Mode&syscall.S_IFMT == syscall.S_IFLNK {
+		// Linux does not allow user xattrs on symlinks
+		return nil
+	}
+	for attr, data := range e.Xattrs {
+		cAttr := attr
+		cData := data
+		if !isAcl(attr) {
+			name, err := f.nameTransform.EncryptXattrName(attr)
+			if err != nil {
+				return fmt.Errorf("%s: xattr %q: %w", e.Path, attr, err)
+			}
+			cAttr = xattrStorePrefix + name
+			cData = []byte{}
+			if len(data) > 0 {
+				cData = f.contentEnc.EncryptBlock(data, 0, nil)
+			}
+		}
+		err := unix.Lsetxattr(f.abs(cPath), cAttr, cData, 0)
+		if err != nil {
+			return fmt.Errorf("%s: xattr %q: %w", e.Path, attr, err)
+		}
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package pathiv
 import (
 	"crypto/sha256"
 	"encoding/binary"
+	"encoding/hex"
 
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 )
@@ -46,6 +47,15 @@ func DeriveFile(path string) (fileIVs FileIVs) {
 	return fileIVs
 }
 
+// DeriveFileFromID is like DeriveFile, but derives the IVs from a random
+// per-file identity instead of the path. Used by reverse mode "-stable-ivs",
+// where the ciphertext should not change when a file is renamed.
+func DeriveFileFromID(id []byte) FileIVs {
+	// Paths never contain a null byte, so the leading null byte makes sure
+	// that we cannot collide with a path-derived value.
+	return DeriveFile("\000" + hex.EncodeToString(id))
+}
+
 // BlockIV returns the block IV for block number "blockNo". "block0iv" is the block
 // IV of block #0.
 func BlockIV(block0iv []byte, blockNo uint64) []byte {
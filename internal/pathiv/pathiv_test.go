@@ -26,3 +26,25 @@ func TestBlockIV(t *testing.T) {
 		t.Errorf("\nhave=%s\nwant=%s", hex.EncodeToString(b28), hex.EncodeToString(expected))
 	}
 }
+
+// TestDeriveFileFromID checks that ID-derived IVs are stable and differ from
+// path-derived IVs.
+func TestDeriveFileFromID(t *testing.T) {
+	id := bytes.Repeat([]byte{0x42}, 16)
+	a := DeriveFileFromID(id)
+	b := DeriveFileFromID(id)
+	if !bytes.Equal(a.ID, b.ID) || !bytes.Equal(a.Block0IV, b.Block0IV) {
+		t.Errorf("derivation is not deterministic")
+	}
+	if bytes.Equal(a.ID, a.Block0IV) {
+		t.Errorf("ID and Block0IV should differ")
+	}
+	p := DeriveFile(hex.EncodeToString(id))
+	if bytes.Equal(a.ID, p.ID) {
+		t.Errorf("ID-derived value collides with path-derived value")
+	}
+	c := DeriveFileFromID(bytes.Repeat([]byte{0x43}, 16))
+	if bytes.Equal(a.ID, c.ID) {
+		t.Errorf("different IDs should give different IVs")
+	}
+}
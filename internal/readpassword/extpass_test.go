@@ -9,7 +9,7 @@ import (
 
 func TestMain(m *testing.M) {
 	// Shut up info output
-	tlog.Info.Enabled = false
+	tlog.Info.SetEnabled(false)
 	os.Exit(m.Run())
 }
 
@@ -0,0 +1,22 @@
+package syscallcompat
+
+import (
+	"net"
+)
+
+// PeerCred returns the effective uid and gid of the process at the other end
+// of the Unix socket connection "conn", as recorded by the kernel when the
+// connection was established.
+func PeerCred(conn *net.UnixConn) (uid uint32, gid uint32, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+	err2 := raw.Control(func(fd uintptr) {
+		uid, gid, err = peerCred(int(fd))
+	})
+	if err2 != nil {
+		return 0, 0, err2
+	}
+	return uid, gid, err
+}
@@ -0,0 +1,19 @@
+//go:build darwin || freebsd
+
+package syscallcompat
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func peerCred(fd int) (uid uint32, gid uint32, err error) {
+	cred, err := unix.GetsockoptXucred(fd, unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return 0, 0, err
+	}
+	if cred.Ngroups < 1 {
+		return 0, 0, unix.EINVAL
+	}
+	// The first group is the effective gid
+	return cred.Uid, cred.Groups[0], nil
+}
@@ -0,0 +1,13 @@
+package syscallcompat
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func peerCred(fd int) (uid uint32, gid uint32, err error) {
+	cred, err := unix.GetsockoptUcred(fd, unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return 0, 0, err
+	}
+	return cred.Uid, cred.Gid, nil
+}
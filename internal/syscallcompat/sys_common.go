@@ -71,6 +71,21 @@ func Openat(dirfd int, path string, flags int, mode uint32) (fd int, err error)
 	return fd, err
 }
 
+// OpenatFollow is like Openat, but follows a symlink in the last path
+// component. Only use it where following symlinks is explicitly wanted,
+// like in reverse mode with -follow-symlinks.
+// Retries on EINTR.
+func OpenatFollow(dirfd int, path string, flags int) (fd int, err error) {
+	if flags&syscall.O_CREAT != 0 {
+		tlog.Warn.Printf("OpenatFollow: O_CREAT is not supported: flags = %#x", flags)
+		return -1, syscall.EINVAL
+	}
+	flags |= syscall.O_CLOEXEC
+	return retryEINTR2(func() (int, error) {
+		return unix.Openat(dirfd, path, flags, 0)
+	})
+}
+
 // Fchownat syscall.
 func Fchownat(dirfd int, path string, uid int, gid int, flags int) (err error) {
 	// Why would we ever want to call this without AT_SYMLINK_NOFOLLOW?
@@ -108,6 +123,22 @@ func Fstatat2(dirfd int, path string, flags int) (*syscall.Stat_t, error) {
 	return &st, nil
 }
 
+// Fstatat2Follow is like Fstatat2, but follows a symlink in the last path
+// component. Only use it where following symlinks is explicitly wanted,
+// like in reverse mode with -follow-symlinks.
+// Retries on EINTR.
+func Fstatat2Follow(dirfd int, path string) (*syscall.Stat_t, error) {
+	var stUnix unix.Stat_t
+	err := retryEINTR(func() error {
+		return unix.Fstatat(dirfd, path, &stUnix, 0)
+	})
+	if err != nil {
+		return nil, err
+	}
+	st := Unix2syscall(stUnix)
+	return &st, nil
+}
+
 const XATTR_SIZE_MAX = 65536
 
 // Make the buffer 1kB bigger so we can detect overflows. Unfortunately,
@@ -133,6 +164,15 @@ func Lgetxattr(path string, attr string) (val []byte, err error) {
 	return getxattrSmartBuf(fn)
 }
 
+// Getxattr is a wrapper around unix.Getxattr that handles the buffer sizing.
+// Unlike Lgetxattr, it follows symlinks.
+func Getxattr(path string, attr string) (val []byte, err error) {
+	fn := func(buf []byte) (int, error) {
+		return unix.Getxattr(path, attr, buf)
+	}
+	return getxattrSmartBuf(fn)
+}
+
 func getxattrSmartBuf(fn func(buf []byte) (int, error)) ([]byte, error) {
 	// Fastpaths. Important for security.capabilities, which gets queried a lot.
 	buf := make([]byte, GETXATTR_BUFSZ_SMALL)
@@ -197,6 +237,16 @@ func Llistxattr(path string) (attrs []string, err error) {
 	return listxattrSmartBuf(listxattrSyscall)
 }
 
+// Listxattr is a wrapper for unix.Listxattr that handles buffer sizing and
+// parsing the returned blob to a string slice. Unlike Llistxattr, it follows
+// symlinks.
+func Listxattr(path string) (attrs []string, err error) {
+	listxattrSyscall := func(buf []byte) (int, error) {
+		return unix.Listxattr(path, buf)
+	}
+	return listxattrSmartBuf(listxattrSyscall)
+}
+
 // listxattrSmartBuf handles smart buffer sizing for Flistxattr and Llistxattr
 func listxattrSmartBuf(listxattrSyscall func([]byte) (int, error)) ([]string, error) {
 	const LISTXATTR_BUFSZ_SMALL = 100
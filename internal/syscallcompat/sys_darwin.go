@@ -169,3 +169,9 @@ func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags
 	// Let RenameatxNp handle everything else
 	return unix.RenameatxNp(olddirfd, oldpath, newdirfd, newpath, uint32(flags))
 }
+
+// SetIdlePriority does nothing. There is no portable way to lower the
+// priority of a single thread.
+func SetIdlePriority() error {
+	return nil
+}
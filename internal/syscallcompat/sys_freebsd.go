@@ -158,3 +158,9 @@ func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags
 
 	return unix.Renameat(olddirfd, oldpath, newdirfd, newpath)
 }
+
+// SetIdlePriority does nothing. There is no portable way to lower the
+// priority of a single thread.
+func SetIdlePriority() error {
+	return nil
+}
@@ -183,3 +183,24 @@ func Renameat2(olddirfd int, oldpath string, newdirfd int, newpath string, flags
 	})
 	return err
 }
+
+// SetIdlePriority lowers the CPU priority (nice 19) and the I/O priority
+// (idle class) of the calling thread. Call runtime.LockOSThread() first,
+// or the Go runtime may run other goroutines on the thread.
+func SetIdlePriority() error {
+	tid := unix.Gettid()
+	if err := unix.Setpriority(unix.PRIO_PROCESS, tid, 19); err != nil {
+		return err
+	}
+	// See ioprio_set(2)
+	const (
+		ioprioWhoProcess = 1
+		ioprioClassIdle  = 3
+		ioprioClassShift = 13
+	)
+	_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
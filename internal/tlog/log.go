@@ -9,6 +9,7 @@ import (
 	"log"
 	"log/syslog"
 	"os"
+	"sync/atomic"
 
 	"golang.org/x/term"
 )
@@ -46,8 +47,9 @@ func JSONDump(obj interface{}) string {
 
 // toggledLogger - a Logger than can be enabled and disabled
 type toggledLogger struct {
-	// Enable or disable output
-	Enabled bool
+	// Enable or disable output. Atomic because the control socket can
+	// toggle the debug output while other goroutines log.
+	enabled atomic.Bool
 	// Panic after logging a message, useful in regression tests
 	Wpanic bool
 	// Private prefix and postfix are used for coloring
@@ -68,8 +70,18 @@ func trimNewline(msg string) string {
 	return msg
 }
 
+// Enabled returns true if the logger produces output
+func (l *toggledLogger) Enabled() bool {
+	return l.enabled.Load()
+}
+
+// SetEnabled enables or disables output
+func (l *toggledLogger) SetEnabled(enabled bool) {
+	l.enabled.Store(enabled)
+}
+
 func (l *toggledLogger) Printf(format string, v ...interface{}) {
-	if !l.Enabled {
+	if !l.Enabled() {
 		return
 	}
 	msg := trimNewline(fmt.Sprintf(format, v...))
@@ -79,7 +91,7 @@ func (l *toggledLogger) Printf(format string, v ...interface{}) {
 	}
 }
 func (l *toggledLogger) Println(v ...interface{}) {
-	if !l.Enabled {
+	if !l.Enabled() {
 		return
 	}
 	msg := trimNewline(fmt.Sprint(v...))
@@ -122,21 +134,21 @@ func init() {
 		Logger: log.New(os.Stdout, "", 0),
 	}
 	Info = &toggledLogger{
-		Enabled: true,
-		Logger:  log.New(os.Stdout, "", 0),
+		Logger: log.New(os.Stdout, "", 0),
 	}
+	Info.SetEnabled(true)
 	Warn = &toggledLogger{
-		Enabled: true,
 		Logger:  log.New(os.Stderr, "", 0),
 		prefix:  ColorYellow,
 		postfix: ColorReset,
 	}
+	Warn.SetEnabled(true)
 	Fatal = &toggledLogger{
-		Enabled: true,
 		Logger:  log.New(os.Stderr, "", 0),
 		prefix:  ColorRed,
 		postfix: ColorReset,
 	}
+	Fatal.SetEnabled(true)
 }
 
 // SwitchToSyslog redirects the output of this logger to syslog.
@@ -171,7 +183,7 @@ func SwitchLoggerToSyslog() {
 // PrintMasterkeyReminder reminds the user that he should store the master key in
 // a safe place.
 func PrintMasterkeyReminder(key []byte) {
-	if !Info.Enabled {
+	if !Info.Enabled() {
 		// Quiet mode
 		return
 	}
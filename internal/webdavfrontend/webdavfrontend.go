@@ -0,0 +1,269 @@
+// Package webdavfrontend serves the plaintext view of a cipherdir over
+// WebDAV, for machines where FUSE is not available. It implements the
+// webdav.FileSystem interface on top of the public volume package.
+package webdavfrontend
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync/atomic"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/rfjakob/gocryptfs/v2/volume"
+)
+
+// FS implements webdav.FileSystem
+type FS struct {
+	v        *volume.Volume
+	readOnly bool
+	// isIdle is reset to false on every access, and set to true by
+	// WasActive(), like fusefrontend.RootNode.IsIdle.
+	isIdle atomic.Bool
+	// openFiles counts the files that are currently open
+	openFiles atomic.Int64
+}
+
+var _ webdav.FileSystem = &FS{}
+
+// New returns a webdav.FileSystem for "v". If "readOnly" is set, all
+// modifications fail with EPERM.
+func New(v *volume.Volume, readOnly bool) *FS {
+	return &FS{v: v, readOnly: readOnly}
+}
+
+// WasActive returns true if there has been any access since the last call,
+// or if files are open. This is used for "-idle".
+func (f *FS) WasActive() bool {
+	return !f.isIdle.Swap(true) || f.openFiles.Load() > 0
+}
+
+// volumePath converts a WebDAV path ("/foo/bar") into an io/fs path
+// ("foo/bar").
+func volumePath(name string) string {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "."
+	}
+	return name[1:]
+}
+
+// checkWrite marks the filesystem as active and returns an error if it is
+// read-only.
+func (f *FS) checkWrite(op string, name string) error {
+	f.isIdle.Store(false)
+	if f.readOnly {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	}
+	return nil
+}
+
+// Mkdir implements webdav.FileSystem
+func (f *FS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = volumePath(name)
+	if err := f.checkWrite("mkdir", name); err != nil {
+		return err
+	}
+	return f.v.Mkdir(name, perm)
+}
+
+// RemoveAll implements webdav.FileSystem
+func (f *FS) RemoveAll(ctx context.Context, name string) error {
+	name = volumePath(name)
+	if err := f.checkWrite("remove", name); err != nil {
+		return err
+	}
+	if name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+	}
+	return f.removeAll(name)
+}
+
+func (f *FS) removeAll(name string) error {
+	fi, err := f.v.Lstat(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.IsDir() {
+		entries, err := f.v.ReadDir(name)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err = f.removeAll(path.Join(name, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+	return f.v.Remove(name)
+}
+
+// Rename implements webdav.FileSystem
+func (f *FS) Rename(ctx context.Context, oldName, newName string) error {
+	oldName = volumePath(oldName)
+	if err := f.checkWrite("rename", oldName); err != nil {
+		return err
+	}
+	return f.v.Rename(oldName, volumePath(newName))
+}
+
+// Stat implements webdav.FileSystem. Symlinks to regular files are
+// followed. Other symlinks are shown as they are, because WebDAV has no
+// concept of symlinks, and following symlinks to directories could make
+// recursive listings loop.
+func (f *FS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	f.isIdle.Store(false)
+	name = volumePath(name)
+	fi, err := f.v.Lstat(name)
+	if err != nil || fi.Mode()&fs.ModeSymlink == 0 {
+		return fi, err
+	}
+	target, err := f.v.Stat(name)
+	if err != nil || !target.Mode().IsRegular() {
+		return fi, nil
+	}
+	return target, nil
+}
+
+// OpenFile implements webdav.FileSystem. Files can be opened for reading,
+// or created (or truncated) for sequential writing, which is what the
+// WebDAV PUT and COPY methods need.
+func (f *FS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	f.isIdle.Store(false)
+	name = volumePath(name)
+	create := flag&(os.O_CREATE|os.O_TRUNC) != 0
+	if create {
+		if err := f.checkWrite("open", name); err != nil {
+			return nil, err
+		}
+		_, err := f.v.Lstat(name)
+		exists := err == nil
+		if exists && flag&os.O_EXCL != 0 {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		}
+		if !exists && flag&os.O_CREATE == 0 {
+			return nil, err
+		}
+		// O_CREATE without O_TRUNC on an existing file opens it for reading
+		create = !exists || flag&os.O_TRUNC != 0
+	}
+	file := &file{fs: f, name: name}
+	if create {
+		w, err := f.v.Create(name, perm)
+		if err != nil {
+			return nil, err
+		}
+		file.w = w
+	} else {
+		r, err := f.v.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		file.r = r
+	}
+	f.openFiles.Add(1)
+	return file, nil
+}
+
+// file implements webdav.File
+type file struct {
+	fs   *FS
+	name string
+	// Exactly one of "r" and "w" is set
+	r fs.File
+	w io.WriteCloser
+	// written is the number of bytes written to "w"
+	written int64
+	// dirEntries holds the remaining entries for Readdir
+	dirEntries []fs.DirEntry
+	dirLoaded  bool
+}
+
+func (fl *file) Close() error {
+	fl.fs.openFiles.Add(-1)
+	if fl.w != nil {
+		return fl.w.Close()
+	}
+	return fl.r.Close()
+}
+
+func (fl *file) Read(p []byte) (int, error) {
+	if fl.r == nil {
+		return 0, &fs.PathError{Op: "read", Path: fl.name, Err: os.ErrInvalid}
+	}
+	return fl.r.Read(p)
+}
+
+func (fl *file) Write(p []byte) (int, error) {
+	if fl.w == nil {
+		return 0, &fs.PathError{Op: "write", Path: fl.name, Err: os.ErrInvalid}
+	}
+	fl.fs.isIdle.Store(false)
+	n, err := fl.w.Write(p)
+	fl.written += int64(n)
+	return n, err
+}
+
+func (fl *file) Seek(offset int64, whence int) (int64, error) {
+	if s, ok := fl.r.(io.Seeker); ok {
+		return s.Seek(offset, whence)
+	}
+	return 0, &fs.PathError{Op: "seek", Path: fl.name, Err: os.ErrInvalid}
+}
+
+func (fl *file) Readdir(count int) ([]fs.FileInfo, error) {
+	if !fl.dirLoaded {
+		entries, err := fl.fs.v.ReadDir(fl.name)
+		if err != nil {
+			return nil, err
+		}
+		fl.dirEntries = entries
+		fl.dirLoaded = true
+	}
+	n := len(fl.dirEntries)
+	if count > 0 {
+		if n == 0 {
+			return nil, io.EOF
+		}
+		n = min(n, count)
+	}
+	infos := make([]fs.FileInfo, 0, n)
+	for _, e := range fl.dirEntries[:n] {
+		fi, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, fi)
+	}
+	fl.dirEntries = fl.dirEntries[n:]
+	return infos, nil
+}
+
+func (fl *file) Stat() (fs.FileInfo, error) {
+	if fl.r != nil {
+		return fl.r.Stat()
+	}
+	fi, err := fl.fs.v.Lstat(fl.name)
+	if err != nil {
+		return nil, err
+	}
+	// The last partial block is only written on Close()
+	return &writtenInfo{FileInfo: fi, size: fl.written}, nil
+}
+
+// writtenInfo reports the number of bytes written as the size of a file
+// that is still open for writing.
+type writtenInfo struct {
+	fs.FileInfo
+	size int64
+}
+
+func (wi *writtenInfo) Size() int64 {
+	return wi.size
+}
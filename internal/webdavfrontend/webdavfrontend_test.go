@@ -0,0 +1,134 @@
+package webdavfrontend
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/volume"
+)
+
+// newServer creates a new gocryptfs filesystem and serves it over WebDAV
+func newServer(t *testing.T, readOnly bool) (*httptest.Server, *FS) {
+	dir := t.TempDir()
+	pw := []byte("test")
+	err := configfile.Create(&configfile.CreateArgs{
+		Filename: filepath.Join(dir, configfile.ConfDefaultName),
+		Password: pw,
+		LogN:     10,
+		Creator:  "webdavfrontend_test",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer syscall.Close(dirfd)
+	if err = nametransform.WriteDirIVAt(dirfd); err != nil {
+		t.Fatal(err)
+	}
+	v, err := volume.Open(dir, volume.Options{Password: pw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { v.Close() })
+	davFS := New(v, readOnly)
+	srv := httptest.NewServer(&webdav.Handler{
+		FileSystem: davFS,
+		LockSystem: webdav.NewMemLS(),
+	})
+	t.Cleanup(srv.Close)
+	return srv, davFS
+}
+
+// do sends a WebDAV request and returns the status code and body
+func do(t *testing.T, method string, url string, body string, hdr ...string) (int, string) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i+1 < len(hdr); i += 2 {
+		req.Header.Set(hdr[i], hdr[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	content, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(content)
+}
+
+func TestReadWrite(t *testing.T) {
+	srv, davFS := newServer(t, false)
+	big := strings.Repeat("0123456789", 1000)
+	steps := []struct {
+		method string
+		path   string
+		body   string
+		hdr    []string
+		want   int
+	}{
+		{"MKCOL", "/dir", "", nil, http.StatusCreated},
+		{"PUT", "/dir/file", big, nil, http.StatusCreated},
+		{"PUT", "/dir/empty", "", nil, http.StatusCreated},
+		{"COPY", "/dir/file", "", []string{"Destination", srv.URL + "/copy"}, http.StatusCreated},
+		{"MOVE", "/copy", "", []string{"Destination", srv.URL + "/dir/moved"}, http.StatusCreated},
+		{"PROPFIND", "/", "", []string{"Depth", "infinity"}, http.StatusMultiStatus},
+		{"DELETE", "/dir/empty", "", nil, http.StatusNoContent},
+	}
+	for _, s := range steps {
+		code, body := do(t, s.method, srv.URL+s.path, s.body, s.hdr...)
+		if code != s.want {
+			t.Fatalf("%s %s: want %d, got %d: %s", s.method, s.path, s.want, code, body)
+		}
+		if s.method == "PROPFIND" {
+			for _, name := range []string{"/dir/file", "/dir/moved", "/dir/empty"} {
+				if !strings.Contains(body, name) {
+					t.Errorf("PROPFIND: %q missing", name)
+				}
+			}
+		}
+	}
+	for _, p := range []string{"/dir/file", "/dir/moved"} {
+		code, body := do(t, "GET", srv.URL+p, "")
+		if code != http.StatusOK || body != big {
+			t.Errorf("GET %s: code %d, %d bytes", p, code, len(body))
+		}
+	}
+	if code, _ := do(t, "GET", srv.URL+"/copy", ""); code != http.StatusNotFound {
+		t.Errorf("GET /copy after MOVE: want 404, got %d", code)
+	}
+	if !davFS.WasActive() {
+		t.Error("WasActive should be true after access")
+	}
+	if davFS.WasActive() {
+		t.Error("WasActive should be false without access")
+	}
+	if code, _ := do(t, "DELETE", srv.URL+"/dir", ""); code != http.StatusNoContent {
+		t.Errorf("DELETE /dir: want 204, got %d", code)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	srv, _ := newServer(t, true)
+	for _, method := range []string{"MKCOL", "PUT"} {
+		code, _ := do(t, method, srv.URL+"/x", "content")
+		if code < 400 {
+			t.Errorf("%s in read-only mode: got %d", method, code)
+		}
+	}
+	if code, _ := do(t, "PROPFIND", srv.URL+"/", "", "Depth", "1"); code != http.StatusMultiStatus {
+		t.Errorf("PROPFIND: got %d", code)
+	}
+}
@@ -143,12 +143,18 @@ func main() {
 	args := parseCliOpts(os.Args)
 	// Fork a child into the background if "-fg" is not set AND we are mounting
 	// a filesystem. The child will do all the work.
-	if !args.fg && flagSet.NArg() == 2 {
+	if !args.fg && flagSet.NArg() == 2 && countOpFlags(&args) == 0 {
 		ret := forkChild()
 		os.Exit(ret)
 	}
+	// "-tar" and "-decrypt-tree CIPHERDIR -" write a tar stream to stdout.
+	// Keep our messages out of it.
+	if args.tar || (args.decrypt_tree && flagSet.Arg(1) == "-") {
+		tlog.Info.Logger.SetOutput(os.Stderr)
+		tlog.Debug.Logger.SetOutput(os.Stderr)
+	}
 	if args.debug {
-		tlog.Debug.Enabled = true
+		tlog.Debug.SetEnabled(true)
 	}
 	tlog.Debug.Printf("cli args: %q", os.Args)
 	// "-v"
@@ -169,6 +175,15 @@ func main() {
 		speed.Run()
 		os.Exit(0)
 	}
+	// "-status" takes a mountpoint or socket, not CIPHERDIR
+	if args.status {
+		if flagSet.NArg() != 1 || countOpFlags(&args) > 1 {
+			tlog.Fatal.Printf("Usage: %s -status MOUNTPOINT|SOCKET", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+		status(flagSet.Arg(0))
+		os.Exit(0)
+	}
 	if args.wpanic {
 		tlog.Warn.Wpanic = true
 		tlog.Debug.Printf("Panicking on warnings")
@@ -185,8 +200,13 @@ func main() {
 		}
 		os.Exit(exitcodes.Usage)
 	}
-	// Check that CIPHERDIR exists
-	args.cipherdir, _ = filepath.Abs(flagSet.Arg(0))
+	// Check that CIPHERDIR exists. "-encrypt-tree PLAINDIR CIPHERDIR" has it
+	// as the second argument.
+	if args.encrypt_tree && flagSet.NArg() == 2 {
+		args.cipherdir, _ = filepath.Abs(flagSet.Arg(1))
+	} else {
+		args.cipherdir, _ = filepath.Abs(flagSet.Arg(0))
+	}
 	err = isDir(args.cipherdir)
 	if err != nil {
 		tlog.Fatal.Printf("Invalid cipherdir: %v", err)
@@ -194,7 +214,7 @@ func main() {
 	}
 	// "-q"
 	if args.quiet {
-		tlog.Info.Enabled = false
+		tlog.Info.SetEnabled(false)
 	}
 	// "-reverse" implies "-aessiv"
 	if args.reverse {
@@ -204,6 +224,38 @@ func main() {
 			tlog.Fatal.Printf("-exclude only works in reverse mode")
 			os.Exit(exitcodes.ExcludeError)
 		}
+		if args.stable_ivs {
+			tlog.Fatal.Printf("-stable-ivs only works in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args.follow_symlinks {
+			tlog.Fatal.Printf("-follow-symlinks only works in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+		if args._mergeDirs != nil {
+			tlog.Fatal.Printf("-merge only works in reverse mode")
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// "-stable-ivs" stores the file IDs in xattrs, which is not implemented
+	// on FreeBSD
+	if args.stable_ivs && runtime.GOOS == "freebsd" {
+		tlog.Fatal.Printf("-stable-ivs is not supported on FreeBSD")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-follow-symlinks" needs /proc/self/fd to find out if a file can also
+	// be reached without symlinks (see canonicalCPath)
+	if args.follow_symlinks && runtime.GOOS != "linux" {
+		tlog.Fatal.Printf("-follow-symlinks is only supported on Linux")
+		os.Exit(exitcodes.Usage)
+	}
+	// "-merge"
+	for name, dir := range args._mergeDirs {
+		err = isDir(dir)
+		if err != nil {
+			tlog.Fatal.Printf("-merge %s: invalid directory: %v", name, err)
+			os.Exit(exitcodes.CipherDir)
+		}
 	}
 	// "-config"
 	if args.config != "" {
@@ -273,11 +325,25 @@ func main() {
 		return
 	}
 	if nOps > 1 {
-		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck is allowed")
+		tlog.Fatal.Printf("At most one of -info, -init, -passwd, -fsck, -decrypt-tree, -encrypt-tree, -webdav, -tar is allowed")
 		os.Exit(exitcodes.Usage)
 	}
-	if flagSet.NArg() != 1 {
-		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck take exactly one argument, %d given",
+	if args.decrypt_tree || args.encrypt_tree {
+		if flagSet.NArg() != 2 {
+			if args.decrypt_tree {
+				tlog.Fatal.Printf("Usage: %s -decrypt-tree [OPTIONS] CIPHERDIR DEST", tlog.ProgramName)
+			} else {
+				tlog.Fatal.Printf("Usage: %s -encrypt-tree [OPTIONS] PLAINDIR CIPHERDIR", tlog.ProgramName)
+			}
+			os.Exit(exitcodes.Usage)
+		}
+	} else if args.fsck && args.reverse {
+		if flagSet.NArg() != 2 {
+			tlog.Fatal.Printf("Usage: %s -fsck -reverse [OPTIONS] PLAINDIR CIPHERCOPY", tlog.ProgramName)
+			os.Exit(exitcodes.Usage)
+		}
+	} else if flagSet.NArg() != 1 {
+		tlog.Fatal.Printf("The options -info, -init, -passwd, -fsck, -webdav, -tar take exactly one argument, %d given",
 			flagSet.NArg())
 		os.Exit(exitcodes.Usage)
 	}
@@ -301,4 +367,24 @@ func main() {
 		code := fsck(&args)
 		os.Exit(code)
 	}
+	// "-decrypt-tree"
+	if args.decrypt_tree {
+		decryptTree(&args)
+		os.Exit(0)
+	}
+	// "-encrypt-tree"
+	if args.encrypt_tree {
+		encryptTree(&args)
+		os.Exit(0)
+	}
+	// "-webdav"
+	if args.webdav != "" {
+		serveWebdav(&args)
+		os.Exit(0)
+	}
+	// "-tar"
+	if args.tar {
+		reverseTar(&args)
+		os.Exit(0)
+	}
 }
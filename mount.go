@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"log"
 	"log/syslog"
 	"math"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -21,6 +24,8 @@ import (
 	"github.com/hanwen/go-fuse/v2/fs"
 	"github.com/hanwen/go-fuse/v2/fuse"
 
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/audit"
 	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
 	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
 	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
@@ -28,6 +33,7 @@ import (
 	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
 	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/v2/internal/metrics"
 	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
 	"github.com/rfjakob/gocryptfs/v2/internal/openfiletable"
 	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
@@ -95,6 +101,14 @@ func doMount(args *argContainer) {
 			tlog.Fatal.Printf("ctlsock: %v", err)
 			os.Exit(exitcodes.CtlSock)
 		}
+		if len(args.ctlsock_allow) > 0 {
+			// Let the other users connect, the ACL checks them
+			if err = os.Chmod(args.ctlsock, 0777); err != nil {
+				args._ctlsockFd.Close()
+				tlog.Fatal.Printf("ctlsock: %v", err)
+				os.Exit(exitcodes.CtlSock)
+			}
+		}
 		// Close also deletes the socket file
 		defer func() {
 			err = args._ctlsockFd.Close()
@@ -102,16 +116,69 @@ func doMount(args *argContainer) {
 				tlog.Warn.Printf("ctlsock close: %v", err)
 			}
 		}()
+		// Let "gocryptfs -status MOUNTPOINT" find the socket
+		defer registerCtlsock(args.mountpoint, args.ctlsock)()
+	}
+	// Same for the metrics listener
+	var metricsListener net.Listener
+	if args.metrics != "" {
+		// A Unix socket is only accessible by us
+		metricsListener, err = listenLocal(args.metrics)
+		if err != nil {
+			tlog.Fatal.Printf("-metrics: %v", err)
+			os.Exit(exitcodes.Metrics)
+		}
+		// Close also deletes the socket file
+		defer metricsListener.Close()
+	}
+	// And the audit log
+	if args.audit_log != "" {
+		dest := args.audit_log
+		if dest != audit.Syslog {
+			// Rotation renames the file, and we cd to / when daemonizing
+			dest, _ = filepath.Abs(dest)
+		}
+		args._auditLog, err = audit.Open(dest, int64(args.audit_log_size)<<20, args.audit_log_keep)
+		if err != nil {
+			tlog.Fatal.Printf("-audit-log: %v", err)
+			os.Exit(exitcodes.AuditLog)
+		}
+		defer args._auditLog.Close()
 	}
 	// Initialize gocryptfs (read config file, ask for password, ...)
 	fs, wipeKeys := initFuseFrontend(args)
 	// Try to wipe secret keys from memory after unmount
 	defer wipeKeys()
-	// Initialize go-fuse FUSE server
-	srv := initGoFuse(fs, args)
+	// Initialize go-fuse FUSE server.
+	// With a recorder, go-fuse reads the clock twice for every operation.
+	// Only pay for that if somebody can look at the results: "-metrics",
+	// or op tracing, which can be switched on through the control socket.
+	var ops *opRecorder
+	var latencies fuse.LatencyMap
+	if metricsListener != nil || args._ctlsockFd != nil {
+		ops = &opRecorder{}
+		if metricsListener != nil {
+			ops.metrics = &metrics.Ops{}
+		}
+		latencies = ops
+	}
+	srv := initGoFuse(fs, latencies, args)
 	if x, ok := fs.(AfterUnmounter); ok {
 		defer x.AfterUnmount()
 	}
+	// We have opened the socket early so that we cannot fail here after
+	// asking the user for the password
+	if args._ctlsockFd != nil {
+		toggles := &logToggles{ops: ops, fuseDebug: args.fusedebug}
+		go ctlsocksrv.Serve(args._ctlsockFd, fs.(ctlsocksrv.Interface), ctlsocksrv.Options{
+			Unmount: srv.Unmount,
+			ACL:     args._ctlsockACL,
+			Logging: toggles,
+		})
+	}
+	if metricsListener != nil {
+		go metrics.Serve(metricsListener, ops.metrics, fs.(metrics.Source))
+	}
 
 	tlog.Info.Println(tlog.ColorGreen + "Filesystem mounted and ready." + tlog.ColorReset)
 	// We have been forked into the background, as evidenced by the set
@@ -152,23 +219,56 @@ func doMount(args *argContainer) {
 	// Return memory that was allocated for scrypt (64M by default!) and other
 	// stuff that is no longer needed to the OS
 	debug.FreeOSMemory()
+	// Start the background scrubber. Do it after we have switched to syslog,
+	// that's where the findings go.
+	if args.scrub {
+		fs.(*fusefrontend.RootNode).StartScrubber()
+	}
 	// Set up autounmount, if requested.
 	if args.idle > 0 && !args.reverse {
 		// Not being in reverse mode means we always have a forward file system.
 		fwdFs := fs.(*fusefrontend.RootNode)
-		go idleMonitor(args.idle, fwdFs, srv, args.mountpoint)
+		wasActive := func() bool {
+			// Atomically check whether the flag is 0 and reset it to 1 if so.
+			isIdle := !fwdFs.IsIdle.CompareAndSwap(false, true)
+			// Any form of current or recent access resets the idle counter.
+			return !isIdle || openfiletable.CountOpenFiles() > 0
+		}
+		go idleMonitor(args.idle, wasActive, srv.Unmount, args.mountpoint)
 	}
 	// Wait for unmount.
 	srv.Wait()
+	// Let the ctlsock answer the Unmount request, if that is where the
+	// unmount came from
+	ctlsocksrv.WaitUnmount()
+}
+
+// scrubStateFile returns the "-scrub-state" file. The default is a file
+// in the user's cache directory that is unique for each CIPHERDIR, or ""
+// if there is no cache directory.
+func scrubStateFile(args *argContainer) string {
+	if args.scrub_state != "" {
+		fn, _ := filepath.Abs(args.scrub_state)
+		return fn
+	}
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		tlog.Info.Printf("scrub: %v, progress will not be saved", err)
+		return ""
+	}
+	h := sha256.Sum256([]byte(args.cipherdir))
+	return filepath.Join(cacheDir, "gocryptfs", "scrub-"+hex.EncodeToString(h[:8])+".json")
 }
 
 // Based on the EncFS idle monitor:
 // https://github.com/vgough/encfs/blob/1974b417af189a41ffae4c6feb011d2a0498e437/encfs/main.cpp#L851
 // idleMonitor is a function to be run as a thread that checks for
 // filesystem idleness and unmounts if we've been idle for long enough.
+// "wasActive" reports if there has been any access since the last call,
+// "unmount" stops serving the filesystem (FUSE unmount or WebDAV shutdown).
 const checksDuringTimeoutPeriod = 4
 
-func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.RootNode, srv *fuse.Server, mountpoint string) {
+func idleMonitor(idleTimeout time.Duration, wasActive func() bool, unmount func() error, mountpoint string) {
 	// sleepNs is the sleep time between checks, in nanoseconds.
 	sleepNs := contentenc.MinUint64(
 		uint64(idleTimeout/checksDuringTimeoutPeriod),
@@ -179,21 +279,18 @@ func idleMonitor(idleTimeout time.Duration, fs *fusefrontend.RootNode, srv *fuse
 		return time.Duration(sleepNs * uint64(idleCount))
 	}
 	for {
-		// Atomically check whether the flag is 0 and reset it to 1 if so.
-		isIdle := !fs.IsIdle.CompareAndSwap(false, true)
-		// Any form of current or recent access resets the idle counter.
-		openFileCount := openfiletable.CountOpenFiles()
-		if !isIdle || openFileCount > 0 {
+		active := wasActive()
+		if active {
 			idleCount = 0
 		} else {
 			idleCount++
 		}
 		tlog.Debug.Printf(
-			"idleMonitor: idle for %v (idleCount = %d, isIdle = %t, open = %d)",
-			idleTime(), idleCount, isIdle, openFileCount)
+			"idleMonitor: idle for %v (idleCount = %d, active = %t)",
+			idleTime(), idleCount, active)
 		if idleCount > 0 && idleCount%timeoutCycles == 0 {
 			tlog.Info.Printf("idleMonitor: filesystem idle; unmounting: %s", mountpoint)
-			err := srv.Unmount()
+			err := unmount()
 			if err != nil {
 				// We get "Device or resource busy" when a process has its
 				// working directory on the mount. Log the event at Info level
@@ -230,6 +327,38 @@ func setOpenFileLimit() {
 // initFuseFrontend - initialize gocryptfs/internal/fusefrontend
 // Calls os.Exit on errors
 func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys func()) {
+	frontendArgs, cCore, cEnc, nameTransform := initCrypto(args)
+	frontendArgs.Status.MountTime = time.Now().Unix()
+	if args.corruption_log != "" {
+		frontendArgs.CorruptionLog, _ = filepath.Abs(args.corruption_log)
+	}
+	frontendArgs.AuditLog = args._auditLog
+	if args.scrub {
+		frontendArgs.Scrub = &fusefrontend.ScrubArgs{
+			BwLimit:   args.scrub_bwlimit * 1e6,
+			Interval:  args.scrub_interval,
+			StateFile: scrubStateFile(args),
+		}
+	}
+	// Spawn fusefrontend
+	tlog.Debug.Printf("frontendArgs: %s", tlog.JSONDump(frontendArgs))
+	if args.reverse {
+		if cCore.AEADBackend != cryptocore.BackendAESSIV {
+			log.Panic("reverse mode must use AES-SIV, everything else is insecure")
+		}
+		rootNode = fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
+	} else {
+		rootNode = fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+	}
+	return rootNode, func() { cCore.Wipe() }
+}
+
+// initCrypto loads the master key and reconciles CLI and config file
+// arguments. Returns the crypto helpers that the frontends (and the offline
+// tree operations) need.
+// Calls os.Exit on errors
+func initCrypto(args *argContainer) (frontendArgs fusefrontend.Args, cCore *cryptocore.CryptoCore,
+	cEnc *contentenc.ContentEnc, nameTransform *nametransform.NameTransform) {
 	var err error
 	var confFile *configfile.ConfFile
 	// Get the masterkey from the command line if it was specified
@@ -269,7 +398,7 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 	if args._forceOwner != nil {
 		args.allow_other = true
 	}
-	frontendArgs := fusefrontend.Args{
+	frontendArgs = fusefrontend.Args{
 		Cipherdir:          args.cipherdir,
 		PlaintextNames:     args.plaintextnames,
 		LongNames:          args.longnames,
@@ -285,12 +414,24 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		OneFileSystem:      args.one_file_system,
 		DeterministicNames: args.deterministic_names,
 		NoXattr:            args.noxattr,
+		StableIVs:          args.stable_ivs,
+		MergeDirs:          args._mergeDirs,
+		FollowSymlinks:     args.follow_symlinks,
 	}
 	// confFile is nil when "-zerokey" or "-masterkey" was used
 	if confFile != nil {
 		// Settings from the config file override command line args
 		frontendArgs.PlaintextNames = confFile.IsFeatureFlagSet(configfile.FlagPlaintextNames)
 		frontendArgs.DeterministicNames = !confFile.IsFeatureFlagSet(configfile.FlagDirIV)
+		frontendArgs.StableIVs = confFile.IsFeatureFlagSet(configfile.FlagStableIVs)
+		if args.stable_ivs && !frontendArgs.StableIVs {
+			tlog.Fatal.Printf("-stable-ivs must be passed to -init, this filesystem has been created without it")
+			os.Exit(exitcodes.Usage)
+		}
+		if frontendArgs.StableIVs && runtime.GOOS == "freebsd" {
+			tlog.Fatal.Printf("This filesystem has been created with -stable-ivs, which is not supported on FreeBSD")
+			os.Exit(exitcodes.Usage)
+		}
 		// Things that don't have to be in frontendArgs are only in args
 		args.longnamemax = confFile.LongNameMax
 		args.raw64 = confFile.IsFeatureFlagSet(configfile.FlagRaw64)
@@ -327,9 +468,9 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 	}
 
 	// Init crypto backend
-	cCore := cryptocore.New(masterkey, cryptoBackend, IVBits, args.hkdf)
-	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
-	nameTransform := nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.longnamemax,
+	cCore = cryptocore.New(masterkey, cryptoBackend, IVBits, args.hkdf)
+	cEnc = contentenc.New(cCore, contentenc.DefaultBS)
+	nameTransform = nametransform.New(cCore.EMECipher, frontendArgs.LongNames, args.longnamemax,
 		args.raw64, []string(args.badname), frontendArgs.DeterministicNames)
 	// After the crypto backend is initialized,
 	// we can purge the master key from memory.
@@ -337,22 +478,20 @@ func initFuseFrontend(args *argContainer) (rootNode fs.InodeEmbedder, wipeKeys f
 		masterkey[i] = 0
 	}
 	masterkey = nil
-	// Spawn fusefrontend
-	tlog.Debug.Printf("frontendArgs: %s", tlog.JSONDump(frontendArgs))
-	if args.reverse {
-		if cryptoBackend != cryptocore.BackendAESSIV {
-			log.Panic("reverse mode must use AES-SIV, everything else is insecure")
-		}
-		rootNode = fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
-	} else {
-		rootNode = fusefrontend.NewRootNode(frontendArgs, cEnc, nameTransform)
+	// Static part of the ctlsock "Status" answer
+	frontendArgs.Status = ctlsock.StatusStruct{
+		Version:     GitVersion,
+		Cipherdir:   args.cipherdir,
+		Mountpoint:  args.mountpoint,
+		Reverse:     args.reverse,
+		AEADBackend: cCore.AEADBackend.String(),
+		IdleTimeout: int64(args.idle / time.Second),
 	}
-	// We have opened the socket early so that we cannot fail here after
-	// asking the user for the password
-	if args._ctlsockFd != nil {
-		go ctlsocksrv.Serve(args._ctlsockFd, rootNode.(ctlsocksrv.Interface))
+	if confFile != nil {
+		frontendArgs.Status.ConfigFile = args.config
+		frontendArgs.Status.FeatureFlags = confFile.FeatureFlags
 	}
-	return rootNode, func() { cCore.Wipe() }
+	return frontendArgs, cCore, cEnc, nameTransform
 }
 
 type RootInoer interface {
@@ -361,8 +500,9 @@ type RootInoer interface {
 
 // initGoFuse calls into go-fuse to mount `rootNode` on `args.mountpoint`.
 // The mountpoint is ready to use when the functions returns.
+// "ops" sees every FUSE operation, it may be nil.
 // On error, it calls os.Exit and does not return.
-func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
+func initGoFuse(rootNode fs.InodeEmbedder, ops fuse.LatencyMap, args *argContainer) *fuse.Server {
 	var fuseOpts *fs.Options
 	sec := time.Second
 	if args.sharedstorage {
@@ -507,7 +647,16 @@ func initGoFuse(rootNode fs.InodeEmbedder, args *argContainer) *fuse.Server {
 		}
 	}
 
-	srv, err := fs.Mount(args.mountpoint, rootNode, fuseOpts)
+	// Like fs.Mount(), but we have to call RecordLatencies() before the
+	// server starts
+	srv, err := fuse.NewServer(fs.NewNodeFS(rootNode, fuseOpts), args.mountpoint, &fuseOpts.MountOptions)
+	if err == nil {
+		if ops != nil {
+			srv.RecordLatencies(ops)
+		}
+		go srv.Serve()
+		err = srv.WaitMount()
+	}
 	if err != nil {
 		tlog.Fatal.Printf("fs.Mount failed: %s", strings.TrimSpace(err.Error()))
 		if runtime.GOOS == "darwin" {
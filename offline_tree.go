@@ -0,0 +1,104 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend"
+	"github.com/rfjakob/gocryptfs/v2/internal/fusefrontend_reverse"
+	"github.com/rfjakob/gocryptfs/v2/internal/offline"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// initOffline loads the config and the master key and returns an
+// offline.FS for args.cipherdir, plus a function that wipes the keys.
+// Calls os.Exit on errors.
+func initOffline(args *argContainer) (f *offline.FS, wipeKeys func()) {
+	if args.reverse {
+		tlog.Fatal.Printf("-decrypt-tree and -encrypt-tree do not work in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	frontendArgs, cCore, cEnc, nameTransform := initCrypto(args)
+	f = offline.New(offlineArgs(frontendArgs), cEnc, nameTransform)
+	return f, func() { cCore.Wipe() }
+}
+
+// offlineArgs picks the settings that apply to offline access
+func offlineArgs(a fusefrontend.Args) offline.Args {
+	return offline.Args{
+		Cipherdir:          a.Cipherdir,
+		PlaintextNames:     a.PlaintextNames,
+		DeterministicNames: a.DeterministicNames,
+		LongNames:          a.LongNames,
+		ConfigCustom:       a.ConfigCustom,
+	}
+}
+
+// cleanSubdir turns the "-subdir" argument into a relative plaintext path
+func cleanSubdir(subdir string) string {
+	return strings.Trim(filepath.Clean("/"+subdir), "/")
+}
+
+// decryptTree implements "gocryptfs -decrypt-tree CIPHERDIR DEST".
+// DEST "-" writes a tar stream to stdout.
+func decryptTree(args *argContainer) {
+	dest := flagSet.Arg(1)
+	f, wipeKeys := initOffline(args)
+	defer wipeKeys()
+	var err error
+	if dest == "-" {
+		tw := offline.NewTarWriter(os.Stdout)
+		err = f.DecryptTree(cleanSubdir(args.subdir), tw)
+		if err == nil {
+			err = tw.Close()
+		}
+	} else {
+		err = f.DecryptTree(cleanSubdir(args.subdir), offline.NewDirWriter(dest))
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-decrypt-tree: %v", err)
+		wipeKeys()
+		os.Exit(exitcodes.OfflineTree)
+	}
+}
+
+// encryptTree implements "gocryptfs -encrypt-tree PLAINDIR CIPHERDIR".
+// CIPHERDIR is already in args.cipherdir.
+func encryptTree(args *argContainer) {
+	plainDir := flagSet.Arg(0)
+	f, wipeKeys := initOffline(args)
+	defer wipeKeys()
+	w, err := f.NewTreeWriter(cleanSubdir(args.subdir))
+	if err == nil {
+		err = offline.WalkDir(plainDir, w)
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-encrypt-tree: %v", err)
+		wipeKeys()
+		os.Exit(exitcodes.OfflineTree)
+	}
+}
+
+// reverseTar implements "gocryptfs -reverse -tar PLAINDIR". It writes the
+// ciphertext view that a reverse mount would show to stdout as a tar stream.
+func reverseTar(args *argContainer) {
+	if !args.reverse {
+		tlog.Fatal.Printf("-tar only works in reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	frontendArgs, cCore, cEnc, nameTransform := initCrypto(args)
+	defer cCore.Wipe()
+	if cCore.AEADBackend != cryptocore.BackendAESSIV {
+		log.Panic("reverse mode must use AES-SIV, everything else is insecure")
+	}
+	rn := fusefrontend_reverse.NewRootNode(frontendArgs, cEnc, nameTransform)
+	if err := rn.WriteTar(os.Stdout); err != nil {
+		tlog.Fatal.Printf("-tar: %v", err)
+		cCore.Wipe()
+		os.Exit(exitcodes.OfflineTree)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+)
+
+// ctlsockRegistryPath returns the path of the symlink that points from
+// "mountpoint" to its control socket, so that "gocryptfs -status
+// MOUNTPOINT" can find the socket. Empty if $XDG_RUNTIME_DIR is not set.
+// We don't fall back to /tmp, anybody could plant symlinks there.
+func ctlsockRegistryPath(mountpoint string) string {
+	dir := os.Getenv("XDG_RUNTIME_DIR")
+	if dir == "" {
+		return ""
+	}
+	h := sha256.Sum256([]byte(mountpoint))
+	return filepath.Join(dir, "gocryptfs", "ctlsock-"+hex.EncodeToString(h[:8]))
+}
+
+// registerCtlsock records that the control socket of "mountpoint" is
+// "sock". Call the returned function on unmount.
+func registerCtlsock(mountpoint string, sock string) func() {
+	fn := ctlsockRegistryPath(mountpoint)
+	if fn == "" {
+		return func() {}
+	}
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		tlog.Debug.Printf("registerCtlsock: %v", err)
+		return func() {}
+	}
+	// Replace a stale entry left behind by a crash
+	os.Remove(fn)
+	if err := os.Symlink(sock, fn); err != nil {
+		tlog.Debug.Printf("registerCtlsock: %v", err)
+		return func() {}
+	}
+	return func() { os.Remove(fn) }
+}
+
+// status prints the status of a mounted filesystem. "path" is the control
+// socket or the mountpoint. This is called when you pass the "-status"
+// option.
+func status(path string) {
+	sock := path
+	fi, err := os.Stat(path)
+	if err == nil && fi.IsDir() {
+		mnt, _ := filepath.Abs(path)
+		reg := ctlsockRegistryPath(mnt)
+		if reg == "" {
+			tlog.Fatal.Printf("-status: XDG_RUNTIME_DIR is not set, pass the -ctlsock path instead of the mountpoint")
+			os.Exit(exitcodes.CtlSock)
+		}
+		sock, err = os.Readlink(reg)
+		if err != nil {
+			tlog.Fatal.Printf("-status: %q has not been mounted with -ctlsock", path)
+			os.Exit(exitcodes.CtlSock)
+		}
+	}
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		tlog.Fatal.Printf("-status: %v", err)
+		os.Exit(exitcodes.CtlSock)
+	}
+	defer c.Close()
+	resp, err := c.Query(&ctlsock.RequestStruct{Status: true})
+	if err == nil && resp.Status == nil {
+		err = fmt.Errorf("no status in response, is gocryptfs too old?")
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-status: %v", err)
+		os.Exit(exitcodes.CtlSock)
+	}
+	s := resp.Status
+	mode := "forward"
+	if s.Reverse {
+		mode = "reverse"
+	}
+	mountTime := time.Unix(s.MountTime, 0)
+	// Pretty-print
+	fmt.Printf("Version:      %s\n", s.Version)
+	fmt.Printf("Cipherdir:    %s\n", s.Cipherdir)
+	fmt.Printf("Mountpoint:   %s (%s mode)\n", s.Mountpoint, mode)
+	fmt.Printf("Mounted:      %s (%s ago)\n", mountTime.Format(time.DateTime), time.Since(mountTime).Round(time.Second))
+	if s.ConfigFile != "" {
+		fmt.Printf("ConfigFile:   %s\n", s.ConfigFile)
+		fmt.Printf("FeatureFlags: %s\n", strings.Join(s.FeatureFlags, " "))
+	}
+	fmt.Printf("AEADBackend:  %s\n", s.AEADBackend)
+	fmt.Printf("Encrypted:    %d blocks, %.2f MB\n", s.BlocksEncrypted, float64(s.BytesEncrypted)/1e6)
+	fmt.Printf("Decrypted:    %d blocks, %.2f MB\n", s.BlocksDecrypted, float64(s.BytesDecrypted)/1e6)
+	if !s.Reverse {
+		fmt.Printf("OpenFiles:    %d\n", s.OpenFiles)
+		rate := 0.0
+		if s.DirCacheLookups > 0 {
+			rate = float64(s.DirCacheHits) * 100 / float64(s.DirCacheLookups)
+		}
+		fmt.Printf("DirCache:     %d hits, %d lookups (%.0f%%)\n", s.DirCacheHits, s.DirCacheLookups, rate)
+	}
+	if s.IdleTimeout > 0 {
+		fmt.Printf("Idle:         %v (-idle %v)\n", s.Idle, time.Duration(s.IdleTimeout)*time.Second)
+	} else {
+		fmt.Printf("Idle:         -idle not set\n")
+	}
+}
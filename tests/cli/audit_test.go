@@ -0,0 +1,88 @@
+package cli
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/audit"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestAuditLog mounts with "-audit-log", does a few operations and checks
+// the records
+func TestAuditLog(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	logFile := dir + ".audit.log"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-audit-log", logFile)
+
+	if err := os.WriteFile(mnt+"/file1", []byte("foo"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(mnt+"/file1", 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(mnt+"/dir1", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(mnt+"/file1", mnt+"/dir1/file2"); err != nil {
+		t.Fatal(err)
+	}
+	// Not empty
+	if err := syscall.Rmdir(mnt + "/dir1"); err != syscall.ENOTEMPTY {
+		t.Fatalf("rmdir: want ENOTEMPTY, got %v", err)
+	}
+	if _, err := os.ReadFile(mnt + "/dir1/file2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(mnt + "/dir1/file2"); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	want := []audit.Record{
+		{Op: "create", Path: "file1", Detail: "O_WRONLY|O_TRUNC"},
+		{Op: "setattr", Path: "file1", Detail: "mode"},
+		{Op: "mkdir", Path: "dir1"},
+		{Op: "rename", Path: "file1", NewPath: "dir1/file2"},
+		{Op: "rmdir", Path: "dir1", Errno: int32(syscall.ENOTEMPTY), Result: syscall.ENOTEMPTY.Error()},
+		{Op: "open", Path: "dir1/file2", Detail: "O_RDONLY"},
+		{Op: "unlink", Path: "dir1/file2"},
+	}
+	f, err := os.Open(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var have []audit.Record
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r audit.Record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatal(err)
+		}
+		have = append(have, r)
+	}
+	if len(have) != len(want) {
+		for _, r := range have {
+			t.Logf("%+v", r)
+		}
+		t.Fatalf("want %d records, have %d", len(want), len(have))
+	}
+	for i, w := range want {
+		h := have[i]
+		if w.Result == "" {
+			w.Result = "OK"
+		}
+		if h.Op != w.Op || h.Path != w.Path || h.NewPath != w.NewPath || h.Detail != w.Detail ||
+			h.Errno != w.Errno || h.Result != w.Result {
+			t.Errorf("record %d: want %+v, have %+v", i, w, h)
+		}
+		if h.Uid != uint32(os.Getuid()) || h.Pid == 0 || h.Time.IsZero() {
+			t.Errorf("record %d: wrong caller or time: %+v", i, h)
+		}
+	}
+}
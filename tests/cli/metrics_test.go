@@ -0,0 +1,120 @@
+package cli
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// getMetrics fetches "/metrics" from the "-metrics" Unix socket "sock"
+func getMetrics(t *testing.T, sock string) string {
+	client, closeConns := closingClient(func() (net.Conn, error) {
+		return net.Dial("unix", sock)
+	})
+	defer closeConns()
+	resp, err := client.Get("http://gocryptfs/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+// checkMetrics checks that "body" contains all lines in "want"
+func checkMetrics(t *testing.T, body string, want []string) {
+	lines := strings.Split(body, "\n")
+	for _, w := range want {
+		found := false
+		for _, l := range lines {
+			if l == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			t.Errorf("line %q not found", w)
+		}
+	}
+	if t.Failed() {
+		t.Log(body)
+	}
+}
+
+// TestMetrics mounts with "-metrics" and checks that the FUSE operations,
+// the crypto counters and the open files show up
+func TestMetrics(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	sock := dir + ".metrics.sock"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test", "-metrics", sock)
+	defer test_helpers.UnmountPanic(mnt)
+	if fi, err := os.Stat(sock); err != nil || fi.Mode().Perm() != 0700 {
+		t.Errorf("socket permissions: %v %v", fi, err)
+	}
+
+	f, err := os.Create(mnt + "/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write(make([]byte, 5000)); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	body := getMetrics(t, sock)
+	checkMetrics(t, body, []string{
+		"# TYPE gocryptfs_fuse_op_duration_seconds histogram",
+		"gocryptfs_blocks_encrypted_total 2",
+		"gocryptfs_encrypted_bytes_total 5000",
+		"gocryptfs_auth_failures_total 0",
+		"gocryptfs_open_file_handles 1",
+		"gocryptfs_open_files 1",
+	})
+	if !strings.Contains(body, `gocryptfs_fuse_op_duration_seconds_count{op="CREATE"} `) {
+		t.Errorf("no CREATE operations counted")
+	}
+	// Make sure we get an answer in reverse mode as well
+	f.Close()
+	rdir := test_helpers.InitFS(t, "-reverse")
+	rmnt := rdir + ".mnt"
+	rsock := rdir + ".metrics.sock"
+	test_helpers.MountOrFatal(t, rdir, rmnt, "-reverse", "-extpass", "echo test", "-metrics", rsock)
+	defer test_helpers.UnmountPanic(rmnt)
+	if _, err = os.ReadFile(rmnt + "/gocryptfs.conf"); err != nil {
+		t.Fatal(err)
+	}
+	checkMetrics(t, getMetrics(t, rsock), []string{
+		"gocryptfs_open_file_handles 0",
+		"gocryptfs_auth_failures_total 0",
+	})
+}
+
+// TestMetricsNoRemoteTCP checks that "-metrics" refuses to listen on a
+// non-localhost TCP address
+func TestMetricsNoRemoteTCP(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	mnt := dir + ".mnt"
+	err := test_helpers.Mount(dir, mnt, false, "-extpass", "echo test", "-metrics", "0.0.0.0:0")
+	if err == nil {
+		test_helpers.UnmountPanic(mnt)
+		t.Fatal("mount should have failed")
+	}
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Metrics {
+		t.Errorf("wrong exit code: want=%d, have=%d", exitcodes.Metrics, code)
+	}
+}
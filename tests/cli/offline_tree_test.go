@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestEncryptDecryptTree encrypts a directory using "-encrypt-tree", checks
+// the result through a mount, and decrypts it again using "-decrypt-tree".
+func TestEncryptDecryptTree(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	plain := dir + ".plain"
+	long := strings.Repeat("l", 200)
+	if err := os.MkdirAll(plain+"/sub/"+long, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(plain+"/sub/"+long+"/file", []byte("content"), 0640); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub", plain+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-encrypt-tree", plain, dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The mount must see the files
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	content, err := os.ReadFile(mnt + "/sub/" + long + "/file")
+	if err != nil {
+		t.Error(err)
+	} else if string(content) != "content" {
+		t.Errorf("wrong content: %q", string(content))
+	}
+	if target, _ := os.Readlink(mnt + "/link"); target != "sub" {
+		t.Errorf("wrong symlink target: %q", target)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	// Decrypt a subtree into a directory
+	out := dir + ".out"
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-decrypt-tree", "-subdir", "sub", dir, out)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	content, err = os.ReadFile(out + "/" + long + "/file")
+	if err != nil {
+		t.Error(err)
+	} else if string(content) != "content" {
+		t.Errorf("wrong content: %q", string(content))
+	}
+	fi, err := os.Stat(out + "/" + long + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("wrong mode %v", fi.Mode())
+	}
+
+	// Decrypt to a tar stream
+	var buf bytes.Buffer
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-decrypt-tree", dir, "-")
+	cmd.Stdout = &buf
+	cmd.Stderr = os.Stderr
+	if err = cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, hdr.Name)
+	}
+	want := []string{"./", "./link", "./sub/", "./sub/" + long + "/", "./sub/" + long + "/file"}
+	if strings.Join(names, "\n") != strings.Join(want, "\n") {
+		t.Errorf("wrong tar contents:\nhave %q\nwant %q", names, want)
+	}
+}
@@ -0,0 +1,59 @@
+package cli
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestStatus checks the ctlsock "Status" request and "gocryptfs -status"
+func TestStatus(t *testing.T) {
+	// Registry for "gocryptfs -status MOUNTPOINT", inherited by the mount
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", sock, "-idle", "1h")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := os.WriteFile(pDir+"/file", make([]byte, 10000), 0600); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{Status: true})
+	s := resp.Status
+	if resp.ErrNo != 0 || s == nil {
+		t.Fatalf("Status failed: %+v", resp)
+	}
+	if s.Cipherdir != cDir || s.Mountpoint != pDir || s.Reverse {
+		t.Errorf("wrong paths: %+v", s)
+	}
+	if s.ConfigFile != cDir+"/gocryptfs.conf" || len(s.FeatureFlags) == 0 || s.AEADBackend == "" {
+		t.Errorf("wrong config info: %+v", s)
+	}
+	if s.BlocksEncrypted != 3 || s.BytesEncrypted != 10000 {
+		t.Errorf("wrong encryption stats: %+v", s)
+	}
+	if s.OpenFiles != 1 || s.IdleTimeout != 3600 || s.Idle {
+		t.Errorf("wrong state: %+v", s)
+	}
+
+	for _, arg := range []string{sock, pDir} {
+		out, err := exec.Command(test_helpers.GocryptfsBinary, "-status", arg).CombinedOutput()
+		if err != nil {
+			t.Fatalf("-status %s: %v\n%s", arg, err, out)
+		}
+		if !strings.Contains(string(out), "Cipherdir:    "+cDir+"\n") ||
+			!strings.Contains(string(out), "Encrypted:    3 blocks, 0.01 MB\n") {
+			t.Errorf("-status %s: unexpected output:\n%s", arg, out)
+		}
+	}
+}
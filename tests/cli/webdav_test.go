@@ -0,0 +1,193 @@
+package cli
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// closingClient returns an HTTP client that connects using "dial", and a
+// function that closes all its connections. The transport closes idle
+// connections asynchronously, which can trip the fd leak check in TestMain.
+func closingClient(dial func() (net.Conn, error)) (*http.Client, func()) {
+	var mu sync.Mutex
+	var conns []net.Conn
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			c, err := dial()
+			if err == nil {
+				mu.Lock()
+				conns = append(conns, c)
+				mu.Unlock()
+			}
+			return c, err
+		},
+	}}
+	return client, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, c := range conns {
+			c.Close()
+		}
+		conns = nil
+	}
+}
+
+// TestWebdav serves a cipherdir using "-webdav" on a Unix socket, writes a
+// file, checks it through a mount, and checks that "-idle" stops the server.
+func TestWebdav(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	sock := dir + ".sock"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-webdav", sock, "-idle", "2s", dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+	defer cmd.Process.Kill()
+
+	client, closeConns := closingClient(func() (net.Conn, error) {
+		return net.Dial("unix", sock)
+	})
+	var err error
+	for i := 0; i < 50; i++ {
+		if _, err = os.Stat(sock); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Created with a restrictive umask, not chmod'ed afterwards
+	if fi, _ := os.Stat(sock); fi.Mode().Perm() != 0700 {
+		t.Errorf("socket permissions: %v", fi.Mode())
+	}
+	req, _ := http.NewRequest("PUT", "http://gocryptfs/file1", strings.NewReader("webdav content"))
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("PUT: status %d", resp.StatusCode)
+	}
+	resp, err = client.Get("http://gocryptfs/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(content) != "webdav content" {
+		t.Errorf("GET: wrong content %q", content)
+	}
+	closeConns()
+
+	select {
+	case err = <-exited:
+		if err != nil {
+			t.Errorf("gocryptfs -webdav exited with error: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("-idle did not stop the server")
+	}
+	if _, err = os.Stat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket was not deleted: %v", err)
+	}
+
+	mnt := dir + ".mnt"
+	test_helpers.MountOrFatal(t, dir, mnt, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(mnt)
+	content, err = os.ReadFile(mnt + "/file1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "webdav content" {
+		t.Errorf("mount: wrong content %q", content)
+	}
+}
+
+// TestWebdavToken checks that "-webdav" on a TCP address requires
+// "-webdav-token", and that requests without the token are rejected.
+func TestWebdavToken(t *testing.T) {
+	dir := test_helpers.InitFS(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-webdav", addr, dir)
+	err = cmd.Run()
+	if code := test_helpers.ExtractCmdExitCode(err); code != exitcodes.Usage {
+		t.Errorf("without -webdav-token: want exit code %d, have %d", exitcodes.Usage, code)
+	}
+
+	tokenFile := dir + ".token"
+	if err = os.WriteFile(tokenFile, []byte("s3cret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd = exec.Command(test_helpers.GocryptfsBinary, "-q", "-extpass", "echo test",
+		"-webdav", addr, "-webdav-token", tokenFile, dir)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer cmd.Wait()
+	defer cmd.Process.Kill()
+
+	client, closeConns := closingClient(func() (net.Conn, error) {
+		return net.Dial("tcp", addr)
+	})
+	defer closeConns()
+	url := "http://" + addr + "/"
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = client.Get(url); err == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without token: want status %d, have %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+	for _, tc := range []struct {
+		password string
+		status   int
+	}{
+		{"wrong", http.StatusUnauthorized},
+		{"s3cret", http.StatusMultiStatus},
+	} {
+		req, _ := http.NewRequest("PROPFIND", url, nil)
+		req.Header.Set("Depth", "0")
+		req.SetBasicAuth("anyone", tc.password)
+		resp, err = client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("password %q: want status %d, have %d", tc.password, tc.status, resp.StatusCode)
+		}
+	}
+}
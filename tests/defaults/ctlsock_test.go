@@ -1,9 +1,17 @@
 package defaults
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
 	"os"
+	"path/filepath"
+	"slices"
 	"syscall"
 	"testing"
+	"time"
 
 	"github.com/rfjakob/gocryptfs/v2/ctlsock"
 	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
@@ -96,3 +104,334 @@ func TestCtlSockDecryptCrash(t *testing.T) {
 	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
 	defer test_helpers.UnmountPanic(pDir)
 }
+
+// TestCtlSockCorruptions checks that corruptions found while accessing
+// files are logged, survive a remount with -corruption-log, and can be
+// cleared.
+func TestCtlSockCorruptions(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	logFile := cDir + ".corruptions"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pDir+"/dir/file", make([]byte, 3*4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cFile := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: "dir/file"}).Result
+	test_helpers.UnmountPanic(pDir)
+	// Corrupt block 1, and add a name that cannot be decrypted
+	f, err := os.OpenFile(cDir+"/"+cFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, 18+4128+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.WriteFile(cDir+"/"+filepath.Dir(cFile)+"/invalid_name", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	mount := func(sock string) {
+		test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test",
+			"-wpanic=false", "-corruption-log", logFile)
+	}
+	list := func(sock string, clear bool) []ctlsock.CorruptionEvent {
+		resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ListCorruptions: true, ClearCorruptions: clear})
+		if resp.ErrNo != 0 {
+			t.Fatalf("ListCorruptions: %s", resp.ErrText)
+		}
+		return resp.Corruptions
+	}
+	sock = cDir + ".sock2"
+	mount(sock)
+	if _, err := os.ReadFile(pDir + "/dir/file"); err == nil {
+		t.Error("reading the corrupt file should fail")
+	}
+	if _, err := os.ReadDir(pDir + "/dir"); err != nil {
+		t.Error(err)
+	}
+	events := list(sock, false)
+	test_helpers.UnmountPanic(pDir)
+	var haveBlock, haveName bool
+	for _, e := range events {
+		switch {
+		case e.Type == "block" && e.Path == "dir/file" && e.Offset == 4096:
+			haveBlock = true
+		case e.Type == "name" && e.Path == "dir/invalid_name" && e.Item == "invalid_name":
+			haveName = true
+		}
+	}
+	if !haveBlock || !haveName {
+		t.Errorf("missing events: %+v", events)
+	}
+
+	// The events are loaded from the -corruption-log file on the next mount
+	sock = cDir + ".sock3"
+	mount(sock)
+	if events2 := list(sock, true); len(events2) != len(events) {
+		t.Errorf("have %d events after remount, want %d", len(events2), len(events))
+	}
+	if events2 := list(sock, false); len(events2) != 0 {
+		t.Errorf("log has not been cleared: %+v", events2)
+	}
+	test_helpers.UnmountPanic(pDir)
+	if st, err := os.Stat(logFile); err != nil || st.Size() != 0 {
+		t.Errorf("log file has not been cleared: %v %v", st, err)
+	}
+}
+
+// TestCtlSockControl checks the ReadOnly, ReadWrite, Flush and Unmount
+// requests.
+func TestCtlSockControl(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	pid := test_helpers.MountInfo[pDir].Pid
+	f, err := os.Create(pDir + "/file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("foo")); err != nil {
+		t.Fatal(err)
+	}
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err = c.SetReadOnly(true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("bar")); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("write to open file: want EROFS, got %v", err)
+	}
+	if err = os.Mkdir(pDir+"/dir", 0700); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("mkdir: want EROFS, got %v", err)
+	}
+	if _, err = os.OpenFile(pDir+"/file", os.O_WRONLY, 0); !errors.Is(err, syscall.EROFS) {
+		t.Errorf("open for writing: want EROFS, got %v", err)
+	}
+	if content, err := os.ReadFile(pDir + "/file"); err != nil || string(content) != "foo" {
+		t.Errorf("read: %q %v", content, err)
+	}
+	if err = c.SetReadOnly(false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("bar")); err != nil {
+		t.Errorf("write after ReadWrite: %v", err)
+	}
+	if err = c.Flush(); err != nil {
+		t.Errorf("Flush: %v", err)
+	}
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ReadOnly: true, ReadWrite: true})
+	if resp.ErrNo == 0 {
+		t.Error("ReadOnly together with ReadWrite should fail")
+	}
+	// The filesystem is busy while we have a file open
+	if err = c.Unmount(); err == nil {
+		t.Fatal("Unmount should fail while a file is open")
+	}
+	f.Close()
+	var unmountErr error
+	for i := 0; i < 10; i++ {
+		// File close on FUSE is asynchronous
+		if unmountErr = c.Unmount(); unmountErr == nil {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if unmountErr != nil {
+		test_helpers.UnmountPanic(pDir)
+		t.Fatalf("Unmount: %v", unmountErr)
+	}
+	// The gocryptfs process should exit
+	for i := 0; i < 100; i++ {
+		if syscall.Kill(pid, 0) == syscall.ESRCH {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("gocryptfs process %d is still running after Unmount", pid)
+}
+
+// TestCtlSockProtocol checks the Hello request, pipelined requests with IDs,
+// version 1 style requests and batch path translation.
+func TestCtlSockProtocol(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	// The request with the wrong type triggers a warning
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test", "-wpanic=false")
+	defer test_helpers.UnmountPanic(pDir)
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	version, caps, err := c.Hello()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != ctlsock.ProtocolVersion || !slices.Contains(caps, "DecryptPaths") || !slices.Contains(caps, "Status") {
+		t.Errorf("Hello: version=%d capabilities=%v", version, caps)
+	}
+
+	// Enough paths for several batches, and some that fail
+	var paths []string
+	for i := 0; i < 2500; i++ {
+		paths = append(paths, fmt.Sprintf("dir/file%d", i))
+	}
+	paths = append(paths, "nonexisting/file", "/dir/")
+	enc, err := c.EncryptPaths(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(enc) != len(paths) {
+		t.Fatalf("got %d results for %d paths", len(enc), len(paths))
+	}
+	var cPaths []string
+	for i, r := range enc[:2500] {
+		if r.ErrNo != 0 || r.Result == "" {
+			t.Fatalf("path %q: %+v", paths[i], r)
+		}
+		cPaths = append(cPaths, r.Result)
+	}
+	if r := enc[2500]; r.ErrNo != int32(syscall.ENOENT) || r.Result != "" {
+		t.Errorf("nonexisting path: %+v", r)
+	}
+	if r := enc[2501]; r.ErrNo != 0 || r.WarnText == "" {
+		t.Errorf("non-canonical path: %+v", r)
+	}
+	dec, err := c.DecryptPaths(cPaths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range dec {
+		if r.Result != paths[i] {
+			t.Fatalf("decrypted %q to %q, want %q", cPaths[i], r.Result, paths[i])
+		}
+	}
+
+	// Raw protocol: pipelined requests with IDs, a request with a wrong
+	// type, and a version 1 request without the trailing newline
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = conn.Write([]byte(`{"ID":7,"EncryptPath":"dir"}` + "\n" +
+		`{"ID":8,"EncryptPath":1}` + "\n" +
+		`{"DecryptPath":"` + enc[0].Result + `"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	var resp []ctlsock.ResponseStruct
+	for i := 0; i < 3; i++ {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rs ctlsock.ResponseStruct
+		if err = json.Unmarshal(line, &rs); err != nil {
+			t.Fatal(err)
+		}
+		resp = append(resp, rs)
+	}
+	if resp[0].ID != 7 || resp[0].ErrNo != 0 || resp[0].Result != filepath.Dir(cPaths[0]) {
+		t.Errorf("request 7: %+v", resp[0])
+	}
+	if resp[1].ID != 8 || resp[1].ErrNo == 0 {
+		t.Errorf("request 8: %+v", resp[1])
+	}
+	if resp[2].ID != 0 || resp[2].ErrNo != 0 || resp[2].Result != paths[0] {
+		t.Errorf("version 1 request: %+v", resp[2])
+	}
+}
+
+// TestCtlSockAllow checks that -ctlsock-allow opens up the socket file
+// permissions, and that we can still use it.
+func TestCtlSockAllow(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test",
+		"-ctlsock-allow", "65534:status")
+	defer test_helpers.UnmountPanic(pDir)
+	fi, err := os.Stat(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0777 {
+		t.Errorf("wrong socket permissions %v", fi.Mode())
+	}
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: "foo"})
+	if resp.ErrNo != 0 {
+		t.Errorf("the owner should be allowed everything: %+v", resp)
+	}
+}
+
+// TestCtlSockLogging checks that the Logging request switches the debug
+// output, and reverts it after RevertAfter.
+func TestCtlSockLogging(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-ctlsock="+sock, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	on, off := true, false
+	s, err := c.SetLogging(ctlsock.LogSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s != (ctlsock.LogStatus{}) {
+		t.Errorf("initial state: %+v", s)
+	}
+	s, err = c.SetLogging(ctlsock.LogSettings{Debug: &on, OpTrace: &on, RevertAfter: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Debug || !s.OpTrace || s.FuseDebug || s.RevertAt == 0 {
+		t.Errorf("after switching on: %+v", s)
+	}
+	// A second temporary change keeps the original state to revert to
+	if s, err = c.SetLogging(ctlsock.LogSettings{Debug: &off, RevertAfter: 1}); err != nil || s.Debug || !s.OpTrace {
+		t.Fatalf("second change: %+v %v", s, err)
+	}
+	// go-fuse debug output cannot be switched at runtime
+	if _, err = c.SetLogging(ctlsock.LogSettings{FuseDebug: &on}); err == nil {
+		t.Error("switching FuseDebug should fail")
+	}
+	// Generate some FUSE operations
+	os.ReadDir(pDir)
+	time.Sleep(1500 * time.Millisecond)
+	s, err = c.SetLogging(ctlsock.LogSettings{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *s != (ctlsock.LogStatus{}) {
+		t.Errorf("after revert: %+v", s)
+	}
+	// Without RevertAfter, the change is permanent
+	if s, err = c.SetLogging(ctlsock.LogSettings{OpTrace: &on}); err != nil || !s.OpTrace || s.RevertAt != 0 {
+		t.Errorf("permanent change: %+v %v", s, err)
+	}
+	if s, err = c.SetLogging(ctlsock.LogSettings{OpTrace: &off}); err != nil || s.OpTrace {
+		t.Errorf("switching off: %+v %v", s, err)
+	}
+}
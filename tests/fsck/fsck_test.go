@@ -148,3 +148,43 @@ func TestTerabyteFile(t *testing.T) {
 	cmd.Wait()
 	timer.Stop()
 }
+
+// TestCheckpoint resumes a check from a "-fsck-checkpoint" file
+func TestCheckpoint(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	for _, n := range []string{"a", "b", "c"} {
+		if err := os.WriteFile(pDir+"/"+n, []byte(n), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	checkpoint := cDir + ".checkpoint"
+	js := `{"Cipherdir": "` + cDir + `", "Done": "b", "Files": 2, "Corrupt": [{"Path": "a", "Type": "read"}]}`
+	if err := os.WriteFile(checkpoint, []byte(js), 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runFsck(t, "-fsck-checkpoint", checkpoint, cDir)
+	if !strings.Contains(out, `resuming after "b"`) {
+		t.Errorf("resume not reported")
+	}
+	// The corrupt file from the checkpoint is still reported
+	if code != exitcodes.FsckErrors || !strings.Contains(out, "1 corrupt files") {
+		t.Errorf("want 1 corrupt file and exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+	if _, err := os.Stat(checkpoint); !os.IsNotExist(err) {
+		t.Errorf("checkpoint should be removed after a complete run: %v", err)
+	}
+
+	// A checkpoint of another filesystem is rejected
+	js = `{"Cipherdir": "/nonexisting", "Done": "b"}`
+	if err := os.WriteFile(checkpoint, []byte(js), 0600); err != nil {
+		t.Fatal(err)
+	}
+	_, code = runFsck(t, "-fsck-checkpoint", checkpoint, cDir)
+	if code != exitcodes.Usage {
+		t.Errorf("want exit code %d, have %d", exitcodes.Usage, code)
+	}
+}
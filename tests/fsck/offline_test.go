@@ -0,0 +1,117 @@
+package fsck
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestOffline checks that "-fsck -offline" finds the same problems as the
+// mounted check, and the structural ones that a mount hides.
+func TestOffline(t *testing.T) {
+	if _, code := runFsck(t, "-offline", "broken_fs_v1.4"); code != exitcodes.FsckErrors {
+		t.Errorf("broken_fs_v1.4: want exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", sock)
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"dir/file", "big"} {
+		if err := os.WriteFile(pDir+"/"+p, make([]byte, 5*4096), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Sparse file, the hole has to be skipped
+	f, err := os.Create(pDir + "/sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte("foo"), 1<<30); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	long := strings.Repeat("l", 200)
+	if err := os.WriteFile(pDir+"/"+long, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	cFile := cDir + "/" + test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: "dir/file"}).Result
+	cBig := cDir + "/" + test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: "big"}).Result
+	cLong := cDir + "/" + test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: long}).Result
+	test_helpers.UnmountPanic(pDir)
+
+	if out, code := runFsck(t, "-offline", cDir); code != 0 {
+		t.Fatalf("clean fs: exit code %d\n%s", code, out)
+	}
+
+	// Corrupt blocks 1 and 3. All bad blocks are reported, not only the
+	// first one.
+	bf, err := os.OpenFile(cBig, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blockNo := range []int64{1, 3} {
+		if _, err = bf.WriteAt([]byte{0xff}, 18+blockNo*4128+100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bf.Close()
+	// Invalid gocryptfs.diriv
+	diriv := filepath.Dir(cFile) + "/gocryptfs.diriv"
+	os.Chmod(diriv, 0600)
+	if err := os.WriteFile(diriv, []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Orphaned .name file
+	if err := os.Remove(cLong); err != nil {
+		t.Fatal(err)
+	}
+	// Leftover temporary files, and a file that belongs to a sync client
+	for _, tmp := range []string{"gocryptfs.conf.tmp", "gocryptfs.diriv.rmdir.123", ".stfolder"} {
+		if err := os.WriteFile(cDir+"/"+tmp, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	out, code := runFsck(t, "-offline", cDir)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("want exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+	for _, want := range []string{
+		"corrupt block 1 (plaintext offset 4096)",
+		"corrupt block 3 (plaintext offset 12288)",
+		`invalid gocryptfs.diriv in dir "dir"`,
+		"orphaned long name file",
+		`leftover temporary file in dir "": "gocryptfs.conf.tmp"`,
+		`leftover temporary file in dir "": "gocryptfs.diriv.rmdir.123"`,
+		`ignoring unencrypted file in dir "": ".stfolder"`,
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%q missing in output", want)
+		}
+	}
+
+	if out, code := runFsck(t, "-offline", "-repair", "-repair-diriv", cDir); code != 0 {
+		t.Errorf("repair: exit code %d\n%s", code, out)
+	}
+	if out, code := runFsck(t, "-offline", cDir); code != 0 {
+		t.Errorf("after repair: exit code %d\n%s", code, out)
+	}
+	// The damaged gocryptfs.diriv is kept
+	if m, _ := filepath.Glob(diriv + ".bad.*"); len(m) != 1 {
+		t.Errorf("damaged gocryptfs.diriv should be kept, have %v", m)
+	} else if b, _ := os.ReadFile(m[0]); string(b) != "short" {
+		t.Errorf("damaged gocryptfs.diriv has wrong content %q", b)
+	}
+	if _, err := os.Stat(cDir + "/.stfolder"); err != nil {
+		t.Errorf("repair must leave .stfolder alone: %v", err)
+	}
+}
@@ -0,0 +1,153 @@
+package fsck
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+func runFsck(t *testing.T, args ...string) (out string, code int) {
+	args = append([]string{"-fsck", "-extpass", "echo test"}, args...)
+	outBin, err := exec.Command(test_helpers.GocryptfsBinary, args...).CombinedOutput()
+	t.Log(string(outBin))
+	return string(outBin), test_helpers.ExtractCmdExitCode(err)
+}
+
+// TestRepair breaks a filesystem in the ways "-fsck -repair" can fix and
+// checks that it does.
+func TestRepair(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", sock)
+	content := make([]byte, 3*4096)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	long := strings.Repeat("l", 200)
+	files := []string{"dir/file", "big", long}
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	cPaths := make(map[string]string)
+	for _, p := range files {
+		if err := os.WriteFile(pDir+"/"+p, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+		resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: p})
+		cPaths[p] = cDir + "/" + resp.Result
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// "dir" loses its gocryptfs.diriv
+	if err := os.Remove(filepath.Dir(cPaths["dir/file"]) + "/gocryptfs.diriv"); err != nil {
+		t.Fatal(err)
+	}
+	// Leave the .name file of the long name behind
+	if err := os.Remove(cPaths[long]); err != nil {
+		t.Fatal(err)
+	}
+	corruptBlock1 := func() {
+		f, err := os.OpenFile(cPaths["big"], os.O_WRONLY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		if _, err = f.WriteAt([]byte{0xff, 0xff}, 18+4128+100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	corruptBlock1()
+
+	nameFile, err := os.ReadFile(cPaths[long] + ".name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without -repair-diriv, the names in "dir" stay where they are
+	out, code := runFsck(t, "-repair", cDir)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("no -repair-diriv: want exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+	if !strings.Contains(out, "not recreating gocryptfs.diriv") {
+		t.Errorf("no -repair-diriv: missing diriv not reported")
+	}
+	if _, err := os.Stat(cPaths["dir/file"]); err != nil {
+		t.Errorf("no -repair-diriv: file has been moved: %v", err)
+	}
+	// That run has already fixed the rest
+	corruptBlock1()
+	if err := os.WriteFile(cPaths[long]+".name", nameFile, 0400); err != nil {
+		t.Fatal(err)
+	}
+
+	out, code = runFsck(t, "-repair", "-repair-diriv", "-dry-run", cDir)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("dry run: want exit code %d, have %d", exitcodes.FsckErrors, code)
+	}
+	if !strings.Contains(out, "would recreate gocryptfs.diriv") {
+		t.Errorf("dry run: missing diriv not reported")
+	}
+	if _, err := os.Stat(cPaths[long] + ".name"); err != nil {
+		t.Errorf("dry run changed something: %v", err)
+	}
+
+	logFile := cDir + ".repair.log"
+	out, code = runFsck(t, "-repair", "-repair-diriv", "-repair-log", logFile, cDir)
+	if code != 0 {
+		t.Errorf("repair: want exit code 0, have %d", code)
+	}
+	for _, want := range []string{
+		"recreate gocryptfs.diriv",
+		"remove orphaned",
+		"move undecryptable",
+		"zero bad block 1 (plaintext offset 4096)",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("repair: %q missing in output", want)
+		}
+	}
+	log, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := strings.Count(string(log), "\n"); n != 4 {
+		t.Errorf("repair log should have 4 lines, has %d:\n%s", n, log)
+	}
+	if _, code = runFsck(t, cDir); code != 0 {
+		t.Errorf("fsck after repair: exit code %d", code)
+	}
+
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	want := append([]byte{}, content...)
+	clear(want[4096:8192])
+	if have, err := os.ReadFile(pDir + "/big"); err != nil || !bytes.Equal(have, want) {
+		t.Errorf("big: wrong content after zeroing, err=%v", err)
+	}
+	lf, err := os.ReadDir(pDir + "/lost+found")
+	if err != nil || len(lf) != 1 {
+		t.Fatalf("lost+found: %v %v", lf, err)
+	}
+	if have, err := os.ReadFile(pDir + "/lost+found/" + lf[0].Name()); err != nil || !bytes.Equal(have, content) {
+		t.Errorf("file in lost+found: wrong content, err=%v", err)
+	}
+	test_helpers.UnmountPanic(pDir)
+
+	// Remove a bad block instead of zeroing it
+	corruptBlock1()
+	if _, code = runFsck(t, "-repair", "-repair-blocks", "remove", cDir); code != 0 {
+		t.Errorf("remove: want exit code 0, have %d", code)
+	}
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(pDir)
+	want = append(append([]byte{}, content[:4096]...), content[8192:]...)
+	if have, err := os.ReadFile(pDir + "/big"); err != nil || !bytes.Equal(have, want) {
+		t.Errorf("big: wrong content after removing, len=%d err=%v", len(have), err)
+	}
+}
@@ -0,0 +1,106 @@
+package fsck
+
+import (
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// report is the part of the "-fsck-report" file we check
+type report struct {
+	ExitCode int
+	Counters struct {
+		Files     int
+		Corrupt   int
+		Mitigated int
+	}
+	Corrupt []struct {
+		Path   string
+		Type   string
+		Blocks []struct {
+			BlockNo uint64
+			Offset  int64
+		}
+	}
+	Mitigated []struct {
+		Path string
+		Type string
+	}
+}
+
+func readReport(t *testing.T, fn string) (r report) {
+	js, err := os.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(js, &r); err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+// TestReport checks the "-fsck-report" file of both engines
+func TestReport(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", sock)
+	if err := os.WriteFile(pDir+"/file", make([]byte, 5*4096), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cFile := cDir + "/" + test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: "file"}).Result
+	test_helpers.UnmountPanic(pDir)
+	f, err := os.OpenFile(cFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, blockNo := range []int64{1, 3} {
+		if _, err = f.WriteAt([]byte{0xff}, 18+blockNo*4128+100); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	// A name that cannot be decrypted is hidden by the mount
+	if err := os.WriteFile(cDir+"/invalid_name", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offline := range []bool{false, true} {
+		fn := cDir + ".report.json"
+		args := []string{"-fsck-report", fn, cDir}
+		if offline {
+			args = append([]string{"-offline"}, args...)
+		}
+		runFsck(t, args...)
+		r := readReport(t, fn)
+		if r.ExitCode != exitcodes.FsckErrors {
+			t.Errorf("offline=%v: ExitCode=%d", offline, r.ExitCode)
+		}
+		if r.Counters.Corrupt != 2 {
+			t.Errorf("offline=%v: Counters.Corrupt=%d, want 2", offline, r.Counters.Corrupt)
+		}
+		var blocks []int64
+		for _, p := range r.Corrupt {
+			if p.Path == "file" && p.Type == "block" {
+				for _, b := range p.Blocks {
+					blocks = append(blocks, b.Offset)
+				}
+			}
+		}
+		if len(blocks) != 2 || blocks[0] != 4096 || blocks[1] != 3*4096 {
+			t.Errorf("offline=%v: wrong bad blocks: %v", offline, blocks)
+		}
+		// Through the mount, the bad name is a mitigated corruption
+		wantMitigated := 1
+		if offline {
+			wantMitigated = 0
+		}
+		if len(r.Mitigated) != wantMitigated || r.Counters.Mitigated != wantMitigated {
+			t.Errorf("offline=%v: Mitigated=%v", offline, r.Mitigated)
+		}
+	}
+}
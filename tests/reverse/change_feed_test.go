@@ -0,0 +1,172 @@
+package reverse_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestChangedSince checks the ChangedSince ctlsock request
+func TestChangedSince(t *testing.T) {
+	backingDir, mnt, sock := newReverseFS(nil)
+	defer test_helpers.UnmountPanic(mnt)
+	if err := os.Mkdir(backingDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"file1", "dir/file2", "dir/longfile." + x240} {
+		if err := os.WriteFile(backingDir+"/"+p, []byte("content"), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	encrypt := func(p string) string {
+		resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: p})
+		if resp.ErrNo != 0 {
+			t.Fatalf("EncryptPath %q: %s", p, resp.ErrText)
+		}
+		return resp.Result
+	}
+	changedSince := func(since int64) ctlsock.ResponseStruct {
+		resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ChangedSince: since})
+		if resp.ErrNo != 0 {
+			t.Fatalf("ChangedSince: %s", resp.ErrText)
+		}
+		sort.Strings(resp.Changed)
+		return resp
+	}
+	// Everything is reported on the first run
+	resp := changedSince(1)
+	want := []string{".", configfile.ConfDefaultName, encrypt("file1"), encrypt("dir"), encrypt("dir/file2"),
+		encrypt("dir/longfile." + x240)}
+	if !plaintextnames {
+		want = append(want, encrypt("dir/longfile."+x240)+nametransform.LongNameSuffix)
+	}
+	if !plaintextnames && !deterministic_names {
+		want = append(want, nametransform.DirIVFilename, filepath.Join(encrypt("dir"), nametransform.DirIVFilename))
+	}
+	sort.Strings(want)
+	if !slices.Equal(resp.Changed, want) {
+		t.Errorf("first run:\nhave=%q\nwant=%q", resp.Changed, want)
+	}
+	// Wait until our files are older than the returned timestamp, which
+	// lags behind by one second.
+	time.Sleep(1500 * time.Millisecond)
+	resp = changedSince(1)
+	// Nothing has changed since
+	resp = changedSince(resp.Timestamp)
+	if len(resp.Changed) != 0 {
+		t.Errorf("nothing changed, but have %q", resp.Changed)
+	}
+	// Modify a file and create a new one
+	if err := os.WriteFile(backingDir+"/file1", []byte("changed"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(backingDir+"/dir/file3", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	resp = changedSince(resp.Timestamp)
+	// The IVs below "dir" are derived from its path, so everything in it
+	// is reported
+	want = []string{encrypt("file1"), encrypt("dir"), encrypt("dir/file2"), encrypt("dir/file3"),
+		encrypt("dir/longfile." + x240)}
+	if !plaintextnames {
+		want = append(want, encrypt("dir/longfile."+x240)+nametransform.LongNameSuffix)
+	}
+	if !plaintextnames && !deterministic_names {
+		want = append(want, filepath.Join(encrypt("dir"), nametransform.DirIVFilename))
+	}
+	sort.Strings(want)
+	if !slices.Equal(resp.Changed, want) {
+		t.Errorf("second run:\nhave=%q\nwant=%q", resp.Changed, want)
+	}
+
+	// Renaming a directory changes the ciphertext of everything below it
+	time.Sleep(1500 * time.Millisecond)
+	resp = changedSince(1)
+	if err := os.Mkdir(backingDir+"/a", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(backingDir+"/dir", backingDir+"/a/dir2"); err != nil {
+		t.Fatal(err)
+	}
+	resp = changedSince(resp.Timestamp)
+	for _, p := range []string{"a/dir2", "a/dir2/file2", "a/dir2/file3"} {
+		if !slices.Contains(resp.Changed, encrypt(p)) {
+			t.Errorf("after rename: %q missing", p)
+		}
+	}
+}
+
+// TestChangedSinceMax checks that ChangedMax splits the answer into several
+// responses
+func TestChangedSinceMax(t *testing.T) {
+	backingDir, mnt, sock := newReverseFS(nil)
+	defer test_helpers.UnmountPanic(mnt)
+	for i := 0; i < 10; i++ {
+		if err := os.WriteFile(fmt.Sprintf("%s/file%d", backingDir, i), nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ChangedSince: 1}).Changed
+
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err = json.NewEncoder(conn).Encode(ctlsock.RequestStruct{ID: 7, ChangedSince: 1, ChangedMax: 3}); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(conn)
+	var have []string
+	for {
+		var resp ctlsock.ResponseStruct
+		if err = dec.Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.ID != 7 || resp.ErrNo != 0 {
+			t.Fatalf("bad response %+v", resp)
+		}
+		if len(resp.Changed) > 3 {
+			t.Errorf("got %d paths, ChangedMax is 3", len(resp.Changed))
+		}
+		have = append(have, resp.Changed...)
+		if !resp.ChangedMore {
+			if resp.Timestamp == 0 {
+				t.Error("last response has no Timestamp")
+			}
+			break
+		}
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("have=%q\nwant=%q", have, want)
+	}
+
+	// Same through the client library
+	c, err := ctlsock.New(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Conn.Close()
+	have = nil
+	_, err = c.ChangedSince(1, func(changed []string) error {
+		have = append(have, changed...)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(have, want) {
+		t.Errorf("client: have=%q\nwant=%q", have, want)
+	}
+}
@@ -0,0 +1,133 @@
+package reverse_test
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestFollowSymlinks checks that "-follow-symlinks" presents link targets
+// in place of the links, and that dangling links and directory loops are
+// passed through as symlinks.
+func TestFollowSymlinks(t *testing.T) {
+	outside, err := os.MkdirTemp(test_helpers.TmpDir, "follow_outside_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(outside+"/file2", []byte("content2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backingDir, mnt, sock := newReverseFS([]string{"-follow-symlinks"})
+	defer test_helpers.UnmountPanic(mnt)
+	if err = os.Mkdir(backingDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(backingDir+"/dir/file1", []byte("content1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	links := map[string]string{
+		"linkdir":      outside,
+		"linkfile":     "dir/file1",
+		"dangling":     "does-not-exist",
+		"dir/loop":     "..",
+		"dir/selfloop": ".",
+	}
+	for name, target := range links {
+		if err = os.Symlink(target, backingDir+"/"+name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// "linkfile" and "dir/file1" are the same file and must have the same
+	// ciphertext. "-tar" reads "dir/file1" first.
+	tarDir := backingDir + ".tar"
+	if err = os.Mkdir(tarDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	tarCmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-reverse", "-follow-symlinks", "-tar",
+		"-extpass", "echo test", backingDir)
+	tarCmd.Stderr = os.Stderr
+	tarOut, err := tarCmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	untar := exec.Command("tar", "-xf", "-", "-C", tarDir)
+	untar.Stdin = tarOut
+	if err = tarCmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := untar.CombinedOutput(); err != nil {
+		t.Fatalf("tar: %v\n%s", err, out)
+	}
+	if err = tarCmd.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	var ciphertexts []string
+	for _, p := range []string{"dir/file1", "linkfile"} {
+		resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: p})
+		c, err := os.ReadFile(tarDir + "/" + resp.Result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ciphertexts = append(ciphertexts, string(c))
+	}
+	if ciphertexts[0] != ciphertexts[1] {
+		t.Errorf("linkfile and dir/file1 have different ciphertext")
+	}
+
+	// Mount the encrypted view in forward mode
+	fwd := mnt + ".fwd"
+	if err = os.Mkdir(fwd, 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, mnt, fwd, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(fwd)
+
+	for p, content := range map[string]string{
+		"dir/file1":     "content1",
+		"linkfile":      "content1",
+		"linkdir/file2": "content2",
+	} {
+		have, err := os.ReadFile(fwd + "/" + p)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(have) != content {
+			t.Errorf("%s: wrong content %q", p, have)
+		}
+	}
+	for p, isDir := range map[string]bool{"linkdir": true, "linkfile": false} {
+		fi, err := os.Lstat(fwd + "/" + p)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if fi.Mode()&os.ModeSymlink != 0 || fi.IsDir() != isDir {
+			t.Errorf("%s: wrong file type %v", p, fi.Mode())
+		}
+	}
+	// Not followed
+	for _, p := range []string{"dangling", "dir/loop", "dir/selfloop"} {
+		target, err := os.Readlink(fwd + "/" + p)
+		if err != nil {
+			t.Errorf("%s: should be a symlink: %v", p, err)
+			continue
+		}
+		if target != links[p] {
+			t.Errorf("%s: wrong symlink target %q", p, target)
+		}
+	}
+	// Directory entries have the type of the link target
+	entries, err := os.ReadDir(fwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.Name() == "linkdir" && !e.IsDir() {
+			t.Errorf("linkdir: wrong type in directory listing: %v", e.Type())
+		}
+	}
+}
@@ -74,12 +74,19 @@ func TestMain(m *testing.M) {
 
 // newReverseFS creates and mounts a new, empty reverse filesystem.
 func newReverseFS(extraMountArgs []string) (backingDir, mntDir, ctlsockPath string) {
+	return newReverseFSInit(nil, extraMountArgs)
+}
+
+// newReverseFSInit is like newReverseFS, but also passes "extraInitArgs" to
+// "gocryptfs -init".
+func newReverseFSInit(extraInitArgs []string, extraMountArgs []string) (backingDir, mntDir, ctlsockPath string) {
 	args := []string{"-reverse"}
 	if plaintextnames {
 		args = append(args, "-plaintextnames")
 	} else if deterministic_names {
 		args = append(args, "-deterministic-names")
 	}
+	args = append(args, extraInitArgs...)
 	backingDir = test_helpers.InitFS(nil, args...)
 	mntDir = backingDir + ".mnt"
 	ctlsockPath = mntDir + ".sock"
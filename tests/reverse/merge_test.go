@@ -0,0 +1,80 @@
+package reverse_test
+
+import (
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestMerge mounts two extra plaintext directories via "-merge" and checks
+// that they show up as top-level directories in the decrypted view.
+func TestMerge(t *testing.T) {
+	m1, err := os.MkdirTemp(test_helpers.TmpDir, "merge1_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m2, err := os.MkdirTemp(test_helpers.TmpDir, "merge2_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(m1+"/file1", []byte("content1"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Mkdir(m2+"/sub", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(m2+"/sub/file2", []byte("content2"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	backingDir, mnt, _ := newReverseFS([]string{"-merge", "one=" + m1, "-merge", "two=" + m2})
+	defer test_helpers.UnmountPanic(mnt)
+	// "two" in the backing directory is shadowed by the merged directory
+	if err = os.Mkdir(backingDir+"/two", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = os.WriteFile(backingDir+"/file0", []byte("content0"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Mount the encrypted view in forward mode
+	fwd := mnt + ".fwd"
+	if err = os.Mkdir(fwd, 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, mnt, fwd, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(fwd)
+
+	entries, err := os.ReadDir(fwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	sort.Strings(names)
+	want := []string{"file0", "one", "two"}
+	if len(names) != len(want) {
+		t.Fatalf("wrong directory content: have=%v want=%v", names, want)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatalf("wrong directory content: have=%v want=%v", names, want)
+		}
+	}
+	for p, content := range map[string]string{
+		"file0":         "content0",
+		"one/file1":     "content1",
+		"two/sub/file2": "content2",
+	} {
+		have, err := os.ReadFile(fwd + "/" + p)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if string(have) != content {
+			t.Errorf("%s: wrong content %q", p, have)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package reverse_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/pkg/xattr"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// readCiphertext reads the encrypted version of the relative plaintext path
+// "pPath" from the reverse mount "mnt".
+func readCiphertext(t *testing.T, mnt string, sock string, pPath string) []byte {
+	req := ctlsock.RequestStruct{EncryptPath: pPath}
+	resp := test_helpers.QueryCtlSock(t, sock, req)
+	if resp.ErrNo != 0 {
+		t.Fatalf("EncryptPath %q: %s", pPath, resp.ErrText)
+	}
+	content, err := os.ReadFile(mnt + "/" + resp.Result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// TestStableIVs checks that, with -stable-ivs, moving a file to a different
+// directory does not change its ciphertext content.
+func TestStableIVs(t *testing.T) {
+	backingDir, mnt, sock := newReverseFSInit([]string{"-stable-ivs"}, nil)
+	defer test_helpers.UnmountPanic(mnt)
+	if !xattrSupported(backingDir) {
+		t.Skip("xattrs not supported")
+	}
+	if err := os.Mkdir(backingDir+"/dir1", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(backingDir+"/dir1/file", []byte("hello world\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	c1 := readCiphertext(t, mnt, sock, "dir1/file")
+	if len(c1) == 0 {
+		t.Fatal("empty ciphertext")
+	}
+	// The ID has been stored on the plaintext file
+	id, err := xattr.LGet(backingDir+"/dir1/file", "user.gocryptfs.reverse.fileid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(id) != 16+8 {
+		t.Errorf("wrong ID length %d", len(id))
+	}
+	if err := os.Rename(backingDir+"/dir1", backingDir+"/dir2"); err != nil {
+		t.Fatal(err)
+	}
+	c2 := readCiphertext(t, mnt, sock, "dir2/file")
+	if !bytes.Equal(c1, c2) {
+		t.Errorf("ciphertext has changed after rename")
+	}
+	// The ID xattr must not show up in the encrypted view
+	req := ctlsock.RequestStruct{EncryptPath: "dir2/file"}
+	resp := test_helpers.QueryCtlSock(t, sock, req)
+	names, err := xattr.LList(mnt + "/" + resp.Result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 0 {
+		t.Errorf("unexpected xattrs in encrypted view: %v", names)
+	}
+}
+
+// TestStableIVsConfig checks that "-stable-ivs" is stored in the config file,
+// and that it can not be enabled at mount time for a filesystem that has been
+// created without it.
+func TestStableIVsConfig(t *testing.T) {
+	dir := test_helpers.InitFS(t, "-reverse", "-stable-ivs")
+	c, err := configfile.Load(dir + "/" + configfile.ConfReverseName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsFeatureFlagSet(configfile.FlagStableIVs) {
+		t.Errorf("StableIVs feature flag is not set")
+	}
+	dir = test_helpers.InitFS(t, "-reverse")
+	err = test_helpers.Mount(dir, dir+".mnt", false, "-reverse", "-extpass", "echo test", "-stable-ivs")
+	if err == nil {
+		test_helpers.UnmountPanic(dir + ".mnt")
+		t.Fatal("mount with -stable-ivs should have failed")
+	}
+}
+
+// TestStableIVsCopy checks that a file that has been copied including its ID
+// xattr (cp -a) gets a new ID, and that a damaged ID is replaced.
+func TestStableIVsCopy(t *testing.T) {
+	backingDir, mnt, sock := newReverseFSInit([]string{"-stable-ivs"}, nil)
+	defer test_helpers.UnmountPanic(mnt)
+	if !xattrSupported(backingDir) {
+		t.Skip("xattrs not supported")
+	}
+	content := []byte("hello world\n")
+	for _, f := range []string{"file1", "file2", "file3"} {
+		if err := os.WriteFile(backingDir+"/"+f, content, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c1 := readCiphertext(t, mnt, sock, "file1")
+	id1, err := xattr.LGet(backingDir+"/file1", "user.gocryptfs.reverse.fileid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Copy the ID to file2 and put a damaged ID on file3
+	if err := xattr.LSet(backingDir+"/file2", "user.gocryptfs.reverse.fileid", id1); err != nil {
+		t.Fatal(err)
+	}
+	if err := xattr.LSet(backingDir+"/file3", "user.gocryptfs.reverse.fileid", []byte("short")); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"file2", "file3"} {
+		c := readCiphertext(t, mnt, sock, f)
+		if bytes.Equal(c1, c) {
+			t.Errorf("%s: same ciphertext as file1", f)
+		}
+		id, err := xattr.LGet(backingDir+"/"+f, "user.gocryptfs.reverse.fileid")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(id, id1) || len(id) != len(id1) {
+			t.Errorf("%s: ID has not been replaced: %x", f, id)
+		}
+	}
+	// file1 keeps its ID
+	if c := readCiphertext(t, mnt, sock, "file1"); !bytes.Equal(c1, c) {
+		t.Errorf("file1: ciphertext has changed")
+	}
+}
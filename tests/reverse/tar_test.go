@@ -0,0 +1,110 @@
+package reverse_test
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// TestTar checks that "gocryptfs -reverse -tar" writes the same ciphertext
+// tree that the reverse mount shows, and that the extracted tar can be
+// mounted in forward mode.
+func TestTar(t *testing.T) {
+	backingDir, mnt, _ := newReverseFS([]string{"-exclude", "excluded"})
+	defer test_helpers.UnmountPanic(mnt)
+	if err := os.Mkdir(backingDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"file1":       "content1",
+		"dir/" + x240: string(make([]byte, 10000)),
+		"dir/empty":   "",
+		"excluded":    "secret",
+	}
+	for p, content := range files {
+		if err := os.WriteFile(backingDir+"/"+p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir/empty", backingDir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+
+	tarFile := backingDir + ".tar"
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-q", "-reverse", "-tar", "-extpass", "echo test",
+		"-exclude", "excluded", backingDir)
+	out, err := os.Create(tarFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd.Stdout = out
+	cmd.Stderr = os.Stderr
+	err = cmd.Run()
+	out.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	extracted := backingDir + ".extracted"
+	if err = os.Mkdir(extracted, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("tar", "-xf", tarFile, "-C", extracted).CombinedOutput(); err != nil {
+		t.Fatalf("tar: %v\n%s", err, out)
+	}
+	if out, err := exec.Command("diff", "-r", "--no-dereference", mnt, extracted).CombinedOutput(); err != nil {
+		t.Errorf("extracted tar differs from the reverse mount: %v\n%s", err, out)
+	}
+
+	fwd := backingDir + ".fwd"
+	if err = os.Mkdir(fwd, 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, extracted, fwd, "-extpass", "echo test")
+	defer test_helpers.UnmountPanic(fwd)
+	for p, content := range files {
+		have, err := os.ReadFile(fwd + "/" + p)
+		if p == "excluded" {
+			if err == nil {
+				t.Errorf("excluded file is in the tar")
+			}
+			continue
+		}
+		if err != nil {
+			t.Error(err)
+		} else if string(have) != content {
+			t.Errorf("%s: wrong content", p)
+		}
+	}
+	if target, err := os.Readlink(fwd + "/link"); err != nil || target != "dir/empty" {
+		t.Errorf("link: target=%q err=%v", target, err)
+	}
+}
+
+// TestTarNoLongNames checks that "-tar" does not hash long names when
+// "-longnames=false" is passed, like the reverse mount.
+func TestTarNoLongNames(t *testing.T) {
+	if plaintextnames {
+		t.Skip("no long names with -plaintextnames")
+	}
+	backingDir := test_helpers.InitFS(t, "-reverse")
+	if err := os.WriteFile(backingDir+"/"+x240, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command(test_helpers.GocryptfsBinary, "-q", "-reverse", "-tar", "-extpass", "echo test",
+		"-longnames=false", backingDir).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("tar", "-t")
+	cmd.Stdin = bytes.NewReader(out)
+	list, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("tar: %v\n%s", err, list)
+	}
+	if bytes.Contains(list, []byte("gocryptfs.longname.")) {
+		t.Errorf("long name has been hashed:\n%s", list)
+	}
+}
@@ -0,0 +1,93 @@
+package reverse_test
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// runVerify runs "gocryptfs -fsck -reverse" and returns the output
+// and the exit code.
+func runVerify(t *testing.T, plainDir string, cipherCopy string) (string, int) {
+	cmd := exec.Command(test_helpers.GocryptfsBinary, "-fsck", "-reverse", "-extpass", "echo test",
+		plainDir, cipherCopy)
+	outBin, err := cmd.CombinedOutput()
+	out := string(outBin)
+	t.Log(out)
+	return out, test_helpers.ExtractCmdExitCode(err)
+}
+
+// TestVerifyCopy checks that "-fsck -reverse" accepts an up-to-date copy of
+// the ciphertext view, and reports missing and stale files afterwards.
+func TestVerifyCopy(t *testing.T) {
+	backingDir, mnt, _ := newReverseFS(nil)
+	if err := os.Mkdir(backingDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"file1":     "content1",
+		"dir/file2": "content2",
+		"dir/same":  "aaaa",
+		"gone":      "will be deleted from the copy",
+	}
+	for p, content := range files {
+		if err := os.WriteFile(backingDir+"/"+p, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("dir/file2", backingDir+"/link"); err != nil {
+		t.Fatal(err)
+	}
+	cipherCopy := mnt + ".copy"
+	cmd := exec.Command("cp", "-a", mnt, cipherCopy)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("cp: %v\n%s", err, out)
+	}
+	test_helpers.UnmountPanic(mnt)
+
+	out, code := runVerify(t, backingDir, cipherCopy)
+	if code != 0 {
+		t.Fatalf("up-to-date copy: wrong exit code, have=%d want=0", code)
+	}
+	if !strings.Contains(out, "no problems found") {
+		t.Errorf("up-to-date copy: unexpected output")
+	}
+
+	// Change the plaintext after making the copy
+	if err := os.WriteFile(backingDir+"/dir/same", []byte("bbbb"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(backingDir+"/new", []byte("new"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// Delete "gone" from the copy. We find the ciphertext name through a
+	// forward mount.
+	fwd := mnt + ".fwd"
+	if err := os.Mkdir(fwd, 0700); err != nil {
+		t.Fatal(err)
+	}
+	test_helpers.MountOrFatal(t, cipherCopy, fwd, "-extpass", "echo test",
+		"-config", backingDir+"/.gocryptfs.reverse.conf")
+	err := os.Remove(fwd + "/gone")
+	test_helpers.UnmountPanic(fwd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, code = runVerify(t, backingDir, cipherCopy)
+	if code != exitcodes.FsckErrors {
+		t.Errorf("wrong exit code, have=%d want=%d", code, exitcodes.FsckErrors)
+	}
+	if !strings.Contains(out, "0 corrupt files, 0 files skipped, 2 missing, 1 stale") {
+		t.Errorf("wrong summary")
+	}
+	for _, want := range []string{`"new"`, `"gone"`, `"dir/same"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("%s is not reported", want)
+		}
+	}
+}
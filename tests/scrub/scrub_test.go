@@ -0,0 +1,125 @@
+package scrub
+
+import (
+	"encoding/json"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rfjakob/gocryptfs/v2/ctlsock"
+	"github.com/rfjakob/gocryptfs/v2/tests/test_helpers"
+)
+
+// waitPass queries the scrub status until a pass has been completed
+func waitPass(t *testing.T, sock string) *ctlsock.ScrubStatus {
+	for i := 0; i < 100; i++ {
+		resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ScrubStatus: true})
+		if resp.ErrNo != 0 {
+			t.Fatalf("ScrubStatus: %s", resp.ErrText)
+		}
+		if resp.Scrub.LastPassEnd != 0 && !resp.Scrub.Running {
+			return resp.Scrub
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	t.Fatal("timeout waiting for the scrub pass to finish")
+	return nil
+}
+
+// TestScrub checks that the scrubber finds bad blocks and names, and that
+// it resumes where it stopped.
+func TestScrub(t *testing.T) {
+	cDir := test_helpers.InitFS(t)
+	pDir := cDir + ".mnt"
+	sock := cDir + ".sock"
+	stateFile := cDir + ".scrub.json"
+	test_helpers.MountOrFatal(t, cDir, pDir, "-extpass", "echo test", "-ctlsock", sock)
+	// Without -scrub, there is nothing to query
+	resp := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{ScrubStatus: true})
+	if resp.ErrNo != int32(syscall.ENOTSUP) {
+		t.Errorf("ScrubStatus without -scrub: ErrNo=%d ErrText=%q", resp.ErrNo, resp.ErrText)
+	}
+	if err := os.Mkdir(pDir+"/dir", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range []string{"file", "dir/file2"} {
+		if err := os.WriteFile(pDir+"/"+p, make([]byte, 5*4096), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	cFile := test_helpers.QueryCtlSock(t, sock, ctlsock.RequestStruct{EncryptPath: "file"}).Result
+	test_helpers.UnmountPanic(pDir)
+	// Corrupt block 2
+	f, err := os.OpenFile(cDir+"/"+cFile, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.WriteAt([]byte{0xff}, 18+2*4128+100); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if err := os.WriteFile(cDir+"/invalid_name", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The socket file is deleted asynchronously on exit, use a new one for
+	// every mount
+	sock = cDir + ".scrub.sock"
+	scrubArgs := []string{"-extpass", "echo test", "-wpanic=false",
+		"-scrub", "-scrub-bwlimit", "0", "-scrub-state", stateFile}
+	test_helpers.MountOrFatal(t, cDir, pDir, append(scrubArgs, "-ctlsock", sock)...)
+	s := waitPass(t, sock)
+	test_helpers.UnmountPanic(pDir)
+	if s.Pass != 1 || s.Files != 2 || s.Bytes != 10*4096 {
+		t.Errorf("wrong status after first pass: %+v", s)
+	}
+	var haveBlock, haveName bool
+	for _, f := range s.Findings {
+		switch {
+		case f.Type == "block" && f.Path == "file" && f.CipherPath == cFile && f.Offset == 2*4096:
+			haveBlock = true
+		case f.Type == "name" && f.Path == "invalid_name":
+			haveName = true
+		default:
+			t.Errorf("unexpected finding: %+v", f)
+		}
+	}
+	if !haveBlock || !haveName || s.FindingsTotal != 2 {
+		t.Errorf("missing findings: %+v", s.Findings)
+	}
+
+	// Pretend that the scrubber was stopped in "file", behind the bad block
+	js, err := os.ReadFile(stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var st map[string]interface{}
+	if err = json.Unmarshal(js, &st); err != nil {
+		t.Fatal(err)
+	}
+	if st["InProgress"] != false || st["Pass"] != 1.0 {
+		t.Errorf("wrong state file content: %s", js)
+	}
+	st["InProgress"] = true
+	st["Pass"] = 5
+	st["Pos"] = cFile
+	st["Off"] = 3 * 4096
+	st["Files"] = 100
+	js, _ = json.Marshal(st)
+	if err = os.WriteFile(stateFile, js, 0600); err != nil {
+		t.Fatal(err)
+	}
+	sock = cDir + ".resume.sock"
+	test_helpers.MountOrFatal(t, cDir, pDir, append(scrubArgs, "-ctlsock", sock)...)
+	s = waitPass(t, sock)
+	test_helpers.UnmountPanic(pDir)
+	if s.Pass != 5 || s.Files <= 100 {
+		t.Errorf("wrong status after resumed pass: %+v", s)
+	}
+	for _, f := range s.Findings {
+		if f.Type == "block" {
+			t.Errorf("block before the resume position was checked: %+v", f)
+		}
+	}
+}
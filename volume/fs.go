@@ -0,0 +1,363 @@
+package volume
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/offline"
+)
+
+// Verify that the interfaces are implemented.
+var _ fs.FS = &Volume{}
+var _ fs.StatFS = &Volume{}
+var _ fs.ReadDirFS = &Volume{}
+var _ fs.ReadFileFS = &Volume{}
+
+// maxSymlinks is the maximum number of symlinks we follow when resolving a
+// path, like the Linux kernel (MAXSYMLINKS).
+const maxSymlinks = 40
+
+// pathError wraps "err" into an *fs.PathError for the plaintext "name", so
+// that ciphertext paths do not leak to the caller.
+func pathError(op string, name string, err error) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) {
+		err = pe.Err
+	}
+	return &fs.PathError{Op: op, Path: name, Err: err}
+}
+
+// splitPath splits a valid io/fs path into its components
+func splitPath(name string) []string {
+	if name == "." {
+		return nil
+	}
+	return strings.Split(name, "/")
+}
+
+// resolve returns the ciphertext path of the plaintext path "name".
+// Symlinks in the parent directories are followed. The last component is
+// followed if "followLast" is set. The last component does not have to
+// exist.
+func (v *Volume) resolve(op string, name string, followLast bool) (cPath string, err error) {
+	if v.fs == nil {
+		return "", pathError(op, name, fs.ErrClosed)
+	}
+	if !fs.ValidPath(name) {
+		return "", pathError(op, name, fs.ErrInvalid)
+	}
+	parts := splitPath(name)
+	hops := 0
+	for i := 0; i < len(parts); i++ {
+		cName, err := v.fs.EncryptName(cPath, parts[i])
+		if err != nil {
+			return "", pathError(op, name, err)
+		}
+		cChild := path.Join(cPath, cName)
+		last := i == len(parts)-1
+		if last && !followLast {
+			return cChild, nil
+		}
+		st, err := v.fs.Lstat(cChild)
+		if err != nil {
+			if last && errors.Is(err, syscall.ENOENT) {
+				return cChild, nil
+			}
+			return "", pathError(op, name, err)
+		}
+		if st.Mode&syscall.S_IFMT != syscall.S_IFLNK {
+			cPath = cChild
+			continue
+		}
+		hops++
+		if hops > maxSymlinks {
+			return "", pathError(op, name, syscall.ELOOP)
+		}
+		target, err := v.fs.Readlink(cChild)
+		if err != nil {
+			return "", pathError(op, name, err)
+		}
+		if path.IsAbs(target) {
+			return "", pathError(op, name, fs.ErrInvalid)
+		}
+		// Start over with the symlink target spliced in
+		next := path.Join(path.Join(parts[:i]...), target)
+		if next == ".." || strings.HasPrefix(next, "../") {
+			// Points outside of the filesystem
+			return "", pathError(op, name, fs.ErrInvalid)
+		}
+		parts = append(splitPath(next), parts[i+1:]...)
+		cPath = ""
+		i = -1
+	}
+	return cPath, nil
+}
+
+// fileInfo implements fs.FileInfo
+type fileInfo struct {
+	name string
+	st   *unix.Stat_t
+}
+
+// newFileInfo returns the fs.FileInfo of the ciphertext path "cPath" under
+// the plaintext name "name".
+func (v *Volume) newFileInfo(op string, cPath string, name string) (*fileInfo, error) {
+	st, err := v.fs.Lstat(cPath)
+	if err != nil {
+		return nil, pathError(op, name, err)
+	}
+	return &fileInfo{name: path.Base(name), st: st}, nil
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+// Size returns the plaintext size
+func (fi *fileInfo) Size() int64 {
+	return fi.st.Size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(fi.st.Mode & 0777)
+	if fi.st.Mode&syscall.S_ISUID != 0 {
+		mode |= fs.ModeSetuid
+	}
+	if fi.st.Mode&syscall.S_ISGID != 0 {
+		mode |= fs.ModeSetgid
+	}
+	if fi.st.Mode&syscall.S_ISVTX != 0 {
+		mode |= fs.ModeSticky
+	}
+	switch fi.st.Mode & syscall.S_IFMT {
+	case syscall.S_IFDIR:
+		mode |= fs.ModeDir
+	case syscall.S_IFLNK:
+		mode |= fs.ModeSymlink
+	case syscall.S_IFIFO:
+		mode |= fs.ModeNamedPipe
+	case syscall.S_IFSOCK:
+		mode |= fs.ModeSocket
+	case syscall.S_IFCHR:
+		mode |= fs.ModeDevice | fs.ModeCharDevice
+	case syscall.S_IFBLK:
+		mode |= fs.ModeDevice
+	}
+	return mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return time.Unix(fi.st.Mtim.Unix())
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.Mode().IsDir()
+}
+
+// Sys returns the *unix.Stat_t of the ciphertext file, with Size translated
+// to the plaintext size.
+func (fi *fileInfo) Sys() any {
+	return fi.st
+}
+
+// Stat implements fs.StatFS. Symlinks are followed.
+func (v *Volume) Stat(name string) (fs.FileInfo, error) {
+	cPath, err := v.resolve("stat", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return v.newFileInfo("stat", cPath, name)
+}
+
+// Lstat is like Stat, but does not follow a symlink in the last component.
+func (v *Volume) Lstat(name string) (fs.FileInfo, error) {
+	cPath, err := v.resolve("lstat", name, false)
+	if err != nil {
+		return nil, err
+	}
+	return v.newFileInfo("lstat", cPath, name)
+}
+
+// ReadLink returns the plaintext target of the symlink "name".
+func (v *Volume) ReadLink(name string) (string, error) {
+	cPath, err := v.resolve("readlink", name, false)
+	if err != nil {
+		return "", err
+	}
+	target, err := v.fs.Readlink(cPath)
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+	return target, nil
+}
+
+// ReadDir implements fs.ReadDirFS. The entries are sorted by name.
+func (v *Volume) ReadDir(name string) ([]fs.DirEntry, error) {
+	cPath, err := v.resolve("readdir", name, true)
+	if err != nil {
+		return nil, err
+	}
+	return v.readDir(cPath, name)
+}
+
+func (v *Volume) readDir(cPath string, name string) ([]fs.DirEntry, error) {
+	entries, err := v.fs.ReadDir(cPath)
+	if err != nil {
+		return nil, pathError("readdir", name, err)
+	}
+	out := make([]fs.DirEntry, 0, len(entries))
+	for _, e := range entries {
+		fi, err := v.newFileInfo("readdir", path.Join(cPath, e.CName), path.Join(name, e.Name))
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				// Deleted in the meantime
+				continue
+			}
+			return nil, err
+		}
+		out = append(out, fs.FileInfoToDirEntry(fi))
+	}
+	return out, nil
+}
+
+// ReadFile implements fs.ReadFileFS
+func (v *Volume) ReadFile(name string) ([]byte, error) {
+	f, err := v.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
+
+// Open implements fs.FS. Directories implement fs.ReadDirFile, regular
+// files implement io.ReaderAt and io.Seeker.
+func (v *Volume) Open(name string) (fs.File, error) {
+	cPath, err := v.resolve("open", name, true)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := v.newFileInfo("open", cPath, name)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &dir{v: v, cPath: cPath, name: name, fi: fi}, nil
+	}
+	if !fi.Mode().IsRegular() {
+		return nil, pathError("open", name, fs.ErrInvalid)
+	}
+	f, err := v.fs.Open(cPath)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	return &file{f: f, name: name, fi: fi}, nil
+}
+
+// file is an open regular file
+type file struct {
+	f    *offline.File
+	name string
+	fi   *fileInfo
+	off  int64
+}
+
+func (f *file) Stat() (fs.FileInfo, error) {
+	return f.fi, nil
+}
+
+func (f *file) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.f.ReadAt(p, off)
+	if err != nil && err != io.EOF {
+		err = pathError("read", f.name, err)
+	}
+	return n, err
+}
+
+// Seek implements io.Seeker
+func (f *file) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.f.Size()
+	default:
+		return 0, pathError("seek", f.name, fs.ErrInvalid)
+	}
+	if offset < 0 {
+		return 0, pathError("seek", f.name, fs.ErrInvalid)
+	}
+	f.off = offset
+	return offset, nil
+}
+
+func (f *file) Close() error {
+	return f.f.Close()
+}
+
+// dir is an open directory
+type dir struct {
+	v     *Volume
+	cPath string
+	name  string
+	fi    *fileInfo
+	// entries is loaded on the first ReadDir call
+	entries []fs.DirEntry
+	loaded  bool
+}
+
+func (d *dir) Stat() (fs.FileInfo, error) {
+	return d.fi, nil
+}
+
+func (d *dir) Read([]byte) (int, error) {
+	return 0, pathError("read", d.name, syscall.EISDIR)
+}
+
+// ReadDir implements fs.ReadDirFile
+func (d *dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.loaded {
+		var err error
+		d.entries, err = d.v.readDir(d.cPath, d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.loaded = true
+	}
+	if n <= 0 {
+		out := d.entries
+		d.entries = nil
+		return out, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	n = min(n, len(d.entries))
+	out := slices.Clone(d.entries[:n])
+	d.entries = d.entries[n:]
+	return out, nil
+}
+
+func (d *dir) Close() error {
+	return nil
+}
@@ -0,0 +1,122 @@
+// Package volume is a Go library that reads and writes gocryptfs
+// filesystems directly, without a FUSE mount.
+//
+// A Volume implements io/fs.FS (plus fs.StatFS, fs.ReadDirFS and
+// fs.ReadFileFS) for reading, and has methods to create, write, rename and
+// delete files and directories. Names are slash-separated and relative to
+// the root of the filesystem, as required by io/fs. Symlinks are followed,
+// as long as they stay inside the filesystem.
+//
+// Only forward-mode cipherdirs are supported. The Volume must not be
+// modified while the cipherdir is mounted by gocryptfs at the same time.
+//
+// The API of this package is stable: exported identifiers will not be
+// removed or changed incompatibly within the v2 major version.
+// See volume_test.go for a usage example.
+package volume
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/contentenc"
+	"github.com/rfjakob/gocryptfs/v2/internal/cryptocore"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+	"github.com/rfjakob/gocryptfs/v2/internal/offline"
+)
+
+// ErrPasswordIncorrect is returned by Open when the password does not
+// decrypt the master key.
+var ErrPasswordIncorrect = errors.New("password incorrect")
+
+// Options configures Open. Either Password or Masterkey must be set.
+type Options struct {
+	// Password decrypts the master key stored in the config file
+	Password []byte
+	// Masterkey is used instead of the password. This is the 32-byte
+	// binary key, not the hex string that "gocryptfs -init" prints.
+	// Use this for FIDO2-protected filesystems.
+	Masterkey []byte
+	// Config is the path to the config file. The default is
+	// CIPHERDIR/gocryptfs.conf.
+	Config string
+}
+
+// Volume is an open gocryptfs filesystem
+type Volume struct {
+	fs    *offline.FS
+	cCore *cryptocore.CryptoCore
+}
+
+// Open opens the gocryptfs filesystem in the directory "cipherdir".
+// Call Close() when done to wipe the keys from memory.
+func Open(cipherdir string, opts Options) (*Volume, error) {
+	cipherdir, err := filepath.Abs(cipherdir)
+	if err != nil {
+		return nil, err
+	}
+	confPath := opts.Config
+	if confPath == "" {
+		confPath = filepath.Join(cipherdir, configfile.ConfDefaultName)
+	}
+	cf, err := configfile.Load(confPath)
+	if err != nil {
+		return nil, err
+	}
+	backend, err := cf.ContentEncryption()
+	if err != nil {
+		return nil, err
+	}
+	var masterkey []byte
+	if opts.Masterkey != nil {
+		if len(opts.Masterkey) != cryptocore.KeyLen {
+			return nil, fmt.Errorf("master key must be %d bytes, got %d",
+				cryptocore.KeyLen, len(opts.Masterkey))
+		}
+		// Make a copy so we can wipe it without touching the caller's buffer
+		masterkey = append([]byte(nil), opts.Masterkey...)
+	} else {
+		if len(opts.Password) == 0 {
+			return nil, errors.New("neither Password nor Masterkey is set")
+		}
+		masterkey, err = cf.DecryptMasterKey(opts.Password)
+		if err != nil {
+			// This is the only error DecryptMasterKey returns
+			return nil, ErrPasswordIncorrect
+		}
+	}
+	plaintextNames := cf.IsFeatureFlagSet(configfile.FlagPlaintextNames)
+	deterministicNames := !cf.IsFeatureFlagSet(configfile.FlagDirIV)
+	longNames := cf.IsFeatureFlagSet(configfile.FlagLongNames)
+	cCore := cryptocore.New(masterkey, backend, backend.NonceSize*8,
+		cf.IsFeatureFlagSet(configfile.FlagHKDF))
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	cEnc := contentenc.New(cCore, contentenc.DefaultBS)
+	nameTransform := nametransform.New(cCore.EMECipher, longNames, cf.LongNameMax,
+		cf.IsFeatureFlagSet(configfile.FlagRaw64), nil, deterministicNames)
+	v := &Volume{
+		fs: offline.New(offline.Args{
+			Cipherdir:          cipherdir,
+			PlaintextNames:     plaintextNames,
+			DeterministicNames: deterministicNames,
+			LongNames:          longNames,
+			ConfigCustom:       opts.Config != "",
+		}, cEnc, nameTransform),
+		cCore: cCore,
+	}
+	return v, nil
+}
+
+// Close wipes the keys from memory. The Volume cannot be used afterwards.
+func (v *Volume) Close() error {
+	if v.cCore != nil {
+		v.cCore.Wipe()
+		v.cCore = nil
+	}
+	v.fs = nil
+	return nil
+}
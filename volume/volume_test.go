@@ -0,0 +1,224 @@
+package volume
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"testing/fstest"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/configfile"
+	"github.com/rfjakob/gocryptfs/v2/internal/nametransform"
+)
+
+var testPw = []byte("test")
+
+// initDir creates a new gocryptfs filesystem like "gocryptfs -init" does
+func initDir(t *testing.T, args configfile.CreateArgs) string {
+	dir := t.TempDir()
+	args.Filename = filepath.Join(dir, configfile.ConfDefaultName)
+	args.Password = testPw
+	args.LogN = 10
+	args.Creator = "volume_test"
+	if err := configfile.Create(&args); err != nil {
+		t.Fatal(err)
+	}
+	if !args.PlaintextNames && !args.DeterministicNames {
+		dirfd, err := syscall.Open(dir, syscall.O_RDONLY|syscall.O_DIRECTORY, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer syscall.Close(dirfd)
+		if err = nametransform.WriteDirIVAt(dirfd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func openVolume(t *testing.T, dir string) *Volume {
+	v, err := Open(dir, Options{Password: testPw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { v.Close() })
+	return v
+}
+
+// populate creates some files, directories and symlinks in "v"
+func populate(t *testing.T, v *Volume) {
+	long := strings.Repeat("l", 200)
+	if err := v.MkdirAll("dir/"+long+"/sub", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.WriteFile("dir/"+long+"/sub/file", []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.WriteFile("empty", nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	w, err := v.Create("big", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Odd-sized writes to test the block buffering
+	for i := 0; i < 1000; i++ {
+		if _, err = w.Write(bytes.Repeat([]byte{byte(i)}, 333)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = v.Symlink("dir/"+long, "link"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFS(t *testing.T) {
+	for _, args := range []configfile.CreateArgs{
+		{},
+		{PlaintextNames: true},
+		{DeterministicNames: true},
+		{XChaCha20Poly1305: true},
+		{AESSIV: true},
+	} {
+		dir := initDir(t, args)
+		v := openVolume(t, dir)
+		populate(t, v)
+		long := strings.Repeat("l", 200)
+		err := fstest.TestFS(v, "big", "empty", "dir/"+long+"/sub/file", "link")
+		if err != nil {
+			t.Errorf("%+v: %v", args, err)
+		}
+		// Symlinks are followed
+		if content, err := v.ReadFile("link/sub/file"); err != nil || string(content) != "content" {
+			t.Errorf("%+v: ReadFile through symlink: %q %v", args, content, err)
+		}
+		// The data must be readable after re-opening
+		v.Close()
+		v = openVolume(t, dir)
+		content, err := fs.ReadFile(v, "big")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(content) != 333000 || content[333] != 1 || content[332999] != byte(999%256) {
+			t.Errorf("%+v: wrong content in big", args)
+		}
+		if target, err := v.ReadLink("link"); err != nil || target != "dir/"+long {
+			t.Errorf("%+v: ReadLink: %q %v", args, target, err)
+		}
+	}
+}
+
+func TestWrongPassword(t *testing.T) {
+	dir := initDir(t, configfile.CreateArgs{})
+	_, err := Open(dir, Options{Password: []byte("wrong")})
+	if err != ErrPasswordIncorrect {
+		t.Errorf("want ErrPasswordIncorrect, got %v", err)
+	}
+}
+
+func TestRenameRemove(t *testing.T) {
+	dir := initDir(t, configfile.CreateArgs{})
+	v := openVolume(t, dir)
+	populate(t, v)
+	long := strings.Repeat("l", 200)
+	long2 := strings.Repeat("m", 200)
+	if err := v.Rename("dir/"+long, long2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.Stat("dir/" + long); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("old name still exists: %v", err)
+	}
+	if content, err := v.ReadFile(long2 + "/sub/file"); err != nil || string(content) != "content" {
+		t.Errorf("ReadFile after rename: %q %v", content, err)
+	}
+	// Replace a file
+	if err := v.Rename("empty", "big"); err != nil {
+		t.Fatal(err)
+	}
+	if fi, err := v.Stat("big"); err != nil || fi.Size() != 0 {
+		t.Errorf("Stat after rename: %v %v", fi, err)
+	}
+	// A file cannot replace a directory, which must survive
+	if err := v.Mkdir("emptydir", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Rename("big", "emptydir"); !errors.Is(err, syscall.EISDIR) {
+		t.Errorf("rename file onto dir: want EISDIR, got %v", err)
+	}
+	if err := v.WriteFile("emptydir/file", nil, 0644); err != nil {
+		t.Errorf("emptydir is broken after failed rename: %v", err)
+	}
+	// A directory replaces an empty directory, but not a non-empty one
+	if err := v.Rename(long2+"/sub", "emptydir"); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("rename onto non-empty dir: want ENOTEMPTY, got %v", err)
+	}
+	if err := v.Remove("emptydir/file"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Rename(long2+"/sub", "emptydir"); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := v.ReadFile("emptydir/file"); err != nil || string(content) != "content" {
+		t.Errorf("ReadFile after replacing a dir: %q %v", content, err)
+	}
+	if err := v.Rename("emptydir", long2+"/sub"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Remove(long2); !errors.Is(err, syscall.ENOTEMPTY) {
+		t.Errorf("Remove of non-empty dir: %v", err)
+	}
+	for _, name := range []string{long2 + "/sub/file", long2 + "/sub", long2, "big", "link", "dir"} {
+		if err := v.Remove(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Only gocryptfs.conf and gocryptfs.diriv are left, no .name files
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		for _, e := range entries {
+			t.Logf("leftover: %s", e.Name())
+		}
+		t.Errorf("want 2 entries, have %d", len(entries))
+	}
+}
+
+func TestEscape(t *testing.T) {
+	dir := initDir(t, configfile.CreateArgs{})
+	v := openVolume(t, dir)
+	if err := v.Symlink("../outside", "up"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Symlink("/etc", "abs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Symlink("loop", "loop"); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"up", "abs", "../x", "/etc"} {
+		if _, err := v.Open(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("%q: want ErrInvalid, got %v", name, err)
+		}
+	}
+	if _, err := v.Open("loop"); !errors.Is(err, syscall.ELOOP) {
+		t.Errorf("want ELOOP, got %v", err)
+	}
+	f, err := v.Open(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Read(make([]byte, 1)); err == nil || err == io.EOF {
+		t.Errorf("Read on a directory should fail, got %v", err)
+	}
+}
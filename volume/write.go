@@ -0,0 +1,187 @@
+package volume
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"syscall"
+)
+
+// createPath resolves the parent directory of the plaintext path "name" and
+// creates the ciphertext name of the last component. "existed" tells if
+// there already is an entry of that name.
+func (v *Volume) createPath(op string, name string) (cPath string, existed bool, err error) {
+	if !fs.ValidPath(name) || name == "." {
+		return "", false, pathError(op, name, fs.ErrInvalid)
+	}
+	cDir, err := v.resolve(op, path.Dir(name), true)
+	if err != nil {
+		return "", false, err
+	}
+	cName, err := v.fs.CreateName(cDir, path.Base(name))
+	if err != nil {
+		return "", false, pathError(op, name, err)
+	}
+	cPath = path.Join(cDir, cName)
+	_, err = v.fs.Lstat(cPath)
+	return cPath, err == nil, nil
+}
+
+// undoName deletes the long name file that createPath created for "cPath"
+func (v *Volume) undoName(cPath string) {
+	v.fs.DeleteName(path.Dir(cPath), path.Base(cPath))
+}
+
+// fileWriter wraps offline.FileWriter to return plaintext paths in errors
+type fileWriter struct {
+	w    io.WriteCloser
+	name string
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		err = pathError("write", w.name, err)
+	}
+	return n, err
+}
+
+func (w *fileWriter) Close() error {
+	if err := w.w.Close(); err != nil {
+		return pathError("close", w.name, err)
+	}
+	return nil
+}
+
+// Create creates or truncates the file "name" and returns a writer for its
+// content. Writes are sequential and must be finished with Close(). Like
+// os.Create, "perm" is subject to the umask. A symlink in the last
+// component is not followed.
+func (v *Volume) Create(name string, perm fs.FileMode) (io.WriteCloser, error) {
+	cPath, existed, err := v.createPath("create", name)
+	if err != nil {
+		return nil, err
+	}
+	w, err := v.fs.Create(cPath, uint32(perm.Perm()))
+	if err != nil {
+		if !existed {
+			v.undoName(cPath)
+		}
+		return nil, pathError("create", name, err)
+	}
+	return &fileWriter{w: w, name: name}, nil
+}
+
+// WriteFile writes "data" to the file "name", creating it if necessary.
+func (v *Volume) WriteFile(name string, data []byte, perm fs.FileMode) error {
+	w, err := v.Create(name, perm)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// Mkdir creates the directory "name" with permissions "perm". Unlike
+// os.Mkdir, the umask is not applied.
+func (v *Volume) Mkdir(name string, perm fs.FileMode) error {
+	cPath, existed, err := v.createPath("mkdir", name)
+	if err != nil {
+		return err
+	}
+	if existed {
+		return pathError("mkdir", name, fs.ErrExist)
+	}
+	if err = v.fs.Mkdir(cPath, uint32(perm.Perm())); err != nil {
+		v.undoName(cPath)
+		return pathError("mkdir", name, err)
+	}
+	return nil
+}
+
+// MkdirAll creates the directory "name" and all missing parents, like
+// os.MkdirAll.
+func (v *Volume) MkdirAll(name string, perm fs.FileMode) error {
+	if !fs.ValidPath(name) {
+		return pathError("mkdir", name, fs.ErrInvalid)
+	}
+	var p string
+	for _, part := range splitPath(name) {
+		p = path.Join(p, part)
+		fi, err := v.Stat(p)
+		if err == nil {
+			if !fi.IsDir() {
+				return pathError("mkdir", p, syscall.ENOTDIR)
+			}
+			continue
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err = v.Mkdir(p, perm); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove deletes the file, symlink or empty directory "name".
+func (v *Volume) Remove(name string) error {
+	if name == "." {
+		return pathError("remove", name, fs.ErrInvalid)
+	}
+	cPath, err := v.resolve("remove", name, false)
+	if err != nil {
+		return err
+	}
+	if err = v.fs.Remove(cPath); err != nil {
+		return pathError("remove", name, err)
+	}
+	return nil
+}
+
+// Rename renames "oldname" to "newname". An existing file, or an empty
+// directory, at "newname" is replaced.
+func (v *Volume) Rename(oldname string, newname string) error {
+	if oldname == "." {
+		return pathError("rename", oldname, fs.ErrInvalid)
+	}
+	cOld, err := v.resolve("rename", oldname, false)
+	if err != nil {
+		return err
+	}
+	if _, err = v.fs.Lstat(cOld); err != nil {
+		return pathError("rename", oldname, err)
+	}
+	if !fs.ValidPath(newname) || newname == "." {
+		return pathError("rename", newname, fs.ErrInvalid)
+	}
+	cNewDir, err := v.resolve("rename", path.Dir(newname), true)
+	if err != nil {
+		return err
+	}
+	if _, err = v.fs.Rename(cOld, cNewDir, path.Base(newname)); err != nil {
+		return pathError("rename", newname, err)
+	}
+	return nil
+}
+
+// Symlink creates the symlink "name" pointing to "target".
+func (v *Volume) Symlink(target string, name string) error {
+	cPath, existed, err := v.createPath("symlink", name)
+	if err != nil {
+		return err
+	}
+	if existed {
+		return pathError("symlink", name, fs.ErrExist)
+	}
+	if err = v.fs.Symlink(target, cPath); err != nil {
+		v.undoName(cPath)
+		return pathError("symlink", name, err)
+	}
+	return nil
+}
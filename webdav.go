@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/net/webdav"
+
+	"github.com/rfjakob/gocryptfs/v2/internal/exitcodes"
+	"github.com/rfjakob/gocryptfs/v2/internal/syscallcompat"
+	"github.com/rfjakob/gocryptfs/v2/internal/tlog"
+	"github.com/rfjakob/gocryptfs/v2/internal/webdavfrontend"
+	"github.com/rfjakob/gocryptfs/v2/volume"
+)
+
+// listenLocal opens the listener for "-webdav ADDR" and "-metrics ADDR".
+// ADDR is either the path to a Unix socket (contains a "/"), or a localhost
+// TCP address. A Unix socket is created with permissions 0700.
+func listenLocal(addr string) (net.Listener, error) {
+	if strings.Contains(addr, "/") {
+		// Chmod'ing the socket after creating it would leave a window
+		// in which other users can connect. We are still starting up, so
+		// there is nobody else creating files who could be affected by
+		// the umask.
+		oldMask := syscall.Umask(0077)
+		defer syscall.Umask(oldMask)
+		return net.Listen("unix", addr)
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if host != "localhost" {
+		ip := net.ParseIP(host)
+		if ip == nil || !ip.IsLoopback() {
+			return nil, errors.New("only localhost TCP addresses are allowed, use a Unix socket otherwise")
+		}
+	}
+	return net.Listen("tcp", addr)
+}
+
+// lookupUids translates the "-webdav-user" arguments (user names or numeric
+// uids) into uids.
+func lookupUids(users []string) (map[uint32]bool, error) {
+	uids := map[uint32]bool{uint32(os.Getuid()): true}
+	for _, u := range users {
+		if uid, err := strconv.ParseUint(u, 10, 32); err == nil {
+			uids[uint32(uid)] = true
+			continue
+		}
+		pw, err := user.Lookup(u)
+		if err != nil {
+			return nil, err
+		}
+		uid, err := strconv.ParseUint(pw.Uid, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		uids[uint32(uid)] = true
+	}
+	return uids, nil
+}
+
+// uidListener only accepts Unix socket connections from the users in
+// "uids". Other connections are closed right away.
+type uidListener struct {
+	net.Listener
+	uids map[uint32]bool
+}
+
+func (l *uidListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		uid, _, err := syscallcompat.PeerCred(conn.(*net.UnixConn))
+		if err != nil {
+			tlog.Warn.Printf("webdav: cannot get peer credentials: %v", err)
+		} else if l.uids[uid] {
+			return conn, nil
+		} else {
+			tlog.Warn.Printf("webdav: rejected connection from uid %d", uid)
+		}
+		conn.Close()
+	}
+}
+
+// readWebdavToken reads the "-webdav-token" file. Like for "-passfile", only
+// the first line counts.
+func readWebdavToken(path string) (string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token, _, _ := strings.Cut(string(content), "\n")
+	if token == "" {
+		return "", errors.New("token is empty")
+	}
+	return token, nil
+}
+
+// tokenHandler only passes on requests that carry the token as the HTTP
+// basic auth password. The user name is ignored.
+type tokenHandler struct {
+	http.Handler
+	token []byte
+}
+
+func (h *tokenHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, pw, ok := r.BasicAuth()
+	if !ok || subtle.ConstantTimeCompare([]byte(pw), h.token) != 1 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="gocryptfs"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	h.Handler.ServeHTTP(w, r)
+}
+
+// serveWebdav implements "gocryptfs -webdav ADDR CIPHERDIR". It serves the
+// plaintext view until it gets SIGINT or SIGTERM, or until it has been idle
+// for "-idle".
+func serveWebdav(args *argContainer) {
+	if args.reverse {
+		tlog.Fatal.Printf("-webdav does not support reverse mode")
+		os.Exit(exitcodes.Usage)
+	}
+	isUnix := strings.Contains(args.webdav, "/")
+	if len(args.webdav_user) > 0 && !isUnix {
+		tlog.Fatal.Printf("-webdav-user only works with a Unix socket")
+		os.Exit(exitcodes.Usage)
+	}
+	if !isUnix && args.webdav_token == "" {
+		// Any local user could connect otherwise
+		tlog.Fatal.Printf("-webdav: a TCP address needs -webdav-token, use a Unix socket otherwise")
+		os.Exit(exitcodes.Usage)
+	}
+	uids, err := lookupUids(args.webdav_user)
+	if err != nil {
+		tlog.Fatal.Printf("-webdav-user: %v", err)
+		os.Exit(exitcodes.Usage)
+	}
+	var token string
+	if args.webdav_token != "" {
+		token, err = readWebdavToken(args.webdav_token)
+		if err != nil {
+			tlog.Fatal.Printf("-webdav-token: %v", err)
+			os.Exit(exitcodes.Usage)
+		}
+	}
+	// Listen early so we can error out before asking the user for the
+	// password
+	listener, err := listenLocal(args.webdav)
+	if err != nil {
+		tlog.Fatal.Printf("-webdav: %v", err)
+		os.Exit(exitcodes.WebDAV)
+	}
+	// Close also deletes the socket file
+	defer listener.Close()
+	if isUnix {
+		if len(args.webdav_user) > 0 {
+			// Let the other users connect, the uidListener checks them
+			if err = os.Chmod(args.webdav, 0777); err != nil {
+				tlog.Fatal.Printf("-webdav: %v", err)
+				os.Exit(exitcodes.WebDAV)
+			}
+		}
+		listener = &uidListener{Listener: listener, uids: uids}
+	}
+	// Get the master key like a mount does, but let the volume package do
+	// the rest
+	masterkey := handleArgsMasterkey(args)
+	if masterkey == nil {
+		masterkey, _, err = loadConfig(args)
+		if err != nil {
+			listener.Close()
+			exitcodes.Exit(err)
+		}
+	}
+	opts := volume.Options{Masterkey: masterkey}
+	if args._configCustom {
+		opts.Config = args.config
+	}
+	v, err := volume.Open(args.cipherdir, opts)
+	for i := range masterkey {
+		masterkey[i] = 0
+	}
+	if err != nil {
+		tlog.Fatal.Printf("-webdav: %v", err)
+		listener.Close()
+		os.Exit(exitcodes.WebDAV)
+	}
+	defer v.Close()
+	davFS := webdavfrontend.New(v, args.ro)
+	var handler http.Handler = &webdav.Handler{
+		FileSystem: davFS,
+		LockSystem: webdav.NewMemLS(),
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				tlog.Debug.Printf("webdav: %s %q: %v", r.Method, r.URL.Path, err)
+			}
+		},
+	}
+	if token != "" {
+		handler = &tokenHandler{Handler: handler, token: []byte(token)}
+	}
+	srv := &http.Server{Handler: handler}
+	shutdown := func() error {
+		return srv.Shutdown(context.Background())
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ch
+		shutdown()
+	}()
+	if args.idle > 0 {
+		go idleMonitor(args.idle, davFS.WasActive, shutdown, args.webdav)
+	}
+	tlog.Info.Println(tlog.ColorGreen + "Serving WebDAV on " + args.webdav + tlog.ColorReset)
+	err = srv.Serve(listener)
+	if err != http.ErrServerClosed {
+		tlog.Fatal.Printf("-webdav: %v", err)
+		os.Exit(exitcodes.WebDAV)
+	}
+}